@@ -0,0 +1,293 @@
+package gateway
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// API key scopes, they are the route groups a key can call
+const (
+	ScopeConsumer  = "consumer"
+	ScopeMerchant  = "merchant"
+	ScopeDashboard = "dashboard"
+)
+
+const apiKeyPrefix = "nk_"
+
+var (
+	ErrInvalidAPIKey = errors.New("invalid api key")
+	ErrAPIKeyExpired = errors.New("api key has expired")
+	ErrAPIKeyRevoked = errors.New("api key was revoked")
+	ErrInvalidScope  = errors.New("scopes must be consumer, merchant or dashboard")
+)
+
+var keyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// APIClient is an API key of a B2B client. Only the SHA-256 of the key is
+// stored, the key itself is shown once when it is created or rotated. Prefix is
+// the first part of the key, it identifies the key in logs and in the dashboard.
+type APIClient struct {
+	gorm.Model
+	Name    string   `json:"name"`
+	Email   string   `json:"email"`
+	Prefix  string   `json:"prefix" gorm:"uniqueIndex"`
+	KeyHash string   `json:"-" redact:"secret"`
+	Scopes  []string `json:"scopes" gorm:"serializer:json"`
+	// RateLimit is the number of requests per minute the key can make, 0 for no limit
+	RateLimit int `json:"rate_limit"`
+	// AllowedIPs are the IPs or CIDRs the key can be used from, any IP when it is empty
+	AllowedIPs []string   `json:"allowed_ips" gorm:"serializer:json"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	// ReplacedByID is the key that replaced this one when it was rotated
+	ReplacedByID uint `json:"replaced_by_id,omitempty"`
+	// TerminalIDs are the terminals of a merchant key, it registers the webhooks
+	// receiving their events (e.g., reversals)
+	TerminalIDs []string `json:"terminal_ids" gorm:"serializer:json"`
+}
+
+// Validate checks the scopes and the allowed IPs of a
+func (a *APIClient) Validate() error {
+	if len(a.Scopes) == 0 {
+		return ErrInvalidScope
+	}
+	for _, scope := range a.Scopes {
+		if scope != ScopeConsumer && scope != ScopeMerchant && scope != ScopeDashboard {
+			return ErrInvalidScope
+		}
+	}
+	for _, ip := range a.AllowedIPs {
+		if _, _, err := net.ParseCIDR(ip); err != nil && net.ParseIP(ip) == nil {
+			return errors.New("invalid allowed ip: " + ip)
+		}
+	}
+	if a.RateLimit < 0 {
+		return errors.New("rate_limit must not be negative")
+	}
+	return nil
+}
+
+// HasScope reports whether a can call the endpoints of scope
+func (a *APIClient) HasScope(scope string) bool {
+	for _, s := range a.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsIP reports whether a can be used from ip
+func (a *APIClient) AllowsIP(ip string) bool {
+	if len(a.AllowedIPs) == 0 {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	for _, allowed := range a.AllowedIPs {
+		if _, network, err := net.ParseCIDR(allowed); err == nil {
+			if parsed != nil && network.Contains(parsed) {
+				return true
+			}
+		} else if parsed != nil && parsed.Equal(net.ParseIP(allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// active returns why a can't be used at now, nil when it can
+func (a *APIClient) active(now time.Time) error {
+	if a.RevokedAt != nil {
+		return ErrAPIKeyRevoked
+	}
+	if a.ExpiresAt != nil && !now.Before(*a.ExpiresAt) {
+		return ErrAPIKeyExpired
+	}
+	return nil
+}
+
+// newAPIKey returns a new key and its prefix, e.g., nk_3ifk5rha.<secret>
+func newAPIKey() (key, prefix string, err error) {
+	b := make([]byte, 35)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	prefix = apiKeyPrefix + strings.ToLower(keyEncoding.EncodeToString(b[:5]))
+	return prefix + "." + strings.ToLower(keyEncoding.EncodeToString(b[5:])), prefix, nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewAPIClient stores client with a new key, and returns the key
+func NewAPIClient(db *gorm.DB, client *APIClient) (string, error) {
+	if err := client.Validate(); err != nil {
+		return "", err
+	}
+	key, prefix, err := newAPIKey()
+	if err != nil {
+		return "", err
+	}
+	client.ID = 0
+	client.Prefix, client.KeyHash = prefix, hashAPIKey(key)
+	client.RevokedAt, client.LastUsedAt, client.ReplacedByID = nil, nil, 0
+	if err := db.Create(client).Error; err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// RotateAPIClient replaces the key of the client id with a new one having the
+// same settings. The old key keeps working for grace so that the client can
+// deploy the new one.
+func RotateAPIClient(db *gorm.DB, id uint, grace time.Duration) (*APIClient, string, error) {
+	var old APIClient
+	if err := db.First(&old, id).Error; err != nil {
+		return nil, "", err
+	}
+	if err := old.active(time.Now()); err != nil {
+		return nil, "", err
+	}
+	client := &APIClient{Name: old.Name, Email: old.Email, Scopes: old.Scopes, RateLimit: old.RateLimit,
+		AllowedIPs: old.AllowedIPs, ExpiresAt: old.ExpiresAt, TerminalIDs: old.TerminalIDs}
+	var key string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if key, err = NewAPIClient(tx, client); err != nil {
+			return err
+		}
+		expiresAt := time.Now().Add(grace)
+		if old.ExpiresAt != nil && old.ExpiresAt.Before(expiresAt) {
+			expiresAt = *old.ExpiresAt
+		}
+		return tx.Model(&old).Updates(map[string]any{"expires_at": expiresAt, "replaced_by_id": client.ID}).Error
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return client, key, nil
+}
+
+// RevokeAPIClient revokes the key of the client id right away
+func RevokeAPIClient(db *gorm.DB, id uint) error {
+	res := db.Model(&APIClient{}).Where("id = ? AND revoked_at IS NULL", id).Update("revoked_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// APIKeyAuth authenticates B2B clients with the API key they send in the
+// X-API-Key header, see RequireAPIKey.
+type APIKeyAuth struct {
+	Db *gorm.DB
+	// Enforced are the scopes whose endpoints can't be called without a key
+	Enforced []string
+	// Limiter shares the rate limits of the clients between the noebs instances, they are kept in memory when it is nil
+	Limiter *RateLimiter
+	buckets tokenBuckets
+}
+
+// Authenticate returns the client of key
+func (a *APIKeyAuth) Authenticate(key string) (*APIClient, error) {
+	prefix, _, ok := strings.Cut(key, ".")
+	if !ok || !strings.HasPrefix(prefix, apiKeyPrefix) {
+		return nil, ErrInvalidAPIKey
+	}
+	var client APIClient
+	if err := a.Db.Where("prefix = ?", prefix).First(&client).Error; err != nil {
+		return nil, ErrInvalidAPIKey
+	}
+	if subtle.ConstantTimeCompare([]byte(client.KeyHash), []byte(hashAPIKey(key))) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+	if err := client.active(time.Now()); err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+func (a *APIKeyAuth) enforced(scope string) bool {
+	for _, s := range a.Enforced {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireAPIKey authorizes the clients whose key has scope, from their allowed
+// IPs and within their rate limit. Requests without a key only pass when scope
+// isn't enforced, but a key that is sent is always checked. It sets api_client
+// (the key prefix) and api_client_id in the context.
+func (a *APIKeyAuth) RequireAPIKey(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("X-API-Key")
+		if key == "" {
+			key = c.GetHeader("api-key")
+		}
+		if key == "" {
+			if a.enforced(scope) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "X-API-Key header is required", "code": "api_key_required"})
+				return
+			}
+			c.Next()
+			return
+		}
+		client, err := a.Authenticate(key)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": err.Error(), "code": "wrong_api_key"})
+			return
+		}
+		if !client.HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "api key can't call the " + scope + " endpoints", "code": "scope_not_allowed"})
+			return
+		}
+		if !client.AllowsIP(c.ClientIP()) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "api key can't be used from " + c.ClientIP(), "code": "ip_not_allowed"})
+			return
+		}
+		now := time.Now()
+		take := a.buckets.take
+		if a.Limiter != nil {
+			take = a.Limiter.Take
+		}
+		if client.RateLimit > 0 {
+			if ok, wait := take(client.Prefix, client.RateLimit, time.Minute, now); !ok {
+				c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"message": "rate limit exceeded", "code": "rate_limited"})
+				return
+			}
+		}
+		// last_used_at is only for spotting unused keys, a minute is precise enough
+		if client.LastUsedAt == nil || now.Sub(*client.LastUsedAt) > time.Minute {
+			if err := a.Db.Model(client).Update("last_used_at", now).Error; err != nil {
+				log.WithField("api_client", client.Prefix).Errorf("error in updating last_used_at: %v", err)
+			}
+		}
+		c.Set("api_client", client.Prefix)
+		c.Set("api_client_id", client.ID)
+		c.Set("terminal_ids", client.TerminalIDs)
+		c.Next()
+	}
+}
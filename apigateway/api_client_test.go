@@ -0,0 +1,83 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAPIKeyAuth_RequireAPIKey(t *testing.T) {
+	db := testSessionAuth(t).Db
+	db.AutoMigrate(&APIClient{})
+	a := &APIKeyAuth{Db: db, Enforced: []string{ScopeMerchant}}
+
+	if _, err := NewAPIClient(db, &APIClient{Name: "bad", Scopes: []string{"everything"}}); err != ErrInvalidScope {
+		t.Errorf("NewAPIClient() with an unknown scope error = %v", err)
+	}
+	merchant := &APIClient{Name: "acme", Scopes: []string{ScopeMerchant}, AllowedIPs: []string{"192.0.2.0/24"}}
+	merchantKey, err := NewAPIClient(db, merchant)
+	if err != nil {
+		t.Fatalf("NewAPIClient() error = %v", err)
+	}
+	limited := &APIClient{Name: "limited", Scopes: []string{ScopeConsumer, ScopeMerchant}, RateLimit: 1}
+	limitedKey, _ := NewAPIClient(db, limited)
+	rotated, newKey, err := RotateAPIClient(db, merchant.ID, 0)
+	if err != nil || rotated.Name != "acme" || rotated.AllowedIPs[0] != "192.0.2.0/24" {
+		t.Fatalf("RotateAPIClient() = %+v, %v", rotated, err)
+	}
+	revoked := &APIClient{Name: "revoked", Scopes: []string{ScopeMerchant}}
+	revokedKey, _ := NewAPIClient(db, revoked)
+	if err := RevokeAPIClient(db, revoked.ID); err != nil {
+		t.Fatalf("RevokeAPIClient() error = %v", err)
+	}
+
+	r := gin.New()
+	r.POST("/purchase", a.RequireAPIKey(ScopeMerchant), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"api_client": c.GetString("api_client")})
+	})
+	r.POST("/consumer/p2p", a.RequireAPIKey(ScopeConsumer), func(c *gin.Context) { c.Status(http.StatusOK) })
+	tests := []struct {
+		name     string
+		path     string
+		key      string
+		ip       string
+		wantCode int
+	}{
+		{"allowed ip", "/purchase", newKey, "192.0.2.10", http.StatusOK},
+		{"ip not allowed", "/purchase", newKey, "198.51.100.1", http.StatusForbidden},
+		{"rotated key", "/purchase", merchantKey, "192.0.2.10", http.StatusUnauthorized},
+		{"revoked key", "/purchase", revokedKey, "192.0.2.10", http.StatusUnauthorized},
+		{"wrong secret", "/purchase", rotated.Prefix + ".wrong", "192.0.2.10", http.StatusUnauthorized},
+		{"enforced scope without a key", "/purchase", "", "192.0.2.10", http.StatusUnauthorized},
+		{"optional scope without a key", "/consumer/p2p", "", "192.0.2.10", http.StatusOK},
+		{"scope not allowed", "/consumer/p2p", newKey, "192.0.2.10", http.StatusForbidden},
+		{"within the rate limit", "/consumer/p2p", limitedKey, "192.0.2.10", http.StatusOK},
+		{"over the rate limit", "/purchase", limitedKey, "192.0.2.10", http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, tt.path, nil)
+			req.RemoteAddr = tt.ip + ":4000"
+			req.Header.Set("X-API-Key", tt.key)
+			r.ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Errorf("RequireAPIKey() code = %v, want %v: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+				t.Errorf("RequireAPIKey() didn't set Retry-After")
+			}
+		})
+	}
+
+	// the old key keeps working during the grace period of a rotation
+	_, graceKey, _ := RotateAPIClient(db, limited.ID, time.Hour)
+	for _, key := range []string{limitedKey, graceKey} {
+		if client, err := a.Authenticate(key); err != nil || client.Name != "limited" {
+			t.Errorf("Authenticate() during the grace period = %v, %v", client, err)
+		}
+	}
+}
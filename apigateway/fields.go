@@ -7,11 +7,14 @@ import (
 // Token used by noebs client to refresh an existing token, that is Token.JWT
 // Signature is the signed Message (it could be a mobile username, or totp code)
 // and Message is the raw message (it could be a mobile username, or totp code)
+// RefreshToken refreshes a session instead, see JWTAuth.Refresh
 type Token struct {
-	JWT       string `json:"authorization"`
-	Signature string `json:"signature"`
-	Message   string `json:"message"`
-	Mobile    string `json:"mobile" binding:"required,len=10"`
+	JWT          string `json:"authorization"`
+	Signature    string `json:"signature"`
+	Message      string `json:"message" redact:"secret"` // the otp, signed or not
+	Mobile       string `json:"mobile" binding:"omitempty,len=10"`
+	RefreshToken string `json:"refresh_token" redact:"secret"`
+	DeviceID     string `json:"device_id"`
 }
 
 type ErrorResponse struct {
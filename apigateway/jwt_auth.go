@@ -9,64 +9,85 @@ import (
 	"github.com/adonese/noebs/ebs_fields"
 	"github.com/go-redis/redis/v7"
 	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 // JWTAuth provides an encapsulation for jwt auth
 type JWTAuth struct {
 	Key         []byte
 	NoebsConfig ebs_fields.NoebsConfig
+	// Db stores the sessions and the revoked tokens, see NewSession
+	Db *gorm.DB
+	// Keyring signs and verifies the tokens, Key (HMAC) alone is used when it is nil
+	Keyring *JWTKeyring
+	// legacyRefreshUntil is the end of LegacyRefresh, zero for no limit
+	legacyRefreshUntil time.Time
 }
 
 type GetRedisClient func(string) *redis.Client
 
 // Init initializes jwt auth
-func (j *JWTAuth) Init() {
-	log.Printf("jwt_key: %s", j.NoebsConfig.JWTKey)
+func (j *JWTAuth) Init() error {
 	j.Key = []byte(j.NoebsConfig.JWTKey)
+	keyring, err := NewJWTKeyring(&j.NoebsConfig, j.Key)
+	if err != nil {
+		return err
+	}
+	j.Keyring = keyring
+	if j.NoebsConfig.LegacyRefreshUntil != "" {
+		if j.legacyRefreshUntil, err = time.Parse(time.RFC3339, j.NoebsConfig.LegacyRefreshUntil); err != nil {
+			return fmt.Errorf("legacy_refresh_until: %w", err)
+		}
+	}
+	return nil
+}
+
+// keyring returns j.Keyring, or a keyring of the HMAC key alone when it isn't set
+func (j *JWTAuth) keyring() *JWTKeyring {
+	if j.Keyring != nil {
+		return j.Keyring
+	}
+	return &JWTKeyring{hmacKey: j.Key}
 }
 
-// GenerateJWT generates a JWT standard token with default values hardcoded. FIXME
+// GenerateJWT generates an access token for serviceID that isn't tied to a session
 func (j *JWTAuth) GenerateJWT(serviceID string) (string, error) {
+	token, _, err := j.GenerateAccessToken(serviceID, 0)
+	return token, err
+}
+
+// GenerateAccessToken generates a short-lived access token of the session
+// sessionID, it is identified by its jti so that it can be revoked.
+func (j *JWTAuth) GenerateAccessToken(mobile string, sessionID uint) (string, *TokenClaims, error) {
 	// Create a new token object, specifying signing method and the claims
 	// you would like it to contain.
-	expiresAt := time.Now().Add(10 * time.Hour).UTC().Unix()
-	claims := TokenClaims{
-		serviceID,
-		jwt.StandardClaims{
-			ExpiresAt: expiresAt,
+	claims := &TokenClaims{
+		Mobile:    mobile,
+		SessionID: sessionID,
+		StandardClaims: jwt.StandardClaims{
+			Id:        uuid.New().String(),
+			ExpiresAt: time.Now().Add(j.accessTTL()).UTC().Unix(),
 			Issuer:    "noebs",
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	log.Println("generating token")
-	// Sign and get the complete encoded token as a string using the secret
-	if j.Key == nil {
-		return "", errors.New("empty jwt key")
-	}
-	log.Printf("jwt_key: %s", j.Key)
-	if tokenString, err := token.SignedString(j.Key); err == nil {
-		return tokenString, nil
-	} else {
-		return "", err
+	tokenString, err := j.keyring().Sign(claims)
+	if err != nil {
+		return "", nil, err
 	}
+	return tokenString, claims, nil
 }
 
-// VerifyJWT giving a jwt token and a secret it validates the token against a hard coded TokenClaims struct
+// VerifyJWT giving a jwt token it validates the token against a hard coded TokenClaims struct,
+// with the keys of the keyring (see JWTKeyring.Keyfunc)
 func (j *JWTAuth) VerifyJWT(tokenString string) (*TokenClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &TokenClaims{}, func(token *jwt.Token) (interface{}, error) {
-		// Don't forget to validate the alg is what you expect:
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return j.Key, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, &TokenClaims{}, j.keyring().Keyfunc)
 	if token == nil {
 		log.Println(err)
 		return nil, err
 	}
 
 	if claims, ok := token.Claims.(*TokenClaims); ok && token.Valid {
-		log.Println("why am i here?")
 		return claims, nil
 	} else {
 		return claims, err
@@ -99,6 +120,10 @@ func (j *JWTAuth) verifyWithClaim(tokenString string) error {
 // TokenClaims noebs standard claim
 type TokenClaims struct {
 	Mobile string `json:"mobile"`
+	// SessionID is the session the token was issued for, 0 for tokens issued without one
+	SessionID uint `json:"sid,omitempty"`
+	// Operator is the username of the operator of the token, it is empty for consumer tokens
+	Operator string `json:"op,omitempty"`
 	jwt.StandardClaims
 }
 
@@ -0,0 +1,215 @@
+package gateway
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+)
+
+var (
+	ErrUnknownKey  = errors.New("token is signed with an unknown key")
+	ErrLegacyToken = errors.New("HMAC signed tokens are no longer accepted")
+	errEmptyJWTKey = errors.New("empty jwt key")
+)
+
+// jwtKey is a key of a JWTKeyring
+type jwtKey struct {
+	id         string
+	method     jwt.SigningMethod
+	private    crypto.Signer
+	public     crypto.PublicKey
+	activeFrom time.Time
+	retireAt   time.Time // zero when the key is never retired
+}
+
+func (k *jwtKey) retired(now time.Time) bool {
+	return !k.retireAt.IsZero() && !now.Before(k.retireAt)
+}
+
+// JWTKeyring signs tokens with RS256 or EdDSA keys identified by the kid header.
+// Several keys can be valid at once: the active one signs the new tokens while the
+// others verify the tokens signed before a rotation. Tokens signed with the HMAC
+// key are accepted during the migration window, or signed with it when the
+// keyring has no asymmetric keys at all.
+type JWTKeyring struct {
+	keys        []*jwtKey // ordered by activeFrom
+	hmacKey     []byte
+	legacyUntil time.Time // zero for no limit
+}
+
+// NewJWTKeyring creates the keyring of the jwt_keys of noebsConfig, hmacKey
+// being the legacy key.
+func NewJWTKeyring(noebsConfig *ebs_fields.NoebsConfig, hmacKey []byte) (*JWTKeyring, error) {
+	k := &JWTKeyring{hmacKey: hmacKey}
+	var err error
+	if noebsConfig.LegacyJWTUntil != "" {
+		if k.legacyUntil, err = time.Parse(time.RFC3339, noebsConfig.LegacyJWTUntil); err != nil {
+			return nil, fmt.Errorf("legacy_jwt_until: %w", err)
+		}
+	}
+	for id, cfg := range noebsConfig.JWTKeys {
+		key := &jwtKey{id: id}
+		if key.private, err = parsePrivateKey(cfg.PrivateKey); err != nil {
+			return nil, fmt.Errorf("jwt key %q: %w", id, err)
+		}
+		key.public = key.private.Public()
+		switch key.private.(type) {
+		case *rsa.PrivateKey:
+			key.method = jwt.SigningMethodRS256
+		case ed25519.PrivateKey:
+			key.method = jwt.SigningMethodEdDSA
+		default:
+			return nil, fmt.Errorf("jwt key %q: only RSA and Ed25519 keys are supported", id)
+		}
+		if cfg.ActiveFrom != "" {
+			if key.activeFrom, err = time.Parse(time.RFC3339, cfg.ActiveFrom); err != nil {
+				return nil, fmt.Errorf("jwt key %q active_from: %w", id, err)
+			}
+		}
+		if cfg.RetireAt != "" {
+			if key.retireAt, err = time.Parse(time.RFC3339, cfg.RetireAt); err != nil {
+				return nil, fmt.Errorf("jwt key %q retire_at: %w", id, err)
+			}
+		}
+		k.keys = append(k.keys, key)
+	}
+	sort.Slice(k.keys, func(i, j int) bool { return k.keys[i].activeFrom.Before(k.keys[j].activeFrom) })
+	return k, nil
+}
+
+// parsePrivateKey parses a PEM encoded private key, or reads it from the file at key
+func parsePrivateKey(key string) (crypto.Signer, error) {
+	data := []byte(key)
+	if !strings.HasPrefix(strings.TrimSpace(key), "-----BEGIN") {
+		var err error
+		if data, err = os.ReadFile(key); err != nil {
+			return nil, err
+		}
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("private key is not PEM encoded")
+	}
+	if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		signer, ok := parsed.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("unsupported private key")
+		}
+		return signer, nil
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// signingKey returns the key signing tokens at now, nil when tokens are signed with the HMAC key
+func (k *JWTKeyring) signingKey(now time.Time) *jwtKey {
+	var active *jwtKey
+	for _, key := range k.keys {
+		if !key.activeFrom.After(now) && !key.retired(now) {
+			active = key
+		}
+	}
+	return active
+}
+
+// Sign signs claims with the active key, setting the kid header
+func (k *JWTKeyring) Sign(claims jwt.Claims) (string, error) {
+	key := k.signingKey(time.Now())
+	if key == nil {
+		if len(k.hmacKey) == 0 {
+			return "", errEmptyJWTKey
+		}
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(k.hmacKey)
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.id
+	return token.SignedString(key.private)
+}
+
+// Keyfunc returns the key verifying token, it is used with jwt.Parse
+func (k *JWTKeyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	now := time.Now()
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if len(k.hmacKey) == 0 {
+			return nil, errEmptyJWTKey
+		}
+		if len(k.keys) > 0 && !k.legacyUntil.IsZero() && !now.Before(k.legacyUntil) {
+			return nil, ErrLegacyToken
+		}
+		return k.hmacKey, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	for _, key := range k.keys {
+		if key.id != kid {
+			continue
+		}
+		// the algorithm is the key's, never the one the token claims
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		if key.retired(now) {
+			return nil, ErrUnknownKey
+		}
+		return key.public, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// JWK is a public key as published in a JWK set (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519 keys
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS returns the public keys of k that aren't retired, including the ones
+// that will only sign tokens later so that verifiers have them in advance.
+func (k *JWTKeyring) JWKS() []JWK {
+	keys := []JWK{}
+	now := time.Now()
+	for _, key := range k.keys {
+		if key.retired(now) {
+			continue
+		}
+		jwk := JWK{Kid: key.id, Use: "sig", Alg: key.method.Alg()}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		keys = append(keys, jwk)
+	}
+	return keys
+}
+
+// JWKS publishes the keys verifying noebs tokens, served at /.well-known/jwks.json
+func (j *JWTAuth) JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{"keys": j.keyring().JWKS()})
+}
@@ -0,0 +1,111 @@
+package gateway
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+)
+
+func pemKey(t *testing.T, key any) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func TestJWTKeyring(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, retiredKey, _ := ed25519.GenerateKey(rand.Reader)
+	now := time.Now()
+	hmacKey := []byte("legacy secret")
+	legacy := &JWTAuth{Key: hmacKey}
+	legacyToken, _ := legacy.GenerateJWT("0912141679")
+
+	noebsConfig := ebs_fields.NoebsConfig{
+		JWTKeys: map[string]ebs_fields.JWTKeyConfig{
+			"rsa-1":   {PrivateKey: pemKey(t, rsaKey), ActiveFrom: now.Add(-time.Hour).Format(time.RFC3339)},
+			"ed-2":    {PrivateKey: pemKey(t, edKey), ActiveFrom: now.Add(time.Hour).Format(time.RFC3339)},
+			"retired": {PrivateKey: pemKey(t, retiredKey), RetireAt: now.Add(-time.Minute).Format(time.RFC3339)},
+		},
+	}
+	keyring, err := NewJWTKeyring(&noebsConfig, hmacKey)
+	if err != nil {
+		t.Fatalf("NewJWTKeyring() error = %v", err)
+	}
+	j := &JWTAuth{Key: hmacKey, Keyring: keyring}
+	token, err := j.GenerateJWT("0912141679")
+	if err != nil {
+		t.Fatalf("GenerateJWT() error = %v", err)
+	}
+	parsed, _, _ := new(jwt.Parser).ParseUnverified(token, &TokenClaims{})
+	// ed-2 is scheduled, rsa-1 signs until then
+	if parsed.Header["kid"] != "rsa-1" || parsed.Method != jwt.SigningMethodRS256 {
+		t.Errorf("GenerateJWT() header = %v", parsed.Header)
+	}
+	retired, _ := jwt.NewWithClaims(jwt.SigningMethodEdDSA, &TokenClaims{Mobile: "0912141679"}).SignedString(retiredKey)
+	forged := jwt.NewWithClaims(jwt.SigningMethodEdDSA, &TokenClaims{Mobile: "0912141679"})
+	forged.Header["kid"] = "rsa-1"
+	forgedToken, _ := forged.SignedString(edKey)
+
+	tests := []struct {
+		name        string
+		token       string
+		legacyUntil time.Time
+		wantErr     bool
+	}{
+		{"active key", token, time.Time{}, false},
+		{"legacy token", legacyToken, time.Time{}, false},
+		{"legacy token in the migration window", legacyToken, now.Add(time.Hour), false},
+		{"legacy token after the migration window", legacyToken, now.Add(-time.Hour), true},
+		{"retired key", retired, time.Time{}, true},
+		{"algorithm of another key", forgedToken, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyring.legacyUntil = tt.legacyUntil
+			claims, err := j.VerifyJWT(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyJWT() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && claims.Mobile != "0912141679" {
+				t.Errorf("VerifyJWT() mobile = %v", claims.Mobile)
+			}
+		})
+	}
+
+	// partners verify the tokens with the published keys alone
+	r := gin.New()
+	r.GET("/.well-known/jwks.json", j.JWKS)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	var jwks struct{ Keys []JWK }
+	json.Unmarshal(w.Body.Bytes(), &jwks)
+	published := map[string]JWK{}
+	for _, k := range jwks.Keys {
+		published[k.Kid] = k
+	}
+	if len(published) != 2 || published["ed-2"].Crv != "Ed25519" || published["retired"].Kid != "" {
+		t.Fatalf("JWKS() = %s", w.Body.String())
+	}
+	n, _ := base64.RawURLEncoding.DecodeString(published["rsa-1"].N)
+	e, _ := base64.RawURLEncoding.DecodeString(published["rsa-1"].E)
+	public := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	if _, err := jwt.Parse(token, func(*jwt.Token) (interface{}, error) { return public, nil }); err != nil {
+		t.Errorf("token doesn't verify with the published key: %v", err)
+	}
+}
@@ -28,7 +28,6 @@ func (a *JWTAuth) AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 		claims, err := a.VerifyJWT(h)
-		log.Printf("They key is: %v", a.Key)
 		if e, ok := err.(*jwt.ValidationError); ok {
 			if e.Errors&jwt.ValidationErrorExpired != 0 {
 				// in this case you might need to give it another spin
@@ -39,9 +38,20 @@ func (a *JWTAuth) AuthMiddleware() gin.HandlerFunc {
 				return
 			}
 		} else if err == nil {
+			if claims.Operator != "" {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "operator tokens are only valid for the dashboard", "code": "unauthorized"})
+				return
+			}
+			if a.Revoked(claims) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Token was revoked", "code": "jwt_revoked"})
+				return
+			}
 			// FIXME it is better to let the endpoint explicitly Get the claim off the user
 			//  as we will assume the auth server will reside in a different domain!
 			c.Set("mobile", claims.Mobile)
+			c.Set("session_id", claims.SessionID)
+			c.Set("jti", claims.Id)
+			c.Set("jwt_expires_at", claims.ExpiresAt)
 			log.Printf("the username is: %s", claims.Mobile)
 			c.Next()
 		}
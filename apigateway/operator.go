@@ -0,0 +1,241 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Operator roles. Admins manage noebs and its operators, support staff read every
+// transaction, and merchant viewers only see the transactions of their merchant.
+const (
+	RoleAdmin          = "admin"
+	RoleSupport        = "support"
+	RoleMerchantViewer = "merchant_viewer"
+)
+
+var (
+	ErrInvalidRole         = errors.New("role must be one of admin, support or merchant_viewer")
+	ErrMerchantScope       = errors.New("a merchant viewer needs a terminal_id or a merchant_id")
+	ErrOperatorCredentials = errors.New("wrong username or password")
+)
+
+// dummyHash is compared against when the username is unknown, so that it takes as long as a wrong password
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("noebs operator"), 8)
+
+// Operator is an account of the dashboard and the admin endpoints, they are
+// separate from the consumers (ebs_fields.User) and sign in with a username.
+type Operator struct {
+	gorm.Model
+	Username string `json:"username" gorm:"uniqueIndex"`
+	Password string `json:"-" redact:"secret"`
+	Role     string `json:"role"`
+	// TerminalID and MerchantID scope a merchant viewer, they are unused for the other roles
+	TerminalID string `json:"terminal_id"`
+	MerchantID string `json:"merchant_id"`
+	Disabled   bool   `json:"disabled"`
+}
+
+// AuditLog is a request an operator made, it is written for every request
+// that goes through RequireRole, denied ones included. Sensitive changes users
+// make to their accounts are recorded too, see AuditUser.
+type AuditLog struct {
+	ID        uint      `json:"id" gorm:"primarykey"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+	Operator  string    `json:"operator" gorm:"index"`
+	Role      string    `json:"role"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	// Target is the path parameters of the request, e.g., the id of the operator that was disabled
+	Target    string `json:"target"`
+	Status    int    `json:"status"`
+	IP        string `json:"ip"`
+	RequestID string `json:"request_id"`
+	// Mobile is the user of a user event, Event names it, e.g., password_reset
+	Mobile string `json:"mobile,omitempty" gorm:"index"`
+	Event  string `json:"event,omitempty"`
+}
+
+// ValidRole reports whether role is an operator role
+func ValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleSupport || role == RoleMerchantViewer
+}
+
+// NewOperator creates an operator whose password is stored as a bcrypt hash
+func NewOperator(db *gorm.DB, username, password, role, terminalID, merchantID string) (*Operator, error) {
+	if !ValidRole(role) {
+		return nil, ErrInvalidRole
+	}
+	if role == RoleMerchantViewer && terminalID == "" && merchantID == "" {
+		return nil, ErrMerchantScope
+	}
+	if len(password) < 8 {
+		return nil, errors.New("password must be at least 8 characters")
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), 8)
+	if err != nil {
+		return nil, err
+	}
+	op := &Operator{Username: username, Password: string(hashed), Role: role}
+	if role == RoleMerchantViewer {
+		op.TerminalID, op.MerchantID = terminalID, merchantID
+	}
+	if err := db.Create(op).Error; err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// EnsureAdmin creates an admin named username when there are no operators at all,
+// so that the first admin can sign in and create the other operators.
+func EnsureAdmin(db *gorm.DB, username, password string) (bool, error) {
+	if username == "" {
+		return false, nil
+	}
+	var count int64
+	if err := db.Model(&Operator{}).Count(&count).Error; err != nil || count > 0 {
+		return false, err
+	}
+	if _, err := NewOperator(db, username, password, RoleAdmin, "", ""); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GenerateOperatorToken generates an access token of op, it is only accepted by RequireRole
+func (j *JWTAuth) GenerateOperatorToken(op *Operator) (string, error) {
+	claims := &TokenClaims{
+		Operator: op.Username,
+		StandardClaims: jwt.StandardClaims{
+			Id:        uuid.New().String(),
+			ExpiresAt: time.Now().Add(j.accessTTL()).UTC().Unix(),
+			Issuer:    "noebs",
+		},
+	}
+	return j.keyring().Sign(claims)
+}
+
+// OperatorLogin signs an operator in with their username and password
+func (j *JWTAuth) OperatorLogin(c *gin.Context) {
+	var req struct {
+		Username string `json:"username" binding:"required"`
+		Password string `json:"password" binding:"required" redact:"secret"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	if j.Db == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": errNoSessionStore.Error(), "code": "database_error"})
+		return
+	}
+	var op Operator
+	if err := j.Db.Where("username = ? AND disabled = ?", req.Username, false).First(&op).Error; err != nil {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(req.Password))
+		c.JSON(http.StatusUnauthorized, gin.H{"message": ErrOperatorCredentials.Error(), "code": "wrong_credentials"})
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(op.Password), []byte(req.Password)); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": ErrOperatorCredentials.Error(), "code": "wrong_credentials"})
+		return
+	}
+	token, err := j.GenerateOperatorToken(&op)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "jwt_error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"authorization": token, "expires_in": int(j.accessTTL().Seconds()), "role": op.Role})
+}
+
+// RequireRole authorizes the operators having one of roles. The operator is
+// read on every request so that disabling them or changing their role is
+// effective right away. It sets operator, role, terminal_id and merchant_id in
+// the context, and writes an AuditLog of the request once it is handled.
+func (j *JWTAuth) RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h := c.GetHeader("Authorization")
+		if h == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "empty header was sent", "code": "unauthorized"})
+			return
+		}
+		claims, err := j.VerifyJWT(h)
+		if err != nil || claims.Operator == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "not an operator token", "code": "unauthorized"})
+			return
+		}
+		if j.IsRevoked(claims.Id) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Token was revoked", "code": "jwt_revoked"})
+			return
+		}
+		if j.Db == nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": errNoSessionStore.Error(), "code": "database_error"})
+			return
+		}
+		var op Operator
+		if err := j.Db.Where("username = ? AND disabled = ?", claims.Operator, false).First(&op).Error; err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "operator not found or disabled", "code": "unauthorized"})
+			return
+		}
+		defer j.audit(c, &op)
+
+		allowed := false
+		for _, role := range roles {
+			allowed = allowed || op.Role == role
+		}
+		if !allowed {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "your role can't access this endpoint", "code": "forbidden"})
+			return
+		}
+		c.Set("operator", op.Username)
+		c.Set("role", op.Role)
+		c.Set("terminal_id", op.TerminalID)
+		c.Set("merchant_id", op.MerchantID)
+		c.Next()
+	}
+}
+
+// audit writes the AuditLog of the request c of op
+func (j *JWTAuth) audit(c *gin.Context, op *Operator) {
+	params := make([]string, 0, len(c.Params))
+	for _, p := range c.Params {
+		params = append(params, p.Key+"="+p.Value)
+	}
+	entry := AuditLog{
+		Operator:  op.Username,
+		Role:      op.Role,
+		Method:    c.Request.Method,
+		Path:      c.FullPath(),
+		Target:    strings.Join(params, "&"),
+		Status:    c.Writer.Status(),
+		IP:        c.ClientIP(),
+		RequestID: c.GetString("request_id"),
+	}
+	if err := j.Db.Create(&entry).Error; err != nil {
+		log.WithFields(log.Fields{"operator": op.Username, "path": entry.Path}).Errorf("error in writing the audit log: %v", err)
+	}
+}
+
+// AuditUser writes an AuditLog of the event of the user mobile, once the
+// response of the request c is written.
+func (j *JWTAuth) AuditUser(c *gin.Context, mobile, event string) {
+	entry := AuditLog{
+		Mobile:    mobile,
+		Event:     event,
+		Method:    c.Request.Method,
+		Path:      c.FullPath(),
+		Status:    c.Writer.Status(),
+		IP:        c.ClientIP(),
+		RequestID: c.GetString("request_id"),
+	}
+	if err := j.Db.Create(&entry).Error; err != nil {
+		log.WithFields(log.Fields{"mobile": mobile, "event": event}).Errorf("error in writing the audit log: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestJWTAuth_RequireRole(t *testing.T) {
+	j := testSessionAuth(t)
+	j.Db.AutoMigrate(&Operator{}, &AuditLog{})
+	if ok, err := EnsureAdmin(j.Db, "admin", "admin password"); !ok || err != nil {
+		t.Fatalf("EnsureAdmin() = %v, %v", ok, err)
+	}
+	if ok, _ := EnsureAdmin(j.Db, "admin2", "admin password"); ok {
+		t.Errorf("EnsureAdmin() created an admin while there are operators")
+	}
+	if _, err := NewOperator(j.Db, "viewer", "viewer password", RoleMerchantViewer, "", ""); err != ErrMerchantScope {
+		t.Errorf("NewOperator() of an unscoped merchant viewer error = %v", err)
+	}
+	NewOperator(j.Db, "viewer", "viewer password", RoleMerchantViewer, "12345678", "")
+	disabled, _ := NewOperator(j.Db, "former", "former password", RoleSupport, "", "")
+	j.Db.Model(disabled).Update("disabled", true)
+
+	r := gin.New()
+	r.POST("/login", j.OperatorLogin)
+	r.GET("/all", j.RequireRole(RoleAdmin, RoleMerchantViewer), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"terminal_id": c.GetString("terminal_id")})
+	})
+	r.GET("/stream", j.RequireRole(RoleAdmin), func(c *gin.Context) { c.Status(http.StatusOK) })
+	login := func(username, password string) string {
+		body, _ := json.Marshal(gin.H{"username": username, "password": password})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(body)))
+		var res struct{ Authorization string }
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return res.Authorization
+	}
+	admin, viewer := login("admin", "admin password"), login("viewer", "viewer password")
+	if admin == "" || viewer == "" {
+		t.Fatalf("OperatorLogin() didn't sign the operators in")
+	}
+	if token := login("admin", "wrong password"); token != "" {
+		t.Errorf("OperatorLogin() signed in with a wrong password")
+	}
+	if token := login("former", "former password"); token != "" {
+		t.Errorf("OperatorLogin() signed a disabled operator in")
+	}
+	consumer, _ := j.GenerateJWT("0912141679")
+
+	tests := []struct {
+		name     string
+		path     string
+		token    string
+		wantCode int
+	}{
+		{"admin", "/stream", admin, http.StatusOK},
+		{"merchant viewer", "/all", viewer, http.StatusOK},
+		{"role not allowed", "/stream", viewer, http.StatusForbidden},
+		{"consumer token", "/all", consumer, http.StatusUnauthorized},
+		{"no token", "/all", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Authorization", tt.token)
+			r.ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Errorf("RequireRole() code = %v, want %v: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+		})
+	}
+
+	// consumer endpoints don't accept operator tokens either
+	consumerRoute := gin.New()
+	consumerRoute.GET("/", j.AuthMiddleware(), func(c *gin.Context) { c.Status(http.StatusOK) })
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", admin)
+	consumerRoute.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("AuthMiddleware() with an operator token = %v", w.Code)
+	}
+
+	var logs []AuditLog
+	j.Db.Order("id").Find(&logs)
+	if len(logs) != 3 {
+		t.Fatalf("RequireRole() wrote %d audit logs, want 3", len(logs))
+	}
+	if logs[2].Operator != "viewer" || logs[2].Path != "/stream" || logs[2].Status != http.StatusForbidden {
+		t.Errorf("audit log of a denied request = %+v", logs[2])
+	}
+}
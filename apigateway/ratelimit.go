@@ -0,0 +1,247 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	log "github.com/sirupsen/logrus"
+)
+
+// pruneEvery is how often the buckets and failures kept in memory are pruned
+const pruneEvery = time.Minute
+
+// bucket is a token bucket, see tokenBuckets
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // when it is refilled, a full bucket is the same as none
+}
+
+// tokenBuckets rate limits requests by key: a bucket holds up to limit tokens
+// that refill evenly over per, and every request takes one.
+type tokenBuckets struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	pruned  time.Time
+}
+
+// take takes a token of the bucket of key. It returns false when the bucket is
+// empty, together with how long until a token is available.
+func (t *tokenBuckets) take(key string, limit int, per time.Duration, now time.Time) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.buckets == nil {
+		t.buckets = make(map[string]*bucket)
+	}
+	if now.Sub(t.pruned) >= pruneEvery {
+		for k, b := range t.buckets {
+			if !now.Before(b.full) {
+				delete(t.buckets, k)
+			}
+		}
+		t.pruned = now
+	}
+	b, ok := t.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit), last: now}
+		t.buckets[key] = b
+	}
+	rate := float64(limit) / float64(per)
+	b.tokens += float64(now.Sub(b.last)) * rate
+	if b.tokens > float64(limit) {
+		b.tokens = float64(limit)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		b.full = now.Add(time.Duration((float64(limit) - b.tokens) / rate))
+		return false, time.Duration((1 - b.tokens) / rate)
+	}
+	b.tokens--
+	b.full = now.Add(time.Duration((float64(limit) - b.tokens) / rate))
+	return true, 0
+}
+
+// takeScript is tokenBuckets.take in Redis, times are in milliseconds. It
+// returns how long until a token is available, 0 when one was taken.
+var takeScript = redis.NewScript(`
+local limit, per, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local b = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens, last = tonumber(b[1]) or limit, tonumber(b[2]) or now
+local rate = limit / per
+tokens = math.min(limit, tokens + math.max(0, now - last) * rate)
+local wait = 0
+if tokens < 1 then
+	wait = math.ceil((1 - tokens) / rate)
+else
+	tokens = tokens - 1
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "last", now)
+redis.call("PEXPIRE", KEYS[1], per)
+return wait
+`)
+
+// failScript counts a failure of KEYS[1] in a window of ARGV[1] milliseconds
+var failScript = redis.NewScript(`
+local n = redis.call("INCR", KEYS[1])
+if n == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return n
+`)
+
+// redisRetry is how long the RateLimiter stays in memory after Redis failed
+const redisRetry = 30 * time.Second
+
+// ipFactor is how many times the limit of a mobile or a device an IP gets,
+// users behind the same NAT share it.
+const ipFactor = 5
+
+type failures struct {
+	count   int
+	expires time.Time
+}
+
+// RateLimiter rate limits requests with token buckets and counts failed
+// attempts, e.g., wrong passwords. They are kept in Redis so that all noebs
+// instances share them, and in memory while Redis is nil or unreachable.
+type RateLimiter struct {
+	Redis *redis.Client
+
+	local     tokenBuckets
+	mu        sync.Mutex
+	failures  map[string]*failures
+	pruned    time.Time // when the expired failures were last pruned
+	downUntil time.Time
+}
+
+// redis returns the Redis client, nil when it is down
+func (r *RateLimiter) redis(now time.Time) *redis.Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Redis == nil || now.Before(r.downUntil) {
+		return nil
+	}
+	return r.Redis
+}
+
+func (r *RateLimiter) redisFailed(err error, now time.Time) {
+	log.Errorf("rate limits are kept in memory for %v, redis failed: %v", redisRetry, err)
+	r.mu.Lock()
+	r.downUntil = now.Add(redisRetry)
+	r.mu.Unlock()
+}
+
+// Take takes a token of the bucket of key, which holds up to limit tokens
+// refilled over per. It returns false when the bucket is empty, together with
+// how long until a token is available.
+func (r *RateLimiter) Take(key string, limit int, per time.Duration, now time.Time) (bool, time.Duration) {
+	if client := r.redis(now); client != nil {
+		wait, err := takeScript.Run(client, []string{"ratelimit:" + key}, limit, per.Milliseconds(), now.UnixMilli()).Int64()
+		if err == nil {
+			return wait == 0, time.Duration(wait) * time.Millisecond
+		}
+		r.redisFailed(err, now)
+	}
+	return r.local.take(key, limit, per, now)
+}
+
+// Fail counts a failed attempt of key and returns the number of failures in
+// the window, which starts with the first one.
+func (r *RateLimiter) Fail(key string, window time.Duration, now time.Time) int {
+	if client := r.redis(now); client != nil {
+		n, err := failScript.Run(client, []string{"failures:" + key}, window.Milliseconds()).Int()
+		if err == nil {
+			return n
+		}
+		r.redisFailed(err, now)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failures == nil {
+		r.failures = make(map[string]*failures)
+	}
+	if now.Sub(r.pruned) >= pruneEvery {
+		for k, f := range r.failures {
+			if !now.Before(f.expires) {
+				delete(r.failures, k)
+			}
+		}
+		r.pruned = now
+	}
+	f, ok := r.failures[key]
+	if !ok || !now.Before(f.expires) {
+		f = &failures{expires: now.Add(window)}
+		r.failures[key] = f
+	}
+	f.count++
+	return f.count
+}
+
+// Reset forgets the failed attempts of key
+func (r *RateLimiter) Reset(key string) {
+	if client := r.redis(time.Now()); client != nil {
+		if err := client.Del("failures:" + key).Err(); err != nil {
+			r.redisFailed(err, time.Now())
+		}
+	}
+	r.mu.Lock()
+	delete(r.failures, key)
+	r.mu.Unlock()
+}
+
+// rateLimitKeys are the fields of a request body a rate limit is keyed by
+type rateLimitKeys struct {
+	Mobile   string `json:"mobile"`
+	DeviceID string `json:"device_id"`
+	PAN      string `json:"PAN"`
+}
+
+// Limit rate limits the route name to limit requests per, for each IP, mobile,
+// device and card of the requests. The mobile, device_id and PAN are read from
+// the JSON body, the mobile of a signed in user is used when there is one.
+func (r *RateLimiter) Limit(name string, limit int, per time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var keys rateLimitKeys
+		if c.Request.Body != nil {
+			body, err := io.ReadAll(c.Request.Body)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+				return
+			}
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+			json.Unmarshal(body, &keys)
+		}
+		if mobile := c.GetString("mobile"); mobile != "" {
+			keys.Mobile = mobile
+		}
+
+		now := time.Now()
+		ok, wait := r.Take(name+":ip:"+c.ClientIP(), limit*ipFactor, per, now)
+		for _, key := range []struct{ kind, value string }{{"mobile", keys.Mobile}, {"device", keys.DeviceID}, {"pan", keys.PAN}} {
+			if key.value == "" {
+				continue
+			}
+			if key.kind == "pan" {
+				key.value = ebs_fields.HashPAN(key.value)
+			}
+			if allowed, w := r.Take(name+":"+key.kind+":"+key.value, limit, per, now); !allowed {
+				ok, wait = false, time.Duration(math.Max(float64(wait), float64(w)))
+			}
+		}
+		if !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"message": "too many requests, try again later", "code": "rate_limited"})
+			return
+		}
+		c.Next()
+	}
+}
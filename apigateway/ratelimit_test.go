@@ -0,0 +1,111 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+)
+
+func Test_tokenBuckets_take(t *testing.T) {
+	var b tokenBuckets
+	now := time.Now()
+	tests := []struct {
+		name     string
+		key      string
+		at       time.Duration
+		want     bool
+		wantWait time.Duration
+	}{
+		{"full bucket", "a", 0, true, 0},
+		{"second token", "a", 0, true, 0},
+		{"empty bucket", "a", 0, false, 30 * time.Second},
+		{"other key", "b", 0, true, 0},
+		{"refilled", "a", 30 * time.Second, true, 0},
+		{"partially refilled", "a", 45 * time.Second, false, 15 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, wait := b.take(tt.key, 2, time.Minute, now.Add(tt.at))
+			if got != tt.want || wait.Round(time.Second) != tt.wantWait {
+				t.Errorf("take() = %v, %v, want %v, %v", got, wait, tt.want, tt.wantWait)
+			}
+		})
+	}
+	// b is full again, a isn't yet
+	b.take("c", 2, time.Minute, now.Add(61*time.Second))
+	if _, ok := b.buckets["b"]; ok || len(b.buckets) != 2 {
+		t.Errorf("take() kept %d buckets, want a and c", len(b.buckets))
+	}
+}
+
+func TestRateLimiter_Fail(t *testing.T) {
+	// redis isn't reachable, the failures are counted in memory
+	r := &RateLimiter{Redis: redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", DialTimeout: 100 * time.Millisecond})}
+	now := time.Now()
+	tests := []struct {
+		name string
+		key  string
+		at   time.Duration
+		want int
+	}{
+		{"first failure", "a", 0, 1},
+		{"second failure", "a", time.Minute, 2},
+		{"other key", "b", time.Minute, 1},
+		{"window is over", "a", time.Hour, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.Fail(tt.key, time.Hour, now.Add(tt.at)); got != tt.want {
+				t.Errorf("Fail() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	r.Reset("a")
+	if got := r.Fail("a", time.Hour, now); got != 1 {
+		t.Errorf("Fail() after Reset() = %v, want 1", got)
+	}
+	r.Fail("c", time.Hour, now.Add(2*time.Hour))
+	if len(r.failures) != 1 {
+		t.Errorf("Fail() kept %d failures after the others expired, want 1", len(r.failures))
+	}
+}
+
+func TestRateLimiter_Limit(t *testing.T) {
+	r := &RateLimiter{}
+	router := gin.New()
+	router.POST("/login", r.Limit("login", 2, time.Minute), func(c *gin.Context) {
+		var req Token
+		if err := c.ShouldBindJSON(&req); err != nil || req.Mobile == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "the body was consumed"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"result": "ok"})
+	})
+	tests := []struct {
+		name   string
+		body   string
+		want   int
+		header string
+	}{
+		{"first", `{"mobile": "0912141679"}`, http.StatusOK, ""},
+		{"second", `{"mobile": "0912141679", "device_id": "a"}`, http.StatusOK, ""},
+		{"mobile is limited", `{"mobile": "0912141679", "device_id": "b"}`, http.StatusTooManyRequests, "30"},
+		{"other mobile on the device", `{"mobile": "0912141680", "device_id": "a"}`, http.StatusOK, ""},
+		{"device is limited", `{"mobile": "0912141681", "device_id": "a"}`, http.StatusTooManyRequests, "30"},
+		{"other mobile", `{"mobile": "0912141682"}`, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(tt.body)))
+			if w.Code != tt.want || w.Header().Get("Retry-After") != tt.header {
+				t.Errorf("Limit() = %v, Retry-After %q, want %v, %q: %s", w.Code, w.Header().Get("Retry-After"), tt.want, tt.header, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package gateway
+
+import (
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// RequestID tags every request with an id, taken from the X-Request-ID header
+// when the client sent one. The id is echoed in the response and is carried by
+// the request context, so the EBS exchanges of the request are stored with it.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(ebs_fields.RequestIDHeader)
+		if id == "" || len(id) > 64 {
+			id = uuid.New().String()
+		}
+		c.Set("request_id", id)
+		c.Header(ebs_fields.RequestIDHeader, id)
+		c.Request = c.Request.WithContext(ebs_fields.WithRequestID(c.Request.Context(), id))
+		c.Next()
+	}
+}
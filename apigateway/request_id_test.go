@@ -0,0 +1,40 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"client id", "req-1", "req-1"},
+		{"generated", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fromCtx string
+			r := gin.New()
+			r.Use(RequestID())
+			r.GET("/", func(c *gin.Context) { fromCtx = ebs_fields.RequestID(c.Request.Context()) })
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set(ebs_fields.RequestIDHeader, tt.header)
+			}
+			r.ServeHTTP(w, req)
+			got := w.Header().Get(ebs_fields.RequestIDHeader)
+			if got == "" || got != fromCtx || (tt.want != "" && got != tt.want) {
+				t.Errorf("RequestID() header = %q, context = %q, want %q", got, fromCtx, tt.want)
+			}
+		})
+	}
+}
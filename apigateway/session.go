@@ -0,0 +1,319 @@
+package gateway
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultAccessTTL  = 15 * time.Minute
+	defaultRefreshTTL = 30 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrSessionRevoked      = errors.New("session was revoked")
+	ErrLegacyRefreshEnded  = errors.New("tokens issued without a session can't be refreshed anymore, sign in again")
+	errNoSessionStore      = errors.New("sessions are not enabled, JWTAuth.Db is not set")
+)
+
+// Session is a device the user signed in from. The client keeps the refresh
+// token of the session while noebs only stores its hash. Every refresh rotates
+// it, and a rotated token that is presented again revokes the session since
+// it has likely been stolen.
+type Session struct {
+	gorm.Model
+	Mobile       string `json:"-" gorm:"index"`
+	DeviceID     string `json:"device_id"`
+	UserAgent    string `json:"user_agent"`
+	IP           string `json:"ip"`
+	RefreshHash  string `json:"-" gorm:"uniqueIndex"`
+	PreviousHash string `json:"-" gorm:"index"`
+	// AccessJTI is the jti of the latest access token of the session, it is
+	// denied until AccessExpiresAt when the session is revoked. The earlier
+	// tokens of the session are denied by their session, see Revoked.
+	AccessJTI       string     `json:"-"`
+	AccessExpiresAt time.Time  `json:"-"`
+	LastUsedAt      time.Time  `json:"last_used_at"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	RevokedAt       *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Active reports whether s can still be refreshed at now
+func (s Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+// RevokedToken denies an access token by its jti until the token expires
+type RevokedToken struct {
+	JTI       string    `gorm:"primaryKey"`
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// TokenPair is what a client gets when it signs in or refreshes its session
+type TokenPair struct {
+	AccessToken  string `json:"authorization"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"` // seconds until the access token expires
+	SessionID    uint   `json:"session_id"`
+}
+
+func (j *JWTAuth) accessTTL() time.Duration {
+	if j.NoebsConfig.AccessTokenTTL > 0 {
+		return time.Duration(j.NoebsConfig.AccessTokenTTL) * time.Second
+	}
+	return defaultAccessTTL
+}
+
+func (j *JWTAuth) refreshTTL() time.Duration {
+	if j.NoebsConfig.RefreshTokenTTL > 0 {
+		return time.Duration(j.NoebsConfig.RefreshTokenTTL) * time.Second
+	}
+	return defaultRefreshTTL
+}
+
+// NewSession signs mobile in from a device and returns the tokens of the new session
+func (j *JWTAuth) NewSession(mobile, deviceID, userAgent, ip string) (TokenPair, error) {
+	if j.Db == nil {
+		return TokenPair{}, errNoSessionStore
+	}
+	now := time.Now()
+	refresh, err := newRefreshToken()
+	if err != nil {
+		return TokenPair{}, err
+	}
+	session := Session{Mobile: mobile, DeviceID: deviceID, UserAgent: userAgent, IP: ip,
+		RefreshHash: hashRefreshToken(refresh), LastUsedAt: now, ExpiresAt: now.Add(j.refreshTTL())}
+	if err := j.Db.Create(&session).Error; err != nil {
+		return TokenPair{}, err
+	}
+	return j.issue(&session, refresh, now)
+}
+
+// Refresh rotates the refresh token of a session and issues a new access token
+func (j *JWTAuth) Refresh(refreshToken string) (TokenPair, error) {
+	if j.Db == nil {
+		return TokenPair{}, errNoSessionStore
+	}
+	now := time.Now()
+	hash := hashRefreshToken(refreshToken)
+	var session Session
+	if err := j.Db.Where("refresh_hash = ?", hash).First(&session).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return TokenPair{}, err
+		}
+		// a rotated token is reused: whoever holds the session now, it can't be trusted
+		if err := j.Db.Where("previous_hash = ?", hash).First(&session).Error; err == nil {
+			j.revoke(&session, now)
+			return TokenPair{}, ErrSessionRevoked
+		}
+		return TokenPair{}, ErrInvalidRefreshToken
+	}
+	if session.RevokedAt != nil {
+		return TokenPair{}, ErrSessionRevoked
+	}
+	if !session.Active(now) {
+		return TokenPair{}, ErrInvalidRefreshToken
+	}
+
+	refresh, err := newRefreshToken()
+	if err != nil {
+		return TokenPair{}, err
+	}
+	// the condition on refresh_hash makes concurrent refreshes with the same token fail but one
+	res := j.Db.Model(&Session{}).Where("id = ? AND refresh_hash = ?", session.ID, hash).
+		Updates(map[string]any{"refresh_hash": hashRefreshToken(refresh), "previous_hash": hash, "last_used_at": now})
+	if res.Error != nil {
+		return TokenPair{}, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return TokenPair{}, ErrInvalidRefreshToken
+	}
+	return j.issue(&session, refresh, now)
+}
+
+// LegacyRefresh starts a new session on deviceID for the (possibly expired)
+// access token of claims, for the clients that have no refresh token. The
+// caller proves the token is theirs, e.g., with the key of the user. The new
+// session replaces the session of the token unless it was revoked. A token
+// issued without a session is denied once it is refreshed, and they all are
+// once the user signs out of them (see RevokeLegacyTokens).
+func (j *JWTAuth) LegacyRefresh(claims *TokenClaims, deviceID, userAgent, ip string) (TokenPair, error) {
+	if j.Db == nil {
+		return TokenPair{}, errNoSessionStore
+	}
+	now := time.Now()
+	if !j.legacyRefreshUntil.IsZero() && !now.Before(j.legacyRefreshUntil) {
+		return TokenPair{}, ErrLegacyRefreshEnded
+	}
+	if claims.SessionID != 0 {
+		var session Session
+		err := j.Db.Where("mobile = ?", claims.Mobile).First(&session, claims.SessionID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return TokenPair{}, ErrSessionRevoked
+		} else if err != nil {
+			return TokenPair{}, err
+		}
+		if !session.Active(now) {
+			return TokenPair{}, ErrSessionRevoked
+		}
+		if err := j.revoke(&session, now); err != nil {
+			return TokenPair{}, err
+		}
+		return j.NewSession(claims.Mobile, session.DeviceID, userAgent, ip)
+	}
+
+	var user ebs_fields.User
+	if err := j.Db.Where("mobile = ?", claims.Mobile).First(&user).Error; err != nil {
+		return TokenPair{}, err
+	}
+	if user.LegacyTokensRevokedAt != nil || j.IsRevoked(claims.Id) {
+		return TokenPair{}, ErrSessionRevoked
+	}
+	// the token is expired already, it is denied for as long as a session lasts
+	if err := j.RevokeToken(claims.Id, now.Add(j.refreshTTL())); err != nil {
+		return TokenPair{}, err
+	}
+	return j.NewSession(claims.Mobile, deviceID, userAgent, ip)
+}
+
+// issue signs a new access token for session and returns it with refresh
+func (j *JWTAuth) issue(session *Session, refresh string, now time.Time) (TokenPair, error) {
+	access, claims, err := j.GenerateAccessToken(session.Mobile, session.ID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	session.AccessJTI = claims.Id
+	session.AccessExpiresAt = time.Unix(claims.ExpiresAt, 0)
+	err = j.Db.Model(&Session{}).Where("id = ?", session.ID).
+		Updates(map[string]any{"access_jti": session.AccessJTI, "access_expires_at": session.AccessExpiresAt}).Error
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{AccessToken: access, RefreshToken: refresh, ExpiresIn: claims.ExpiresAt - now.Unix(), SessionID: session.ID}, nil
+}
+
+// Sessions returns the active sessions of mobile, the most recently used first
+func (j *JWTAuth) Sessions(mobile string) ([]Session, error) {
+	var sessions []Session
+	if j.Db == nil {
+		return sessions, errNoSessionStore
+	}
+	err := j.Db.Where("mobile = ? AND revoked_at IS NULL AND expires_at > ?", mobile, time.Now()).
+		Order("last_used_at DESC").Find(&sessions).Error
+	return sessions, err
+}
+
+// RevokeSession revokes the session id of mobile, together with its access token
+func (j *JWTAuth) RevokeSession(mobile string, id uint) error {
+	if j.Db == nil {
+		return errNoSessionStore
+	}
+	var session Session
+	if err := j.Db.Where("mobile = ? AND revoked_at IS NULL", mobile).First(&session, id).Error; err != nil {
+		return err
+	}
+	return j.revoke(&session, time.Now())
+}
+
+// RevokeSessions revokes every session of mobile, e.g., when their password is changed
+func (j *JWTAuth) RevokeSessions(mobile string) error {
+	if j.Db == nil {
+		return errNoSessionStore
+	}
+	var sessions []Session
+	if err := j.Db.Where("mobile = ? AND revoked_at IS NULL", mobile).Find(&sessions).Error; err != nil {
+		return err
+	}
+	now := time.Now()
+	for i := range sessions {
+		if err := j.revoke(&sessions[i], now); err != nil {
+			return err
+		}
+	}
+	return j.RevokeLegacyTokens(mobile)
+}
+
+// RevokeLegacyTokens signs mobile out of the tokens issued without a session,
+// they are denied by LegacyRefresh from now on.
+func (j *JWTAuth) RevokeLegacyTokens(mobile string) error {
+	if j.Db == nil {
+		return errNoSessionStore
+	}
+	return j.Db.Model(&ebs_fields.User{}).Where("mobile = ?", mobile).Update("legacy_tokens_revoked_at", time.Now()).Error
+}
+
+func (j *JWTAuth) revoke(session *Session, now time.Time) error {
+	if err := j.Db.Model(session).Update("revoked_at", now).Error; err != nil {
+		return err
+	}
+	return j.RevokeToken(session.AccessJTI, session.AccessExpiresAt)
+}
+
+// RevokeToken denies the access token jti, expiresAt is when it would have
+// expired anyway and the denylist entry can be dropped.
+func (j *JWTAuth) RevokeToken(jti string, expiresAt time.Time) error {
+	if j.Db == nil {
+		return errNoSessionStore
+	}
+	now := time.Now()
+	if jti == "" || !expiresAt.After(now) {
+		return nil
+	}
+	j.Db.Where("expires_at <= ?", now).Delete(&RevokedToken{})
+	return j.Db.Clauses(clause.OnConflict{DoNothing: true}).Create(&RevokedToken{JTI: jti, ExpiresAt: expiresAt}).Error
+}
+
+// IsRevoked reports whether the access token jti was revoked, it is when the
+// denylist can't be read. Nothing is revoked when sessions aren't enabled.
+func (j *JWTAuth) IsRevoked(jti string) bool {
+	if j.Db == nil || jti == "" {
+		return false
+	}
+	var count int64
+	if err := j.Db.Model(&RevokedToken{}).Where("jti = ?", jti).Count(&count).Error; err != nil {
+		log.Printf("unable to check revoked tokens: %v", err)
+		return true
+	}
+	return count > 0
+}
+
+// Revoked reports whether the access token of claims was revoked: its jti is
+// denied, or its session was revoked or removed, which denies the tokens the
+// session issued before its latest one too. It is when they can't be read.
+func (j *JWTAuth) Revoked(claims *TokenClaims) bool {
+	if j.IsRevoked(claims.Id) {
+		return true
+	}
+	if j.Db == nil || claims.SessionID == 0 {
+		return false
+	}
+	var count int64
+	if err := j.Db.Model(&Session{}).Where("id = ? AND mobile = ? AND revoked_at IS NULL", claims.SessionID, claims.Mobile).Count(&count).Error; err != nil {
+		log.Printf("unable to check the session of a token: %v", err)
+		return true
+	}
+	return count == 0
+}
+
+func newRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
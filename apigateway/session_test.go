@@ -0,0 +1,164 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func testSessionAuth(t *testing.T) *JWTAuth {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("unable to open test db: %v", err)
+	}
+	db.AutoMigrate(&Session{}, &RevokedToken{}, &ebs_fields.User{})
+	return &JWTAuth{Key: []byte("session test key"), Db: db}
+}
+
+func TestJWTAuth_Refresh(t *testing.T) {
+	j := testSessionAuth(t)
+	first, err := j.NewSession("0912141679", "device-1", "test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewSession() error = %v", err)
+	}
+	claims, err := j.VerifyJWT(first.AccessToken)
+	if err != nil || claims.Mobile != "0912141679" || claims.SessionID != first.SessionID || claims.Id == "" {
+		t.Fatalf("NewSession() access token claims = %+v, %v", claims, err)
+	}
+
+	second, err := j.Refresh(first.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	if second.RefreshToken == first.RefreshToken || second.SessionID != first.SessionID {
+		t.Errorf("Refresh() = %+v, want a rotated refresh token of session %d", second, first.SessionID)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"unknown token", "not a refresh token", ErrInvalidRefreshToken},
+		// presenting a rotated token revokes the session, the latest token included
+		{"reused token", first.RefreshToken, ErrSessionRevoked},
+		{"revoked session", second.RefreshToken, ErrSessionRevoked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := j.Refresh(tt.token); err != tt.wantErr {
+				t.Errorf("Refresh() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+	claims, _ = j.VerifyJWT(second.AccessToken)
+	if !j.IsRevoked(claims.Id) {
+		t.Errorf("IsRevoked() = false for the access token of a revoked session")
+	}
+}
+
+func TestJWTAuth_AuthMiddleware_revoked(t *testing.T) {
+	j := testSessionAuth(t)
+	kept, _ := j.NewSession("0912141679", "device-1", "test", "127.0.0.1")
+	revoked, _ := j.NewSession("0912141679", "device-2", "test", "127.0.0.1")
+	other, _ := j.NewSession("0912141680", "device-3", "test", "127.0.0.1")
+	// only the latest access token of a session is denied by its jti
+	earlier, _ := j.NewSession("0912141679", "device-4", "test", "127.0.0.1")
+	if latest, err := j.Refresh(earlier.RefreshToken); err != nil || j.RevokeSession("0912141679", latest.SessionID) != nil {
+		t.Fatalf("unable to revoke a refreshed session: %v", err)
+	}
+	if err := j.RevokeSession("0912141680", revoked.SessionID); err == nil {
+		t.Errorf("RevokeSession() revoked a session of another user")
+	}
+	if err := j.RevokeSession("0912141679", revoked.SessionID); err != nil {
+		t.Fatalf("RevokeSession() error = %v", err)
+	}
+
+	r := gin.New()
+	r.Use(j.AuthMiddleware())
+	r.GET("/", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"session_id": c.GetUint("session_id")}) })
+	tests := []struct {
+		name     string
+		token    string
+		wantCode int
+	}{
+		{"active session", kept.AccessToken, http.StatusOK},
+		{"revoked session", revoked.AccessToken, http.StatusUnauthorized},
+		{"other user", other.AccessToken, http.StatusOK},
+		{"earlier token of a revoked session", earlier.AccessToken, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", tt.token)
+			r.ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Errorf("AuthMiddleware() code = %v, want %v: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+		})
+	}
+
+	if err := j.RevokeSessions("0912141679"); err != nil {
+		t.Fatalf("RevokeSessions() error = %v", err)
+	}
+	if sessions, _ := j.Sessions("0912141679"); len(sessions) != 0 {
+		t.Errorf("Sessions() = %d sessions after RevokeSessions()", len(sessions))
+	}
+	if sessions, _ := j.Sessions("0912141680"); len(sessions) != 1 {
+		t.Errorf("Sessions() of another user = %d sessions, want 1", len(sessions))
+	}
+}
+
+func TestJWTAuth_LegacyRefresh(t *testing.T) {
+	j := testSessionAuth(t)
+	j.Db.Create(&ebs_fields.User{Model: gorm.Model{ID: 1}, Mobile: "0912141679"})
+	j.Db.Create(&ebs_fields.User{Model: gorm.Model{ID: 2}, Mobile: "0912141680"})
+	expired := time.Now().Add(-time.Hour).Unix()
+	legacy := func(mobile string, sessionID uint) *TokenClaims {
+		_, claims, _ := j.GenerateAccessToken(mobile, sessionID)
+		claims.ExpiresAt = expired
+		return claims
+	}
+	revoked, _ := j.NewSession("0912141679", "device-1", "test", "127.0.0.1")
+	j.RevokeSession("0912141679", revoked.SessionID)
+	active, _ := j.NewSession("0912141679", "device-2", "test", "127.0.0.1")
+	refreshed := legacy("0912141679", 0)
+	signedOut := legacy("0912141680", 0)
+	j.RevokeLegacyTokens("0912141680")
+
+	tests := []struct {
+		name    string
+		claims  *TokenClaims
+		wantErr error
+	}{
+		{"revoked session", legacy("0912141679", revoked.SessionID), ErrSessionRevoked},
+		{"active session", legacy("0912141679", active.SessionID), nil},
+		{"replaced session", legacy("0912141679", active.SessionID), ErrSessionRevoked},
+		{"without a session", refreshed, nil},
+		{"refreshed already", refreshed, ErrSessionRevoked},
+		{"signed out", signedOut, ErrSessionRevoked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pair, err := j.LegacyRefresh(tt.claims, "device-3", "test", "127.0.0.1")
+			if err != tt.wantErr {
+				t.Fatalf("LegacyRefresh() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (pair.SessionID == 0 || pair.RefreshToken == "") {
+				t.Errorf("LegacyRefresh() = %+v, want a new session", pair)
+			}
+		})
+	}
+
+	j.legacyRefreshUntil = time.Now()
+	if _, err := j.LegacyRefresh(legacy("0912141679", 0), "device-3", "test", "127.0.0.1"); err != ErrLegacyRefreshEnded {
+		t.Errorf("LegacyRefresh() after legacy_refresh_until error = %v, want %v", err, ErrLegacyRefreshEnded)
+	}
+}
@@ -0,0 +1,301 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
+)
+
+// SignatureHeader has the base64 signature of a request, see SignedMessage.
+const SignatureHeader = "X-Signature"
+
+const (
+	// SignatureTimestampHeader has the unix time, in seconds, the request was signed at
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+	// SignatureNonceHeader has a random value that is used only once
+	SignatureNonceHeader = "X-Signature-Nonce"
+	// signatureWindow is how far the signing time can be from the time of noebs
+	signatureWindow = 5 * time.Minute
+)
+
+var (
+	ErrInvalidSignature = errors.New("the signature doesn't match the request")
+	ErrInvalidPublicKey = errors.New("the public key must be a base64 or a PEM encoded PKIX key")
+	ErrStaleSignature   = errors.New("the signature is too old, or from the future")
+	ErrReplayedNonce    = errors.New("the nonce of the signature was already used")
+
+	errDuplicateField = errors.New("the body has the same field more than once")
+)
+
+// SignatureNonce is a nonce that was used to sign a request, it is kept until
+// a request with its timestamp would be refused anyway.
+type SignatureNonce struct {
+	Mobile    string    `gorm:"primaryKey"`
+	Nonce     string    `gorm:"primaryKey"`
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// SignedMessage returns what the apps sign: the timestamp, the nonce and the
+// canonical JSON of the body, separated by new lines.
+func SignedMessage(timestamp, nonce string, body []byte) ([]byte, error) {
+	canonical, err := CanonicalJSON(body)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(timestamp+"\n"+nonce+"\n"), canonical...), nil
+}
+
+// CanonicalJSON returns the JSON body with its object keys sorted and without
+// any whitespace, it is what the apps sign. Numbers are kept as they were sent.
+func CanonicalJSON(body []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// VerifySignature verifies the base64 signature of message by publicKey, a
+// PKIX RSA (PKCS #1 v1.5), ECDSA or Ed25519 key. RSA and ECDSA signatures are
+// of the SHA-256 of message.
+func VerifySignature(publicKey, signature string, message []byte) error {
+	var der []byte
+	if block, _ := pem.Decode([]byte(publicKey)); block != nil {
+		der = block.Bytes
+	} else {
+		var err error
+		if der, err = base64.StdEncoding.DecodeString(publicKey); err != nil {
+			return ErrInvalidPublicKey
+		}
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return ErrInvalidPublicKey
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	hash := sha256.Sum256(message)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, hash[:], sig) {
+			err = ErrInvalidSignature
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, message, sig) {
+			err = ErrInvalidSignature
+		}
+	default:
+		return ErrInvalidPublicKey
+	}
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// decodeFields decodes the JSON object body keyed by foldKey. The handlers
+// bind their fields case insensitively, the last of the keys that only differ
+// by case wins there, so such keys are refused with errDuplicateField.
+func decodeFields(body []byte) (map[string]any, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, errors.New("the body is not a JSON object")
+	}
+	fields := make(map[string]any)
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := foldKey(t.(string))
+		if _, ok := fields[key]; ok {
+			return nil, fmt.Errorf("%w: %s", errDuplicateField, t)
+		}
+		var v any
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		fields[key] = v
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// foldKey returns key with its letters case folded the way encoding/json
+// matches the keys of objects to the fields of structs.
+func foldKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		folded := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f < folded {
+				folded = f
+			}
+		}
+		return folded
+	}, key)
+}
+
+// signer returns the user who sent the request and the public key of the
+// device they sent it from. The user is the one signed in, or else the owner
+// of the card of the request.
+func (j *JWTAuth) signer(c *gin.Context, fields map[string]any) (*ebs_fields.User, string) {
+	mobile, sessionID := c.GetString("mobile"), c.GetUint("session_id")
+	if h := c.GetHeader("Authorization"); mobile == "" && h != "" {
+		if claims, err := j.VerifyJWT(h); err == nil && claims.Operator == "" && !j.Revoked(claims) {
+			mobile, sessionID = claims.Mobile, claims.SessionID
+		}
+	}
+	var user ebs_fields.User
+	var err error
+	if mobile != "" {
+		user, err = ebs_fields.GetUserByMobile(mobile, j.Db)
+	} else if pan, ok := fields[foldKey("PAN")].(string); ok && pan != "" {
+		user, err = ebs_fields.GetUserByCard(pan, j.Db)
+	} else {
+		return nil, ""
+	}
+	if err != nil || user.Mobile == "" {
+		return nil, ""
+	}
+	if sessionID != 0 {
+		var session Session
+		var device ebs_fields.Device
+		if j.Db.Where("mobile = ?", user.Mobile).First(&session, sessionID).Error == nil &&
+			j.Db.Where("user_mobile = ? AND device_id = ?", user.Mobile, session.DeviceID).First(&device).Error == nil &&
+			device.PublicKey != "" {
+			return &user, device.PublicKey
+		}
+	}
+	return &user, user.PublicKey
+}
+
+// useNonce records that mobile signed a request with nonce at timestamp, it
+// fails when the timestamp is out of signatureWindow or the nonce was used.
+func (j *JWTAuth) useNonce(mobile, timestamp, nonce string, now time.Time) error {
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || nonce == "" || len(nonce) > 128 {
+		return ErrInvalidSignature
+	}
+	signedAt := time.Unix(sec, 0)
+	if signedAt.Before(now.Add(-signatureWindow)) || signedAt.After(now.Add(signatureWindow)) {
+		return ErrStaleSignature
+	}
+	j.Db.Where("expires_at <= ?", now).Delete(&SignatureNonce{})
+	res := j.Db.Clauses(clause.OnConflict{DoNothing: true}).Create(&SignatureNonce{Mobile: mobile, Nonce: nonce, ExpiresAt: signedAt.Add(signatureWindow)})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrReplayedNonce
+	}
+	return nil
+}
+
+// SignedRequests verifies the signatures of requests (see SignatureHeader)
+// with the public key of the device of the user. A signature covers its
+// timestamp and nonce (see SignedMessage), so it can't be replayed. A
+// signature is required when the user enabled User.SignRequests and the amount
+// in the amountField of the body is more than their User.SignAbove; an empty
+// amountField requires it for any request. A signature that is sent is always
+// verified. Bodies with fields that only differ by case are refused, see
+// decodeFields.
+//
+// It must run before the handlers that rewrite the body, e.g., ResolveCardRef.
+func (j *JWTAuth) SignedRequests(amountField string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body []byte
+		if c.Request.Body != nil {
+			var err error
+			if body, err = io.ReadAll(c.Request.Body); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+				return
+			}
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		fields, err := decodeFields(body)
+		if errors.Is(err, errDuplicateField) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+			return
+		} else if err != nil {
+			// the handler reports the invalid body
+			c.Next()
+			return
+		}
+		user, publicKey := j.signer(c, fields)
+		signature := c.GetHeader(SignatureHeader)
+		if user == nil {
+			if signature != "" {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "the request is not of a registered user", "code": "invalid_signature"})
+				return
+			}
+			c.Next()
+			return
+		}
+
+		if signature == "" {
+			required := user.SignRequests
+			// a request without a valid amount has to be signed all the same
+			if n, ok := fields[foldKey(amountField)].(json.Number); ok && amountField != "" {
+				if amount, err := n.Float64(); err == nil {
+					required = required && amount > float64(user.SignAbove)
+				}
+			}
+			if required {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "sign the request with the key of your device", "code": "signature_required"})
+				return
+			}
+			c.Next()
+			return
+		}
+		if strings.TrimSpace(publicKey) == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "no public key is registered for the device", "code": "invalid_signature"})
+			return
+		}
+		timestamp, nonce := c.GetHeader(SignatureTimestampHeader), c.GetHeader(SignatureNonceHeader)
+		message, _ := SignedMessage(timestamp, nonce, body)
+		if err := VerifySignature(publicKey, signature, message); err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": err.Error(), "code": "invalid_signature"})
+			return
+		}
+		if err := j.useNonce(user.Mobile, timestamp, nonce, time.Now()); err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": err.Error(), "code": "invalid_signature"})
+			return
+		}
+		c.Set("signed", true)
+		c.Next()
+	}
+}
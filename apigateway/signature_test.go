@@ -0,0 +1,120 @@
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	got, err := CanonicalJSON([]byte(`{ "tranAmount": 10.50, "PAN": "<card>", "a": {"z": 1, "b": [2, 1]} }`))
+	if err != nil {
+		t.Fatalf("CanonicalJSON() error = %v", err)
+	}
+	if want := `{"PAN":"<card>","a":{"b":[2,1],"z":1},"tranAmount":10.50}`; string(got) != want {
+		t.Errorf("CanonicalJSON() = %s, want %s", got, want)
+	}
+}
+
+func TestJWTAuth_SignedRequests(t *testing.T) {
+	j := testSessionAuth(t)
+	j.Db.AutoMigrate(&ebs_fields.User{}, &ebs_fields.Card{}, &ebs_fields.Device{}, &SignatureNonce{})
+
+	devicePub, devicePriv, _ := ed25519.GenerateKey(rand.Reader)
+	userPriv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	encode := func(key any) string {
+		der, _ := x509.MarshalPKIXPublicKey(key)
+		return base64.StdEncoding.EncodeToString(der)
+	}
+	user := ebs_fields.User{Model: gorm.Model{ID: 1}, Mobile: "0912141679", PublicKey: encode(&userPriv.PublicKey), SignRequests: true, SignAbove: 1000}
+	if err := j.Db.Create(&user).Error; err != nil {
+		t.Fatalf("unable to create the user: %v", err)
+	}
+	j.Db.Create(&ebs_fields.Card{Pan: "9222081700176714465", Expiry: "2302", UserID: user.ID})
+	j.Db.Create(&ebs_fields.Device{UserMobile: user.Mobile, DeviceID: "phone", PublicKey: encode(devicePub), Trusted: true})
+	j.Db.Create(&ebs_fields.User{Model: gorm.Model{ID: 2}, Mobile: "0912141680"})
+	phone, _ := j.NewSession(user.Mobile, "phone", "test", "127.0.0.1")
+	tablet, _ := j.NewSession(user.Mobile, "tablet", "test", "127.0.0.1")
+	other, _ := j.NewSession("0912141680", "phone", "test", "127.0.0.1")
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-signatureWindow-time.Minute).Unix(), 10)
+	signDevice := func(timestamp, nonce, body string) string {
+		msg, _ := SignedMessage(timestamp, nonce, []byte(body))
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(devicePriv, msg))
+	}
+	signUser := func(timestamp, nonce, body string) string {
+		msg, _ := SignedMessage(timestamp, nonce, []byte(body))
+		hash := sha256.Sum256(msg)
+		sig, _ := ecdsa.SignASN1(rand.Reader, userPriv, hash[:])
+		return base64.StdEncoding.EncodeToString(sig)
+	}
+
+	r := gin.New()
+	r.POST("/", j.SignedRequests("tranAmount"), func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"signed": c.GetBool("signed")}) })
+	r.PUT("/", j.SignedRequests(""), func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"signed": c.GetBool("signed")}) })
+	big := `{"tranAmount": 5000, "toCard": "x"}`
+	small := `{"tranAmount": 50, "toCard": "x"}`
+	tests := []struct {
+		name      string
+		method    string
+		token     string
+		body      string
+		timestamp string
+		nonce     string
+		signature string
+		wantCode  int
+	}{
+		{"below the threshold", http.MethodPost, phone.AccessToken, small, "", "", "", http.StatusOK},
+		{"above the threshold", http.MethodPost, phone.AccessToken, big, "", "", "", http.StatusUnauthorized},
+		{"signed by the device", http.MethodPost, phone.AccessToken, big, now, "n1", signDevice(now, "n1", big), http.StatusOK},
+		{"replayed", http.MethodPost, phone.AccessToken, big, now, "n1", signDevice(now, "n1", big), http.StatusUnauthorized},
+		{"another nonce", http.MethodPost, phone.AccessToken, big, now, "n2", signDevice(now, "n1", big), http.StatusUnauthorized},
+		{"too old", http.MethodPost, phone.AccessToken, big, old, "n3", signDevice(old, "n3", big), http.StatusUnauthorized},
+		{"without a nonce", http.MethodPost, phone.AccessToken, big, now, "", signDevice(now, "", big), http.StatusUnauthorized},
+		{"signed for another body", http.MethodPost, phone.AccessToken, big, now, "n4", signDevice(now, "n4", small), http.StatusUnauthorized},
+		{"signed by another key", http.MethodPost, phone.AccessToken, big, now, "n5", signUser(now, "n5", big), http.StatusUnauthorized},
+		// the tablet has no key of its own, the key of the user is used
+		{"signed by the user key", http.MethodPost, tablet.AccessToken, big, now, "n6", signUser(now, "n6", big), http.StatusOK},
+		{"invalid signature below the threshold", http.MethodPost, phone.AccessToken, small, now, "n7", "bm90IGEgc2lnbmF0dXJl", http.StatusUnauthorized},
+		{"amount as a string", http.MethodPost, phone.AccessToken, `{"tranAmount": "5"}`, "", "", "", http.StatusUnauthorized},
+		{"any amount", http.MethodPut, phone.AccessToken, `{"sign_requests": false}`, "", "", "", http.StatusUnauthorized},
+		{"user without a policy", http.MethodPost, other.AccessToken, big, "", "", "", http.StatusOK},
+		{"not a user", http.MethodPost, "", big, "", "", "", http.StatusOK},
+		// the handlers bind the fields case insensitively
+		{"amount of another case", http.MethodPost, phone.AccessToken, `{"tranAmount": 1, "TranAmount": 5000}`, "", "", "", http.StatusBadRequest},
+		{"card of a user", http.MethodPost, "", `{"tranAmount": 5000, "pan": "9222081700176714465"}`, "", "", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", tt.token)
+			}
+			if tt.signature != "" {
+				req.Header.Set(SignatureHeader, tt.signature)
+				req.Header.Set(SignatureTimestampHeader, tt.timestamp)
+				req.Header.Set(SignatureNonceHeader, tt.nonce)
+			}
+			r.ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Errorf("SignedRequests() code = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+		})
+	}
+}
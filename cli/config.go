@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	firebase "firebase.google.com/go/v4"
 	gateway "github.com/adonese/noebs/apigateway"
@@ -15,7 +16,9 @@ import (
 	"github.com/adonese/noebs/dashboard"
 	"github.com/adonese/noebs/ebs_fields"
 	"github.com/adonese/noebs/merchant"
+	"github.com/adonese/noebs/redact"
 	"github.com/adonese/noebs/utils"
+	"github.com/adonese/noebs/webhook"
 	"github.com/bradfitz/iter"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
@@ -64,6 +67,8 @@ func GetMainEngine() *gin.Engine {
 	route := gin.Default()
 	instrument := gateway.Instrumentation()
 	route.Use(instrument)
+	route.Use(gateway.RequestID())
+	route.GET("/.well-known/jwks.json", auth.JWKS)
 	// route.Use(sentrygin.New(sentrygin.Options{}))
 	route.HandleMethodNotAllowed = true
 	route.POST("/ebs/*all", merchantServices.EBS)
@@ -86,50 +91,83 @@ func GetMainEngine() *gin.Engine {
 	        - base.html
 	*/
 	route.Static("/dashboard/assets", "./dashboard/template")
-	route.POST("/generate_api_key", consumerService.GenerateAPIKey)
-	route.POST("/workingKey", merchantServices.WorkingKey)
-	route.POST("/cardTransfer", merchantServices.CardTransfer)
-	route.POST("/voucher", merchantServices.GenerateVoucher)
-	route.POST("/voucher/cash_in", merchantServices.VoucherCashIn)
-	route.POST("/cashout", merchantServices.VoucherCashOut)
-	route.POST("/purchase", merchantServices.Purchase)
-	route.POST("/cashIn", merchantServices.CashIn)
-	route.POST("/cashOut", merchantServices.CashOut)
-	route.POST("/billInquiry", merchantServices.BillInquiry)
-	route.POST("/billPayment", merchantServices.BillPayment)
-	route.POST("/bills", merchantServices.TopUpPayment)
-	route.POST("/changePin", merchantServices.ChangePIN)
-	route.POST("/miniStatement", merchantServices.MiniStatement)
-	route.POST("/isAlive", merchantServices.IsAlive)
-	route.POST("/balance", merchantServices.Balance)
-	route.POST("/refund", merchantServices.Refund)
-	route.POST("/toAccount", merchantServices.ToAccount)
-	route.POST("/statement", merchantServices.Statement)
+	route.POST("/generate_api_key", auth.RequireRole(gateway.RoleAdmin), dashService.CreateAPIClient)
+	merchantAPI := route.Group("", apiKeys.RequireAPIKey(gateway.ScopeMerchant))
+	merchantAPI.POST("/workingKey", merchantServices.WorkingKey)
+	merchantAPI.POST("/cardTransfer", merchantServices.CardTransfer)
+	merchantAPI.POST("/voucher", merchantServices.GenerateVoucher)
+	merchantAPI.POST("/voucher/cash_in", merchantServices.VoucherCashIn)
+	merchantAPI.POST("/cashout", merchantServices.VoucherCashOut)
+	merchantAPI.POST("/purchase", merchantServices.Purchase)
+	merchantAPI.POST("/cashIn", merchantServices.CashIn)
+	merchantAPI.POST("/cashOut", merchantServices.CashOut)
+	merchantAPI.POST("/billInquiry", merchantServices.BillInquiry)
+	merchantAPI.POST("/billPayment", merchantServices.BillPayment)
+	merchantAPI.POST("/bills", merchantServices.TopUpPayment)
+	merchantAPI.POST("/changePin", merchantServices.ChangePIN)
+	merchantAPI.POST("/miniStatement", merchantServices.MiniStatement)
+	merchantAPI.POST("/isAlive", merchantServices.IsAlive)
+	merchantAPI.POST("/balance", merchantServices.Balance)
+	merchantAPI.POST("/refund", merchantServices.Refund)
+	merchantAPI.POST("/toAccount", merchantServices.ToAccount)
+	merchantAPI.POST("/statement", merchantServices.Statement)
+	// the webhooks of the terminals of the merchant api key, e.g., for their reversals
+	merchantAPI.GET("/webhooks", webhookService.ListEndpoints)
+	merchantAPI.POST("/webhooks", webhookService.CreateEndpoint)
+	merchantAPI.DELETE("/webhooks/:id", webhookService.DeleteEndpoint)
+	merchantAPI.GET("/webhooks/:id/deliveries", webhookService.ListDeliveries)
+	merchantAPI.POST("/webhooks/deliveries/:id/redeliver", webhookService.Redeliver)
 	route.GET("/test", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"message": true})
 	})
 
 	route.GET("/wrk", merchantServices.IsAliveWrk)
 	route.GET("/metrics", gin.WrapH(promhttp.Handler()))
-	dashboardGroup := route.Group("/dashboard")
+	// operators sign in without an api key, the first one is issued at /generate_api_key
+	route.POST("/dashboard/login", auth.OperatorLogin)
+	dashboardGroup := route.Group("/dashboard", apiKeys.RequireAPIKey(gateway.ScopeDashboard))
 	{
-		dashboardGroup.GET("/", dashService.BrowserDashboard)
-		dashboardGroup.GET("/get_tid", dashService.TransactionByTid)
-		dashboardGroup.GET("/get", dashService.TransactionByTid)
-		dashboardGroup.GET("/create", dashService.MakeDummyTransaction)
-		dashboardGroup.GET("/all", dashService.GetAll)
-		dashboardGroup.GET("/all/:id", dashService.GetID)
-		dashboardGroup.GET("/count", dashService.TransactionsCount)
-		dashboardGroup.GET("/settlement", dashService.DailySettlement)
-		dashboardGroup.GET("/merchant", dashService.MerchantTransactionsEndpoint)
-		dashboardGroup.GET("/merchant/:id", dashService.MerchantViews)
-		dashboardGroup.POST("/issues", dashService.ReportIssueEndpoint)
-		dashboardGroup.GET("/status", dashService.QRStatus)
-		dashboardGroup.GET("/test_browser", dashService.IndexPage)
-		dashboardGroup.GET("/stream", dashService.Stream)
+
+		// merchant viewers only see their own terminal, see dashboard.scope
+		merchantGroup := dashboardGroup.Group("", auth.RequireRole(gateway.RoleAdmin, gateway.RoleSupport, gateway.RoleMerchantViewer))
+		merchantGroup.GET("/get_tid", dashService.TransactionByTid)
+		merchantGroup.GET("/get", dashService.TransactionByTid)
+		merchantGroup.GET("/all", dashService.GetAll)
+		merchantGroup.GET("/all/:id", dashService.GetID)
+		merchantGroup.GET("/count", dashService.TransactionsCount)
+		merchantGroup.GET("/merchant", dashService.MerchantTransactionsEndpoint)
+		merchantGroup.POST("/issues", dashService.ReportIssueEndpoint)
+
+		staffGroup := dashboardGroup.Group("", auth.RequireRole(gateway.RoleAdmin, gateway.RoleSupport))
+		staffGroup.GET("/", dashService.BrowserDashboard)
+		staffGroup.GET("/merchant/:id", dashService.MerchantViews)
+		staffGroup.GET("/status", dashService.QRStatus)
+		staffGroup.GET("/ebs_exchanges", dashService.EBSExchanges)
+		staffGroup.GET("/kyc", dashService.KYCs)
+		staffGroup.GET("/kyc/:mobile", dashService.KYC)
+		staffGroup.GET("/kyc/:mobile/:image", dashService.KYCImage)
+		staffGroup.POST("/kyc/:mobile/review", dashService.ReviewKYC)
+
+		adminGroup := dashboardGroup.Group("", auth.RequireRole(gateway.RoleAdmin))
+		adminGroup.GET("/create", dashService.MakeDummyTransaction)
+		adminGroup.GET("/settlement", dashService.DailySettlement)
+		adminGroup.GET("/test_browser", dashService.IndexPage)
+		adminGroup.GET("/stream", dashService.Stream)
+		adminGroup.GET("/operators", dashService.Operators)
+		adminGroup.POST("/operators", dashService.CreateOperator)
+		adminGroup.DELETE("/operators/:id", dashService.DisableOperator)
+		adminGroup.GET("/audit", dashService.AuditLogs)
+		adminGroup.GET("/api_clients", dashService.APIClients)
+		adminGroup.POST("/api_clients", dashService.CreateAPIClient)
+		adminGroup.PATCH("/api_clients/:id", dashService.UpdateAPIClient)
+		adminGroup.POST("/api_clients/:id/rotate", dashService.RotateAPIClient)
+		adminGroup.DELETE("/api_clients/:id", dashService.RevokeAPIClient)
+		adminGroup.GET("/limits", dashService.Limits)
+		adminGroup.POST("/limits", dashService.CreateLimit)
+		adminGroup.DELETE("/limits/:id", dashService.DeleteLimit)
 	}
 
-	cons := route.Group("/consumer")
+	cons := route.Group("/consumer", apiKeys.RequireAPIKey(gateway.ScopeConsumer))
 
 	{
 		cons.POST("/register", consumerService.CreateUser)
@@ -138,24 +176,24 @@ func GetMainEngine() *gin.Engine {
 		cons.POST("/balance", consumerService.Balance)
 		cons.POST("/status", consumerService.TransactionStatus)
 		cons.POST("/is_alive", consumerService.IsAlive)
-		cons.POST("/bill_payment", consumerService.BillPayment)
+		cons.POST("/bill_payment", consumerService.ResolveCardRef("PAN"), consumerService.Idempotency, consumerService.BillPayment)
 		cons.POST("/bills", consumerService.GetBills)
 		cons.GET("/guess_biller", consumerService.GetBiller)
 		cons.POST("/bill_inquiry", consumerService.BillInquiry)
-		cons.POST("/p2p", consumerService.CardTransfer)
+		cons.POST("/p2p", auth.SignedRequests("tranAmount"), consumerService.ResolveCardRef("PAN"), consumerService.Idempotency, consumerService.CardTransfer)
 		cons.POST("/cashIn", consumerService.CashIn)
 		cons.POST("/cashOut", consumerService.CashOut)
 		cons.POST("/account", consumerService.AccountTransfer)
-		cons.POST("/purchase", consumerService.Purchase)
+		cons.POST("/purchase", consumerService.ResolveCardRef("PAN"), consumerService.Idempotency, consumerService.Purchase)
 		cons.POST("/n/status", consumerService.Status)
 		cons.POST("/key", consumerService.WorkingKey)
-		cons.POST("/ipin", consumerService.IPinChange)
+		cons.POST("/ipin", rateLimiter.Limit("ipin", 5, time.Hour), consumerService.IPinChange)
 		cons.POST("/generate_qr", consumerService.QRMerchantRegistration)
-		cons.POST("/qr_payment", consumerService.QRPayment)
+		cons.POST("/qr_payment", auth.SignedRequests("tranAmount"), consumerService.QRPayment)
 		cons.POST("/qr_status", consumerService.QRTransactions)
 		cons.POST("/ipin_key", consumerService.IPINKey)
-		cons.POST("/generate_ipin", consumerService.GenerateIpin)
-		cons.POST("/complete_ipin", consumerService.CompleteIpin)
+		cons.POST("/generate_ipin", rateLimiter.Limit("ipin", 5, time.Hour), consumerService.GenerateIpin)
+		cons.POST("/complete_ipin", rateLimiter.Limit("ipin", 5, time.Hour), consumerService.CompleteIpin)
 		cons.POST("/qr_refund", consumerService.QRRefund)
 		cons.POST("/qr_complete", consumerService.QRComplete)
 		cons.POST("/card_info", consumerService.EbsGetCardInfo)
@@ -165,17 +203,17 @@ func GetMainEngine() *gin.Engine {
 		cons.POST("/vouchers/generate", consumerService.GenerateVoucher)
 		cons.POST("/cards/new", consumerService.RegisterCard)
 		cons.POST("/cards/complete", consumerService.CompleteRegistration)
-		cons.POST("/login", consumerService.LoginHandler)
-		cons.POST("/kyc", consumerService.KYC)
+		cons.POST("/login", rateLimiter.Limit("login", 10, 15*time.Minute), consumerService.LoginHandler)
 		cons.GET("/transaction", gin.HandlerFunc(func(ctx *gin.Context) {
 			var res ebs_fields.EBSResponse
 			id := ctx.Query("uuid")
 			if response, err := res.GetByUUID(id, database); err != nil {
-				response, err = res.GetEBSUUID(id, database, &noebsConfig)
+				response, err = res.GetEBSUUID(ctx.Request.Context(), ebsClient, id, database, &noebsConfig)
 				if err != nil {
 					ctx.JSON(http.StatusBadRequest, gin.H{"code": "not_found", "message": err.Error()})
 					return
 				}
+				ctx.JSON(http.StatusOK, response)
 			} else {
 				ctx.JSON(http.StatusOK, response)
 			}
@@ -186,20 +224,29 @@ func GetMainEngine() *gin.Engine {
 				ctx.JSON(http.StatusBadRequest, gin.H{"code": "not_found", "message": err.Error()})
 				return
 			} else {
-				ctx.JSON(http.StatusOK, response)
+				ctx.JSON(http.StatusOK, gin.H{"mobile": response.Mobile, "Cards": response.Cards})
 			}
 		}))
-		cons.POST("/otp/generate",
+		// both share the otp_generate limit, so that the insecure one can't be used to get around it
+		cons.POST("/otp/generate", rateLimiter.Limit("otp_generate", 3, 15*time.Minute),
 			gin.HandlerFunc(func(c *gin.Context) {
 				consumerService.GenerateSignInCode(c, false)
 			}))
-		cons.POST("/otp/generate_insecure",
+		cons.POST("/otp/generate_insecure", rateLimiter.Limit("otp_generate", 3, 15*time.Minute),
 			gin.HandlerFunc(func(c *gin.Context) {
 				consumerService.GenerateSignInCode(c, true)
 			}))
-		cons.POST("/otp/login", consumerService.SingleLoginHandler)
-		cons.POST("/otp/verify", consumerService.VerifyOTP)
-		cons.POST("/otp/balance", consumerService.BalanceStep)
+		cons.POST("/otp/login", rateLimiter.Limit("otp_login", 5, 15*time.Minute), consumerService.SingleLoginHandler)
+		cons.POST("/otp/verify", rateLimiter.Limit("otp_verify", 5, 15*time.Minute), consumerService.VerifyOTP)
+		cons.POST("/otp/balance", rateLimiter.Limit("otp_balance", 3, 15*time.Minute), consumerService.BalanceStep)
+		// shares the otp_verify limit, both take an otp
+		cons.POST("/devices/verify", rateLimiter.Limit("otp_verify", 5, 15*time.Minute), consumerService.VerifyDevice)
+		cons.POST("/mfa/login", rateLimiter.Limit("mfa", 5, 15*time.Minute), consumerService.VerifyMFALogin)
+		// the reset steps share the limits of the sign in steps they are like
+		cons.POST("/password/reset/request", rateLimiter.Limit("otp_generate", 3, 15*time.Minute), consumerService.RequestPasswordReset)
+		cons.POST("/password/reset/otp", rateLimiter.Limit("otp_verify", 5, 15*time.Minute), consumerService.PasswordResetOTP)
+		cons.POST("/password/reset/card", rateLimiter.Limit("otp_balance", 3, 15*time.Minute), consumerService.PasswordResetCard)
+		cons.POST("/password/reset", rateLimiter.Limit("password_reset", 5, 15*time.Minute), consumerService.ResetPassword)
 		cons.POST("/verify_firebase", consumerService.VerifyFirebase)
 		cons.POST("/test", func(c *gin.Context) {
 			c.JSON(http.StatusOK, gin.H{"message": true})
@@ -211,21 +258,50 @@ func GetMainEngine() *gin.Engine {
 		cons.PUT("/user", consumerService.UpdateUser)
 		cons.GET("/user/lang", consumerService.GetUserLanguage)
 		cons.PUT("/user/lang", consumerService.SetUserLanguage)
+		cons.GET("/user/notifications", consumerService.GetNotificationChannel)
+		cons.PUT("/user/notifications", consumerService.SetNotificationChannel)
+		cons.GET("/user/signing", consumerService.GetSigningPolicy)
+		cons.PUT("/user/signing", auth.SignedRequests(""), consumerService.SetSigningPolicy)
+		cons.GET("/mfa", consumerService.MFA)
+		cons.POST("/mfa/enroll", consumerService.EnrollMFA)
+		cons.POST("/mfa/confirm", rateLimiter.Limit("mfa", 5, 15*time.Minute), consumerService.ConfirmMFA)
+		cons.POST("/mfa/disable", rateLimiter.Limit("mfa", 5, 15*time.Minute), consumerService.DisableMFA)
+		cons.POST("/mfa/backup_codes", rateLimiter.Limit("mfa", 5, 15*time.Minute), consumerService.NewBackupCodes)
 		cons.GET("/notifications", consumerService.Notifications)
+		cons.GET("/notifications/ws", consumerService.NotificationsWS)
 		cons.GET("/transactions", consumerService.GetTransactions)
-		cons.POST("/p2p_mobile", consumerService.MobileTransfer)
+		cons.POST("/p2p_mobile", auth.SignedRequests("tranAmount"), consumerService.ResolveCardRef("PAN"), consumerService.Idempotency, consumerService.MobileTransfer)
 		cons.POST("/cards/set_main", consumerService.SetMainCard)
 		cons.POST("/user/firebase", consumerService.AddFirebaseID)
 		cons.Any("/beneficiary", consumerService.Beneficiaries)
 		cons.POST("/change_password", consumerService.ChangePassword)
+		cons.POST("/kyc", consumerService.KYC)
+		cons.GET("/kyc", consumerService.KYCStatus)
+		cons.GET("/sessions", consumerService.ListSessions)
+		cons.DELETE("/sessions", consumerService.RevokeSessions)
+		cons.DELETE("/sessions/:id", consumerService.RevokeSession)
+		cons.GET("/devices", consumerService.Devices)
+		cons.DELETE("/devices/:id", consumerService.RemoveDevice)
+		cons.POST("/logout", consumerService.Logout)
 		cons.GET("/get_cards", consumerService.GetCards)
 		cons.POST("/add_card", consumerService.AddCards)
 		cons.PUT("/edit_card", consumerService.EditCard)
 		cons.DELETE("/delete_card", consumerService.RemoveCard)
 		cons.GET("/payment_token", consumerService.GetPaymentToken)
 		cons.POST("/payment_token", consumerService.GeneratePaymentToken)
+		cons.DELETE("/payment_token", consumerService.CancelPaymentToken)
 		cons.POST("/payment_request", consumerService.PaymentRequest)
-		cons.POST("/payment_token/quick_pay", consumerService.NoebsQuickPayment)
+		cons.POST("/payment_token/quick_pay", consumerService.ResolveCardRef("PAN"), consumerService.Idempotency, consumerService.NoebsQuickPayment)
+		cons.GET("/scheduled", consumerService.ListScheduledPayments)
+		cons.POST("/scheduled", consumerService.CreateScheduledPayment)
+		cons.GET("/scheduled/:id", consumerService.GetScheduledPayment)
+		cons.PUT("/scheduled/:id", consumerService.UpdateScheduledPayment)
+		cons.DELETE("/scheduled/:id", consumerService.DeleteScheduledPayment)
+		cons.GET("/webhooks", webhookService.ListEndpoints)
+		cons.POST("/webhooks", webhookService.CreateEndpoint)
+		cons.DELETE("/webhooks/:id", webhookService.DeleteEndpoint)
+		cons.GET("/webhooks/:id/deliveries", webhookService.ListDeliveries)
+		cons.POST("/webhooks/deliveries/:id/redeliver", webhookService.Redeliver)
 		cons.POST("/submit_contacts", func() gin.HandlerFunc {
 			return func(c *gin.Context) {
 				chat.SubmitContacts(c.GetString("mobile"), consumerService.NoebsConfig.DatabasePath, c.Writer, c.Request)
@@ -241,16 +317,21 @@ func init() {
 	logrusLogger.Level = logrus.DebugLevel
 	logrusLogger.SetReportCaller(true)
 	logrusLogger.Out = os.Stderr
-
-	// print stringified version of []byte
-	logrus.Printf("the data is: %x", secretsFile)
+	// nothing should log card data or secrets, whatever logger it goes through
+	redact.Install(logrus.StandardLogger())
+	log.SetOutput(redact.Writer(os.Stderr))
 
 	// load the secrets file
 	if err := json.Unmarshal(secretsFile, &noebsConfig); err != nil {
-		logrusLogger.Printf("error in unmarshaling secrets file: %v - the file: %v", err, string(secretsFile))
+		logrusLogger.Printf("error in unmarshaling secrets file: %v", err)
 	}
 
 	noebsConfig.Defaults()
+	cardKeyring, err := ebs_fields.NewCardKeyring(&noebsConfig)
+	if err != nil {
+		logrusLogger.Fatalf("error in creating card keyring: %v", err)
+	}
+	ebs_fields.SetCardKeyring(cardKeyring)
 	dbpath := "test.db"
 	if noebsConfig.DatabasePath != "" {
 		dbpath = noebsConfig.DatabasePath
@@ -263,7 +344,7 @@ func init() {
 		logrusLogger.Fatalf("error in connecting to db: %v", err)
 	}
 
-	logrusLogger.Printf("The final config file is: %#v", noebsConfig)
+	logrusLogger.Printf("The final config file is: %#v", redact.Value(noebsConfig))
 
 	// Initialize sentry
 	// sentry.Init(sentry.ClientOptions{
@@ -276,7 +357,7 @@ func init() {
 	// FIXME we should pass on the same database here
 	chatDb, err := chat.OpenDb(dbpath)
 	if err != nil {
-		logrusLogger.Printf("The final config file is: %#v", err)
+		logrusLogger.Printf("error in opening chat db: %v", err)
 	}
 
 	hub = *chat.NewHub(chatDb)
@@ -288,22 +369,81 @@ func init() {
 	// check database foreign key for user & credit_cards exists or not
 	database.Migrator().DropConstraint(&consumer.PushData{}, "Transactions")
 	database.Migrator().DropConstraint(&consumer.PushData{}, "fk_push_data_ebs_data")
+	// idempotency keys used to be unique across all the callers
+	database.Migrator().DropIndex(&consumer.IdempotencyKey{}, "idx_idempotency_scope")
 	if err := database.Debug().AutoMigrate(&consumer.PushData{}, &ebs_fields.User{},
 		&ebs_fields.Card{}, &ebs_fields.EBSResponse{}, &ebs_fields.Token{},
-		&ebs_fields.CacheBillers{}, &ebs_fields.CacheCards{}, &ebs_fields.Beneficiary{}, &ebs_fields.KYC{}, &ebs_fields.Passport{}); err != nil {
+		&ebs_fields.CacheBillers{}, &ebs_fields.CacheCards{}, &ebs_fields.Beneficiary{}, &ebs_fields.KYC{}, &ebs_fields.Passport{}, &consumer.IdempotencyKey{}, &merchant.PendingReversal{}, &utils.SMSDelivery{}, &consumer.NotificationRetry{}, &consumer.ScheduledPayment{}, &webhook.Endpoint{}, &webhook.Delivery{}, &ebs_fields.EBSExchange{}, &gateway.Session{}, &gateway.RevokedToken{}, &gateway.SignatureNonce{}, &gateway.Operator{}, &gateway.AuditLog{}, &gateway.APIClient{}, &ebs_fields.Limit{}, &ebs_fields.LimitReservation{}, &ebs_fields.Device{}, &ebs_fields.BackupCode{}, &ebs_fields.MFAChallenge{}, &ebs_fields.ResetTicket{}); err != nil {
 		logrusLogger.Fatalf("error in migration: %v", err)
 	}
 	// check database foreign key for user & credit_cards exists or not
 	database.Migrator().HasConstraint(&consumer.PushData{}, "Transactions")
 	database.Migrator().HasConstraint(&consumer.PushData{}, "fk_push_data_ebs_data")
+	if n, err := ebs_fields.AssignCardRefs(database); err != nil {
+		logrusLogger.Fatalf("error in assigning card references: %v", err)
+	} else if n > 0 {
+		logrusLogger.Printf("assigned references to %d cards", n)
+	}
+
+	if n, err := ebs_fields.HashTransactionPANs(database); err != nil {
+		logrusLogger.Fatalf("error in fingerprinting the cards of transactions: %v", err)
+	} else if n > 0 {
+		logrusLogger.Printf("fingerprinted the cards of %d transactions", n)
+	}
+
+	if ok, err := gateway.EnsureAdmin(database, noebsConfig.AdminUsername, noebsConfig.AdminPassword); err != nil {
+		logrusLogger.Fatalf("error in creating the dashboard admin: %v", err)
+	} else if ok {
+		logrusLogger.Printf("created the dashboard admin %s", noebsConfig.AdminUsername)
+	}
 
-	auth = gateway.JWTAuth{NoebsConfig: noebsConfig}
+	httpEBSClient, err := ebs_fields.NewEBSClientFromConfig(&noebsConfig)
+	if err != nil {
+		logrusLogger.Fatalf("error in creating ebs client: %v", err)
+	}
+	httpEBSClient.Db = database
+	ebsClient = httpEBSClient
+
+	smsSender, err := utils.NewSMSSender(&noebsConfig, database)
+	if err != nil {
+		logrusLogger.Fatalf("error in creating sms sender: %v", err)
+	}
+
+	tokenCodec, err := ebs_fields.NewTokenCodec(&noebsConfig)
+	if err != nil {
+		logrusLogger.Fatalf("error in creating payment token codec: %v", err)
+	}
 
-	auth.Init()
+	webhookService = webhook.NewService(database, logrusLogger)
+	if noebsConfig.BillerWebhookURL != "" {
+		if err := webhookService.EnsureEndpoint(webhook.AllOwners, noebsConfig.BillerWebhookURL, noebsConfig.BillerWebhookSecret); err != nil {
+			logrusLogger.Printf("error in registering the biller webhook: %v", err)
+		}
+	}
+
+	notifiers := map[string]consumer.Notifier{
+		consumer.ChannelPush: &consumer.FCMNotifier{App: firebaseApp},
+		consumer.ChannelSMS:  &consumer.SMSNotifier{Sender: smsSender},
+		consumer.ChannelNone: consumer.NoopNotifier{},
+	}
+	notificationHub := consumer.NewNotificationHub()
+	wsNotifier := &consumer.WSNotifier{Hub: notificationHub}
+	if chatDb != nil {
+		wsNotifier.DB = chatDb.DB
+	}
+	notifiers[consumer.ChannelWS] = wsNotifier
+
+	auth = gateway.JWTAuth{NoebsConfig: noebsConfig, Db: database}
+
+	if err := auth.Init(); err != nil {
+		logrusLogger.Fatalf("error in loading jwt keys: %v", err)
+	}
+	apiKeys = &gateway.APIKeyAuth{Db: database, Enforced: noebsConfig.APIKeyScopes, Limiter: rateLimiter}
+	kycStore := ebs_fields.DirStore{Dir: noebsConfig.KYCStoragePath}
 	binding.Validator = new(ebs_fields.DefaultValidator)
-	consumerService = consumer.Service{Db: database, Redis: redisClient, NoebsConfig: noebsConfig, Logger: logrusLogger, FirebaseApp: firebaseApp, Auth: &auth}
-	dashService = dashboard.Service{Redis: redisClient, Db: database}
-	merchantServices = merchant.Service{Db: database, Redis: redisClient, Logger: logrusLogger, NoebsConfig: noebsConfig}
+	consumerService = consumer.Service{Db: database, Redis: redisClient, NoebsConfig: noebsConfig, Logger: logrusLogger, FirebaseApp: firebaseApp, Auth: &auth, EBSClient: ebsClient, SMS: smsSender, Notifiers: notifiers, NotificationHub: notificationHub, Tokens: tokenCodec, Webhooks: webhookService, KYCStore: kycStore, Limiter: rateLimiter}
+	dashService = dashboard.Service{Redis: redisClient, Db: database, KYCStore: kycStore}
+	merchantServices = merchant.Service{Db: database, Redis: redisClient, Logger: logrusLogger, NoebsConfig: noebsConfig, EBSClient: ebsClient, Webhooks: webhookService}
 	dataConfigs.DB = database
 
 }
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"os"
+
 	gateway "github.com/adonese/noebs/apigateway"
 	"github.com/adonese/noebs/consumer"
 	"github.com/adonese/noebs/dashboard"
 	"github.com/adonese/noebs/ebs_fields"
 	"github.com/adonese/noebs/merchant"
+	"github.com/adonese/noebs/redact"
 	"github.com/adonese/noebs/utils"
+	"github.com/adonese/noebs/webhook"
 	"github.com/sirupsen/logrus"
 	chat "github.com/tutipay/ws"
 	_ "gorm.io/driver/sqlite"
@@ -14,22 +18,39 @@ import (
 )
 
 var noebsConfig ebs_fields.NoebsConfig
-var logrusLogger = logrus.New()
+var logrusLogger = redact.Install(logrus.New())
 var redisClient = utils.GetRedisClient("")
 var database *gorm.DB
 var consumerService consumer.Service
 var dataConfigs ebs_fields.Configs
 var service consumer.Service
 var auth gateway.JWTAuth
+var apiKeys *gateway.APIKeyAuth
+var rateLimiter = &gateway.RateLimiter{Redis: redisClient}
 var dashService dashboard.Service
 var merchantServices = merchant.Service{}
 var hub chat.Hub
+var webhookService *webhook.Service
+var ebsClient ebs_fields.EBSClient
 
 func main() {
+	// encrypt-cards encrypts the stored card data with the active card key and exits
+	if len(os.Args) > 1 && os.Args[1] == "encrypt-cards" {
+		n, err := ebs_fields.EncryptCards(database)
+		if err != nil {
+			logrusLogger.Fatalf("error in encrypting cards: %v", err)
+		}
+		logrusLogger.Printf("encrypted the card data of %d rows", n)
+		return
+	}
 
 	go hub.Run()
 	go consumerService.BillerHooks()
 	go consumerService.Pusher()
+	go consumerService.Reconcile()
+	go consumerService.RunScheduledPayments()
+	go merchantServices.Reconcile()
+	go webhookService.Run()
 	if noebsConfig.Port == "" {
 		noebsConfig.Port = ":8080"
 	}
@@ -5,18 +5,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
+	"time"
 
-	"firebase.google.com/go/v4/messaging"
 	noebsCrypto "github.com/adonese/crypto"
 	gateway "github.com/adonese/noebs/apigateway"
 	"github.com/adonese/noebs/ebs_fields"
+	"github.com/adonese/noebs/redact"
 	"github.com/adonese/noebs/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
-	"github.com/go-redis/redis/v7"
 	"github.com/golang-jwt/jwt"
 	"github.com/pquerna/otp/totp"
 	"golang.org/x/crypto/bcrypt"
@@ -25,56 +24,27 @@ import (
 
 type Auther interface {
 	VerifyJWT(token string) (*gateway.TokenClaims, error)
-	GenerateJWT(token string) (string, error)
+	NewSession(mobile, deviceID, userAgent, ip string) (gateway.TokenPair, error)
+	Refresh(refreshToken string) (gateway.TokenPair, error)
+	LegacyRefresh(claims *gateway.TokenClaims, deviceID, userAgent, ip string) (gateway.TokenPair, error)
+	Sessions(mobile string) ([]gateway.Session, error)
+	RevokeSession(mobile string, id uint) error
+	RevokeSessions(mobile string) error
+	RevokeToken(jti string, expiresAt time.Time) error
+	RevokeLegacyTokens(mobile string) error
+	Revoked(claims *gateway.TokenClaims) bool
+	AuditUser(c *gin.Context, mobile, event string)
 }
 
-// GenerateAPIKey An Admin-only endpoint that is used to generate api key for our clients
-// the user must submit their email to generate a unique token per email.
-// FIXME #59 #58 #61 api generation should be decoupled from apigateway package
-func (s *Service) GenerateAPIKey(c *gin.Context) {
-	var m map[string]string
-	if err := c.ShouldBindJSON(&m); err != nil {
-		if _, ok := m["email"]; ok {
-			k, _ := gateway.GenerateAPIKey()
-			s.Redis.SAdd("apikeys", k)
-			c.JSON(http.StatusOK, gin.H{"result": k})
-			return
-		} else {
-			c.JSON(http.StatusBadRequest, gin.H{"message": "missing_field"})
-			return
-		}
-	} else {
-		c.JSON(http.StatusBadRequest, gin.H{"message": "error in email"})
-
-	}
-}
-
-// ApiKeyMiddleware used to authenticate clients using X-Email and X-API-Key headers
-// FIXME issue #58 #61
-func (s *Service) ApiKeyMiddleware(c *gin.Context) {
-	email := c.GetHeader("X-Email")
-	key := c.GetHeader("X-API-Key")
-	if email == "" || key == "" {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "unauthorized"})
-		return
-	}
-	res, err := s.Redis.HGet("api_keys", email).Result()
-	if err != redis.Nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "unauthorized"})
-		return
-	}
-	if key == res {
-		c.Next()
-	} else {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "unauthorized"})
-		return
-	}
-}
-
-// FIXME issue #58 #61
+// IpFilterMiddleware counts the IPs a user or an API client calls from, it goes after
+// AuthMiddleware or gateway.RequireAPIKey. The latter enforces the IP allowlists of API clients.
 func (s *Service) IpFilterMiddleware(c *gin.Context) {
 	ip := c.ClientIP()
-	if u := c.GetString("mobile"); u != "" {
+	u := c.GetString("mobile")
+	if u == "" {
+		u = c.GetString("api_client")
+	}
+	if u != "" {
 		s.Redis.HIncrBy(u+":ips_count", ip, 1)
 		c.Next()
 	} else {
@@ -91,7 +61,7 @@ func (s *Service) LoginHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
 		return
 	}
-	s.Logger.Printf("the processed request is: %+v\n", req)
+	s.Logger.Printf("the processed request is: %+v\n", redact.Value(req))
 	u := ebs_fields.User{}
 	if notFound := s.Db.Where("email = ? or mobile = ?", strings.ToLower(req.Mobile), strings.ToLower(req.Mobile)).First(&u).Error; errors.Is(notFound, gorm.ErrRecordNotFound) {
 		// service id is not found
@@ -105,18 +75,30 @@ func (s *Service) LoginHandler(c *gin.Context) {
 		// c.JSON(http.StatusUnauthorized, gin.H{"code": "unauthorized_access", "message": "verify phone number with OTP"})
 		// return
 	}
+	if s.accountLocked(c, &u) {
+		return
+	}
 	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(req.Password)); err != nil {
+		if s.signInFailed(&u) {
+			s.accountLocked(c, &u)
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"message": "wrong password entered", "code": "wrong_password"})
 		return
 	}
+	// the failed sign ins are counted until the second factor is verified too
+	if u.MFAEnabled {
+		s.mfaChallenge(c, &u, req.DeviceID, req.PublicKey)
+		return
+	}
+	s.signInSucceeded(u.Mobile, false)
 
-	token, err := s.Auth.GenerateJWT(u.Mobile)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, err)
+	res, ok := s.deviceSession(c, &u, req.DeviceID, req.PublicKey)
+	if !ok {
 		return
 	}
-	c.Writer.Header().Set("Authorization", token)
-	c.JSON(http.StatusOK, gin.H{"authorization": token, "user": u})
+	res["user"] = u
+	c.JSON(http.StatusOK, res)
 }
 
 // SingleLoginHandler is used for one-time authentications. It checks a signed entered otp keys against
@@ -128,7 +110,7 @@ func (s *Service) SingleLoginHandler(c *gin.Context) {
 
 	var req gateway.Token
 	c.ShouldBindWith(&req, binding.JSON)
-	s.Logger.Printf("the processed request is: %v\n", req)
+	s.Logger.Printf("the processed request is: %+v\n", redact.Value(req))
 
 	u := ebs_fields.User{}
 	if notFound := s.Db.Where("username = ? or email = ? or mobile = ?", strings.ToLower(req.Mobile), strings.ToLower(req.Mobile), strings.ToLower(req.Mobile)).First(&u).Error; errors.Is(notFound, gorm.ErrRecordNotFound) {
@@ -136,6 +118,9 @@ func (s *Service) SingleLoginHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"message": notFound.Error(), "code": "not_found"})
 		return
 	}
+	if s.accountLocked(c, &u) {
+		return
+	}
 
 	if _, encErr := noebsCrypto.VerifyWithHeaders(u.PublicKey, req.Signature, req.Message); encErr != nil {
 		s.Logger.Printf("invalid signature in refresh: %v", encErr)
@@ -145,22 +130,33 @@ func (s *Service) SingleLoginHandler(c *gin.Context) {
 
 	// Validate the otp using user's stored public key
 	if totp.Validate(req.Message, u.EncodePublickey32()) == false {
+		if s.signInFailed(&u) {
+			s.accountLocked(c, &u)
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"message": "wrong otp entered", "code": "wrong_otp"})
 		return
 	}
-	token, err := s.Auth.GenerateJWT(u.Mobile)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, err)
+	if u.MFAEnabled {
+		s.mfaChallenge(c, &u, req.DeviceID, "")
 		return
 	}
-	c.Writer.Header().Set("Authorization", token)
-	c.JSON(http.StatusOK, gin.H{"authorization": token, "user": u})
+	s.signInSucceeded(u.Mobile, false)
+	res, ok := s.deviceSession(c, &u, req.DeviceID, "")
+	if !ok {
+		return
+	}
+	res["user"] = u
+	c.JSON(http.StatusOK, res)
 }
 
-// RefreshHandler generates a new access token to the user using
-// their signed public key.
-// the user will sign their username with their private key, and noebs will verify
-// the signature using the stored public key for the user
+// RefreshHandler refreshes a session with its refresh token, the refresh
+// token is rotated and must be replaced by the one in the response.
+//
+// Clients without a refresh token sign Message with the private key of the
+// user instead, noebs verifies the signature with the stored public key of the
+// user in the (possibly expired) JWT and starts a new session for it (see
+// gateway.JWTAuth.LegacyRefresh) until legacy_refresh_until.
 func (s *Service) RefreshHandler(c *gin.Context) {
 	var req gateway.Token
 	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
@@ -169,37 +165,63 @@ func (s *Service) RefreshHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
 		return
 	}
-	claims, err := s.Auth.VerifyJWT(req.JWT)
-	if e, ok := err.(*jwt.ValidationError); ok {
-		if e.Errors&jwt.ValidationErrorExpired != 0 {
-			s.Logger.Info("refresh: auth username is: ", claims.Mobile)
-			user, _ := ebs_fields.GetUserByMobile(claims.Mobile, s.Db)
-			// should verify signature here...
-			if user.PublicKey == "" {
-				s.Logger.Printf("user: %s has no registered pubkey", user.Mobile)
-			}
-			s.Logger.Printf("grabbed user is: %#v", user.Mobile)
-			if _, encErr := noebsCrypto.VerifyWithHeaders(user.PublicKey, req.Signature, req.Message); encErr != nil {
-				s.Logger.Printf("invalid signature in refresh: %v", encErr)
-				c.JSON(http.StatusBadRequest, gin.H{"message": encErr.Error(), "code": "bad_request"})
-				return
-			}
-			auth, _ := s.Auth.GenerateJWT(claims.Mobile)
-			c.Writer.Header().Set("Authorization", auth)
-			c.JSON(http.StatusOK, gin.H{"authorization": auth})
-
-		} else {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Malformed token", "code": "jwt_malformed"})
+	if req.RefreshToken != "" {
+		pair, err := s.Auth.Refresh(req.RefreshToken)
+		if errors.Is(err, gateway.ErrSessionRevoked) {
+			c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error(), "code": "session_revoked"})
+			return
+		} else if errors.Is(err, gateway.ErrInvalidRefreshToken) {
+			c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error(), "code": "invalid_refresh_token"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "session_error"})
 			return
 		}
-	} else if err == nil {
-		// FIXME it is better to let the endpoint explicitly Get the claim off the user
-		//  as we will assume the auth server will reside in a different domain!
-		s.Logger.Printf("the username is: %s", claims.Mobile)
-		auth, _ := s.Auth.GenerateJWT(claims.Mobile)
-		c.Writer.Header().Set("Authorization", auth)
-		c.JSON(http.StatusOK, gin.H{"authorization": auth})
+		c.Writer.Header().Set("Authorization", pair.AccessToken)
+		c.JSON(http.StatusOK, pair)
+		return
+	}
+
+	// an expired token is fine here, as long as it is the only thing wrong with it
+	claims, err := s.Auth.VerifyJWT(req.JWT)
+	if e, ok := err.(*jwt.ValidationError); ok && e.Errors&^jwt.ValidationErrorExpired != 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Malformed token", "code": "jwt_malformed"})
+		return
+	} else if claims == nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Malformed token", "code": "jwt_malformed"})
+		return
+	}
+	if s.Auth.Revoked(claims) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Token was revoked", "code": "jwt_revoked"})
+		return
+	}
+	s.Logger.Info("refresh: auth username is: ", claims.Mobile)
+	user, _ := ebs_fields.GetUserByMobile(claims.Mobile, s.Db)
+	if user.PublicKey == "" {
+		s.Logger.Printf("user: %s has no registered pubkey", user.Mobile)
 	}
+	if _, encErr := noebsCrypto.VerifyWithHeaders(user.PublicKey, req.Signature, req.Message); encErr != nil {
+		s.Logger.Printf("invalid signature in refresh: %v", encErr)
+		c.JSON(http.StatusBadRequest, gin.H{"message": encErr.Error(), "code": "bad_request"})
+		return
+	}
+	deviceID := req.DeviceID
+	if deviceID == "" {
+		deviceID = c.GetHeader("X-Device-ID")
+	}
+	pair, err := s.Auth.LegacyRefresh(claims, deviceID, c.Request.UserAgent(), c.ClientIP())
+	if errors.Is(err, gateway.ErrSessionRevoked) {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error(), "code": "session_revoked"})
+		return
+	} else if errors.Is(err, gateway.ErrLegacyRefreshEnded) {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error(), "code": "refresh_token_required"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "session_error"})
+		return
+	}
+	c.Writer.Header().Set("Authorization", pair.AccessToken)
+	c.JSON(http.StatusOK, pair)
 }
 
 // CreateUser to register a new user to noebs
@@ -237,6 +259,8 @@ func (s *Service) CreateUser(c *gin.Context) {
 	}
 
 	// make sure that the user doesn't exist in the database
+	// tiers are only granted by KYC reviews
+	u.KYCTier = 0
 	if err := u.HashPassword(); err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
 	}
@@ -256,20 +280,34 @@ func (s *Service) VerifyOTP(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "otp was not sent", "code": "empty_otp"})
 		return
 	}
-	s.Logger.Printf("the processed request is: %v\n", req)
+	s.Logger.Printf("the processed request is: %+v\n", redact.Value(req))
 	u := ebs_fields.User{}
 	if notFound := s.Db.Where("mobile = ?", strings.ToLower(req.Mobile)).First(&u).Error; errors.Is(notFound, gorm.ErrRecordNotFound) {
 		c.JSON(http.StatusBadRequest, gin.H{"message": notFound.Error(), "code": "not_found"})
 		return
 	}
 
-	// I think this one is buggy
-	if valid := u.VerifyOtp(req.OTP); !valid {
+	if s.unlockDelayed(c, &u) {
+		return
+	}
+	valid, err := u.UseOtp(s.Db, req.OTP, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": serverError.Error(), "code": "database_error"})
+		return
+	}
+	if !valid {
+		if s.signInFailed(&u) {
+			s.accountLocked(c, &u)
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid otp", "code": "invalid_otp"})
 		return
 	}
 	s.Db.Model(&req).Where("mobile = ?", req.Mobile).Update("is_password_otp", true)
 	s.Db.Model(&req).Where("mobile = ?", req.Mobile).Update("is_verified", true)
+	// the otp proves the user has the phone, which unlocks the account
+	s.signInSucceeded(u.Mobile, true)
+	u.LockedAt = nil
 	c.JSON(http.StatusOK, gin.H{"result": "ok", "user": u, "pubkey": s.NoebsConfig.EBSConsumerKey})
 }
 
@@ -280,15 +318,49 @@ func (s *Service) BalanceStep(c *gin.Context) {
 		ebs_fields.ConsumerBalanceFields
 		Mobile string `json:"mobile,omitempty"`
 	}
-	url := s.NoebsConfig.ConsumerIP + ebs_fields.ConsumerBalanceEndpoint // EBS simulator endpoint url goes here.
 
 	var req data
 	c.ShouldBindWith(&req, binding.JSON)
 	user, _ := ebs_fields.NewUserWithCards(req.Mobile, s.Db)
+	if s.accountLocked(c, user) {
+		return
+	}
+	mobile := req.Mobile
+	deviceID := req.DeviceID
+	if !s.cardChallenge(c, user, req.ConsumerBalanceFields) {
+		return
+	}
+	// the card proves it is the user, on a new device too
+	if deviceID != "" {
+		if _, err := ebs_fields.TrustDevice(s.Db, mobile, ebs_fields.Device{DeviceID: deviceID, Platform: c.GetHeader("X-Device-Platform")}, time.Now()); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+			return
+		}
+	}
+	// the card replaces the password, not the second factor
+	if user.MFAEnabled {
+		s.mfaChallenge(c, user, deviceID, "")
+		return
+	}
+	s.signInSucceeded(mobile, false)
+
+	res, ok := s.newSession(c, mobile, deviceID)
+	if !ok {
+		return
+	}
+	res["result"] = "ok"
+	c.JSON(http.StatusOK, res)
+
+}
+
+// cardChallenge proves that user has the card of req with a balance inquiry
+// at EBS. Otherwise, it counts a failed sign in of user and writes the error.
+func (s *Service) cardChallenge(c *gin.Context, user *ebs_fields.User, req ebs_fields.ConsumerBalanceFields) bool {
+	url := s.NoebsConfig.ConsumerIP + ebs_fields.ConsumerBalanceEndpoint // EBS simulator endpoint url goes here.
 	var isMatched bool
 	if user.Cards == nil {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "no matching card was found", "code": "card_not_matched"})
-		return
+		return false
 	}
 	for _, card := range user.Cards {
 		if req.Pan == card.Pan {
@@ -297,38 +369,36 @@ func (s *Service) BalanceStep(c *gin.Context) {
 		}
 	}
 	if !isMatched {
+		if s.signInFailed(user) {
+			s.accountLocked(c, user)
+			return false
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"message": "no matching card was found", "code": "card_not_matched"})
-		return
+		return false
 	}
 
 	// make transaction to ebs here
-	mobile := req.Mobile
-	req.Mobile = ""
+	req.DelDeviceID()
 	req.ApplicationId = s.NoebsConfig.ConsumerID
 	jsonBuffer, err := json.Marshal(req)
 	if err != nil {
 		// there's an error in parsing the struct. Server error.
 		er := ebs_fields.ErrorDetails{Details: nil, Code: http.StatusBadRequest, Message: "Unable to parse the request", Status: ebs_fields.ParsingError}
 		c.AbortWithStatusJSON(http.StatusBadRequest, ebs_fields.ErrorResponse{ErrorDetails: er})
-		return
+		return false
 	}
 
 	// the only part left is fixing EBS errors. Formalizing them per se.
-	_, _, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
+	_, _, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
 	if ebsErr != nil {
+		if s.signInFailed(user) {
+			s.accountLocked(c, user)
+			return false
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid credentials", "code": "transaction_failed"})
-		return
+		return false
 	}
-
-	// generate a jwt here
-	token, err := s.Auth.GenerateJWT(mobile)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, err)
-		return
-	}
-	c.Writer.Header().Set("Authorization", token)
-	c.JSON(http.StatusOK, gin.H{"result": "ok", "authorization": token})
-
+	return true
 }
 
 // ChangePassword used to change a user's password using their old one
@@ -340,7 +410,7 @@ func (s *Service) ChangePassword(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Bad request.", "code": "bad_request"})
 		return
 	}
-	s.Logger.Printf("the processed request is: %+v\n", req)
+	s.Logger.Printf("the processed request is: %+v\n", redact.Value(req))
 	u := ebs_fields.User{}
 	if notFound := s.Db.Where("mobile = ?", strings.ToLower(mobile)).First(&u).Error; errors.Is(notFound, gorm.ErrRecordNotFound) {
 		// service id is not found
@@ -348,6 +418,22 @@ func (s *Service) ChangePassword(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"message": notFound.Error(), "code": "not_found"})
 		return
 	}
+	if s.accountLocked(c, &u) {
+		return
+	}
+	// a stolen access token alone isn't enough to take the account over
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(req.Password)); err != nil {
+		if s.signInFailed(&u) {
+			s.accountLocked(c, &u)
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"message": "wrong password entered", "code": "wrong_password"})
+		return
+	}
+	if !validatePassword(req.NewPassword) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Password must be at least 8 characters long, and must include at least one capital letter, one symbol and one number", "code": "password_invalid"})
+		return
+	}
 
 	// Create and update the user's password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), 8)
@@ -359,8 +445,20 @@ func (s *Service) ChangePassword(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, err)
 		return
 	}
-
-	c.JSON(http.StatusOK, gin.H{"result": "ok", "user": u})
+	// whoever knew the old password is signed out, this device gets a new session
+	device := s.currentDevice(c)
+	if err := s.Auth.RevokeSessions(u.Mobile); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "session_error"})
+		return
+	}
+	res, ok := s.newSession(c, u.Mobile, device)
+	if !ok {
+		return
+	}
+	res["result"] = "ok"
+	res["user"] = u
+	c.JSON(http.StatusOK, res)
+	s.Auth.AuditUser(c, u.Mobile, "password_change")
 }
 
 // VerifyFirebase used to confirm that the user's token is valid
@@ -384,55 +482,13 @@ func (s *Service) VerifyFirebase(c *gin.Context) {
 	s.Logger.Printf("Verified ID token: %v\n", token)
 }
 
+// SendPush sends data as a firebase push notification to data.To
 func (s *Service) SendPush(data PushData) error {
-	// Obtain a messaging.Client from the App.
-	ctx := context.Background()
-	client, err := s.FirebaseApp.Messaging(ctx)
-	if err != nil {
-		s.Logger.Printf("error getting Messaging clients: %v\n", err)
-	}
-	// This registration token comes from the client FCM SDKs.
-	registrationToken := data.To
-
-	// This is the same struct as PushData, but due to firebase api
-	// we had to make it in a map of string:any
-	firebaseData := map[string]string{
-		"type":           data.Type,
-		"time":           fmt.Sprint(data),
-		"uuid":           data.EBSData.UUID,
-		"call_to_action": data.CallToAction,
-	}
-
-	if data.PaymentRequest != (ebs_fields.QrData{}) { // If you get an error in Payment Request notifications this may be the reason.
-		if PaymentRequest, err := json.Marshal(data.PaymentRequest); err == nil {
-			firebaseData["payment_request"] = string(PaymentRequest)
-		} else {
-			log.Printf("Error marshalling PaymentRequest: %v", err)
-		}
-	}
-
-	// See documentation on defining a message payload.
-	message := &messaging.Message{
-		Token:        registrationToken,
-		Notification: &messaging.Notification{Title: data.Title, Body: data.Body},
-		Android:      &messaging.AndroidConfig{},
-		Webpush:      &messaging.WebpushConfig{},
-		APNS:         &messaging.APNSConfig{},
-		FCMOptions:   &messaging.FCMOptions{},
-		Topic:        "",
-		Condition:    "",
-		Data:         firebaseData,
-	}
-
-	// Send a message to the device corresponding to the provided
-	// registration token.
-	response, err := client.Send(ctx, message)
-	if err != nil {
+	fcm := &FCMNotifier{App: s.FirebaseApp}
+	if err := fcm.Notify(context.Background(), data); err != nil {
 		s.Logger.Printf("the error is: %v", err)
 		return err
 	}
-	// Response is a message ID string.
-	log.Print(response)
 	return nil
 }
 
@@ -440,7 +496,7 @@ func (s *Service) SendPush(data PushData) error {
 func (s *Service) GenerateSignInCode(c *gin.Context, allowInsecure bool) {
 	var req gateway.Token
 	c.ShouldBindWith(&req, binding.JSON)
-	s.Logger.Printf("the req is: %+v", req)
+	s.Logger.Printf("the req is: %+v", redact.Value(req))
 	// default username to mobile, in case username was not provided
 	if req.Mobile == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Mobile number was not sent", "code": "bad_request"})
@@ -452,23 +508,7 @@ func (s *Service) GenerateSignInCode(c *gin.Context, allowInsecure bool) {
 		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
 		return
 	}
-	log.Printf("the key is: %s", key)
 	// this function doesn't have to be blocking.
-	go utils.SendSMS(&s.NoebsConfig, utils.SMS{Mobile: req.Mobile, Message: fmt.Sprintf("Your one-time access code is: %s. DON'T share it with anyone.", key)})
+	s.sendSMS(utils.SMS{Mobile: req.Mobile, Message: fmt.Sprintf("Your one-time access code is: %s. DON'T share it with anyone.", key)})
 	c.JSON(http.StatusCreated, gin.H{"status": "ok", "message": "Password reset link has been sent to your mobile number. Use the info to login in to your account."})
 }
-
-// APIAuth API-Key middleware. Currently is used by consumer services
-func (s *Service) APIAuth() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		if key := c.GetHeader("api-key"); key != "" {
-			if !isMember("apikeys", key, s.Redis) {
-				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"code": "wrong_api_key",
-					"message": "visit https://soluspay.net/contact for a key"})
-				return
-			}
-		}
-		c.Next()
-	}
-
-}
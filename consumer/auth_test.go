@@ -9,6 +9,7 @@ import (
 	firebase "firebase.google.com/go/v4"
 	gateway "github.com/adonese/noebs/apigateway"
 	"github.com/adonese/noebs/ebs_fields"
+	"github.com/adonese/noebs/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v7"
 	"github.com/sirupsen/logrus"
@@ -23,6 +24,18 @@ var noebsConfig = ebs_fields.NoebsConfig{JWTKey: "testme", BillInquiryIPIN: "000
 
 var auth = gateway.JWTAuth{NoebsConfig: noebsConfig}
 
+// openTestDB opens an in-memory database private to the running test and migrates models into it
+func openTestDB(t *testing.T, models ...any) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("unable to open test db: %v", err)
+	}
+	if err := db.AutoMigrate(models...); err != nil {
+		t.Fatalf("unable to migrate test db: %v", err)
+	}
+	return db
+}
+
 func testSetupRouter() *gin.Engine {
 	auth.Init()
 
@@ -35,6 +48,10 @@ func testSetupRouter() *gin.Engine {
 	service.Db = testDB.Debug()
 	service.NoebsConfig = noebsConfig
 	service.Auth = &auth
+	service.EBSClient = &ebs_fields.FakeEBSClient{}
+	service.SMS = &utils.MemorySMS{}
+	service.Tokens, _ = ebs_fields.NewTokenCodec(&noebsConfig)
+	service.Notifiers = map[string]Notifier{ChannelPush: &RecordingNotifier{}, ChannelSMS: &SMSNotifier{Sender: service.SMS}}
 
 	r.GET("/firebase", service.VerifyFirebase)
 	r.POST("/register", service.CreateUser)
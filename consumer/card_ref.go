@@ -0,0 +1,85 @@
+package consumer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+)
+
+// ResolveCardRef is a middleware for the endpoints that take the user's card in
+// field (e.g., PAN). Instead of the card, a request can send the card_ref of one
+// of the user's cards, which is replaced by the card's PAN, and by its expiry
+// date too when field is PAN and expDate is missing. The user must be
+// authenticated to use card_ref, even on endpoints that are otherwise public,
+// with a token AuthMiddleware would accept.
+func (s *Service) ResolveCardRef(field string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := c.GetRawData()
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+			return
+		}
+		setRequestBody(c, body)
+
+		var req map[string]any
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&req); err != nil {
+			c.Next() // the handler reports the binding error
+			return
+		}
+		ref, _ := req["card_ref"].(string)
+		if ref == "" {
+			c.Next()
+			return
+		}
+		mobile := c.GetString("mobile")
+		if mobile == "" {
+			claims, err := s.Auth.VerifyJWT(c.GetHeader("Authorization"))
+			if err != nil || claims.Operator != "" || s.Auth.Revoked(claims) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "card_ref is only accepted from authorized users", "code": "unauthorized"})
+				return
+			}
+			mobile = claims.Mobile
+		}
+		card, err := ebs_fields.GetCardByRef(mobile, ref, s.Db)
+		if errors.Is(err, ebs_fields.ErrCardNotFound) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "card_not_found"})
+			return
+		} else if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": serverError.Error(), "code": "database_error"})
+			return
+		}
+
+		delete(req, "card_ref")
+		req[field] = card.Pan
+		if expDate, _ := req["expDate"].(string); field == "PAN" && expDate == "" {
+			req["expDate"] = card.Expiry
+		}
+		body, _ = json.Marshal(req)
+		setRequestBody(c, body)
+		c.Next()
+	}
+}
+
+// setRequestBody replaces the request body, handlers bind either from the
+// cached body or the request body.
+func setRequestBody(c *gin.Context, body []byte) {
+	c.Set(gin.BodyBytesKey, body)
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+}
+
+// userCard returns the PAN of the user's card referenced by ref, or the one
+// matching masked (see ebs_fields.ExpandCard) for clients that don't send card_ref.
+func userCard(cards []ebs_fields.Card, ref, masked string) (string, error) {
+	if ref != "" {
+		card, err := ebs_fields.CardByRef(cards, ref)
+		return card.Pan, err
+	}
+	return ebs_fields.ExpandCard(masked, cards)
+}
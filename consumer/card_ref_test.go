@@ -0,0 +1,78 @@
+package consumer
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adonese/noebs/apigateway"
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"gorm.io/gorm"
+)
+
+func TestService_ResolveCardRef(t *testing.T) {
+	db := openTestDB(t, &ebs_fields.User{}, &ebs_fields.Card{}, &gateway.RevokedToken{})
+	jwtAuth := &gateway.JWTAuth{Key: []byte("card ref test"), Db: db}
+	s := &Service{Db: db, Auth: jwtAuth}
+
+	owner := ebs_fields.User{Model: gorm.Model{ID: 1}, Mobile: "0912141679", Password: "12345678"}
+	other := ebs_fields.User{Model: gorm.Model{ID: 2}, Mobile: "0912141680", Password: "12345678"}
+	db.Create(&owner)
+	db.Create(&other)
+	card := ebs_fields.Card{Pan: "9222081700176714465", Expiry: "2302", UserID: owner.ID}
+	otherCard := ebs_fields.Card{Pan: "9222081700176714467", Expiry: "2304", UserID: other.ID}
+	db.Create(&card)
+	db.Create(&otherCard)
+	ownerJWT, _ := jwtAuth.GenerateJWT(owner.Mobile)
+	revokedJWT, revoked, _ := jwtAuth.GenerateAccessToken(owner.Mobile, 0)
+	jwtAuth.RevokeToken(revoked.Id, time.Unix(revoked.ExpiresAt, 0))
+	operatorJWT, _ := jwtAuth.GenerateOperatorToken(&gateway.Operator{Username: owner.Mobile})
+
+	var got ebs_fields.ConsumerCardHolderFields
+	r := gin.New()
+	r.POST("/p2p", s.ResolveCardRef("PAN"), func(c *gin.Context) {
+		got = ebs_fields.ConsumerCardHolderFields{}
+		if err := c.ShouldBindBodyWith(&got, binding.JSON); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": "validation_error"})
+			return
+		}
+		c.JSON(http.StatusOK, nil)
+	})
+
+	tests := []struct {
+		name     string
+		jwt      string
+		body     string
+		wantCode int
+		want     ebs_fields.ConsumerCardHolderFields
+	}{
+		{"pan", "", `{"PAN": "9222081700176714465", "IPIN": "x", "expDate": "2302"}`, http.StatusOK, ebs_fields.ConsumerCardHolderFields{Pan: "9222081700176714465", Ipin: "x", ExpDate: "2302"}},
+		{"card ref", ownerJWT, `{"card_ref": "` + card.CardRef + `", "IPIN": "x"}`, http.StatusOK, ebs_fields.ConsumerCardHolderFields{Pan: card.Pan, Ipin: "x", ExpDate: card.Expiry}},
+		{"card ref keeps exp date", ownerJWT, `{"card_ref": "` + card.CardRef + `", "IPIN": "x", "expDate": "2512"}`, http.StatusOK, ebs_fields.ConsumerCardHolderFields{Pan: card.Pan, Ipin: "x", ExpDate: "2512"}},
+		{"unauthorized", "", `{"card_ref": "` + card.CardRef + `", "IPIN": "x"}`, http.StatusUnauthorized, ebs_fields.ConsumerCardHolderFields{}},
+		{"revoked token", revokedJWT, `{"card_ref": "` + card.CardRef + `", "IPIN": "x"}`, http.StatusUnauthorized, ebs_fields.ConsumerCardHolderFields{}},
+		{"operator token", operatorJWT, `{"card_ref": "` + card.CardRef + `", "IPIN": "x"}`, http.StatusUnauthorized, ebs_fields.ConsumerCardHolderFields{}},
+		{"other user's card", ownerJWT, `{"card_ref": "` + otherCard.CardRef + `", "IPIN": "x"}`, http.StatusBadRequest, ebs_fields.ConsumerCardHolderFields{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = ebs_fields.ConsumerCardHolderFields{}
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/p2p", bytes.NewBufferString(tt.body))
+			if tt.jwt != "" {
+				req.Header.Set("Authorization", tt.jwt)
+			}
+			r.ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("ResolveCardRef() code = %v, want %v: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if got != tt.want {
+				t.Errorf("ResolveCardRef() bound %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/adonese/noebs/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// deviceSession starts a session for u, who just signed in on deviceID, when
+// the device is trusted. Otherwise it sends u an otp to verify the device
+// with (see VerifyDevice) and writes the device_verification_required response.
+func (s *Service) deviceSession(c *gin.Context, u *ebs_fields.User, deviceID, publicKey string) (gin.H, bool) {
+	deviceID, ok := signInDevice(c, deviceID)
+	if !ok {
+		return nil, false
+	}
+	now := time.Now()
+	device, err := ebs_fields.SeeDevice(s.Db, u.Mobile, ebs_fields.Device{DeviceID: deviceID, Platform: c.GetHeader("X-Device-Platform"), PublicKey: publicKey}, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return nil, false
+	}
+	if !device.Trusted {
+		if err := device.StartVerification(s.Db, now); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+			return nil, false
+		}
+		if key, err := u.GenerateOtp(); err == nil && s.SMS != nil {
+			s.sendSMS(utils.SMS{Mobile: u.Mobile, Message: fmt.Sprintf("Your code to sign in on a new device is: %s. DON'T share it with anyone.", key)})
+		}
+		c.JSON(http.StatusForbidden, gin.H{"message": "verify the new device with the otp sent to your mobile, or with one of your cards",
+			"code": "device_verification_required", "verify_until": device.VerifyUntil})
+		return nil, false
+	}
+	return s.newSession(c, u.Mobile, deviceID)
+}
+
+// signInDevice returns the device id of a sign in, from the body or else the
+// X-Device-ID header, and writes the device_id_required response without one.
+func signInDevice(c *gin.Context, deviceID string) (string, bool) {
+	if deviceID == "" {
+		deviceID = c.GetHeader("X-Device-ID")
+	}
+	if deviceID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "device_id is required to sign in", "code": "device_id_required"})
+		return "", false
+	}
+	return deviceID, true
+}
+
+// VerifyDevice trusts the device a user just signed in on with the otp they
+// were sent, and starts a session on it.
+func (s *Service) VerifyDevice(c *gin.Context) {
+	var req struct {
+		Mobile   string `json:"mobile" binding:"required"`
+		DeviceID string `json:"device_id" binding:"required"`
+		OTP      string `json:"otp" binding:"required"`
+	}
+	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	u, err := ebs_fields.GetUserByMobile(req.Mobile, s.Db)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "not_found"})
+		return
+	}
+	if s.accountLocked(c, &u) {
+		return
+	}
+	// the otp is only spent on a device waiting for it
+	if _, err := ebs_fields.PendingDevice(s.Db, u.Mobile, req.DeviceID, time.Now()); errors.Is(err, ebs_fields.ErrDeviceNotFound) || errors.Is(err, ebs_fields.ErrDeviceVerificationEnded) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "device_verification_ended"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	ok, err := u.UseOtp(s.Db, req.OTP, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": serverError.Error(), "code": "database_error"})
+		return
+	}
+	if !ok {
+		if s.signInFailed(&u) {
+			s.accountLocked(c, &u)
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid otp", "code": "invalid_otp"})
+		return
+	}
+	device, err := ebs_fields.VerifyDevice(s.Db, u.Mobile, req.DeviceID, time.Now())
+	if errors.Is(err, ebs_fields.ErrDeviceNotFound) || errors.Is(err, ebs_fields.ErrDeviceVerificationEnded) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "device_verification_ended"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	s.signInSucceeded(u.Mobile, false)
+	res, ok := s.newSession(c, u.Mobile, device.DeviceID)
+	if !ok {
+		return
+	}
+	res["user"] = u
+	res["device"] = device
+	c.JSON(http.StatusOK, res)
+}
+
+// Devices lists the devices the user signed in from
+func (s *Service) Devices(c *gin.Context) {
+	devices, err := ebs_fields.GetDevices(s.Db, c.GetString("mobile"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": devices})
+}
+
+// RemoveDevice removes a device of the user and signs it out, signing in on it
+// again needs a new verification.
+func (s *Service) RemoveDevice(c *gin.Context) {
+	mobile := c.GetString("mobile")
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "invalid device id", "code": "bad_request"})
+		return
+	}
+	device, err := ebs_fields.RemoveDevice(s.Db, mobile, uint(id))
+	if errors.Is(err, ebs_fields.ErrDeviceNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"message": err.Error(), "code": "not_found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	sessions, err := s.Auth.Sessions(mobile)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	for _, session := range sessions {
+		if session.DeviceID != device.DeviceID {
+			continue
+		}
+		if err := s.Auth.RevokeSession(mobile, session.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+			return
+		}
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// currentDevice returns the device id of the session of the request
+func (s *Service) currentDevice(c *gin.Context) string {
+	id := c.GetUint("session_id")
+	if id == 0 {
+		return ""
+	}
+	sessions, _ := s.Auth.Sessions(c.GetString("mobile"))
+	for _, session := range sessions {
+		if session.ID == id {
+			return session.DeviceID
+		}
+	}
+	return ""
+}
+
+// pushTokens returns the push tokens of the trusted devices of user. Users
+// who didn't sign in since devices were added only have User.DeviceID.
+func (s *Service) pushTokens(user ebs_fields.User) []string {
+	tokens, err := ebs_fields.PushTokens(s.Db, user.Mobile)
+	if err != nil || len(tokens) == 0 {
+		return []string{user.DeviceID}
+	}
+	return tokens
+}
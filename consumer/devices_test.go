@@ -0,0 +1,73 @@
+package consumer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/adonese/noebs/apigateway"
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+func TestService_devices(t *testing.T) {
+	db := openTestDB(t, &ebs_fields.User{}, &ebs_fields.Device{}, &gateway.Session{}, &gateway.RevokedToken{})
+	jwtAuth := &gateway.JWTAuth{Key: []byte("devices test"), Db: db}
+	s := &Service{Db: db, Auth: jwtAuth, Logger: logrus.New()}
+	user := ebs_fields.User{Model: gorm.Model{ID: 1}, Mobile: "0912141679", Password: "Abc12345!", DeviceID: "phone", PublicKey: "MFwwDQYJKoZIhvcNAQEBBQADSwAwSAJBANx4gKYSMv3CrWWsxdPfxDxFvl"}
+	user.HashPassword()
+	db.Create(&user)
+	otp, _ := user.GenerateOtp()
+
+	r := gin.New()
+	r.POST("/login", s.LoginHandler)
+	r.POST("/devices/verify", s.VerifyDevice)
+	authorized := r.Group("/", jwtAuth.AuthMiddleware())
+	authorized.GET("/devices", s.Devices)
+	authorized.DELETE("/devices/:id", s.RemoveDevice)
+	authorized.GET("/sessions", s.ListSessions)
+
+	do := func(method, path, token string, body any) (int, map[string]any) {
+		payload, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+		req.Header.Set("Authorization", token)
+		r.ServeHTTP(w, req)
+		var res map[string]any
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res
+	}
+
+	code, res := do(http.MethodPost, "/login", "", gin.H{"mobile": user.Mobile, "password": "Abc12345!", "device_id": "phone"})
+	if code != http.StatusOK {
+		t.Fatalf("LoginHandler() on the first device = %v, %v", code, res)
+	}
+	phone := res["authorization"].(string)
+	if code, res := do(http.MethodPost, "/login", "", gin.H{"mobile": user.Mobile, "password": "Abc12345!", "device_id": "laptop"}); res["code"] != "device_verification_required" {
+		t.Fatalf("LoginHandler() on a new device = %v, %v", code, res)
+	}
+	if code, res := do(http.MethodPost, "/devices/verify", "", gin.H{"mobile": user.Mobile, "device_id": "tablet", "otp": otp}); res["code"] != "device_verification_ended" {
+		t.Errorf("VerifyDevice() of a device that didn't sign in = %v, %v", code, res)
+	}
+	code, res = do(http.MethodPost, "/devices/verify", "", gin.H{"mobile": user.Mobile, "device_id": "laptop", "otp": otp})
+	if code != http.StatusOK || res["authorization"] == nil {
+		t.Fatalf("VerifyDevice() = %v, %v", code, res)
+	}
+	laptopID := res["device"].(map[string]any)["ID"].(float64)
+
+	if code, res := do(http.MethodGet, "/devices", phone, nil); code != http.StatusOK || len(res["result"].([]any)) != 2 {
+		t.Errorf("Devices() = %v, %v", code, res)
+	}
+	// removing the laptop signs it out
+	if code, res := do(http.MethodDelete, "/devices/"+fmt.Sprint(laptopID), phone, nil); code != http.StatusNoContent {
+		t.Fatalf("RemoveDevice() = %v, %v", code, res)
+	}
+	if code, res := do(http.MethodGet, "/sessions", phone, nil); code != http.StatusOK || len(res["result"].([]any)) != 1 {
+		t.Errorf("ListSessions() after RemoveDevice() = %v, %v", code, res)
+	}
+}
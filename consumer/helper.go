@@ -11,9 +11,8 @@
 package consumer
 
 import (
+	"context"
 	"errors"
-	"log"
-	"strconv"
 	"strings"
 	"time"
 	"unicode"
@@ -22,6 +21,7 @@ import (
 	"github.com/adonese/noebs/utils"
 	"github.com/go-redis/redis/v7"
 	"github.com/pquerna/otp/totp"
+	"github.com/sirupsen/logrus"
 	"gorm.io/gorm/clause"
 )
 
@@ -32,11 +32,6 @@ var (
 	errObjectNotFound = errors.New("object not found")
 )
 
-func isMember(key, val string, r *redis.Client) bool {
-	b, _ := r.SIsMember(key, val).Result()
-	return b
-}
-
 // validatePassword to include at least one capital letter, one symbol and one number
 // and that it is at least 8 characters long
 func validatePassword(password string) bool {
@@ -63,50 +58,6 @@ func validatePassword(password string) bool {
 	return hasUpper && hasSymbol && hasNumber
 }
 
-// userHasSessions is a handy function we can use to check if a user has any active sessions e.g., esp
-// when we don't want our users to use our app in new devices.
-// we have to implement a way to:
-// - identify user's devices
-// - allow them to use the app in other devices in case their original device was lost
-func userHasSessions(s *Service, username string) bool {
-	// Make sure the user doesn't have any active sessions!
-	lCount, err := s.Redis.Get(username + ":logged_in_devices").Result()
-
-	num, _ := strconv.Atoi(lCount)
-	// Allow for the user to be logged in -- add allowance through someway
-	if err != redis.Nil && num > 1 {
-		// The user is already logged in somewhere else. Communicate that to them, clearly!
-		//c.JSON(http.StatusBadRequest, gin.H{"code": "user_logged_elsewhere",
-		//	"code": "You are logging from another device. You can only have one valid session"})
-		//return
-		log.Print("The user is logging from a different location")
-		return true
-	}
-	return false
-}
-
-// userExceedMaxSessions keep track of many login-attempts a user has made
-func userExceededMaxSessions(s *Service, username string) bool {
-	// make sure number of failed logged_in counts doesn't exceed the allowed threshold.
-	res, err := s.Redis.Get(username + ":login_counts").Result()
-	if err == redis.Nil {
-		// the has just logged in
-		s.Redis.Set(username+":login_counts", 0, time.Hour)
-	} else if err == nil {
-		count, _ := strconv.Atoi(res)
-		if count >= 5 {
-			// Allow users to use another login method (e.g., totp, or they should reset their password)
-			// Lock their account
-			//s.Redis.HSet(username, "suspecious_behavior", 1)
-			s.Redis.HIncrBy(username, "suspicious_behavior", 1)
-			ttl, _ := s.Redis.TTL(username + ":login_counts").Result()
-			log.Printf("user exceeded max sessions %v", ttl)
-			return true
-		}
-	}
-	return false
-}
-
 func (s *Service) store(buf []byte, username string, edit bool) error {
 	z := &redis.Z{
 		Member: buf,
@@ -164,43 +115,113 @@ func (s *Service) ToDatabasename(url string) string {
 	return data[url]
 }
 
-// The buffer of the tranData channel must be greater than the maximum number of
-// concurrnet clients that are connected to all services that use this channel
+// tranData buffers notifications until a Pusher worker picks them up. When it is
+// full, notifications are persisted to the retry queue instead of blocking the handler.
 var tranData = make(chan PushData, 2048)
 
+// enqueuePush hands data over to the Pusher workers without blocking the caller
+func (s *Service) enqueuePush(data PushData) {
+	select {
+	case tranData <- data:
+	default:
+		s.scheduleRetry("", data, errors.New("notification queue is full"))
+	}
+}
+
+// sendSMS sends sms in the background, delivery failures are recorded by the SMSSender
+func (s *Service) sendSMS(sms utils.SMS) {
+	go func() {
+		if err := s.SMS.Send(context.Background(), sms); err != nil {
+			s.Logger.WithFields(logrus.Fields{"code": "sms_error", "message": err.Error()}).Error("unable to send sms")
+		}
+	}()
+}
+
+// Pusher delivers the notifications sent to tranData using NoebsConfig.PushWorkers
+// workers, and retries the failed ones. It should be started once as a goroutine.
 func (s *Service) Pusher() {
-	for data := range tranData {
-		// In the case we want to send a push notification to the receipient
-		//  (typically for telecom operations, or any operation that a user adds a phone number in the transfer field)
-		// But the problem, is that we have lost the reference to the original sender
-		s.Logger.Info("the data is: %+v", data)
-		// we are doing too much of db and logic here, let's simplify it
-		if data.Phone != "" {
-			user, err := ebs_fields.GetUserByMobile(data.Phone, s.Db)
-			if err != nil {
-				// not a tutipay user
-				utils.SendSMS(&s.NoebsConfig, utils.SMS{Mobile: data.Phone, Message: data.Body})
-			} else {
-				data.To = user.DeviceID
-				data.EBSData = ebs_fields.EBSResponse{}
-				data.UserMobile = user.Mobile
-				//Omit association when creating
-				s.Db.Omit(clause.Associations).Create(&data)
-				s.SendPush(data)
-				// FIXME(adonese): fallback option, maybe there is not need for the duplication
-				data.To = data.DeviceID // Sender DeviceID
-				s.SendPush(data)
-			}
-		} else {
-			user, err := ebs_fields.GetUserByCard(data.EBSData.PAN, s.Db)
-			if err != nil {
-				s.Logger.Printf("error finding user: %v", err)
-			} else {
-				data.To = user.DeviceID
-				data.UserMobile = user.Mobile
-				s.Db.Omit(clause.Associations).Create(&data)
-				s.SendPush(data)
+	workers := s.NoebsConfig.PushWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for data := range tranData {
+				s.dispatch(context.Background(), data)
 			}
+		}()
+	}
+	ticker := time.NewTicker(notificationRetryInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.retryNotifications(context.Background(), time.Now())
+	}
+}
+
+// dispatch finds the user data belongs to, stores the notification and sends it
+// through the user's preferred channel.
+func (s *Service) dispatch(ctx context.Context, data PushData) {
+	// In the case we want to send a push notification to the receipient
+	//  (typically for telecom operations, or any operation that a user adds a phone number in the transfer field)
+	// But the problem, is that we have lost the reference to the original sender
+	if data.Phone != "" {
+		user, err := ebs_fields.GetUserByMobile(data.Phone, s.Db)
+		if err != nil {
+			// not a tutipay user
+			s.notify(ctx, ChannelSMS, data)
+			return
+		}
+		data.To = user.DeviceID
+		data.EBSData = ebs_fields.EBSResponse{}
+		data.UserMobile = user.Mobile
+		//Omit association when creating
+		s.Db.Omit(clause.Associations).Create(&data)
+		s.notifyUser(ctx, user, data)
+		// FIXME(adonese): fallback option, maybe there is not need for the duplication
+		if data.DeviceID != "" {
+			data.To = data.DeviceID // Sender DeviceID
+			s.notify(ctx, ChannelPush, data)
 		}
+		return
+	}
+	var user ebs_fields.User
+	var err error
+	if data.UserMobile != "" {
+		// the user was found before the notification was stored for a retry
+		user, err = ebs_fields.GetUserByMobile(data.UserMobile, s.Db)
+	} else {
+		user, err = ebs_fields.GetUserByCard(data.EBSData.PAN, s.Db)
+	}
+	if err != nil {
+		s.Logger.Printf("error finding user: %v", err)
+		return
+	}
+	data.To = user.DeviceID
+	data.UserMobile = user.Mobile
+	s.Db.Omit(clause.Associations).Create(&data)
+	s.notifyUser(ctx, user, data)
+}
+
+// notifyUser sends data through the channel of user, push notifications go to
+// all of their trusted devices.
+func (s *Service) notifyUser(ctx context.Context, user ebs_fields.User, data PushData) {
+	if user.NotificationChannel != "" && user.NotificationChannel != ChannelPush {
+		s.notify(ctx, user.NotificationChannel, data)
+		return
+	}
+	for _, token := range s.pushTokens(user) {
+		data.To = token
+		s.notify(ctx, ChannelPush, data)
+	}
+}
+
+// notify sends data through channel and queues it for a retry if that fails
+func (s *Service) notify(ctx context.Context, channel string, data PushData) {
+	if channel == "" {
+		channel = ChannelPush
+	}
+	if err := s.notifierFor(channel).Notify(ctx, data); err != nil {
+		s.Logger.WithFields(logrus.Fields{"code": "notification_error", "channel": channel, "message": err.Error()}).Error("unable to send notification")
+		s.scheduleRetry(channel, data, err)
 	}
 }
@@ -0,0 +1,144 @@
+package consumer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// idempotencyTimeout is when a request that never completed, e.g., because
+// noebs stopped while waiting for EBS, can be taken over by a retry.
+const idempotencyTimeout = 5 * time.Minute
+
+// IdempotencyKey stores the outcome of a money-moving request so that a client
+// retrying it (e.g., after a timeout) gets the original response instead of
+// being charged twice. Keys are unique per Caller, see idempotencyCaller.
+type IdempotencyKey struct {
+	gorm.Model
+	Caller      string `gorm:"uniqueIndex:idx_idempotency_caller;not null;default:''"`
+	Key         string `gorm:"column:idempotency_key;uniqueIndex:idx_idempotency_caller;not null"`
+	Path        string `gorm:"uniqueIndex:idx_idempotency_caller;not null"`
+	RequestHash string
+	StatusCode  int
+	Response    []byte
+	Completed   bool
+}
+
+// idempotencyWriter keeps a copy of everything written to the response
+type idempotencyWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *idempotencyWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *idempotencyWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Idempotency is a middleware for the endpoints that move money. Requests are
+// keyed by the Idempotency-Key header, or the request UUID when the header is
+// missing. A repeated request with the same payload replays the stored response,
+// while reusing a key with a different payload is rejected with 409. A request
+// still in progress after idempotencyTimeout is taken over by its retry. Bad
+// requests and the errors of noebs that didn't reach EBS aren't stored.
+func (s *Service) Idempotency(c *gin.Context) {
+	body, err := c.GetRawData()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	setRequestBody(c, body)
+
+	key := idempotencyKey(c.GetHeader("Idempotency-Key"), body)
+	if key == "" {
+		c.Next()
+		return
+	}
+	sum := sha256.Sum256(body)
+	record := IdempotencyKey{Caller: idempotencyCaller(c, body), Key: key, Path: c.FullPath(), RequestHash: hex.EncodeToString(sum[:])}
+
+	if err := s.Db.Create(&record).Error; err != nil {
+		var stored IdempotencyKey
+		if err := s.Db.Where("caller = ? AND idempotency_key = ? AND path = ?", record.Caller, record.Key, record.Path).First(&stored).Error; err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": serverError.Error(), "code": "database_error"})
+			return
+		}
+		switch {
+		case stored.RequestHash != record.RequestHash:
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "idempotency key was used with a different payload", "code": "idempotency_conflict"})
+			return
+		case !stored.Completed:
+			now := time.Now()
+			res := s.Db.Model(&IdempotencyKey{}).Where("id = ? AND completed = ? AND updated_at < ?", stored.ID, false, now.Add(-idempotencyTimeout)).
+				Update("updated_at", now)
+			if res.Error != nil || res.RowsAffected == 0 {
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"message": "a request with the same idempotency key is in progress", "code": "request_in_progress"})
+				return
+			}
+			// the request was abandoned, this retry takes it over
+			record = stored
+		default:
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(stored.StatusCode, "application/json; charset=utf-8", stored.Response)
+			c.Abort()
+			return
+		}
+	}
+
+	w := &idempotencyWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	c.Request = c.Request.WithContext(ebs_fields.TrackEBSRequests(c.Request.Context()))
+	c.Next()
+
+	// a bad request never reached EBS, nor did an error of noebs (e.g., of its
+	// database) before it: release the key so that the client can retry. The
+	// errors of EBS are kept, EBS may have moved the money anyway.
+	if w.Status() == http.StatusBadRequest || (w.Status() >= http.StatusInternalServerError && !ebs_fields.SentToEBS(c.Request.Context())) {
+		s.Db.Unscoped().Delete(&record)
+		return
+	}
+	s.Db.Model(&record).Updates(IdempotencyKey{StatusCode: w.Status(), Response: w.body.Bytes(), Completed: true})
+}
+
+// idempotencyCaller returns who the keys of c belong to: the signed in user,
+// the API client, or the card paying on the public endpoints.
+func idempotencyCaller(c *gin.Context, body []byte) string {
+	if mobile := c.GetString("mobile"); mobile != "" {
+		return "user:" + mobile
+	}
+	if client := c.GetString("api_client"); client != "" {
+		return "client:" + client
+	}
+	var req struct {
+		PAN string `json:"PAN"`
+	}
+	json.Unmarshal(body, &req)
+	if req.PAN != "" {
+		return "card:" + ebs_fields.HashPAN(req.PAN)
+	}
+	return ""
+}
+
+// idempotencyKey returns header if it is set, otherwise the UUID of the request body
+func idempotencyKey(header string, body []byte) string {
+	if header != "" {
+		return header
+	}
+	var req struct {
+		UUID string `json:"UUID"`
+	}
+	json.Unmarshal(body, &req)
+	return req.UUID
+}
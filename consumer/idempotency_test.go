@@ -0,0 +1,144 @@
+package consumer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"gorm.io/gorm"
+)
+
+func TestService_Idempotency(t *testing.T) {
+	ebs := &ebs_fields.FakeEBSClient{Handler: func(url string, req []byte) (int, ebs_fields.EBSParserFields, error) {
+		return http.StatusBadGateway, ebs_fields.EBSParserFields{}, errors.New("declined")
+	}}
+	s := &Service{Db: openTestDB(t, &IdempotencyKey{}), EBSClient: ebs}
+
+	var calls int
+	r := gin.New()
+	r.POST("/p2p", s.Idempotency, func(c *gin.Context) {
+		var req struct {
+			UUID   string  `json:"UUID" binding:"required"`
+			Amount float32 `json:"tranAmount"`
+		}
+		if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": "validation_error"})
+			return
+		}
+		calls++
+		switch req.Amount {
+		case http.StatusInternalServerError:
+			c.JSON(http.StatusInternalServerError, gin.H{"code": "database_error"})
+			return
+		case http.StatusBadGateway:
+			code, res, _ := s.EBSClient.Do(c.Request.Context(), "/p2p", nil)
+			c.JSON(code, gin.H{"ebs_response": res})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ebs_response": gin.H{"UUID": req.UUID, "calls": calls}})
+	})
+
+	tests := []struct {
+		name      string
+		key       string
+		body      string
+		wantCode  int
+		wantCalls int
+	}{
+		{"first request", "", `{"UUID": "a", "tranAmount": 10}`, http.StatusOK, 1},
+		{"replayed by uuid", "", `{"UUID": "a", "tranAmount": 10}`, http.StatusOK, 1},
+		{"conflicting payload", "", `{"UUID": "a", "tranAmount": 20}`, http.StatusConflict, 1},
+		{"header key", "key-1", `{"UUID": "b", "tranAmount": 10}`, http.StatusOK, 2},
+		{"replayed by header", "key-1", `{"UUID": "b", "tranAmount": 10}`, http.StatusOK, 2},
+		{"bad request", "key-2", `{"tranAmount": 10}`, http.StatusBadRequest, 2},
+		{"fixed bad request", "key-2", `{"UUID": "c", "tranAmount": 10}`, http.StatusOK, 3},
+		{"error of noebs", "key-3", `{"UUID": "d", "tranAmount": 500}`, http.StatusInternalServerError, 4},
+		{"retried error of noebs", "key-3", `{"UUID": "d", "tranAmount": 500}`, http.StatusInternalServerError, 5},
+		{"error of ebs", "key-4", `{"UUID": "e", "tranAmount": 502}`, http.StatusBadGateway, 6},
+		{"replayed error of ebs", "key-4", `{"UUID": "e", "tranAmount": 502}`, http.StatusBadGateway, 6},
+	}
+	var first string
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/p2p", bytes.NewBufferString(tt.body))
+			if tt.key != "" {
+				req.Header.Set("Idempotency-Key", tt.key)
+			}
+			r.ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Errorf("Idempotency() code = %v, want %v: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("Idempotency() handler calls = %v, want %v", calls, tt.wantCalls)
+			}
+			if tt.name == "first request" {
+				first = w.Body.String()
+			}
+			if tt.name == "replayed by uuid" && w.Body.String() != first {
+				t.Errorf("Idempotency() replayed = %s, want %s", w.Body.String(), first)
+			}
+		})
+	}
+}
+
+func TestService_Idempotency_callers(t *testing.T) {
+	db := openTestDB(t, &IdempotencyKey{})
+	s := &Service{Db: db}
+
+	var calls int
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		if mobile := c.GetHeader("X-Mobile"); mobile != "" {
+			c.Set("mobile", mobile)
+		}
+	})
+	r.POST("/p2p", s.Idempotency, func(c *gin.Context) {
+		calls++
+		c.JSON(http.StatusOK, gin.H{"calls": calls})
+	})
+	// requests that never completed, one of them was abandoned
+	db.Create(&[]IdempotencyKey{
+		{Caller: "user:0912141679", Key: "in-progress", Path: "/p2p", RequestHash: hashOf(`{"UUID": "in-progress"}`)},
+		{Model: gorm.Model{UpdatedAt: time.Now().Add(-idempotencyTimeout)}, Caller: "user:0912141679", Key: "abandoned", Path: "/p2p", RequestHash: hashOf(`{"UUID": "abandoned"}`)},
+	})
+
+	tests := []struct {
+		name      string
+		mobile    string
+		body      string
+		wantCode  int
+		wantCalls int
+	}{
+		{"first user", "0912141679", `{"UUID": "a"}`, http.StatusOK, 1},
+		{"same key of another user", "0912141680", `{"UUID": "a"}`, http.StatusOK, 2},
+		{"same key of a card", "", `{"UUID": "a", "PAN": "9222081700176714465"}`, http.StatusOK, 3},
+		{"in progress", "0912141679", `{"UUID": "in-progress"}`, http.StatusConflict, 3},
+		{"abandoned", "0912141679", `{"UUID": "abandoned"}`, http.StatusOK, 4},
+		{"abandoned replayed", "0912141679", `{"UUID": "abandoned"}`, http.StatusOK, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/p2p", bytes.NewBufferString(tt.body))
+			req.Header.Set("X-Mobile", tt.mobile)
+			r.ServeHTTP(w, req)
+			if w.Code != tt.wantCode || calls != tt.wantCalls {
+				t.Errorf("Idempotency() = %v, %d calls, want %v, %d calls: %s", w.Code, calls, tt.wantCode, tt.wantCalls, w.Body)
+			}
+		})
+	}
+}
+
+func hashOf(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
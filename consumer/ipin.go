@@ -0,0 +1,33 @@
+package consumer
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+)
+
+var errInvalidIPINKey = errors.New("the ipin key must be a base64 encoded PKIX RSA key")
+
+// encryptIPIN encrypts pin for EBS: the RSA (PKCS #1 v1.5) encryption of uuid
+// followed by pin, with pubkey the base64 public key EBS gave us.
+func encryptIPIN(pubkey, pin, uuid string) (string, error) {
+	der, err := base64.StdEncoding.DecodeString(pubkey)
+	if err != nil {
+		return "", errInvalidIPINKey
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return "", errInvalidIPINKey
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return "", errInvalidIPINKey
+	}
+	block, err := rsa.EncryptPKCS1v15(rand.Reader, rsaKey, []byte(uuid+pin))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(block), nil
+}
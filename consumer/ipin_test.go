@@ -0,0 +1,26 @@
+package consumer
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"testing"
+)
+
+func Test_encryptIPIN(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	block, err := encryptIPIN(base64.StdEncoding.EncodeToString(der), "0000", "cbd7688f-2a60-439d-b53a-66eb04c060f1")
+	if err != nil {
+		t.Fatalf("encryptIPIN() error = %v", err)
+	}
+	sealed, _ := base64.StdEncoding.DecodeString(block)
+	got, err := rsa.DecryptPKCS1v15(nil, key, sealed)
+	if err != nil || string(got) != "cbd7688f-2a60-439d-b53a-66eb04c060f10000" {
+		t.Errorf("encryptIPIN() encrypted %q, %v", got, err)
+	}
+	if _, err := encryptIPIN("not a key", "0000", "uuid"); err != errInvalidIPINKey {
+		t.Errorf("encryptIPIN() error = %v, want %v", err, errInvalidIPINKey)
+	}
+}
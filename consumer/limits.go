@@ -0,0 +1,81 @@
+package consumer
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// checkLimits checks the transaction limits before a transaction of tranType and
+// amount made with the card pan is sent to EBS, and writes the limit_exceeded
+// response when it would go over one. The user is the one signed in, or the
+// owner of pan on the public endpoints. It returns the mobile of that user, to
+// be stored with the transaction, and the reservation of the amount that is
+// released with releaseLimits once the transaction is stored.
+func (s *Service) checkLimits(c *gin.Context, pan, tranType string, amount float32) (string, *ebs_fields.LimitReservation, bool) {
+	var user ebs_fields.User
+	if mobile := c.GetString("mobile"); mobile != "" {
+		user, _ = ebs_fields.GetUserByMobile(mobile, s.Db)
+		user.Mobile = mobile
+	} else if owner, err := ebs_fields.GetUserByCard(pan, s.Db); err == nil {
+		user = owner
+	}
+	reservation, err := s.reserveLimits(&user, pan, tranType, amount)
+	if e, ok := ebs_fields.IsLimitExceeded(err); ok {
+		c.JSON(http.StatusBadRequest, gin.H{"message": e.Error(), "code": "limit_exceeded",
+			"limit": e.Limit, "used": e.Used, "resets_at": e.ResetsAt})
+		return "", nil, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return "", nil, false
+	}
+	return user.Mobile, reservation, true
+}
+
+// reserveLimits reserves amount against the limits of user and of the card pan
+// for a transaction of tranType, see ebs_fields.ReserveLimits.
+func (s *Service) reserveLimits(user *ebs_fields.User, pan, tranType string, amount float32) (*ebs_fields.LimitReservation, error) {
+	tier, err := ebs_fields.ActiveKYCTier(s.Db, user, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return ebs_fields.ReserveLimits(s.Db, user.Mobile, tier, pan, tranType, amount, time.Now())
+}
+
+// releaseLimits releases a reservation of reserveLimits, once its transaction
+// is stored and counted by the limits.
+func (s *Service) releaseLimits(reservation *ebs_fields.LimitReservation) {
+	if err := reservation.Release(s.Db); err != nil {
+		s.Logger.WithFields(logrus.Fields{
+			"code":    "database_error",
+			"message": err.Error(),
+		}).Error("unable to release a limits reservation")
+	}
+}
+
+// requireKYCTier writes the kyc_required response when the signed in user
+// doesn't have the KYC tier min, 0 lets every user through.
+func (s *Service) requireKYCTier(c *gin.Context, min int) bool {
+	if min == 0 {
+		return true
+	}
+	user, err := ebs_fields.GetUserByMobile(c.GetString("mobile"), s.Db)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "database_error"})
+		return false
+	}
+	tier, err := ebs_fields.ActiveKYCTier(s.Db, &user, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return false
+	}
+	if tier < min {
+		c.JSON(http.StatusForbidden, gin.H{"message": "this transaction needs a verified KYC", "code": "kyc_required",
+			"kyc_tier": tier, "required_kyc_tier": min})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package consumer
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func TestService_CardTransfer_limits(t *testing.T) {
+	db := openTestDB(t, &ebs_fields.User{}, &ebs_fields.Card{}, &ebs_fields.EBSResponse{}, &ebs_fields.Limit{}, &ebs_fields.LimitReservation{})
+	fake := &ebs_fields.FakeEBSClient{}
+	s := &Service{Db: db, Logger: testLogger, EBSClient: fake}
+	user := ebs_fields.User{Model: gorm.Model{ID: 1}, Mobile: "0912141679", Password: "12345678"}
+	db.Create(&user)
+	db.Create(&ebs_fields.Card{Pan: "9222081700176714465", Expiry: "2302", UserID: user.ID})
+	db.Create(&ebs_fields.Limit{Scope: ebs_fields.LimitPerUser, Period: ebs_fields.LimitDaily, MaxAmount: 1000})
+
+	r := gin.New()
+	r.POST("/p2p", s.CardTransfer)
+	// the transfer is public, the limits of the owner of the card apply
+	body, _ := json.Marshal(gin.H{"applicationId": "noebs", "tranDateTime": "200222113700", "UUID": "a6a0a3d4-0c3a-4e5b-9d1e-8e0f0a7e2b11",
+		"PAN": "9222081700176714465", "IPIN": "0000", "expDate": "2302", "tranAmount": 1500, "toCard": "9222081700176711234"})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/p2p", bytes.NewReader(body)))
+
+	var res map[string]any
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if w.Code != http.StatusBadRequest || res["code"] != "limit_exceeded" || res["resets_at"] == nil {
+		t.Fatalf("CardTransfer() = %v, %s", w.Code, w.Body.String())
+	}
+	if len(fake.Requests()) != 0 {
+		t.Errorf("CardTransfer() sent a transaction over the limit to EBS")
+	}
+}
+
+func TestService_MobileTransfer_kycTier(t *testing.T) {
+	db := openTestDB(t, &ebs_fields.User{}, &ebs_fields.Card{}, &ebs_fields.EBSResponse{}, &ebs_fields.Limit{}, &ebs_fields.Passport{})
+	fake := &ebs_fields.FakeEBSClient{}
+	s := &Service{Db: db, Logger: testLogger, EBSClient: fake, NoebsConfig: ebs_fields.NoebsConfig{MobileTransferKYCTier: 1}}
+	db.Create(&ebs_fields.User{Model: gorm.Model{ID: 1}, Mobile: "0912141679", Password: "12345678"})
+	db.Create(&ebs_fields.User{Model: gorm.Model{ID: 2}, Mobile: "0912141680", Password: "12345678", MainCard: "9222081700176711234"})
+
+	r := gin.New()
+	r.POST("/p2p_mobile", func(c *gin.Context) { c.Set("mobile", "0912141679") }, s.MobileTransfer)
+	body, _ := json.Marshal(gin.H{"applicationId": "noebs", "tranDateTime": "200222113700", "UUID": "a6a0a3d4-0c3a-4e5b-9d1e-8e0f0a7e2b11",
+		"PAN": "9222081700176714465", "IPIN": "0000", "expDate": "2302", "tranAmount": 100, "mobile": "0912141680"})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/p2p_mobile", bytes.NewReader(body)))
+
+	var res map[string]any
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if w.Code != http.StatusForbidden || res["code"] != "kyc_required" {
+		t.Fatalf("MobileTransfer() = %v, %s", w.Code, w.Body.String())
+	}
+	if len(fake.Requests()) != 0 {
+		t.Errorf("MobileTransfer() sent the transfer of an unverified user to EBS")
+	}
+}
@@ -0,0 +1,70 @@
+package consumer
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+)
+
+// signInWindow is how long failed sign ins are counted for, a successful one
+// starts over.
+const signInWindow = 24 * time.Hour
+
+// accountLocked writes the account_locked response when the account of u is locked
+func (s *Service) accountLocked(c *gin.Context, u *ebs_fields.User) bool {
+	if u.LockedAt == nil {
+		return false
+	}
+	c.JSON(http.StatusForbidden, gin.H{"message": "the account is locked after too many failed attempts, verify an otp to unlock it",
+		"code": "account_locked", "locked_at": u.LockedAt})
+	return true
+}
+
+// otpUnlockDelay is how long a locked account waits before an otp unlocks it,
+// and a wrong otp locks it again: its otps can't be guessed one after another.
+const otpUnlockDelay = 15 * time.Minute
+
+// unlockDelayed writes the account_locked response when the account of u was
+// locked less than otpUnlockDelay ago, see VerifyOTP.
+func (s *Service) unlockDelayed(c *gin.Context, u *ebs_fields.User) bool {
+	if u.LockedAt == nil || time.Since(*u.LockedAt) >= otpUnlockDelay {
+		return false
+	}
+	return s.accountLocked(c, u)
+}
+
+// signInFailed counts a failed sign in of u, with a password, an otp or a card,
+// and locks the account of u after NoebsConfig.LoginMaxAttempts in a row. It
+// returns whether the account is locked.
+func (s *Service) signInFailed(u *ebs_fields.User) bool {
+	if s.Limiter == nil || u.Mobile == "" || s.NoebsConfig.LoginMaxAttempts <= 0 {
+		return false
+	}
+	now := time.Now()
+	if s.Limiter.Fail("sign_in:"+u.Mobile, signInWindow, now) < s.NoebsConfig.LoginMaxAttempts {
+		return false
+	}
+	if err := s.Db.Model(&ebs_fields.User{}).Where("mobile = ?", u.Mobile).Update("locked_at", now).Error; err != nil {
+		s.Logger.Printf("error in locking the account of %s: %v", u.Mobile, err)
+		return false
+	}
+	s.Logger.Printf("locked the account of %s after %d failed sign ins", u.Mobile, s.NoebsConfig.LoginMaxAttempts)
+	u.LockedAt = &now
+	return true
+}
+
+// signInSucceeded forgets the failed sign ins of mobile, and unlocks its
+// account when unlock is set, i.e., the user verified an otp.
+func (s *Service) signInSucceeded(mobile string, unlock bool) {
+	if s.Limiter != nil {
+		s.Limiter.Reset("sign_in:" + mobile)
+	}
+	if !unlock {
+		return
+	}
+	if err := s.Db.Model(&ebs_fields.User{}).Where("mobile = ?", mobile).Update("locked_at", nil).Error; err != nil {
+		s.Logger.Printf("error in unlocking the account of %s: %v", mobile, err)
+	}
+}
@@ -0,0 +1,69 @@
+package consumer
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adonese/noebs/apigateway"
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+func TestService_LoginHandler_lockout(t *testing.T) {
+	db := openTestDB(t, &ebs_fields.User{}, &ebs_fields.Device{}, &gateway.Session{}, &gateway.RevokedToken{})
+	s := &Service{Db: db, Auth: &gateway.JWTAuth{Key: []byte("lockout test"), Db: db}, Logger: logrus.New(),
+		Limiter: &gateway.RateLimiter{}, NoebsConfig: ebs_fields.NoebsConfig{LoginMaxAttempts: 3}}
+	user := ebs_fields.User{Model: gorm.Model{ID: 1}, Mobile: "0912141679", Password: "Abc12345!", DeviceID: "phone", PublicKey: "MFwwDQYJKoZIhvcNAQEBBQADSwAwSAJBANx4gKYSMv3CrWWsxdPfxDxFvl"}
+	user.HashPassword()
+	db.Create(&user)
+	otp, err := user.GenerateOtp()
+	if err != nil {
+		t.Fatalf("GenerateOtp() error = %v", err)
+	}
+
+	r := gin.New()
+	r.POST("/login", s.LoginHandler)
+	r.POST("/otp/verify", s.VerifyOTP)
+	tests := []struct {
+		name     string
+		path     string
+		body     gin.H
+		wantCode string // empty for a success
+		// lockedAgo moves the lock back before the request when it is set
+		lockedAgo time.Duration
+	}{
+		{"wrong password", "/login", gin.H{"mobile": user.Mobile, "password": "Wrong1234!", "device_id": "phone"}, "wrong_password", 0},
+		{"wrong password again", "/login", gin.H{"mobile": user.Mobile, "password": "Wrong1234!", "device_id": "phone"}, "wrong_password", 0},
+		{"locked", "/login", gin.H{"mobile": user.Mobile, "password": "Wrong1234!", "device_id": "phone"}, "account_locked", 0},
+		{"right password of a locked account", "/login", gin.H{"mobile": user.Mobile, "password": "Abc12345!", "device_id": "phone"}, "account_locked", 0},
+		{"otp right after the lock", "/otp/verify", gin.H{"mobile": user.Mobile, "otp": otp}, "account_locked", 0},
+		{"wrong otp locks again", "/otp/verify", gin.H{"mobile": user.Mobile, "otp": "000000"}, "account_locked", otpUnlockDelay},
+		{"otp after the relock", "/otp/verify", gin.H{"mobile": user.Mobile, "otp": otp}, "account_locked", 0},
+		{"unlocked by an otp", "/otp/verify", gin.H{"mobile": user.Mobile, "otp": otp}, "", otpUnlockDelay},
+		{"right password", "/login", gin.H{"mobile": user.Mobile, "password": "Abc12345!", "device_id": "phone"}, "", 0},
+		{"failures start over", "/login", gin.H{"mobile": user.Mobile, "password": "Wrong1234!", "device_id": "phone"}, "wrong_password", 0},
+		{"wrong otp", "/otp/verify", gin.H{"mobile": user.Mobile, "otp": "000000"}, "invalid_otp", 0},
+		{"locked by a wrong otp", "/otp/verify", gin.H{"mobile": user.Mobile, "otp": "000001"}, "account_locked", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.lockedAgo != 0 {
+				db.Model(&ebs_fields.User{}).Where("mobile = ?", user.Mobile).Update("locked_at", time.Now().Add(-tt.lockedAgo))
+			}
+			body, _ := json.Marshal(tt.body)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(body)))
+			var res map[string]any
+			json.Unmarshal(w.Body.Bytes(), &res)
+			if code, _ := res["code"].(string); (tt.wantCode == "" && w.Code != http.StatusOK) || (tt.wantCode != "" && code != tt.wantCode) {
+				t.Errorf("%s = %v, %s, want %q", tt.path, w.Code, w.Body.String(), tt.wantCode)
+			}
+		})
+	}
+}
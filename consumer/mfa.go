@@ -0,0 +1,211 @@
+package consumer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image/png"
+	"net/http"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// mfaIssuer names noebs in the authenticator apps
+const mfaIssuer = "noebs"
+
+type mfaCode struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// mfaChallenge starts the second step of the sign in of u, who has two-factor
+// authentication enabled, and writes the mfa_required response. The app sends
+// the mfa_token with a code to VerifyMFALogin to get the session.
+func (s *Service) mfaChallenge(c *gin.Context, u *ebs_fields.User, deviceID, publicKey string) {
+	deviceID, ok := signInDevice(c, deviceID)
+	if !ok {
+		return
+	}
+	token, challenge, err := ebs_fields.NewMFAChallenge(s.Db, u.Mobile, deviceID, publicKey, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusForbidden, gin.H{"message": "enter the code of your authenticator app, or a backup code",
+		"code": "mfa_required", "mfa_token": token, "expires_at": challenge.ExpiresAt})
+}
+
+// VerifyMFALogin ends a sign in that returned mfa_required with a code of the
+// user's authenticator app, or one of their backup codes.
+func (s *Service) VerifyMFALogin(c *gin.Context) {
+	var req struct {
+		MFAToken string `json:"mfa_token" binding:"required"`
+		Code     string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	now := time.Now()
+	challenge, err := ebs_fields.GetMFAChallenge(s.Db, req.MFAToken, now)
+	if errors.Is(err, ebs_fields.ErrMFAChallengeNotFound) {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error(), "code": "mfa_challenge_ended"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	u, err := ebs_fields.GetUserByMobile(challenge.Mobile, s.Db)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "not_found"})
+		return
+	}
+	if s.accountLocked(c, &u) {
+		return
+	}
+	if err := ebs_fields.VerifyMFA(s.Db, &u, req.Code, now); errors.Is(err, ebs_fields.ErrInvalidMFACode) {
+		if s.signInFailed(&u) {
+			s.accountLocked(c, &u)
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "invalid_mfa_code"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	if err := challenge.Done(s.Db); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	s.signInSucceeded(u.Mobile, false)
+
+	res, ok := s.deviceSession(c, &u, challenge.DeviceID, challenge.PublicKey)
+	if !ok {
+		return
+	}
+	res["user"] = u
+	c.JSON(http.StatusOK, res)
+}
+
+// MFA returns whether the user has two-factor authentication enabled, and how
+// many backup codes they have left.
+func (s *Service) MFA(c *gin.Context) {
+	u, err := ebs_fields.GetUserByMobile(c.GetString("mobile"), s.Db)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	left, err := ebs_fields.BackupCodesLeft(s.Db, u.Mobile)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": u.MFAEnabled, "backup_codes_left": left})
+}
+
+// EnrollMFA generates a new authenticator app secret for the user, as an
+// otpauth:// URI and its QR code. It is enabled by ConfirmMFA.
+func (s *Service) EnrollMFA(c *gin.Context) {
+	u, err := ebs_fields.GetUserByMobile(c.GetString("mobile"), s.Db)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	key, err := ebs_fields.EnrollTOTP(s.Db, &u, mfaIssuer)
+	if errors.Is(err, ebs_fields.ErrMFAEnabled) {
+		c.JSON(http.StatusConflict, gin.H{"message": err.Error(), "code": "mfa_enabled"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	res := gin.H{"secret": key.Secret(), "uri": key.URL()}
+	if img, err := key.Image(256, 256); err == nil {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err == nil {
+			res["qr"] = "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+		}
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// ConfirmMFA enables two-factor authentication with the first code of the
+// user's authenticator app, and returns their backup codes. They are only
+// shown once.
+func (s *Service) ConfirmMFA(c *gin.Context) {
+	var req mfaCode
+	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	u, err := ebs_fields.GetUserByMobile(c.GetString("mobile"), s.Db)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	codes, err := ebs_fields.ConfirmTOTP(s.Db, &u, req.Code, time.Now())
+	if !s.mfaError(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"backup_codes": codes})
+}
+
+// DisableMFA turns off two-factor authentication with a code of the user's
+// authenticator app or a backup code.
+func (s *Service) DisableMFA(c *gin.Context) {
+	var req mfaCode
+	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	u, err := ebs_fields.GetUserByMobile(c.GetString("mobile"), s.Db)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	if !s.mfaError(c, ebs_fields.DisableMFA(s.Db, &u, req.Code, time.Now())) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": "ok"})
+}
+
+// NewBackupCodes replaces the backup codes of the user, with a code of their
+// authenticator app or one of their current backup codes.
+func (s *Service) NewBackupCodes(c *gin.Context) {
+	var req mfaCode
+	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	u, err := ebs_fields.GetUserByMobile(c.GetString("mobile"), s.Db)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	codes, err := ebs_fields.NewBackupCodes(s.Db, &u, req.Code, time.Now())
+	if !s.mfaError(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"backup_codes": codes})
+}
+
+// mfaError writes the response of the two-factor authentication error err, it
+// returns true when there is none.
+func (s *Service) mfaError(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, ebs_fields.ErrInvalidMFACode):
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "invalid_mfa_code"})
+	case errors.Is(err, ebs_fields.ErrMFANotEnrolled):
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "mfa_not_enrolled"})
+	case errors.Is(err, ebs_fields.ErrMFAEnabled):
+		c.JSON(http.StatusConflict, gin.H{"message": err.Error(), "code": "mfa_enabled"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package consumer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adonese/noebs/apigateway"
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"github.com/pquerna/otp/totp"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+func TestService_LoginHandler_mfa(t *testing.T) {
+	db := openTestDB(t, &ebs_fields.User{}, &ebs_fields.Device{}, &ebs_fields.BackupCode{}, &ebs_fields.MFAChallenge{}, &gateway.Session{}, &gateway.RevokedToken{})
+	s := &Service{Db: db, Auth: &gateway.JWTAuth{Key: []byte("mfa test"), Db: db}, Logger: logrus.New(),
+		Limiter: &gateway.RateLimiter{}, NoebsConfig: ebs_fields.NoebsConfig{LoginMaxAttempts: 2}}
+	user := ebs_fields.User{Model: gorm.Model{ID: 1}, Mobile: "0912141679", Password: "Abc12345!", DeviceID: "phone"}
+	user.HashPassword()
+	db.Create(&user)
+	key, _ := ebs_fields.EnrollTOTP(db, &user, mfaIssuer)
+	code, _ := totp.GenerateCode(key.Secret(), time.Now().Add(-30*time.Second))
+	backup, err := ebs_fields.ConfirmTOTP(db, &user, code, time.Now().Add(-30*time.Second))
+	if err != nil {
+		t.Fatalf("ConfirmTOTP() error = %v", err)
+	}
+
+	r := gin.New()
+	r.POST("/login", s.LoginHandler)
+	r.POST("/mfa/login", s.VerifyMFALogin)
+	post := func(path string, body gin.H) (int, map[string]any) {
+		b, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(b)))
+		var res map[string]any
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res
+	}
+	login := func() string {
+		_, res := post("/login", gin.H{"mobile": user.Mobile, "password": "Abc12345!", "device_id": "phone"})
+		if res["code"] != "mfa_required" || res["authorization"] != nil {
+			t.Fatalf("LoginHandler() = %v, want an mfa_required challenge", res)
+		}
+		return res["mfa_token"].(string)
+	}
+
+	token := login()
+	now, _ := totp.GenerateCode(key.Secret(), time.Now())
+	tests := []struct {
+		name     string
+		token    string
+		code     string
+		wantCode string // empty for a session
+	}{
+		{"unknown challenge", "not a token", now, "mfa_challenge_ended"},
+		{"wrong code", token, "12345678", "invalid_mfa_code"},
+		{"app code", token, now, ""},
+		{"used challenge", token, now, "mfa_challenge_ended"},
+		{"backup code", login(), backup[0], ""},
+		{"used backup code", login(), backup[0], "invalid_mfa_code"},
+		// the wrong codes of the sign ins that followed the password count as failed sign ins
+		{"locked", login(), "12345678", "account_locked"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, res := post("/mfa/login", gin.H{"mfa_token": tt.token, "code": tt.code})
+			if code, _ := res["code"].(string); code != tt.wantCode || (tt.wantCode == "" && (status != http.StatusOK || res["authorization"] == nil)) {
+				t.Errorf("VerifyMFALogin() = %v, %v, want %q", status, res, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestService_signIn_mfa(t *testing.T) {
+	db := openTestDB(t, &ebs_fields.User{}, &ebs_fields.Card{}, &ebs_fields.Device{}, &ebs_fields.BackupCode{}, &ebs_fields.MFAChallenge{}, &gateway.Session{}, &gateway.RevokedToken{})
+	s := &Service{Db: db, Auth: &gateway.JWTAuth{Key: []byte("mfa test"), Db: db}, Logger: logrus.New(), EBSClient: &ebs_fields.FakeEBSClient{},
+		Limiter: &gateway.RateLimiter{}, NoebsConfig: ebs_fields.NoebsConfig{LoginMaxAttempts: 5}}
+	private, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der, _ := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	user := ebs_fields.User{Model: gorm.Model{ID: 1}, Mobile: "0912141679", Password: "Abc12345!", DeviceID: "phone", PublicKey: base64.StdEncoding.EncodeToString(der)}
+	user.HashPassword()
+	db.Create(&user)
+	db.Create(&ebs_fields.Card{Pan: "9222081700176714465", Expiry: "2302", UserID: user.ID})
+	key, _ := ebs_fields.EnrollTOTP(db, &user, mfaIssuer)
+	code, _ := totp.GenerateCode(key.Secret(), time.Now())
+	if _, err := ebs_fields.ConfirmTOTP(db, &user, code, time.Now()); err != nil {
+		t.Fatalf("ConfirmTOTP() error = %v", err)
+	}
+	otp, _ := totp.GenerateCode(user.EncodePublickey32(), time.Now())
+	hashed := sha256.Sum256([]byte(otp))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, private, crypto.SHA256, hashed[:])
+
+	r := gin.New()
+	r.POST("/login", s.LoginHandler)
+	r.POST("/otp/login", s.SingleLoginHandler)
+	r.POST("/otp/balance", s.BalanceStep)
+	tests := []struct {
+		name string
+		path string
+		body gin.H
+	}{
+		{"password", "/login", gin.H{"mobile": user.Mobile, "password": "Abc12345!", "device_id": "phone"}},
+		{"signed otp", "/otp/login", gin.H{"mobile": user.Mobile, "message": otp, "signature": base64.StdEncoding.EncodeToString(signature), "device_id": "phone"}},
+		{"card", "/otp/balance", gin.H{"mobile": user.Mobile, "PAN": "9222081700176714465", "IPIN": "0000", "device_id": "phone"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := json.Marshal(tt.body)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(b)))
+			var res map[string]any
+			json.Unmarshal(w.Body.Bytes(), &res)
+			if res["code"] != "mfa_required" || res["mfa_token"] == nil || res["authorization"] != nil {
+				t.Errorf("%s = %v, %v, want an mfa_required challenge", tt.path, w.Code, res)
+			}
+		})
+	}
+}
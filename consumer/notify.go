@@ -0,0 +1,362 @@
+package consumer
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	firebase "firebase.google.com/go/v4"
+	"firebase.google.com/go/v4/messaging"
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/adonese/noebs/redact"
+	"github.com/adonese/noebs/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Notification channels a user can choose from, see ebs_fields.User.NotificationChannel
+const (
+	ChannelPush = "push"
+	ChannelSMS  = "sms"
+	ChannelWS   = "ws"
+	ChannelNone = "none"
+)
+
+var (
+	errFirebaseNotConfigured = errors.New("firebase app is not configured")
+	errUserNotConnected      = errors.New("the user isn't connected to the notifications websocket")
+)
+
+// Notifier delivers a notification to a user. data.To holds the device token
+// and data.UserMobile (or data.Phone for non-noebs users) the mobile number.
+type Notifier interface {
+	Notify(ctx context.Context, data PushData) error
+}
+
+// FCMNotifier sends notifications through Firebase Cloud Messaging
+type FCMNotifier struct {
+	App *firebase.App
+}
+
+// Notify implements Notifier
+func (f *FCMNotifier) Notify(ctx context.Context, data PushData) error {
+	if f.App == nil {
+		return errFirebaseNotConfigured
+	}
+	client, err := f.App.Messaging(ctx)
+	if err != nil {
+		return err
+	}
+	// This is the same struct as PushData, but due to firebase api
+	// we had to make it in a map of string:any
+	firebaseData := map[string]string{
+		"type":           data.Type,
+		"time":           fmt.Sprint(data),
+		"uuid":           data.EBSData.UUID,
+		"call_to_action": data.CallToAction,
+	}
+	if data.PaymentRequest != (ebs_fields.QrData{}) { // If you get an error in Payment Request notifications this may be the reason.
+		if paymentRequest, err := json.Marshal(data.PaymentRequest); err == nil {
+			firebaseData["payment_request"] = string(paymentRequest)
+		}
+	}
+	message := &messaging.Message{
+		Token:        data.To, // This registration token comes from the client FCM SDKs.
+		Notification: &messaging.Notification{Title: data.Title, Body: data.Body},
+		Android:      &messaging.AndroidConfig{},
+		Webpush:      &messaging.WebpushConfig{},
+		APNS:         &messaging.APNSConfig{},
+		FCMOptions:   &messaging.FCMOptions{},
+		Data:         firebaseData,
+	}
+	_, err = client.Send(ctx, message)
+	return err
+}
+
+// SMSNotifier sends the notification title and body as an SMS
+type SMSNotifier struct {
+	Sender utils.SMSSender
+}
+
+// Notify implements Notifier
+func (n *SMSNotifier) Notify(ctx context.Context, data PushData) error {
+	mobile := data.UserMobile
+	if mobile == "" {
+		mobile = data.Phone
+	}
+	message := data.Body
+	if data.Title != "" {
+		message = data.Title + "\n" + data.Body
+	}
+	return n.Sender.Send(ctx, utils.SMS{Mobile: mobile, Message: message})
+}
+
+// WSNotifier delivers notifications to the websockets the user listens to
+// them on, see Service.NotificationsWS. The notifications of a user who isn't
+// connected are stored in the chats table of the chat hub, which delivers them
+// once the user connects to it.
+type WSNotifier struct {
+	Hub *NotificationHub
+	DB  *sql.DB // the database opened by chat.OpenDb
+}
+
+// Notify implements Notifier. Like the notifications kept for a retry, the
+// ones sent and stored here only carry the masked PAN.
+func (w *WSNotifier) Notify(ctx context.Context, data PushData) error {
+	if data.EBSData.PAN != "" {
+		data.EBSData.PAN = redact.PAN(data.EBSData.PAN)
+	}
+	if w.Hub != nil && w.Hub.Send(data.UserMobile, data) {
+		return nil
+	}
+	if w.DB == nil {
+		return errUserNotConnected
+	}
+	text, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = w.DB.ExecContext(ctx, `INSERT INTO chats("id", "from", "to", "text", "is_delivered", "date") VALUES(?, ?, ?, ?, 0, ?)`,
+		uuid.New().String(), "noebs", data.UserMobile, string(text), time.Now().Unix())
+	return err
+}
+
+// NotificationHub keeps the websockets the signed in users listen to their
+// notifications on.
+type NotificationHub struct {
+	mu    sync.Mutex
+	conns map[string][]*notificationConn
+}
+
+// notificationConn is a websocket of a user, its writes are serialized
+type notificationConn struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+// NewNotificationHub creates an empty NotificationHub
+func NewNotificationHub() *NotificationHub {
+	return &NotificationHub{conns: map[string][]*notificationConn{}}
+}
+
+// Send writes data to the websockets of mobile, and reports whether one of them got it
+func (h *NotificationHub) Send(mobile string, data PushData) bool {
+	h.mu.Lock()
+	conns := append([]*notificationConn(nil), h.conns[mobile]...)
+	h.mu.Unlock()
+	sent := false
+	for _, c := range conns {
+		c.mu.Lock()
+		c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		err := c.conn.WriteJSON(data)
+		c.mu.Unlock()
+		if err != nil {
+			// its reader stops and removes it
+			c.conn.Close()
+			continue
+		}
+		sent = true
+	}
+	return sent
+}
+
+func (h *NotificationHub) add(mobile string, c *notificationConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.conns[mobile] = append(h.conns[mobile], c)
+}
+
+func (h *NotificationHub) remove(mobile string, c *notificationConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	conns := h.conns[mobile][:0]
+	for _, conn := range h.conns[mobile] {
+		if conn != c {
+			conns = append(conns, conn)
+		}
+	}
+	if len(conns) == 0 {
+		delete(h.conns, mobile)
+		return
+	}
+	h.conns[mobile] = conns
+}
+
+var notificationUpgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
+
+// NotificationsWS upgrades the request to a websocket that receives the
+// notifications of the signed in user, when their channel is ChannelWS.
+func (s *Service) NotificationsWS(c *gin.Context) {
+	if s.NotificationHub == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "websocket notifications are not enabled", "code": "not_found"})
+		return
+	}
+	conn, err := notificationUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgrade wrote the error response
+		return
+	}
+	mobile := c.GetString("mobile")
+	nc := &notificationConn{conn: conn}
+	s.NotificationHub.add(mobile, nc)
+	defer func() {
+		s.NotificationHub.remove(mobile, nc)
+		conn.Close()
+	}()
+	// the client doesn't send anything, reading tells when it is gone
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// NoopNotifier drops notifications, it is used for users who opted out
+type NoopNotifier struct{}
+
+// Notify implements Notifier
+func (NoopNotifier) Notify(ctx context.Context, data PushData) error { return nil }
+
+// RecordingNotifier keeps notifications in memory, it is meant for tests
+type RecordingNotifier struct {
+	// Err is returned from Notify when it is set
+	Err error
+
+	mu   sync.Mutex
+	sent []PushData
+}
+
+// Notify implements Notifier
+func (r *RecordingNotifier) Notify(ctx context.Context, data PushData) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+	r.sent = append(r.sent, data)
+	return nil
+}
+
+// Sent returns the notifications delivered so far
+func (r *RecordingNotifier) Sent() []PushData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]PushData(nil), r.sent...)
+}
+
+// isValidChannel reports whether channel is one of the notification channels
+func isValidChannel(channel string) bool {
+	switch channel {
+	case ChannelPush, ChannelSMS, ChannelWS, ChannelNone:
+		return true
+	}
+	return false
+}
+
+// notifierFor returns the Notifier of channel, falling back to push notifications
+func (s *Service) notifierFor(channel string) Notifier {
+	if n, ok := s.Notifiers[channel]; ok {
+		return n
+	}
+	if n, ok := s.Notifiers[ChannelPush]; ok {
+		return n
+	}
+	return NoopNotifier{}
+}
+
+// NotificationRetry is a notification that couldn't be delivered. An empty
+// Channel means it never reached a Pusher worker and has to be dispatched again.
+type NotificationRetry struct {
+	gorm.Model
+	Channel     string
+	Payload     []byte
+	Attempts    int
+	NextAttempt time.Time `gorm:"index"`
+	LastError   string
+}
+
+const (
+	notificationRetryInterval = 30 * time.Second
+	maxNotificationRetryDelay = time.Hour
+	// maxNotificationAttempts is how many times we retry before dropping a notification
+	maxNotificationAttempts = 6
+)
+
+// notificationBackoff returns the delay before the next attempt: 30s, 1m, 2m... capped at an hour
+func notificationBackoff(attempts int) time.Duration {
+	delay := notificationRetryInterval << attempts
+	if delay <= 0 || delay > maxNotificationRetryDelay {
+		return maxNotificationRetryDelay
+	}
+	return delay
+}
+
+// scheduleRetry stores data to be sent again through channel. The clear PAN
+// dispatch finds the user with isn't stored: the user is found now instead.
+func (s *Service) scheduleRetry(channel string, data PushData, cause error) {
+	if channel == "" && data.Phone == "" && data.UserMobile == "" {
+		user, err := ebs_fields.GetUserByCard(data.EBSData.PAN, s.Db)
+		if err != nil {
+			s.Logger.Printf("error finding user: %v", err)
+			return
+		}
+		data.UserMobile = user.Mobile
+	}
+	if data.EBSData.PAN != "" {
+		data.EBSData.PAN = redact.PAN(data.EBSData.PAN)
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	retry := NotificationRetry{Channel: channel, Payload: payload, NextAttempt: time.Now().Add(notificationBackoff(0)), LastError: cause.Error()}
+	if err := s.Db.Create(&retry).Error; err != nil {
+		s.Logger.WithFields(logrus.Fields{
+			"code":    err.Error(),
+			"details": "Error in writing to Database",
+		}).Error("unable to queue notification")
+	}
+}
+
+// retryNotifications resends the notifications that are due at now
+func (s *Service) retryNotifications(ctx context.Context, now time.Time) {
+	var retries []NotificationRetry
+	if err := s.Db.Where("next_attempt <= ?", now).Find(&retries).Error; err != nil {
+		s.Logger.WithFields(logrus.Fields{"code": "notification_error", "message": err.Error()}).Error("unable to load notification retries")
+		return
+	}
+	for _, r := range retries {
+		var data PushData
+		if err := json.Unmarshal(r.Payload, &data); err != nil {
+			s.Db.Unscoped().Delete(&r)
+			continue
+		}
+		if r.Channel == "" {
+			s.Db.Unscoped().Delete(&r)
+			s.dispatch(ctx, data)
+			continue
+		}
+		err := s.notifierFor(r.Channel).Notify(ctx, data)
+		r.Attempts++
+		if err == nil || r.Attempts >= maxNotificationAttempts {
+			if err != nil {
+				s.Logger.WithFields(logrus.Fields{"code": "notification_error", "channel": r.Channel, "message": err.Error()}).Error("giving up on notification")
+			}
+			s.Db.Unscoped().Delete(&r)
+			continue
+		}
+		s.Db.Model(&r).Updates(map[string]any{
+			"attempts":     r.Attempts,
+			"next_attempt": now.Add(notificationBackoff(r.Attempts)),
+			"last_error":   err.Error(),
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/adonese/noebs/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+func TestService_dispatch(t *testing.T) {
+	db := openTestDB(t, &ebs_fields.User{}, &PushData{}, &NotificationRetry{}, &ebs_fields.Device{})
+	db.Create(&ebs_fields.User{Mobile: "0912141679", DeviceID: "device-push"})
+	db.Create(&ebs_fields.User{Mobile: "0912141680", DeviceID: "device-sms", NotificationChannel: ChannelSMS})
+	db.Create(&ebs_fields.User{Mobile: "0912141681", DeviceID: "device-none", NotificationChannel: ChannelNone})
+	db.Create(&ebs_fields.User{Mobile: "0912141682", DeviceID: "device-old"})
+	db.Create(&[]ebs_fields.Device{
+		{UserMobile: "0912141682", DeviceID: "phone", PushToken: "phone-token", Trusted: true},
+		{UserMobile: "0912141682", DeviceID: "tablet", PushToken: "tablet-token", Trusted: true},
+		{UserMobile: "0912141682", DeviceID: "laptop", PushToken: "laptop-token"},
+	})
+
+	tests := []struct {
+		name     string
+		data     PushData
+		wantPush int
+		wantSMS  int
+	}{
+		{"default channel is push", PushData{UUID: "1", Phone: "0912141679"}, 1, 0},
+		{"user prefers sms", PushData{UUID: "2", Phone: "0912141680"}, 0, 1},
+		{"user opted out", PushData{UUID: "3", Phone: "0912141681"}, 0, 0},
+		{"sender is notified too", PushData{UUID: "4", Phone: "0912141681", DeviceID: "sender"}, 1, 0},
+		{"not a noebs user", PushData{UUID: "5", Phone: "0911111111"}, 0, 1},
+		{"trusted devices", PushData{UUID: "6", Phone: "0912141682"}, 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			push, sms := &RecordingNotifier{}, &RecordingNotifier{}
+			s := &Service{Db: db, Logger: logrus.New(), Notifiers: map[string]Notifier{
+				ChannelPush: push,
+				ChannelSMS:  sms,
+				ChannelNone: NoopNotifier{},
+			}}
+			s.dispatch(context.Background(), tt.data)
+			if got := len(push.Sent()); got != tt.wantPush {
+				t.Errorf("dispatch() push notifications = %v, want %v", got, tt.wantPush)
+			}
+			if got := len(sms.Sent()); got != tt.wantSMS {
+				t.Errorf("dispatch() sms notifications = %v, want %v", got, tt.wantSMS)
+			}
+		})
+	}
+}
+
+func TestService_retryNotifications(t *testing.T) {
+	db := openTestDB(t, &ebs_fields.User{}, &PushData{}, &NotificationRetry{})
+	db.Create(&ebs_fields.User{Mobile: "0912141679", DeviceID: "device"})
+	push := &RecordingNotifier{Err: errors.New("fcm is down")}
+	s := &Service{Db: db, Logger: logrus.New(), Notifiers: map[string]Notifier{ChannelPush: push}}
+
+	s.dispatch(context.Background(), PushData{UUID: "1", Phone: "0912141679"})
+	var retry NotificationRetry
+	if err := db.First(&retry).Error; err != nil {
+		t.Fatalf("dispatch() didn't queue the failed notification: %v", err)
+	}
+
+	now := time.Now()
+	s.retryNotifications(context.Background(), now) // not due yet
+	s.retryNotifications(context.Background(), now.Add(time.Minute))
+	db.First(&retry)
+	if retry.Attempts != 1 || retry.LastError != "fcm is down" {
+		t.Errorf("retryNotifications() attempts = %v, last error = %q", retry.Attempts, retry.LastError)
+	}
+
+	push.Err = nil
+	s.retryNotifications(context.Background(), now.Add(time.Hour))
+	var count int64
+	db.Model(&NotificationRetry{}).Count(&count)
+	if count != 0 || len(push.Sent()) != 1 {
+		t.Errorf("retryNotifications() left %v retries and sent %v notifications", count, len(push.Sent()))
+	}
+}
+
+func TestService_scheduleRetry(t *testing.T) {
+	db := openTestDB(t, &ebs_fields.User{}, &ebs_fields.Card{}, &PushData{}, &NotificationRetry{})
+	db.Create(&ebs_fields.User{Model: gorm.Model{ID: 1}, Mobile: "0912141679", DeviceID: "device"})
+	db.Create(&ebs_fields.Card{Pan: "9222081700176714465", Expiry: "2302", UserID: 1})
+	push := &RecordingNotifier{}
+	s := &Service{Db: db, Logger: logrus.New(), Notifiers: map[string]Notifier{ChannelPush: push}}
+
+	// the notification queue was full, and then the push failed
+	data := PushData{UUID: "1", Title: "Card Transfer", EBSData: ebs_fields.EBSResponse{PAN: "9222081700176714465"}}
+	s.scheduleRetry("", data, errors.New("notification queue is full"))
+	s.scheduleRetry(ChannelPush, data, errors.New("fcm is down"))
+
+	var retries []NotificationRetry
+	db.Find(&retries)
+	for _, r := range retries {
+		if bytes.Contains(r.Payload, []byte("9222081700176714465")) {
+			t.Errorf("scheduleRetry() stored the pan: %s", r.Payload)
+		}
+	}
+	s.retryNotifications(context.Background(), time.Now().Add(time.Hour))
+	if sent := push.Sent(); len(sent) != 2 || sent[0].UserMobile != "0912141679" || sent[0].To != "device" {
+		t.Errorf("retryNotifications() sent %+v", sent)
+	}
+}
+
+func TestWSNotifier_Notify(t *testing.T) {
+	hub := NewNotificationHub()
+	s := &Service{NotificationHub: hub}
+	r := gin.New()
+	r.GET("/notifications/ws", func(c *gin.Context) { c.Set("mobile", "0912141679") }, s.NotificationsWS)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/notifications/ws", nil)
+	if err != nil {
+		t.Fatalf("unable to connect: %v", err)
+	}
+	defer conn.Close()
+	n := &WSNotifier{Hub: hub}
+	// the handler registers the connection once it is upgraded
+	data := PushData{UserMobile: "0912141679", Title: "Card Transfer"}
+	data.EBSData.PAN = "9222081700176714465"
+	for i := 0; i < 100 && n.Notify(context.Background(), data) != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var got PushData
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err := conn.ReadJSON(&got); err != nil || got.Title != "Card Transfer" || got.EBSData.PAN != "922208*****4465" {
+		t.Errorf("WSNotifier.Notify() delivered %+v, %v", got, err)
+	}
+	if err := n.Notify(context.Background(), PushData{UserMobile: "0912141680"}); err != errUserNotConnected {
+		t.Errorf("WSNotifier.Notify() to a user who isn't connected = %v, want %v", err, errUserNotConnected)
+	}
+}
+
+func TestSMSNotifier_Notify(t *testing.T) {
+	sender := &utils.MemorySMS{}
+	n := &SMSNotifier{Sender: sender}
+	n.Notify(context.Background(), PushData{Phone: "0912141679", Title: "Payment Success", Body: "You have received 10 SDG"})
+	got := sender.Messages()
+	if len(got) != 1 || got[0].Mobile != "0912141679" || got[0].Message != "Payment Success\nYou have received 10 SDG" {
+		t.Errorf("SMSNotifier.Notify() sent %+v", got)
+	}
+}
+
+func TestFCMNotifier_Notify(t *testing.T) {
+	if err := (&FCMNotifier{}).Notify(context.Background(), PushData{}); err != errFirebaseNotConfigured {
+		t.Errorf("FCMNotifier.Notify() error = %v, want %v", err, errFirebaseNotConfigured)
+	}
+}
@@ -0,0 +1,148 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/adonese/noebs/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// RequestPasswordReset texts an otp to the user to reset their password with
+// (see PasswordResetOTP). It answers the same whether the user exists or not.
+func (s *Service) RequestPasswordReset(c *gin.Context) {
+	var req struct {
+		Mobile string `json:"mobile" binding:"required"`
+	}
+	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	if user, err := ebs_fields.GetUserByMobile(req.Mobile, s.Db); err == nil {
+		if key, err := user.GenerateOtp(); err == nil && s.SMS != nil {
+			s.sendSMS(utils.SMS{Mobile: user.Mobile, Message: fmt.Sprintf("Your code to reset your password is: %s. DON'T share it with anyone.", key)})
+		}
+	}
+	c.JSON(http.StatusAccepted, gin.H{"result": "ok", "message": "verify the otp sent to your mobile, or one of your cards, to reset your password"})
+}
+
+// PasswordResetOTP issues a reset ticket to a user who verified the otp of
+// RequestPasswordReset. Wrong otps count as failed sign ins, see signInFailed.
+func (s *Service) PasswordResetOTP(c *gin.Context) {
+	var req struct {
+		Mobile string `json:"mobile" binding:"required"`
+		OTP    string `json:"otp" binding:"required"`
+	}
+	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	user, err := ebs_fields.GetUserByMobile(req.Mobile, s.Db)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid otp", "code": "invalid_otp"})
+		return
+	}
+	if s.accountLocked(c, &user) {
+		return
+	}
+	ok, err := user.UseOtp(s.Db, req.OTP, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": serverError.Error(), "code": "database_error"})
+		return
+	}
+	if !ok {
+		if s.signInFailed(&user) {
+			s.accountLocked(c, &user)
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid otp", "code": "invalid_otp"})
+		return
+	}
+	s.resetTicket(c, user.Mobile, "otp")
+}
+
+// PasswordResetCard issues a reset ticket to a user who proved they have one
+// of their cards, the same way as BalanceStep.
+func (s *Service) PasswordResetCard(c *gin.Context) {
+	var req struct {
+		ebs_fields.ConsumerBalanceFields
+		Mobile string `json:"mobile"`
+	}
+	// the card is checked at EBS, which sets the fields noebs fills in
+	c.ShouldBindWith(&req, binding.JSON)
+	if req.Mobile == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Mobile number was not sent", "code": "bad_request"})
+		return
+	}
+	user, err := ebs_fields.NewUserWithCards(req.Mobile, s.Db)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "no matching card was found", "code": "card_not_matched"})
+		return
+	}
+	if s.accountLocked(c, user) {
+		return
+	}
+	if !s.cardChallenge(c, user, req.ConsumerBalanceFields) {
+		return
+	}
+	s.resetTicket(c, user.Mobile, "card")
+}
+
+// resetTicket writes a new reset ticket of mobile
+func (s *Service) resetTicket(c *gin.Context, mobile, method string) {
+	token, ticket, err := ebs_fields.NewResetTicket(s.Db, mobile, method, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"reset_ticket": token, "expires_at": ticket.ExpiresAt})
+}
+
+// ResetPassword sets the new password of the user of a reset ticket. It signs
+// every device of the user out and unlocks their account.
+func (s *Service) ResetPassword(c *gin.Context) {
+	var req struct {
+		ResetTicket string `json:"reset_ticket" binding:"required"`
+		NewPassword string `json:"new_password" binding:"required"`
+	}
+	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	// the ticket is kept for another try with a valid password
+	if !validatePassword(req.NewPassword) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Password must be at least 8 characters long, and must include at least one capital letter, one symbol and one number", "code": "password_invalid"})
+		return
+	}
+	ticket, err := ebs_fields.UseResetTicket(s.Db, req.ResetTicket, time.Now())
+	if errors.Is(err, ebs_fields.ErrInvalidResetTicket) {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error(), "code": "invalid_reset_ticket"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), 8)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "internal_error"})
+		return
+	}
+	err = s.Db.Model(&ebs_fields.User{}).Where("mobile = ?", ticket.Mobile).
+		Updates(map[string]any{"password": string(hashedPassword), "is_password_otp": false}).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	s.signInSucceeded(ticket.Mobile, true)
+	if err := s.Auth.RevokeSessions(ticket.Mobile); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "session_error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": "ok"})
+	s.Auth.AuditUser(c, ticket.Mobile, "password_reset")
+}
@@ -0,0 +1,94 @@
+package consumer
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/adonese/noebs/apigateway"
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+func TestService_ResetPassword(t *testing.T) {
+	db := openTestDB(t, &ebs_fields.User{}, &ebs_fields.Device{}, &ebs_fields.ResetTicket{}, &gateway.Session{}, &gateway.RevokedToken{}, &gateway.AuditLog{})
+	jwtAuth := &gateway.JWTAuth{Key: []byte("reset test"), Db: db}
+	s := &Service{Db: db, Auth: jwtAuth, Logger: logrus.New(), Limiter: &gateway.RateLimiter{}, NoebsConfig: ebs_fields.NoebsConfig{LoginMaxAttempts: 3}}
+	user := ebs_fields.User{Model: gorm.Model{ID: 1}, Mobile: "0912141679", Password: "Abc12345!", DeviceID: "phone", PublicKey: "MFwwDQYJKoZIhvcNAQEBBQADSwAwSAJBANx4gKYSMv3CrWWsxdPfxDxFvl"}
+	user.HashPassword()
+	db.Create(&user)
+	session, _ := jwtAuth.NewSession(user.Mobile, "phone", "test", "127.0.0.1")
+	otp, _ := user.GenerateOtp()
+
+	r := gin.New()
+	r.POST("/password/reset/otp", s.PasswordResetOTP)
+	r.POST("/password/reset", s.ResetPassword)
+	r.POST("/login", s.LoginHandler)
+	post := func(path string, body gin.H) (int, map[string]any) {
+		b, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(b)))
+		var res map[string]any
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res
+	}
+
+	if code, res := post("/password/reset/otp", gin.H{"mobile": user.Mobile, "otp": "000000"}); code != http.StatusBadRequest {
+		t.Errorf("PasswordResetOTP() with a wrong otp = %v, %v", code, res)
+	}
+	_, res := post("/password/reset/otp", gin.H{"mobile": user.Mobile, "otp": otp})
+	ticket, _ := res["reset_ticket"].(string)
+	if ticket == "" {
+		t.Fatalf("PasswordResetOTP() = %v, want a reset ticket", res)
+	}
+	if code, res := post("/password/reset/otp", gin.H{"mobile": user.Mobile, "otp": otp}); res["code"] != "invalid_otp" {
+		t.Errorf("PasswordResetOTP() with a used otp = %v, %v", code, res)
+	}
+	db.Model(&ebs_fields.User{}).Where("mobile = ?", user.Mobile).Update("locked_at", user.CreatedAt)
+
+	tests := []struct {
+		name     string
+		path     string
+		body     gin.H
+		wantCode string // empty for a success
+	}{
+		{"weak password", "/password/reset", gin.H{"reset_ticket": ticket, "new_password": "password"}, "password_invalid"},
+		{"reset", "/password/reset", gin.H{"reset_ticket": ticket, "new_password": "Xyz98765!"}, ""},
+		{"used ticket", "/password/reset", gin.H{"reset_ticket": ticket, "new_password": "Xyz98765?"}, "invalid_reset_ticket"},
+		{"old password", "/login", gin.H{"mobile": user.Mobile, "password": "Abc12345!", "device_id": "phone"}, "wrong_password"},
+		// the reset unlocked the account too
+		{"new password", "/login", gin.H{"mobile": user.Mobile, "password": "Xyz98765!", "device_id": "phone"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, res := post(tt.path, tt.body)
+			if code, _ := res["code"].(string); code != tt.wantCode || (tt.wantCode == "" && status != http.StatusOK) {
+				t.Errorf("%s = %v, %v, want %q", tt.path, status, res, tt.wantCode)
+			}
+		})
+	}
+
+	claims, _ := jwtAuth.VerifyJWT(session.AccessToken)
+	if !jwtAuth.IsRevoked(claims.Id) {
+		t.Errorf("ResetPassword() kept the sessions of the user")
+	}
+	var audit gateway.AuditLog
+	if err := db.Where("mobile = ? AND event = ?", user.Mobile, "password_reset").First(&audit).Error; err != nil || audit.Status != http.StatusOK {
+		t.Errorf("ResetPassword() audit log = %+v, %v", audit, err)
+	}
+
+	// wrong otps lock the account like wrong passwords do
+	for i, want := range []string{"invalid_otp", "invalid_otp", "account_locked"} {
+		if _, res := post("/password/reset/otp", gin.H{"mobile": user.Mobile, "otp": "000000"}); res["code"] != want {
+			t.Errorf("PasswordResetOTP() with wrong otp #%d = %v, want %q", i+1, res, want)
+		}
+	}
+	otp, _ = user.GenerateOtp()
+	if _, res := post("/password/reset/otp", gin.H{"mobile": user.Mobile, "otp": otp}); res["code"] != "account_locked" {
+		t.Errorf("PasswordResetOTP() of a locked account = %v", res)
+	}
+}
@@ -87,14 +87,16 @@ import (
 	"time"
 
 	firebase "firebase.google.com/go/v4"
+	gateway "github.com/adonese/noebs/apigateway"
 	"github.com/adonese/noebs/ebs_fields"
+	"github.com/adonese/noebs/redact"
 	"github.com/adonese/noebs/utils"
+	"github.com/adonese/noebs/webhook"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 	"github.com/go-playground/validator/v10"
 	"github.com/go-redis/redis/v7"
 	"github.com/google/uuid"
-	"github.com/noebs/ipin"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
@@ -110,6 +112,18 @@ type Service struct {
 	Logger      *logrus.Logger
 	FirebaseApp *firebase.App
 	Auth        Auther
+	EBSClient   ebs_fields.EBSClient
+	SMS         utils.SMSSender
+	Tokens      *ebs_fields.TokenCodec
+	Webhooks    *webhook.Service
+	// Notifiers maps a notification channel (ChannelPush, ChannelSMS, ...) to its backend
+	Notifiers map[string]Notifier
+	// NotificationHub has the websockets of the users notified through ChannelWS
+	NotificationHub *NotificationHub
+	// KYCStore keeps the images of the KYCs
+	KYCStore ebs_fields.KYCStore
+	// Limiter counts the failed sign ins that lock accounts
+	Limiter *gateway.RateLimiter
 }
 
 var fees = ebs_fields.NewDynamicFeesWithDefaults()
@@ -144,8 +158,8 @@ func (s *Service) Purchase(c *gin.Context) {
 			c.AbortWithStatusJSON(http.StatusBadRequest, ebs_fields.ErrorResponse{ErrorDetails: er})
 		}
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 		res.Name = s.ToDatabasename(url)
 		username, _ := utils.GetOrDefault(c.Keys, "username", "anon")
 		utils.SaveRedisList(s.Redis, username+":all_transactions", &res)
@@ -205,8 +219,8 @@ func (s *Service) IsAlive(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		//// mask the pan
 		res.MaskPAN()
@@ -271,8 +285,8 @@ func (s *Service) BillPayment(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		res.MaskPAN()
 
@@ -324,11 +338,12 @@ func (s *Service) BillPayment(c *gin.Context) {
 			data.Title = "Payment Failure"
 			data.EBSData.PAN = fields.Pan // Changing the masked PAN with the unmasked one.
 			data.Body = fmt.Sprintf("Payment failed due to: %v.", res.ResponseMessage)
-			tranData <- data
+			s.enqueuePush(data)
 
 			payload := ebs_fields.ErrorDetails{Code: res.ResponseCode, Status: ebs_fields.EBSError, Details: res, Message: ebs_fields.EBSError}
 			c.JSON(code, payload)
 		} else {
+			s.publish(c.GetString("mobile"), webhook.BillPaid, webhookTransaction(res.EBSResponse))
 			// This is for push notifications (success)
 			data.Title = "Payment Success"
 			data.EBSData.PAN = fields.Pan // Changing the masked PAN with the unmasked one.
@@ -339,7 +354,7 @@ func (s *Service) BillPayment(c *gin.Context) {
 				phone := "0" + res.PaymentInfo[7:]
 				data.Phone = phone
 				data.Body = fmt.Sprintf("You have received %v %v on your phone: %v.", res.TranAmount, res.AccountCurrency, phone)
-				tranData <- data
+				s.enqueuePush(data)
 				data.Body = fmt.Sprintf("You have sent %v %v to phone: %v successfully.", res.TranAmount, res.AccountCurrency, phone)
 				data.Phone = ""
 			case "0010030002": // mohe
@@ -349,7 +364,7 @@ func (s *Service) BillPayment(c *gin.Context) {
 				phone := strings.Split(res.PaymentInfo, "/")[1][10:]
 				data.Phone = phone
 				data.Body = fmt.Sprintf("%v %v has been paid successfully for Education.", res.TranAmount, res.AccountCurrency)
-				tranData <- data
+				s.enqueuePush(data)
 				data.Phone = ""
 			case "0010030003": // Customs
 				data.Body = fmt.Sprintf("%v %v has been paid successfully for Customs.", res.TranAmount, res.AccountCurrency)
@@ -360,7 +375,7 @@ func (s *Service) BillPayment(c *gin.Context) {
 				data.Body = fmt.Sprintf("%v %v has been paid successfully for Electricity Meter No. %v", res.TranAmount, res.AccountCurrency, meter)
 			}
 
-			tranData <- data
+			s.enqueuePush(data)
 
 			c.JSON(code, gin.H{"ebs_response": res})
 		}
@@ -384,7 +399,7 @@ func (s *Service) GetBills(c *gin.Context) {
 	fields.UUID = uid.String()
 	updatePaymentInfo(&fields, b)
 	fields.PayeeId = b.PayeeID
-	ipinBlock, err := ipin.Encrypt(s.NoebsConfig.EBSConsumerKey, s.NoebsConfig.BillInquiryIPIN, uid.String())
+	ipinBlock, err := encryptIPIN(s.NoebsConfig.EBSConsumerKey, s.NoebsConfig.BillInquiryIPIN, uid.String())
 	if err != nil {
 		s.Logger.Printf("error in encryption: %v", err)
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"code": "bad_request", "message": err.Error()})
@@ -406,8 +421,8 @@ func (s *Service) GetBills(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, ebs_fields.ErrorResponse{ErrorDetails: er})
 	}
 	// the only part left is fixing EBS errors. Formalizing them per se.
-	code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-	s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+	code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+	s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 	// mask the pan
 	res.MaskPAN()
 	res.Name = s.ToDatabasename(url)
@@ -481,7 +496,7 @@ func (s *Service) RegisterWithCard(c *gin.Context) {
 		user.UpsertCards([]ebs_fields.Card{ucard})
 	}
 	c.JSON(http.StatusOK, gin.H{"result": "ok"})
-	go utils.SendSMS(&s.NoebsConfig, utils.SMS{Mobile: card.Mobile, Message: fmt.Sprintf("Your one-time access code is: %s. DON'T share it with anyone.", key)})
+	s.sendSMS(utils.SMS{Mobile: card.Mobile, Message: fmt.Sprintf("Your one-time access code is: %s. DON'T share it with anyone.", key)})
 }
 
 // BillerID retrieves a billerID from noebs and performs an ebs request
@@ -535,8 +550,8 @@ func (s *Service) BillInquiry(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		// mask the pan
 		res.MaskPAN()
@@ -590,8 +605,8 @@ func (s *Service) Balance(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		res.Name = s.ToDatabasename(url)
 		username, _ := utils.GetOrDefault(c.Keys, "username", "anon")
@@ -632,8 +647,8 @@ func (s *Service) TransactionStatus(c *gin.Context) {
 			c.AbortWithStatusJSON(http.StatusBadRequest, ebs_fields.ErrorResponse{ErrorDetails: er})
 		}
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 		res.Name = s.ToDatabasename(url)
 		s.Db.Table("transactions").Create(&res.EBSResponse)
 		if ebsErr != nil {
@@ -704,8 +719,8 @@ func (s *Service) WorkingKey(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		// mask the pan
 		res.MaskPAN()
@@ -760,6 +775,11 @@ func (s *Service) CardTransfer(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, ebs_fields.ErrorResponse{ErrorDetails: payload})
 
 	case nil:
+		sender, reservation, ok := s.checkLimits(c, fields.Pan, s.ToDatabasename(url), fields.TranAmount)
+		if !ok {
+			return
+		}
+		defer s.releaseLimits(reservation)
 		fields.ApplicationId = s.NoebsConfig.ConsumerID
 		fields.DynamicFees = fees.CardTransferfees
 		deviceID := fields.DeviceID
@@ -772,8 +792,8 @@ func (s *Service) CardTransfer(c *gin.Context) {
 		jsonBuffer := fields.MustMarshal()
 		s.Logger.Printf("the request is: %v", string(jsonBuffer))
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		// mask the pan
 		res.MaskPAN()
@@ -784,6 +804,8 @@ func (s *Service) CardTransfer(c *gin.Context) {
 
 		res.EBSResponse.SenderPAN = utils.MaskPAN(fields.Pan)
 		res.EBSResponse.ReceiverPAN = utils.MaskPAN(fields.ToCard)
+		res.EBSResponse.Mobile = sender
+		res.EBSResponse.SenderPANHash = ebs_fields.HashPAN(fields.Pan)
 
 		if err := s.Db.Table("transactions").Create(&res.EBSResponse); err != nil {
 			logrus.WithFields(logrus.Fields{
@@ -807,7 +829,7 @@ func (s *Service) CardTransfer(c *gin.Context) {
 			// This is for push notifications (sender)
 			data.EBSData.PAN = fields.Pan
 			data.Body = fmt.Sprintf("Card Transfer failed due to: %v.", res.ResponseMessage)
-			tranData <- data
+			s.enqueuePush(data)
 
 			c.JSON(code, payload)
 		} else {
@@ -815,12 +837,12 @@ func (s *Service) CardTransfer(c *gin.Context) {
 			data.EBSData.PAN = fields.ToCard
 
 			data.Body = fmt.Sprintf("You have received %v %v from %v.", fields.TranAmount, res.AccountCurrency, res.PAN)
-			tranData <- data
+			s.enqueuePush(data)
 
 			// This is for push notifications (sender)
 			data.EBSData.PAN = fields.Pan
 			data.Body = fmt.Sprintf("%v %v has been transferred successfully from your account to %v.", fields.TranAmount, res.AccountCurrency, res.ToCard)
-			tranData <- data
+			s.enqueuePush(data)
 
 			c.JSON(code, gin.H{"ebs_response": res})
 		}
@@ -860,8 +882,8 @@ func (s *Service) CashIn(c *gin.Context) {
 		fields.ApplicationId = s.NoebsConfig.ConsumerID
 		jsonBuffer := fields.MustMarshal() // this part basically gets us into trouble
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		// mask the pan
 		res.MaskPAN()
@@ -919,8 +941,8 @@ func (s *Service) QRMerchantRegistration(c *gin.Context) {
 		fields.ApplicationId = s.NoebsConfig.ConsumerID
 		jsonBuffer, _ := json.Marshal(fields) // this part basically gets us into trouble
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		// mask the pan
 		res.MaskPAN()
@@ -978,8 +1000,8 @@ func (s *Service) CashOut(c *gin.Context) {
 		fields.ApplicationId = s.NoebsConfig.ConsumerID
 		jsonBuffer := fields.MustMarshal()
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		// mask the pan
 		res.MaskPAN()
@@ -1033,8 +1055,8 @@ func (s *Service) AccountTransfer(c *gin.Context) {
 		fields.ApplicationId = s.NoebsConfig.ConsumerID
 		jsonBuffer, _ := json.Marshal(fields)
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		// mask the pan
 		res.MaskPAN()
@@ -1095,8 +1117,8 @@ func (s *Service) IPinChange(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		// mask the pan
 		res.MaskPAN()
@@ -1156,8 +1178,8 @@ func (s *Service) Status(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 		// mask the pan
 		res.MaskPAN()
 		res.Name = s.ToDatabasename(url)
@@ -1213,8 +1235,8 @@ func (s *Service) QRPayment(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		// mask the pan
 		res.MaskPAN()
@@ -1270,8 +1292,8 @@ func (s *Service) QRTransactions(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		// mask the pan
 		res.MaskPAN()
@@ -1334,8 +1356,8 @@ func (s *Service) QRRefund(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		// mask the pan
 		res.MaskPAN()
@@ -1395,8 +1417,8 @@ func (s *Service) QRComplete(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		// mask the pan
 		res.MaskPAN()
@@ -1456,8 +1478,8 @@ func (s *Service) QRGeneration(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		// mask the pan
 		res.MaskPAN()
@@ -1516,9 +1538,8 @@ func (s *Service) GenerateIpin(c *gin.Context) {
 
 		uid, _ := uuid.NewRandom()
 		// encrypt the password here
-		s.Logger.Printf("ipin password is: %v", s.NoebsConfig.EBSIPINPassword)
 
-		ipinBlock, err := ipin.Encrypt(s.NoebsConfig.EBSIpinKey, s.NoebsConfig.EBSIPINPassword, uid.String())
+		ipinBlock, err := encryptIPIN(s.NoebsConfig.EBSIpinKey, s.NoebsConfig.EBSIPINPassword, uid.String())
 		if err != nil {
 			s.Logger.Printf("error in encryption: %v", err)
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"code": "bad_request", "message": err.Error()})
@@ -1535,8 +1556,8 @@ func (s *Service) GenerateIpin(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		// mask the pan
 		res.MaskPAN()
@@ -1576,11 +1597,10 @@ func (s *Service) CompleteIpin(c *gin.Context) {
 	var fields = ebs_fields.ConsumerGenerateIPinCompletion{}
 
 	c.ShouldBindBodyWith(&fields, binding.JSON)
-	s.Logger.Printf("ipin password is: %v", s.NoebsConfig.EBSIPINPassword)
 	uid, _ := uuid.NewRandom()
-	passwordBlock, _ := ipin.Encrypt(s.NoebsConfig.EBSIpinKey, s.NoebsConfig.EBSIPINPassword, uid.String())
-	ipinBlock, _ := ipin.Encrypt(s.NoebsConfig.EBSIpinKey, fields.Ipin, uid.String())
-	otp, _ := ipin.Encrypt(s.NoebsConfig.EBSIpinKey, fields.Otp, uid.String())
+	passwordBlock, _ := encryptIPIN(s.NoebsConfig.EBSIpinKey, s.NoebsConfig.EBSIPINPassword, uid.String())
+	ipinBlock, _ := encryptIPIN(s.NoebsConfig.EBSIpinKey, fields.Ipin, uid.String())
+	otp, _ := encryptIPIN(s.NoebsConfig.EBSIpinKey, fields.Otp, uid.String())
 	fields.Password = passwordBlock
 	fields.Ipin = ipinBlock
 	fields.Otp = otp
@@ -1596,8 +1616,8 @@ func (s *Service) CompleteIpin(c *gin.Context) {
 	}
 
 	// the only part left is fixing EBS errors. Formalizing them per se.
-	code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-	s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+	code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+	s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 	// mask the pan
 	res.MaskPAN()
 
@@ -1652,8 +1672,8 @@ func (s *Service) IPINKey(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		// mask the pan
 		res.MaskPAN()
@@ -1684,7 +1704,8 @@ func (s *Service) IPINKey(c *gin.Context) {
 }
 
 // GeneratePaymentToken is used by noebs user to charge their customers.
-// the toCard field in `Token` uses a masked PAN (first 6 digits and last 4 digits and any number of * in between)
+// The card to be paid is one of the user's cards, referenced by card_ref or by a masked PAN in toCard
+// (first 6 digits and last 4 digits and any number of * in between).
 func (s *Service) GeneratePaymentToken(c *gin.Context) {
 	var token ebs_fields.Token
 	mobile := c.GetString("mobile")
@@ -1695,11 +1716,11 @@ func (s *Service) GeneratePaymentToken(c *gin.Context) {
 		return
 	}
 
-	if len(user.Cards) < 1 && token.ToCard == "" {
+	if len(user.Cards) < 1 && token.ToCard == "" && token.CardRef == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"code": "no card found"})
 		return
 	}
-	fullPan, err := ebs_fields.ExpandCard(token.ToCard, user.Cards)
+	fullPan, err := userCard(user.Cards, token.CardRef, token.ToCard)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"code": "no_card_found", "message": err.Error()})
 		return
@@ -1708,12 +1729,16 @@ func (s *Service) GeneratePaymentToken(c *gin.Context) {
 	token.UUID = uuid.New().String()
 	token.UserID = user.ID
 	token.User = *user
+	if err := s.initToken(&token, time.Now()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": "bad_request", "message": err.Error()})
+		return
+	}
 	if err := user.SavePaymentToken(&token); err != nil {
 		s.Logger.Printf("error in saving payment token: %v", err)
 		c.JSON(http.StatusBadRequest, gin.H{"code": err.Error(), "message": "Unable to save payment token"})
 		return
 	}
-	encoded, _ := ebs_fields.Encode(&token)
+	encoded, _ := s.Tokens.Encode(&token)
 	s.Logger.Printf("token is: %v", encoded)
 	paymentLink := s.NoebsConfig.PaymentLinkBase + token.UUID
 	c.JSON(http.StatusCreated, gin.H{"token": encoded, "result": encoded, "uuid": token.UUID, "payment_link": paymentLink})
@@ -1723,9 +1748,10 @@ func (s *Service) PaymentRequest(c *gin.Context) {
 	mobile := c.GetString("mobile")
 
 	type PRData struct {
-		Mobile string `json:"mobile,omitempty"`
-		ToCard string `json:"toCard,omitempty"`
-		Amount int    `json:"amount,omitempty"`
+		Mobile  string `json:"mobile,omitempty"`
+		ToCard  string `json:"toCard,omitempty"`
+		CardRef string `json:"card_ref,omitempty"`
+		Amount  int    `json:"amount,omitempty"`
 	}
 
 	var data PRData
@@ -1747,12 +1773,12 @@ func (s *Service) PaymentRequest(c *gin.Context) {
 		return
 	}
 
-	if len(sender.Cards) < 1 && data.ToCard == "" {
+	if len(sender.Cards) < 1 && data.ToCard == "" && data.CardRef == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"code": "no card found"})
 		return
 	}
 
-	fullPan, err := ebs_fields.ExpandCard(data.ToCard, sender.Cards)
+	fullPan, err := userCard(sender.Cards, data.CardRef, data.ToCard)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"code": "no_card_found", "message": err.Error()})
 		return
@@ -1764,12 +1790,16 @@ func (s *Service) PaymentRequest(c *gin.Context) {
 	token.UUID = uuid.New().String()
 	token.UserID = sender.ID
 	token.User = *sender
+	if err := s.initToken(&token, time.Now()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": "bad_request", "message": err.Error()})
+		return
+	}
 	if err := sender.SavePaymentToken(&token); err != nil {
 		s.Logger.Printf("error in saving payment token: %v", err)
 		c.JSON(http.StatusBadRequest, gin.H{"code": err.Error(), "message": "Unable to save payment token"})
 		return
 	}
-	encoded, _ := ebs_fields.Encode(&token)
+	encoded, _ := s.Tokens.Encode(&token)
 	paymentLink := s.NoebsConfig.PaymentLinkBase + token.UUID
 
 	name := sender.Fullname
@@ -1787,8 +1817,8 @@ func (s *Service) PaymentRequest(c *gin.Context) {
 	pData.Body = fmt.Sprintf("%v has requested %v SDG from you.", name, token.Amount)
 	pData.Phone = data.Mobile
 	pData.UserMobile = data.Mobile
-	pData.PaymentRequest = ebs_fields.QrData{UUID: token.UUID, ToCard: token.ToCard, Amount: token.Amount}
-	tranData <- pData
+	pData.PaymentRequest = ebs_fields.QrData{UUID: token.UUID, MaskedCard: ebs_fields.MaskCard(token.ToCard), Amount: token.Amount}
+	s.enqueuePush(pData)
 	c.JSON(http.StatusCreated, gin.H{"token": encoded, "result": encoded, "uuid": token.UUID, "payment_link": paymentLink})
 }
 
@@ -1815,23 +1845,76 @@ func (s *Service) GetPaymentToken(c *gin.Context) {
 			c.JSON(http.StatusBadRequest, ve)
 			return
 		}
-		for _, token := range tokens {
-			token.ToCard = utils.MaskPAN(token.ToCard)
+		for i := range tokens {
+			tokens[i].ToCard = utils.MaskPAN(tokens[i].ToCard)
 		}
 		c.JSON(http.StatusOK, gin.H{"token": tokens, "count": len(tokens)})
 		return
 	}
 	result, err := ebs_fields.GetTokenByUUID(uuid, s.Db)
-	if err != nil {
+	if err != nil && tokenErrorCode(err) == "" {
 		c.JSON(http.StatusNotFound, gin.H{"code": "record_not_found", "message": "token not found"})
 		return
 	}
+	// spent, cancelled and expired tokens are still returned, their status tells why they can't be paid
 
 	// Masking the PAN
 	result.ToCard = utils.MaskPAN(result.ToCard)
 	c.JSON(http.StatusOK, result)
 }
 
+// CancelPaymentToken cancels a payment token (or a payment request) so that it can't be paid anymore
+// Only the user who generated the token can cancel it.
+func (s *Service) CancelPaymentToken(c *gin.Context) {
+	user, err := ebs_fields.GetUserByMobile(c.GetString("mobile"), s.Db)
+	if err != nil {
+		ve := validationError{Message: "user doesn't exist", Code: "record_not_found"}
+		c.JSON(http.StatusBadRequest, ve)
+		return
+	}
+	uuid := c.Query("uuid")
+	if err := ebs_fields.CancelToken(uuid, user.ID, s.Db); err != nil {
+		if code := tokenErrorCode(err); code != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"code": code, "message": err.Error()})
+			return
+		}
+		c.JSON(http.StatusNotFound, gin.H{"code": "record_not_found", "message": "token not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": "ok"})
+}
+
+// initToken sets the lifecycle fields of a new token: it can be paid MaxUses
+// times (once by default) until ExpiresAt (NoebsConfig.PaymentTokenTTL by default).
+func (s *Service) initToken(token *ebs_fields.Token, now time.Time) error {
+	token.Status = ebs_fields.TokenPending
+	token.UsedCount = 0
+	token.IsPaid = false
+	if token.MaxUses <= 0 {
+		token.MaxUses = 1
+	}
+	if token.ExpiresAt == nil && s.NoebsConfig.PaymentTokenTTL > 0 {
+		expiresAt := now.Add(time.Duration(s.NoebsConfig.PaymentTokenTTL) * time.Second)
+		token.ExpiresAt = &expiresAt
+	} else if token.ExpiresAt != nil && !token.ExpiresAt.After(now) {
+		return errors.New("expires_at must be in the future")
+	}
+	return nil
+}
+
+// tokenErrorCode returns the error code of a token that can't be paid, or an empty string for other errors
+func tokenErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ebs_fields.ErrTokenExpired):
+		return "token_expired"
+	case errors.Is(err, ebs_fields.ErrTokenSpent):
+		return "token_spent"
+	case errors.Is(err, ebs_fields.ErrTokenCancelled):
+		return "token_cancelled"
+	}
+	return ""
+}
+
 // NoebsQuickPayment performs a QR or payment via url transaction
 // The api should be like this, and it should work for both the mobile and the web clients
 // The very unique thing about the full payment token is that it is self-containted, the implmenter
@@ -1842,7 +1925,7 @@ func (s *Service) GetPaymentToken(c *gin.Context) {
 // - and it will return a link and a payment token. the link, or noebs link is only valid in the case of
 // noebs' vendors payments (e.g., Solus or tuti): in that, it cannot work for the case of ecommerce
 // - there are two cases for using the endpoint:
-// - using the full-token should render the forms to show the details of the token (toCard, amount, and any comments)
+// - using the full-token should render the forms to show the details of the token (card_ref, amount, and any comments)
 // - using the uuid only, should be followed by the client performing a request to get the token info
 // request body fields should always take precendents over query params
 func (s *Service) NoebsQuickPayment(c *gin.Context) {
@@ -1850,29 +1933,29 @@ func (s *Service) NoebsQuickPayment(c *gin.Context) {
 
 	// those should be nil, and assumed to be sent in the request body -- that's fine.
 	uuid := c.Query("uuid")
-	// token has serious security issues as it exposes the payment card info
-	// in the "to" field.
+	// token is signed by s.Tokens and only carries a reference to the receiver's card,
+	// the card itself is always taken from the stored token.
 	token := c.Query("token")
-	var noebsToken ebs_fields.Token
 
 	var data ebs_fields.QuickPaymentFields
 	c.ShouldBindWith(&data, binding.JSON) // ignore the errors
-	paymentToken, err := ebs_fields.Decode(data.EncodedPaymentToken)
-	if err != nil {
-		// you should now work on the uuid and token
-		if t, err := ebs_fields.Decode(token); err == nil {
-			noebsToken = t
-		} else {
-			if t, err := ebs_fields.GetTokenByUUID(uuid, s.Db); err == nil {
-				noebsToken = t
-			}
+	if data.EncodedPaymentToken != "" {
+		token = data.EncodedPaymentToken
+	}
+	if token != "" {
+		noebsToken, err := s.Tokens.Decode(token)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": "bad_token", "message": err.Error()})
+			return
 		}
-	} else {
-		// we are getting paymentToken from the request
-		noebsToken = paymentToken
+		uuid = noebsToken.UUID
 	}
-	storedToken, err := ebs_fields.GetTokenByUUID(noebsToken.UUID, s.Db)
+	storedToken, err := ebs_fields.GetTokenByUUID(uuid, s.Db)
 	if err != nil {
+		if code := tokenErrorCode(err); code != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"code": code, "message": err.Error()})
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"code": "bad_token", "message": err.Error()})
 		return
 	}
@@ -1881,20 +1964,51 @@ func (s *Service) NoebsQuickPayment(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"code": "amount_mismatch", "message": "amount_mismatch"})
 		return
 	}
+	amount := data.TranAmount
+	if storedToken.Amount != 0 {
+		amount = float32(storedToken.Amount)
+	}
+	sender, reservation, ok := s.checkLimits(c, data.Pan, s.ToDatabasename(url), amount)
+	if !ok {
+		return
+	}
+	defer s.releaseLimits(reservation)
+	// reserve a use of the token before paying, so that a link shared publicly can't be paid twice concurrently
+	if err := ebs_fields.ReserveToken(storedToken.UUID, time.Now(), s.Db); err != nil {
+		code := tokenErrorCode(err)
+		if code == "" {
+			code = "bad_token"
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"code": code, "message": err.Error()})
+		return
+	}
 	data.ApplicationId = s.NoebsConfig.ConsumerID
 	data.ToCard = storedToken.ToCard
-	data.TranAmount = float32(noebsToken.Amount)
-	code, res, ebsErr := ebs_fields.EBSHttpClient(url, data.MarshallP2pFields())
-	storedToken.IsPaid = ebsErr == nil
+	data.TranAmount = amount
+	code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, data.MarshallP2pFields())
+	res.Name = s.ToDatabasename(url)
 	res.EBSResponse.SenderPAN = data.Pan
 	res.EBSResponse.ReceiverPAN = storedToken.ToCard
+	res.EBSResponse.Mobile = sender
+	res.EBSResponse.SenderPANHash = ebs_fields.HashPAN(data.Pan)
+	res.EBSResponse.TokenID = storedToken.ID
 	if res := s.Db.Table("transactions").Create(&res.EBSResponse); res.Error != nil {
 		s.Logger.Printf("Error saving transactions: %v", res.Error.Error())
 		c.JSON(http.StatusInternalServerError, gin.H{"code": res.Error.Error(), "message": "unable_to_save_transaction"})
 	}
-	if res := s.Db.Where("uuid = ?", storedToken.UUID).Updates(&storedToken); res.Error != nil {
-		s.Logger.Printf("Error saving token: %v", res.Error.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"code": res.Error.Error(), "message": "unable_to_save_token"})
+	var tokenErr error
+	switch {
+	case ebsErr == nil:
+		tokenErr = ebs_fields.CompleteToken(storedToken.UUID, s.Db)
+	case errors.Is(ebsErr, ebs_fields.EbsGatewayConnectivityErr):
+		// the payment might have gone through, the use stays reserved until the
+		// transaction is reconciled (see Service.reconcilePending)
+	default:
+		tokenErr = ebs_fields.ReleaseToken(storedToken.UUID, s.Db)
+	}
+	if tokenErr != nil {
+		s.Logger.Printf("Error saving token: %v", tokenErr.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"code": tokenErr.Error(), "message": "unable_to_save_token"})
 	}
 
 	go pushMessage(fmt.Sprintf("Amount of: %v was added! Download noebs apps!", res.EBSResponse.TranAmount))
@@ -1904,7 +2018,11 @@ func (s *Service) NoebsQuickPayment(c *gin.Context) {
 	} else {
 		c.JSON(code, gin.H{"ebs_response": res})
 	}
-	billerChan <- billerForm{EBS: res.EBSResponse, IsSuccessful: ebsErr == nil, Token: data.UUID}
+	event := webhook.TokenPaid
+	if ebsErr != nil {
+		event = webhook.TokenFailed
+	}
+	s.publish(storedToken.User.Mobile, event, tokenEvent{Token: storedToken.UUID, Amount: data.TranAmount, Transaction: webhookTransaction(res.EBSResponse)})
 }
 
 // EbsGetCardInfo get card holder name from pan. Currently is limited to telecos only
@@ -1943,8 +2061,8 @@ func (s *Service) EbsGetCardInfo(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		// mask the pan
 		res.MaskPAN()
@@ -1994,8 +2112,8 @@ func (s *Service) GetMSISDNFromCard(c *gin.Context) {
 			c.AbortWithStatusJSON(http.StatusBadRequest, ebs_fields.ErrorResponse{ErrorDetails: er})
 		}
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 		// mask the pan
 		res.MaskPAN()
 		res.Name = s.ToDatabasename(url)
@@ -2050,8 +2168,8 @@ func (s *Service) RegisterCard(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		// mask the pan
 		res.MaskPAN()
@@ -2123,8 +2241,8 @@ func (s *Service) CompleteRegistration(c *gin.Context) {
 		fields.Mobile = ""
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		res.Name = s.ToDatabasename(url)
 
@@ -2190,8 +2308,8 @@ func (s *Service) GenerateVoucher(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		// mask the pan
 		res.MaskPAN()
@@ -2221,14 +2339,14 @@ func (s *Service) GenerateVoucher(c *gin.Context) {
 		if ebsErr != nil {
 			// This is for push notifications (sender)
 			data.Body = fmt.Sprintf("Voucher generation failed due to: %v.", res.ResponseMessage)
-			tranData <- data
+			s.enqueuePush(data)
 
 			payload := ebs_fields.ErrorDetails{Code: res.ResponseCode, Status: ebs_fields.EBSError, Details: res, Message: ebs_fields.EBSError}
 			c.JSON(code, payload)
 		} else {
 			// This is for push notifications (sender)
 			data.Body = fmt.Sprintf("Voucher number generated for phone %v is %v", fields.VoucherNumber, res.VoucherCode)
-			tranData <- data
+			s.enqueuePush(data)
 
 			c.JSON(code, gin.H{"ebs_response": res})
 
@@ -2297,7 +2415,8 @@ func (s *Service) CheckUser(c *gin.Context) {
 
 func (s *Service) SetMainCard(c *gin.Context) {
 	type Card struct {
-		Pan string `json:"PAN"`
+		Pan     string `json:"PAN"`
+		CardRef string `json:"card_ref"`
 	}
 	mobile := c.GetString("mobile")
 	user, err := ebs_fields.GetUserByMobile(mobile, s.Db)
@@ -2316,7 +2435,13 @@ func (s *Service) SetMainCard(c *gin.Context) {
 	}
 
 	var dbCard ebs_fields.Card
-	result := s.Db.Where("pan = ?", card.Pan).First(&dbCard)
+	query := s.Db.Where("user_id = ?", user.ID)
+	if card.CardRef != "" {
+		query = query.Where("card_ref = ?", card.CardRef)
+	} else {
+		query = query.Where("pan_hash = ?", ebs_fields.HashPAN(card.Pan))
+	}
+	result := query.First(&dbCard)
 	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
 		// Card does not exist
 		s.Logger.Println("Card does not exist")
@@ -2324,7 +2449,7 @@ func (s *Service) SetMainCard(c *gin.Context) {
 		return
 	}
 	// Updating the user
-	result = s.Db.Debug().Model(&ebs_fields.User{}).Where("mobile = ?", user.Mobile).Update("main_card", card.Pan)
+	result = s.Db.Debug().Model(&ebs_fields.User{}).Where("mobile = ?", user.Mobile).Updates(&ebs_fields.User{MainCard: dbCard.Pan})
 	if result.Error != nil {
 		s.Logger.Printf("Error updating user.Pan: %v", result.Error)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not save card as main card"})
@@ -2338,7 +2463,7 @@ func (s *Service) SetMainCard(c *gin.Context) {
 		return
 	}
 	// Setting the new card as the main one
-	result = s.Db.Model(&ebs_fields.Card{}).Where("pan = ?", card.Pan).Update("is_main", true)
+	result = s.Db.Model(&ebs_fields.Card{}).Where("id = ?", dbCard.ID).Update("is_main", true)
 	if result.Error != nil {
 		s.Logger.Printf("Error updating card: %v", result.Error)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not save card as main card"})
@@ -2380,6 +2505,14 @@ func (s *Service) MobileTransfer(c *gin.Context) {
 			return
 		}
 		fields.ToCard = user.MainCard
+		if !s.requireKYCTier(c, s.NoebsConfig.MobileTransferKYCTier) {
+			return
+		}
+		sender, reservation, ok := s.checkLimits(c, fields.Pan, s.ToDatabasename(url), fields.TranAmount)
+		if !ok {
+			return
+		}
+		defer s.releaseLimits(reservation)
 
 		fields.ApplicationId = s.NoebsConfig.ConsumerID
 		fields.DynamicFees = fees.CardTransferfees
@@ -2393,8 +2526,8 @@ func (s *Service) MobileTransfer(c *gin.Context) {
 		jsonBuffer := fields.MustMarshal()
 		s.Logger.Printf("the request is: %v", string(jsonBuffer))
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		// mask the pan
 		res.MaskPAN()
@@ -2403,6 +2536,8 @@ func (s *Service) MobileTransfer(c *gin.Context) {
 		username, _ := utils.GetOrDefault(c.Keys, "username", "anon")
 		utils.SaveRedisList(s.Redis, username+":all_transactions", &res)
 
+		res.EBSResponse.Mobile = sender
+		res.EBSResponse.SenderPANHash = ebs_fields.HashPAN(fields.Pan)
 		if err := s.Db.Table("transactions").Create(&res.EBSResponse); err != nil {
 			logrus.WithFields(logrus.Fields{
 				"code":    "unable to migrate purchase model",
@@ -2425,7 +2560,7 @@ func (s *Service) MobileTransfer(c *gin.Context) {
 			// This is for push notifications (sender)
 			data.EBSData.PAN = fields.Pan
 			data.Body = fmt.Sprintf("Card Transfer failed due to: %v", res.ResponseMessage)
-			tranData <- data
+			s.enqueuePush(data)
 
 			c.JSON(code, payload)
 		} else {
@@ -2433,12 +2568,12 @@ func (s *Service) MobileTransfer(c *gin.Context) {
 			data.EBSData.PAN = fields.ToCard
 
 			data.Body = fmt.Sprintf("You have received %v %v from %v", res.AccountCurrency, fields.TranAmount, res.PAN)
-			tranData <- data
+			s.enqueuePush(data)
 
 			// This is for push notifications (sender)
 			data.EBSData.PAN = fields.Pan
 			data.Body = fmt.Sprintf("%v %v has been transferred from your account to %v", res.AccountCurrency, fields.TranAmount, res.ToCard)
-			tranData <- data
+			s.enqueuePush(data)
 
 			c.JSON(code, gin.H{"ebs_response": res})
 		}
@@ -2447,23 +2582,3 @@ func (s *Service) MobileTransfer(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"code": bindingErr.Error()})
 	}
 }
-
-func (s *Service) GetTransactions(c *gin.Context) {
-	mobile := c.GetString("mobile")
-	user, err := ebs_fields.GetCardsOrFail(mobile, s.Db)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "database_error"})
-		return
-	}
-
-	var trans []ebs_fields.EBSResponse
-	for _, card := range user.Cards {
-		// Mask cards and perform the query for each card
-		uMaskedPan := utils.MaskPAN(card.Pan)
-		var cardTrans []ebs_fields.EBSResponse
-		s.Db.Model(ebs_fields.EBSResponse{}).Where("pan = ? OR sender_pan = ? OR receiver_pan = ?", uMaskedPan, uMaskedPan, uMaskedPan).Find(&cardTrans)
-		trans = append(trans, cardTrans...)
-	}
-
-	c.JSON(http.StatusOK, trans)
-}
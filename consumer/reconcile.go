@@ -0,0 +1,55 @@
+package consumer
+
+import (
+	"context"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/sirupsen/logrus"
+)
+
+// Reconcile resolves the transactions EBS didn't answer (see ebs_fields.ReconcilePending).
+// It should be started once as a goroutine, similar to BillerHooks.
+func (s *Service) Reconcile() {
+	ticker := time.NewTicker(time.Duration(s.NoebsConfig.ReconcileInterval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.reconcilePending(context.Background(), time.Now())
+	}
+}
+
+// reconcilePending queries getTransactionStatus for every pending consumer
+// transaction. Transactions that EBS still doesn't know about after the
+// reconciliation window are marked unresolved.
+func (s *Service) reconcilePending(ctx context.Context, now time.Time) {
+	// give EBS the chance to finish processing before asking about the transaction
+	pending, err := ebs_fields.PendingTransactions(s.Db, now.Add(-time.Duration(s.NoebsConfig.ReconcileInterval)*time.Second))
+	if err != nil {
+		s.Logger.WithFields(logrus.Fields{"code": "reconcile_error", "message": err.Error()}).Error("unable to load pending transactions")
+		return
+	}
+	window := time.Duration(s.NoebsConfig.ReconcileWindow) * time.Second
+	for _, tran := range pending {
+		// merchant transactions have no UUID, they are reversed by merchant.Service.Reconcile
+		if tran.UUID == "" {
+			continue
+		}
+		status, err := ebs_fields.QueryTransactionStatus(ctx, s.EBSClient, &s.NoebsConfig, tran.UUID)
+		if err == nil {
+			if err = tran.Reconcile(s.Db, status); err == nil {
+				s.Logger.WithFields(logrus.Fields{"uuid": tran.UUID, "response_code": tran.ResponseCode}).Info("reconciled pending transaction")
+				if err := ebs_fields.SettleToken(&tran, s.Db); err != nil {
+					s.Logger.WithFields(logrus.Fields{"uuid": tran.UUID, "token_id": tran.TokenID, "message": err.Error()}).Error("unable to settle payment token")
+				}
+				continue
+			}
+		}
+		tran.ReconcileAttempts++
+		state := ebs_fields.ReconcilePending
+		if now.Sub(tran.CreatedAt) > window {
+			state = ebs_fields.ReconcileUnresolved
+			s.Logger.WithFields(logrus.Fields{"uuid": tran.UUID, "message": err.Error()}).Error("unable to reconcile transaction")
+		}
+		tran.MarkReconciliation(s.Db, state)
+	}
+}
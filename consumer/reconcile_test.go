@@ -0,0 +1,76 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"gorm.io/gorm"
+)
+
+func TestService_reconcilePending(t *testing.T) {
+	db := openTestDB(t, &ebs_fields.EBSResponse{}, &ebs_fields.Token{})
+	now := time.Now()
+	// single use payment tokens, reserved by the payments that timed out
+	tokens := []ebs_fields.Token{
+		{Model: gorm.Model{ID: 1}, UUID: "paid", MaxUses: 1, UsedCount: 1, Status: ebs_fields.TokenPending},
+		{Model: gorm.Model{ID: 2}, UUID: "released", MaxUses: 1, UsedCount: 1, Status: ebs_fields.TokenPending},
+	}
+	db.Create(&tokens)
+	pending := []ebs_fields.EBSResponse{
+		{UUID: "confirmed", ReconcileState: ebs_fields.ReconcilePending, ResponseCode: ebs_fields.PENDING, TokenID: 1},
+		{UUID: "unknown", ReconcileState: ebs_fields.ReconcilePending, ResponseCode: ebs_fields.PENDING},
+		{UUID: "expired", ReconcileState: ebs_fields.ReconcilePending, ResponseCode: ebs_fields.PENDING},
+		{UUID: "declined", ReconcileState: ebs_fields.ReconcilePending, ResponseCode: ebs_fields.PENDING, TokenID: 2},
+	}
+	for i := range pending {
+		pending[i].CreatedAt = now.Add(-2 * time.Minute)
+	}
+	pending[2].CreatedAt = now.Add(-time.Hour)
+	db.Table("transactions").Create(&pending)
+
+	fake := &ebs_fields.FakeEBSClient{Handler: func(url string, req []byte) (int, ebs_fields.EBSParserFields, error) {
+		res := ebs_fields.ApprovedResponse(req)
+		if bytes.Contains(req, []byte(`"originalTranUUID":"confirmed"`)) {
+			res.OriginalTransaction = ebs_fields.EBSResponse{ResponseCode: 0, ResponseMessage: "Approval", ResponseStatus: "Successful", ApprovalCode: "123"}
+		}
+		if bytes.Contains(req, []byte(`"originalTranUUID":"declined"`)) {
+			res.OriginalTransaction = ebs_fields.EBSResponse{ResponseCode: 51, ResponseMessage: "Insufficient funds", ResponseStatus: "Failed"}
+		}
+		return http.StatusOK, res, nil
+	}}
+	s := &Service{Db: db, Logger: testLogger, EBSClient: fake, NoebsConfig: ebs_fields.NoebsConfig{ReconcileInterval: 60, ReconcileWindow: 600}}
+	s.reconcilePending(context.Background(), now)
+
+	tests := []struct {
+		uuid      string
+		wantState string
+		wantCode  int
+	}{
+		{"confirmed", ebs_fields.ReconcileConfirmed, 0},
+		{"unknown", ebs_fields.ReconcilePending, ebs_fields.PENDING},
+		{"expired", ebs_fields.ReconcileUnresolved, ebs_fields.PENDING},
+		{"declined", ebs_fields.ReconcileConfirmed, 51},
+	}
+	for _, tt := range tests {
+		t.Run(tt.uuid, func(t *testing.T) {
+			var got ebs_fields.EBSResponse
+			db.Table("transactions").First(&got, "uuid = ?", tt.uuid)
+			if got.ReconcileState != tt.wantState || got.ResponseCode != tt.wantCode {
+				t.Errorf("reconcilePending() = %v (%d), want %v (%d)", got.ReconcileState, got.ResponseCode, tt.wantState, tt.wantCode)
+			}
+		})
+	}
+
+	// the reconciled payments settle their tokens
+	for _, want := range []ebs_fields.Token{{UUID: "paid", UsedCount: 1, IsPaid: true}, {UUID: "released", UsedCount: 0, IsPaid: false}} {
+		var got ebs_fields.Token
+		db.First(&got, "uuid = ?", want.UUID)
+		if got.UsedCount != want.UsedCount || got.IsPaid != want.IsPaid {
+			t.Errorf("reconcilePending() token %s = used %d, paid %v, want used %d, paid %v", want.UUID, got.UsedCount, got.IsPaid, want.UsedCount, want.IsPaid)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/adonese/noebs/redact"
+	"github.com/adonese/noebs/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Types of scheduled payments
+const (
+	ScheduledCardTransfer = "card_transfer"
+	ScheduledBillPayment  = "bill_payment"
+)
+
+// Outcomes of the last run of a scheduled payment
+const (
+	ScheduledSuccessful = "successful"
+	ScheduledFailed     = "failed"
+	// ScheduledPending is a run EBS didn't answer, its transaction is reconciled (see Reconcile)
+	ScheduledPending = "pending"
+)
+
+// ScheduledPayment is a standing order: a card transfer or a bill payment that
+// is paid from the user's main card every time Schedule (a cron expression,
+// see utils.ParseCron) is due, until EndDate. ToCard is stored encrypted, like
+// the cards of the users, and is masked in the responses.
+type ScheduledPayment struct {
+	gorm.Model
+	UserMobile  string     `json:"-" gorm:"index"`
+	Type        string     `json:"type"`
+	ToCard      string     `json:"to_card,omitempty" gorm:"serializer:card" redact:"pan"`
+	PayeeID     string     `json:"payee_id,omitempty"`
+	PaymentInfo string     `json:"payment_info,omitempty"`
+	Amount      float32    `json:"amount"`
+	Schedule    string     `json:"schedule"`
+	EndDate     *time.Time `json:"end_date,omitempty"`
+	Active      bool       `json:"active"`
+	NextRun     time.Time  `json:"next_run" gorm:"index"`
+	LastRun     *time.Time `json:"last_run,omitempty"`
+	LastStatus  string     `json:"last_status,omitempty"`
+	LastMessage string     `json:"last_message,omitempty"`
+	LastUUID    string     `json:"last_uuid,omitempty"` // the UUID of the last transaction, it is stored in transactions
+}
+
+// MarshalJSON masks ToCard
+func (p ScheduledPayment) MarshalJSON() ([]byte, error) {
+	type payment ScheduledPayment
+	masked := payment(p)
+	if masked.ToCard != "" {
+		masked.ToCard = redact.PAN(p.ToCard)
+	}
+	return json.Marshal(masked)
+}
+
+// validate checks p and sets its next run after now
+func (p *ScheduledPayment) validate(now time.Time) error {
+	switch p.Type {
+	case ScheduledCardTransfer:
+		if p.ToCard == "" {
+			return errors.New("to_card is required for card transfers")
+		}
+	case ScheduledBillPayment:
+		if p.PayeeID == "" || p.PaymentInfo == "" {
+			return errors.New("payee_id and payment_info are required for bill payments")
+		}
+	default:
+		return errors.New("type must be either card_transfer or bill_payment")
+	}
+	if p.Amount <= 0 {
+		return errors.New("amount must be greater than zero")
+	}
+	cron, err := utils.ParseCron(p.Schedule)
+	if err != nil {
+		return err
+	}
+	p.NextRun = cron.Next(now)
+	if p.NextRun.IsZero() {
+		return errors.New("schedule never runs")
+	}
+	if p.EndDate != nil && p.EndDate.Before(p.NextRun) {
+		return errors.New("end_date is before the first run")
+	}
+	return nil
+}
+
+// reschedule sets the run after now, the payment is deactivated once it passes EndDate
+func (p *ScheduledPayment) reschedule(now time.Time) {
+	cron, err := utils.ParseCron(p.Schedule)
+	if err != nil {
+		p.Active = false
+		return
+	}
+	p.NextRun = cron.Next(now)
+	if p.NextRun.IsZero() || (p.EndDate != nil && p.EndDate.Before(p.NextRun)) {
+		p.Active = false
+	}
+}
+
+// ListScheduledPayments returns the standing orders of the current user
+func (s *Service) ListScheduledPayments(c *gin.Context) {
+	var payments []ScheduledPayment
+	if err := s.Db.Where("user_mobile = ?", c.GetString("mobile")).Order("id").Find(&payments).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusOK, payments)
+}
+
+// CreateScheduledPayment adds a standing order, e.g.,
+//
+//	{"type": "card_transfer", "to_card": "...", "amount": 100, "schedule": "0 9 1 * *"}
+//
+// pays 100 SDG to to_card at 9 AM on the first of every month.
+func (s *Service) CreateScheduledPayment(c *gin.Context) {
+	var req ScheduledPayment
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	req.Model = gorm.Model{}
+	req.UserMobile = c.GetString("mobile")
+	req.Active = true
+	req.LastRun, req.LastStatus, req.LastMessage, req.LastUUID = nil, "", "", ""
+	if err := req.validate(time.Now()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	if err := s.Db.Create(&req).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusCreated, req)
+}
+
+// GetScheduledPayment returns a standing order by its id
+func (s *Service) GetScheduledPayment(c *gin.Context) {
+	payment, ok := s.scheduledPayment(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, payment)
+}
+
+// UpdateScheduledPayment updates the fields in the request body of a standing
+// order, setting active to false pauses it.
+func (s *Service) UpdateScheduledPayment(c *gin.Context) {
+	payment, ok := s.scheduledPayment(c)
+	if !ok {
+		return
+	}
+	model, mobile, toCard := payment.Model, payment.UserMobile, payment.ToCard
+	if err := c.ShouldBindJSON(&payment); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	payment.Model, payment.UserMobile = model, mobile
+	// the masked card of the responses stands for the stored one
+	if toCard != "" && payment.ToCard == redact.PAN(toCard) {
+		payment.ToCard = toCard
+	}
+	if err := payment.validate(time.Now()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	if err := s.Db.Save(&payment).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusOK, payment)
+}
+
+// DeleteScheduledPayment cancels a standing order
+func (s *Service) DeleteScheduledPayment(c *gin.Context) {
+	payment, ok := s.scheduledPayment(c)
+	if !ok {
+		return
+	}
+	if err := s.Db.Delete(&payment).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// scheduledPayment loads the standing order in the id path parameter, it writes
+// the error response when the current user doesn't have it.
+func (s *Service) scheduledPayment(c *gin.Context) (ScheduledPayment, bool) {
+	var payment ScheduledPayment
+	if err := s.Db.Where("user_mobile = ?", c.GetString("mobile")).First(&payment, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "scheduled payment not found", "code": "not_found"})
+		return payment, false
+	}
+	return payment, true
+}
+
+// RunScheduledPayments executes the due standing orders every minute. It should
+// be started once as a goroutine.
+func (s *Service) RunScheduledPayments() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.runDuePayments(context.Background(), time.Now())
+	}
+}
+
+func (s *Service) runDuePayments(ctx context.Context, now time.Time) {
+	var due []ScheduledPayment
+	if err := s.Db.Where("active = ? AND next_run <= ?", true, now).Find(&due).Error; err != nil {
+		s.Logger.WithFields(logrus.Fields{"code": "scheduler_error", "message": err.Error()}).Error("unable to load scheduled payments")
+		return
+	}
+	for _, p := range due {
+		// the run is claimed before it is paid: neither a crash nor another
+		// instance of noebs can pay it twice
+		p.reschedule(now)
+		claim := s.Db.Model(&ScheduledPayment{}).Where("id = ? AND active = ? AND next_run <= ?", p.ID, true, now).
+			Updates(map[string]any{"next_run": p.NextRun, "active": p.Active})
+		if claim.Error != nil {
+			s.Logger.WithFields(logrus.Fields{"code": "scheduler_error", "message": claim.Error.Error(), "id": p.ID}).Error("unable to claim scheduled payment")
+			continue
+		}
+		if claim.RowsAffected == 0 {
+			continue
+		}
+
+		res, err := s.executeScheduledPayment(ctx, p)
+		p.LastRun = &now
+		p.LastUUID = res.UUID
+		p.LastStatus = ScheduledSuccessful
+		p.LastMessage = res.ResponseMessage
+		switch {
+		case errors.Is(err, ebs_fields.EbsGatewayConnectivityErr):
+			// the money may have moved, the reconciler finds out
+			p.LastStatus = ScheduledPending
+			p.LastMessage = err.Error()
+		case err != nil:
+			p.LastStatus = ScheduledFailed
+			p.LastMessage = err.Error()
+		}
+		if err := s.Db.Model(&p).Select("last_run", "last_uuid", "last_status", "last_message").Updates(&p).Error; err != nil {
+			s.Logger.WithFields(logrus.Fields{"code": "scheduler_error", "message": err.Error(), "id": p.ID}).Error("unable to store the run of scheduled payment")
+		}
+	}
+}
+
+// executeScheduledPayment pays p from the user's main card, stores the
+// transaction and notifies the user of its outcome.
+func (s *Service) executeScheduledPayment(ctx context.Context, p ScheduledPayment) (ebs_fields.EBSResponse, error) {
+	tranUUID := uuid.New().String()
+	failed := func(err error) (ebs_fields.EBSResponse, error) {
+		s.enqueuePush(PushData{
+			Type:  NOEBS_NOTIFICATION,
+			Date:  time.Now().Unix(),
+			UUID:  tranUUID,
+			Title: "Scheduled Payment",
+			Body:  fmt.Sprintf("Your scheduled payment of %v SDG failed: %v.", p.Amount, err),
+			Phone: p.UserMobile,
+		})
+		return ebs_fields.EBSResponse{}, err
+	}
+	cardHolder, err := s.mainCardFields(p.UserMobile, tranUUID)
+	if err != nil {
+		return failed(err)
+	}
+	common := ebs_fields.ConsumerCommonFields{
+		ApplicationId: s.NoebsConfig.ConsumerID,
+		TranDateTime:  ebs_fields.EbsDate(),
+		UUID:          tranUUID,
+	}
+	amount := ebs_fields.AmountFields{TranAmount: p.Amount, TranCurrencyCode: "SDG"}
+
+	var url, cta string
+	var req []byte
+	switch p.Type {
+	case ScheduledCardTransfer:
+		url, cta = s.NoebsConfig.ConsumerIP+ebs_fields.ConsumerCardTransferEndpoint, CTA_CARD_TRANSFER
+		req, _ = json.Marshal(ebs_fields.ConsumerCardTransferFields{
+			ConsumerCommonFields:     common,
+			ConsumerCardHolderFields: cardHolder,
+			AmountFields:             amount,
+			ToCard:                   p.ToCard,
+			DynamicFees:              fees.CardTransferfees,
+		})
+	default:
+		url, cta = s.NoebsConfig.ConsumerIP+ebs_fields.ConsumerBillPaymentEndpoint, CTA_BILL_PAYMENT
+		req, _ = json.Marshal(ebs_fields.ConsumerBillPaymentFields{
+			ConsumerCommonFields:     common,
+			ConsumerCardHolderFields: cardHolder,
+			AmountFields:             amount,
+			ConsumersBillersFields:   ebs_fields.ConsumersBillersFields{PayeeId: p.PayeeID, PaymentInfo: p.PaymentInfo},
+		})
+	}
+	// standing orders are capped by, and count toward, the limits of the user
+	// like the transactions they make themselves
+	user, err := ebs_fields.GetUserByMobile(p.UserMobile, s.Db)
+	if err != nil {
+		return failed(err)
+	}
+	reservation, err := s.reserveLimits(&user, cardHolder.Pan, s.ToDatabasename(url), p.Amount)
+	if err != nil {
+		return failed(err)
+	}
+	defer s.releaseLimits(reservation)
+
+	_, res, ebsErr := s.EBSClient.Do(ctx, url, req)
+	res.MaskPAN()
+	res.Name = s.ToDatabasename(url)
+	res.UUID = tranUUID
+	res.EBSResponse.Mobile = p.UserMobile
+	res.EBSResponse.SenderPANHash = ebs_fields.HashPAN(cardHolder.Pan)
+	if p.Type == ScheduledCardTransfer {
+		res.EBSResponse.SenderPAN = utils.MaskPAN(cardHolder.Pan)
+		res.EBSResponse.ReceiverPAN = utils.MaskPAN(p.ToCard)
+	}
+	if err := s.Db.Table("transactions").Create(&res.EBSResponse).Error; err != nil {
+		s.Logger.WithFields(logrus.Fields{
+			"code":    err.Error(),
+			"details": "Error in writing to Database",
+		}).Error("unable to store scheduled payment")
+	}
+
+	data := PushData{
+		Type:         EBS_NOTIFICATION,
+		Date:         time.Now().Unix(),
+		CallToAction: cta,
+		EBSData:      res.EBSResponse,
+		UUID:         tranUUID,
+		Title:        "Scheduled Payment",
+	}
+	data.EBSData.PAN = cardHolder.Pan // the unmasked PAN is used to find the user
+	if errors.Is(ebsErr, ebs_fields.EbsGatewayConnectivityErr) {
+		data.Body = fmt.Sprintf("Your scheduled payment of %v SDG is being processed.", p.Amount)
+	} else if ebsErr != nil {
+		data.Body = fmt.Sprintf("Your scheduled payment of %v SDG failed due to: %v.", p.Amount, res.ResponseMessage)
+	} else {
+		data.Body = fmt.Sprintf("Your scheduled payment of %v SDG was paid successfully.", p.Amount)
+	}
+	s.enqueuePush(data)
+	return res.EBSResponse, ebsErr
+}
@@ -0,0 +1,183 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+)
+
+func TestScheduledPayment_validate(t *testing.T) {
+	now := time.Date(2023, time.January, 31, 10, 30, 0, 0, time.UTC)
+	past := now.Add(-time.Hour)
+	tests := []struct {
+		name        string
+		payment     ScheduledPayment
+		wantNextRun time.Time
+		wantErr     bool
+	}{
+		{"monthly transfer", ScheduledPayment{Type: ScheduledCardTransfer, ToCard: "9222", Amount: 10, Schedule: "0 9 1 * *"}, time.Date(2023, time.February, 1, 9, 0, 0, 0, time.UTC), false},
+		{"daily bill", ScheduledPayment{Type: ScheduledBillPayment, PayeeID: "0010010001", PaymentInfo: "MPHONE=0912141679", Amount: 10, Schedule: "@daily"}, time.Date(2023, time.February, 1, 0, 0, 0, 0, time.UTC), false},
+		{"missing to_card", ScheduledPayment{Type: ScheduledCardTransfer, Amount: 10, Schedule: "@daily"}, time.Time{}, true},
+		{"missing payee", ScheduledPayment{Type: ScheduledBillPayment, Amount: 10, Schedule: "@daily"}, time.Time{}, true},
+		{"unknown type", ScheduledPayment{Type: "cashout", Amount: 10, Schedule: "@daily"}, time.Time{}, true},
+		{"zero amount", ScheduledPayment{Type: ScheduledCardTransfer, ToCard: "9222", Schedule: "@daily"}, time.Time{}, true},
+		{"invalid schedule", ScheduledPayment{Type: ScheduledCardTransfer, ToCard: "9222", Amount: 10, Schedule: "every day"}, time.Time{}, true},
+		{"ended", ScheduledPayment{Type: ScheduledCardTransfer, ToCard: "9222", Amount: 10, Schedule: "@daily", EndDate: &past}, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.payment.validate(now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !tt.payment.NextRun.Equal(tt.wantNextRun) {
+				t.Errorf("validate() next run = %v, want %v", tt.payment.NextRun, tt.wantNextRun)
+			}
+		})
+	}
+}
+
+func TestService_runDuePayments(t *testing.T) {
+	db := openTestDB(t, &ebs_fields.User{}, &ebs_fields.Card{}, &ebs_fields.EBSResponse{}, &ScheduledPayment{}, &ebs_fields.Limit{}, &ebs_fields.LimitReservation{})
+	user := ebs_fields.User{Mobile: "0912141679"}
+	db.Create(&user)
+	db.Create(&ebs_fields.Card{Pan: "9222081700176714465", Expiry: "2302", IPIN: "0000", UserID: user.ID, IsMain: true})
+	db.Create(&ebs_fields.Limit{Scope: ebs_fields.LimitPerUser, Period: ebs_fields.LimitDaily, TranType: "card_transfer", MaxAmount: 1000})
+
+	now := time.Now()
+	end := now.Add(time.Minute)
+	payments := []ScheduledPayment{
+		{UserMobile: "0912141679", Type: ScheduledCardTransfer, ToCard: "9222081700176714466", Amount: 10, Schedule: "* * * * *", Active: true, NextRun: now.Add(-time.Minute)},
+		{UserMobile: "0912141679", Type: ScheduledBillPayment, PayeeID: "0010010001", PaymentInfo: "MPHONE=0912141679", Amount: 10, Schedule: "@daily", Active: true, NextRun: now.Add(-time.Minute), EndDate: &end},
+		{UserMobile: "0912141679", Type: ScheduledCardTransfer, ToCard: "9222081700176714466", Amount: 10, Schedule: "* * * * *", Active: true, NextRun: now.Add(time.Hour)},
+		// EBS doesn't answer the transfers to this card
+		{UserMobile: "0912141679", Type: ScheduledCardTransfer, ToCard: "9222081700176714467", Amount: 10, Schedule: "* * * * *", Active: true, NextRun: now.Add(-time.Minute)},
+		{UserMobile: "0912141679", Type: ScheduledCardTransfer, ToCard: "9222081700176714466", Amount: 5000, Schedule: "* * * * *", Active: true, NextRun: now.Add(-time.Minute)},
+	}
+	db.Create(&payments)
+
+	fake := &ebs_fields.FakeEBSClient{Handler: func(url string, req []byte) (int, ebs_fields.EBSParserFields, error) {
+		if strings.Contains(string(req), "9222081700176714467") {
+			var res ebs_fields.EBSParserFields
+			json.Unmarshal(req, &res.EBSResponse)
+			res.ResponseStatus, res.ReconcileState = "Pending", ebs_fields.ReconcilePending
+			return http.StatusGatewayTimeout, res, ebs_fields.EbsGatewayConnectivityErr
+		}
+		return http.StatusOK, ebs_fields.ApprovedResponse(req), nil
+	}}
+	s := &Service{Db: db, Logger: testLogger, EBSClient: fake, NoebsConfig: noebsConfig}
+	s.runDuePayments(context.Background(), now)
+	// the runs were claimed, they aren't paid again
+	s.runDuePayments(context.Background(), now)
+
+	if got := len(fake.Requests()); got != 3 {
+		t.Fatalf("runDuePayments() sent %d requests, want 3", got)
+	}
+	tests := []struct {
+		name       string
+		id         uint
+		wantStatus string
+		wantActive bool
+	}{
+		{"recurring", payments[0].ID, ScheduledSuccessful, true},
+		{"past end date", payments[1].ID, ScheduledSuccessful, false},
+		{"not due", payments[2].ID, "", true},
+		{"timed out", payments[3].ID, ScheduledPending, true},
+		{"over the limits", payments[4].ID, ScheduledFailed, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got ScheduledPayment
+			db.First(&got, tt.id)
+			if got.LastStatus != tt.wantStatus || got.Active != tt.wantActive {
+				t.Errorf("runDuePayments() status = %q, active = %v, want %q, %v", got.LastStatus, got.Active, tt.wantStatus, tt.wantActive)
+			}
+			if got.LastUUID != "" {
+				var tran ebs_fields.EBSResponse
+				if err := db.Table("transactions").First(&tran, "uuid = ?", got.LastUUID).Error; err != nil {
+					t.Errorf("runDuePayments() didn't store transaction %v: %v", got.LastUUID, err)
+				}
+				if tran.Mobile != "0912141679" || tran.SenderPANHash != ebs_fields.HashPAN("9222081700176714465") {
+					t.Errorf("runDuePayments() stored transaction of %q, %q", tran.Mobile, tran.SenderPANHash)
+				}
+			}
+			if tt.wantStatus != "" && !got.NextRun.After(now) {
+				t.Errorf("runDuePayments() next run = %v, want after %v", got.NextRun, now)
+			}
+		})
+	}
+}
+
+func TestService_ScheduledPayments(t *testing.T) {
+	db := openTestDB(t, &ScheduledPayment{})
+	s := &Service{Db: db, Logger: testLogger}
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("mobile", c.GetHeader("X-Mobile")) })
+	r.POST("/scheduled", s.CreateScheduledPayment)
+	r.GET("/scheduled", s.ListScheduledPayments)
+	r.PUT("/scheduled/:id", s.UpdateScheduledPayment)
+	r.DELETE("/scheduled/:id", s.DeleteScheduledPayment)
+
+	do := func(method, path, mobile, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("X-Mobile", mobile)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(http.MethodPost, "/scheduled", "0912141679", `{"type": "card_transfer", "to_card": "9222", "amount": 100, "schedule": "0 9 1 * *"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("CreateScheduledPayment() code = %v, body = %s", w.Code, w.Body)
+	}
+	var created ScheduledPayment
+	json.Unmarshal(w.Body.Bytes(), &created)
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		mobile   string
+		body     string
+		wantCode int
+	}{
+		{"invalid schedule", http.MethodPost, "/scheduled", "0912141679", `{"type": "card_transfer", "to_card": "9222", "amount": 100, "schedule": "monthly"}`, http.StatusBadRequest},
+		{"other user", http.MethodPut, "/scheduled/1", "0912141680", `{"active": false}`, http.StatusNotFound},
+		{"pause", http.MethodPut, "/scheduled/1", "0912141679", `{"active": false}`, http.StatusOK},
+		{"delete", http.MethodDelete, "/scheduled/1", "0912141679", "", http.StatusNoContent},
+		{"deleted", http.MethodPut, "/scheduled/1", "0912141679", `{"active": true}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := do(tt.method, tt.path, tt.mobile, tt.body); w.Code != tt.wantCode {
+				t.Errorf("%s %s code = %v, want %v: %s", tt.method, tt.path, w.Code, tt.wantCode, w.Body)
+			}
+		})
+	}
+	if created.ID != 1 || !created.Active {
+		t.Errorf("CreateScheduledPayment() = %+v", created)
+	}
+
+	// the card paid to is only ever returned masked, and sending it back keeps it
+	w = do(http.MethodPost, "/scheduled", "0912141679", `{"type": "card_transfer", "to_card": "9222081700176714466", "amount": 100, "schedule": "0 9 1 * *"}`)
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if created.ToCard != "922208*****4466" {
+		t.Fatalf("CreateScheduledPayment() to_card = %q, want it masked", created.ToCard)
+	}
+	body, _ := json.Marshal(gin.H{"type": "card_transfer", "to_card": created.ToCard, "amount": 200, "schedule": "0 9 1 * *"})
+	if w := do(http.MethodPut, fmt.Sprintf("/scheduled/%d", created.ID), "0912141679", string(body)); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "9222081700176714466") {
+		t.Errorf("UpdateScheduledPayment() = %v, %s", w.Code, w.Body)
+	}
+	var stored ScheduledPayment
+	if db.First(&stored, created.ID); stored.ToCard != "9222081700176714466" || stored.Amount != 200 {
+		t.Errorf("UpdateScheduledPayment() stored %+v", stored)
+	}
+}
@@ -2,6 +2,7 @@ package consumer
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,6 +14,7 @@ import (
 	"time"
 
 	"github.com/adonese/noebs/ebs_fields"
+	"github.com/adonese/noebs/redact"
 	"github.com/adonese/noebs/utils"
 	"github.com/google/uuid"
 	"gorm.io/gorm/clause"
@@ -20,7 +22,6 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 	"github.com/go-redis/redis/v7"
-	"github.com/noebs/ipin"
 	"github.com/sirupsen/logrus"
 )
 
@@ -90,9 +91,15 @@ func (s *Service) AddFirebaseID(c *gin.Context) {
 	}).Create(&ebs_fields.User{Mobile: username, DeviceID: req.Token}); res.Error != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"message": res.Error, "code": "db_error"})
 		return
-	} else {
-		c.JSON(http.StatusOK, nil)
 	}
+	// notifications go to every trusted device, see pushTokens
+	if device := s.currentDevice(c); device != "" {
+		if err := ebs_fields.SetPushToken(s.Db, username, device, req.Token); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "db_error"})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, nil)
 }
 
 // Beneficiaries manage all of beneficiaries data
@@ -101,7 +108,7 @@ func (s *Service) Beneficiaries(c *gin.Context) {
 
 	var req ebs_fields.Beneficiary
 	c.ShouldBindWith(&req, binding.JSON)
-	s.Logger.Printf("the data in beneficiary is: %+v", req)
+	s.Logger.Printf("the data in beneficiary is: %+v", redact.Value(req))
 	user, err := ebs_fields.NewUserWithBeneficiaries(mobile, s.Db)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
@@ -140,6 +147,7 @@ func (s *Service) AddCards(c *gin.Context) {
 	// manually zero-valueing card ID to avoid gorm upserting it
 	for idx := range listCards {
 		listCards[idx].ID = 0
+		listCards[idx].CardRef = ""
 		listCards[idx].UserID = user.ID
 	}
 	if err := user.UpsertCards(listCards); err != nil {
@@ -150,7 +158,7 @@ func (s *Service) AddCards(c *gin.Context) {
 }
 
 // EditCard allow authorized users to edit their cards (e.g., edit pan / expdate)
-// this updates any card via
+// the card is referenced by its card_ref, or by its PAN in card_index
 func (s *Service) EditCard(c *gin.Context) {
 	var req ebs_fields.Card
 	err := c.ShouldBindWith(&req, binding.JSON)
@@ -164,7 +172,7 @@ func (s *Service) EditCard(c *gin.Context) {
 		return
 	}
 	// If no ID was provided that means we are adding a new card. We don't want that!
-	if req.CardIdx == "" {
+	if req.CardIdx == "" && req.CardRef == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "card idx is empty", "code": "card_idx_empty"})
 		return
 	}
@@ -184,7 +192,7 @@ func (s *Service) EditCard(c *gin.Context) {
 }
 
 // RemoveCard allow authorized users to remove their card
-// when the send the card id (from its list in app view)
+// when the send the card_ref (from its list in app view), or its PAN in card_index
 func (s *Service) RemoveCard(c *gin.Context) {
 	username := c.GetString("mobile")
 	if username == "" {
@@ -197,9 +205,9 @@ func (s *Service) RemoveCard(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "unmarshalling_error"})
 		return
 	}
-	s.Logger.Printf("the card is: %v+#", card)
+	s.Logger.Printf("the card is: %+v", redact.Value(card))
 	// If no ID was provided that means we are adding a new card. We don't want that!
-	if card.CardIdx == "" {
+	if card.CardIdx == "" && card.CardRef == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "card idx is empty", "code": "card_idx_empty"})
 		return
 	}
@@ -231,26 +239,10 @@ func (s *Service) NecToName(c *gin.Context) {
 	}
 }
 
-var billerChan = make(chan billerForm)
-
-// BillerHooks submits results to external endpoint
+// BillerHooks updates the validity of cached cards as reported by EBS
 func (s Service) BillerHooks() {
-
-	for {
-		select {
-		case value := <-billerChan:
-			log.Printf("The recv is: %v", value)
-			data, _ := json.Marshal(&value)
-			// FIXME this code is dangerous
-			if value.to == "" {
-				value.to = "http://test.tawasuloman.com:8088/ShihabSudanWS/ShihabEBSConfirmation"
-			}
-			if _, err := http.Post(value.to, "application/json", bytes.NewBuffer(data)); err != nil {
-				log.Printf("the error is: %v", err)
-			}
-		case res := <-ebs_fields.EBSRes:
-			s.Db.Debug().Model(&ebs_fields.CacheCards{}).Where("pan = ?", res.Pan).Update("is_valid", res.IsValid)
-		}
+	for res := range ebs_fields.EBSRes {
+		s.Db.Debug().Model(&ebs_fields.CacheCards{}).Where("pan_hash = ?", ebs_fields.HashPAN(res.Pan)).Update("is_valid", res.IsValid)
 	}
 }
 
@@ -264,26 +256,24 @@ func (s Service) BillerHooks() {
 // - We are not allowed to store value, we cannot save users money in our account
 // - We cannot store user's payment information (pan, ipin, exp date) in our system
 // - And we don't want the user to everytime login into the app and key in their payment information
+//
+// Standing orders (see [ScheduledPayment]) pay from the main card the same way.
 func (s *Service) PaymentOrder() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		mobile := c.GetString("mobile")
 		var req ebs_fields.Token
 		token, _ := uuid.NewRandom()
-		user, err := ebs_fields.GetCardsOrFail(mobile, s.Db)
-		if err != nil {
-			log.Printf("error in retrieving card: %v", err)
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"code": "bad_request", "message": err.Error()})
-		}
-
 		// there shouldn't be any error here, but still
 		if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
 			log.Printf("error in retrieving card: %v", err)
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"code": "bad_request", "message": err.Error()})
+			return
 		}
-		ipinBlock, err := ipin.Encrypt(s.NoebsConfig.EBSConsumerKey, user.Cards[0].IPIN, token.String())
+		cardHolder, err := s.mainCardFields(mobile, token.String())
 		if err != nil {
-			log.Printf("error in encryption: %v", err)
+			log.Printf("error in retrieving card: %v", err)
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"code": "bad_request", "message": err.Error()})
+			return
 		}
 		data := ebs_fields.ConsumerCardTransferFields{
 			ConsumerCommonFields: ebs_fields.ConsumerCommonFields{
@@ -291,14 +281,7 @@ func (s *Service) PaymentOrder() gin.HandlerFunc {
 				TranDateTime:  ebs_fields.EbsDate(),
 				UUID:          token.String(),
 			},
-			// user.Cards[0] won't error, since we:
-			// query the result in [ebs_fields.GetUserCard] and order them by is_main and first created
-			// if no card was added to the user, the [ebs_fields.GetUserCard] will error and we handle it
-			ConsumerCardHolderFields: ebs_fields.ConsumerCardHolderFields{
-				Pan:     user.Cards[0].Pan,
-				Ipin:    ipinBlock,
-				ExpDate: user.Cards[0].Expiry,
-			},
+			ConsumerCardHolderFields: cardHolder,
 			AmountFields: ebs_fields.AmountFields{
 				TranAmount:       float32(req.Amount), // it should be populated
 				TranCurrencyCode: "SDG",
@@ -310,6 +293,8 @@ func (s *Service) PaymentOrder() gin.HandlerFunc {
 		c.Request.Body = ioutil.NopCloser(bytes.NewBuffer(updatedRequest))
 		c.Request.ContentLength = int64(len(updatedRequest))
 		c.Request.Header.Set("Content-Type", "application/json")
+		// ShouldBindBodyWith reads the cached body, so it has to be replaced too
+		c.Set(gin.BodyBytesKey, updatedRequest)
 
 		// Call the next handler
 		c.Next()
@@ -333,6 +318,27 @@ func (s *Service) PaymentOrder() gin.HandlerFunc {
 	}
 }
 
+// mainCardFields returns the card holder fields of the user's main card with the IPIN
+// encrypted for the transaction tranUUID.
+func (s *Service) mainCardFields(mobile, tranUUID string) (ebs_fields.ConsumerCardHolderFields, error) {
+	user, err := ebs_fields.GetCardsOrFail(mobile, s.Db)
+	if err != nil {
+		return ebs_fields.ConsumerCardHolderFields{}, err
+	}
+	// user.Cards[0] won't error, since we:
+	// query the result in [ebs_fields.GetCardsOrFail] and order them by is_main and first created
+	// if no card was added to the user, the [ebs_fields.GetCardsOrFail] will error and we handle it
+	ipinBlock, err := encryptIPIN(s.NoebsConfig.EBSConsumerKey, user.Cards[0].IPIN, tranUUID)
+	if err != nil {
+		return ebs_fields.ConsumerCardHolderFields{}, err
+	}
+	return ebs_fields.ConsumerCardHolderFields{
+		Pan:     user.Cards[0].Pan,
+		Ipin:    ipinBlock,
+		ExpDate: user.Cards[0].Expiry,
+	}, nil
+}
+
 // CashoutPub experimental support to add pubsub support
 // we need to make this api public
 func (s *Service) CashoutPub() {
@@ -523,7 +529,7 @@ func (s *Service) billerID(mobile string) (string, error) {
 	fields.UUID = uid.String()
 	updatePaymentInfo(&fields, b)
 	fields.PayeeId = b.PayeeID
-	ipinBlock, err := ipin.Encrypt(s.NoebsConfig.EBSConsumerKey, s.NoebsConfig.BillInquiryIPIN, uid.String())
+	ipinBlock, err := encryptIPIN(s.NoebsConfig.EBSConsumerKey, s.NoebsConfig.BillInquiryIPIN, uid.String())
 	if err != nil {
 		s.Logger.Printf("error in encryption: %v", err)
 		return "", err
@@ -544,8 +550,8 @@ func (s *Service) billerID(mobile string) (string, error) {
 		return "", err
 	}
 	// the only part left is fixing EBS errors. Formalizing them per se.
-	code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-	s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+	code, res, ebsErr := s.EBSClient.Do(context.Background(), url, jsonBuffer)
+	s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 	// mask the pan
 	res.MaskPAN()
 	res.Name = s.ToDatabasename(url)
@@ -569,7 +575,7 @@ func (s *Service) billerID(mobile string) (string, error) {
 // to ensure that a card is actually valid
 func (s *Service) isValidCard(card ebs_fields.CacheCards) (bool, error) {
 	var dbCard ebs_fields.Card
-	if res := s.Db.Where("pan = ?", card.Pan).First(&dbCard); res.Error == nil {
+	if res := s.Db.Where("pan_hash = ?", ebs_fields.HashPAN(card.Pan)).First(&dbCard); res.Error == nil {
 		// if the card made it to the db this means it's a valid card
 		return true, nil
 	}
@@ -581,7 +587,7 @@ func (s *Service) isValidCard(card ebs_fields.CacheCards) (bool, error) {
 	fields.ConsumerCommonFields.TranDateTime = ebs_fields.EbsDate()
 	fields.ApplicationId = s.NoebsConfig.ConsumerID
 
-	ipinBlock, err := ipin.Encrypt(s.NoebsConfig.EBSConsumerKey, s.NoebsConfig.BillInquiryIPIN, uid.String())
+	ipinBlock, err := encryptIPIN(s.NoebsConfig.EBSConsumerKey, s.NoebsConfig.BillInquiryIPIN, uid.String())
 	if err != nil {
 		s.Logger.Printf("error in encryption: %v", err)
 		return false, err
@@ -597,9 +603,9 @@ func (s *Service) isValidCard(card ebs_fields.CacheCards) (bool, error) {
 	}
 
 	// the only part left is fixing EBS errors. Formalizing them per se.
-	_, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
+	_, res, ebsErr := s.EBSClient.Do(context.Background(), url, jsonBuffer)
 
-	// s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+	// s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 	// mask the pan
 	res.MaskPAN()
 	res.Name = s.ToDatabasename(url)
@@ -640,8 +646,8 @@ func (s *Service) GetIpinPubKey() error {
 		return errors.New("missing fields")
 	}
 	// the only part left is fixing EBS errors. Formalizing them per se.
-	code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-	s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+	code, res, ebsErr := s.EBSClient.Do(context.Background(), url, jsonBuffer)
+	s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 	res.Name = s.ToDatabasename(url)
 	s.Db.Table("transactions").Create(&res.EBSResponse)
 	if ebsErr != nil {
@@ -746,18 +752,131 @@ func (s *Service) SetUserLanguage(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"result": "ok"})
 }
 
+// GetNotificationChannel returns how the user wants to be notified
+func (s *Service) GetNotificationChannel(c *gin.Context) {
+	mobile := c.GetString("mobile")
+	user, err := ebs_fields.GetUserByMobile(mobile, s.Db)
+	if err != nil {
+		s.Logger.Printf("ERROR: could not get user from by mobile: %v", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	channel := user.NotificationChannel
+	if channel == "" {
+		channel = ChannelPush
+	}
+	c.JSON(http.StatusOK, gin.H{"channel": channel})
+}
+
+// SetNotificationChannel sets the channel (push, sms, ws or none) used to notify the user
+func (s *Service) SetNotificationChannel(c *gin.Context) {
+	mobile := c.GetString("mobile")
+	channel := c.Query("channel")
+	if !isValidChannel(channel) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "channel must be one of: push, sms, ws or none", "code": "client_error"})
+		return
+	}
+	user, err := ebs_fields.GetUserByMobile(mobile, s.Db)
+	if err != nil {
+		s.Logger.Printf("ERROR: could not get user from by mobile: %v", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	user.NotificationChannel = channel
+	if err := ebs_fields.UpdateUser(user, s.Db); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": "ok"})
+}
+
+// GetSigningPolicy returns whether the user signs their transfers and payments,
+// and the amount they are signed above.
+func (s *Service) GetSigningPolicy(c *gin.Context) {
+	user, err := ebs_fields.GetUserByMobile(c.GetString("mobile"), s.Db)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sign_requests": user.SignRequests, "sign_above": user.SignAbove})
+}
+
+// SetSigningPolicy sets whether the user signs their transfers and payments of
+// more than sign_above. The route is behind gateway.JWTAuth.SignedRequests, so
+// a user who signs their requests has to sign the change too.
+func (s *Service) SetSigningPolicy(c *gin.Context) {
+	var req struct {
+		SignRequests *bool   `json:"sign_requests" binding:"required"`
+		SignAbove    float32 `json:"sign_above" binding:"min=0"`
+	}
+	if err := c.ShouldBindWith(&req, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	user, err := ebs_fields.GetUserByMobile(c.GetString("mobile"), s.Db)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	if *req.SignRequests && user.PublicKey == "" {
+		var keys int64
+		s.Db.Model(&ebs_fields.Device{}).Where("user_mobile = ? AND trusted AND public_key != ''", user.Mobile).Count(&keys)
+		if keys == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "register the public key of your device first", "code": "no_public_key"})
+			return
+		}
+	}
+	err = s.Db.Model(&ebs_fields.User{}).Where("mobile = ?", user.Mobile).
+		Updates(map[string]any{"sign_requests": *req.SignRequests, "sign_above": req.SignAbove}).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sign_requests": *req.SignRequests, "sign_above": req.SignAbove})
+}
+
+// KYC submits the passport and the images of the signed in user for a review
+// by the support team (see dashboard.ReviewKYC).
 func (s *Service) KYC(ctx *gin.Context) {
-	// Decode the request body into the CreateUserRequest struct
 	var request ebs_fields.KYCPassport
 	err := ctx.ShouldBindJSON(&request)
 	if err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
 		return
 	}
-	if err := ebs_fields.UpdateUserWithKYC(s.Db, &request); err != nil {
+	kyc, err := ebs_fields.SubmitKYC(s.Db, s.KYCStore, ctx.GetString("mobile"), &request, time.Now())
+	switch {
+	case errors.Is(err, ebs_fields.ErrPassportExpired):
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "passport_expired"})
+	case errors.Is(err, ebs_fields.ErrInvalidKYCTransition):
+		ctx.JSON(http.StatusConflict, gin.H{"message": "the kyc is waiting for a review", "code": "kyc_pending"})
+	case errors.Is(err, ebs_fields.ErrInvalidPassport), errors.Is(err, ebs_fields.ErrInvalidKYCImage):
 		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+	case err != nil:
+		s.Logger.Printf("error in submitting kyc: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+	default:
+		ctx.JSON(http.StatusOK, gin.H{"message": "KYC created successfully", "code": "ok", "status": kyc.Status})
+	}
+}
+
+// KYCStatus returns where the KYC of the signed in user is in the review, and
+// the tier they have.
+func (s *Service) KYCStatus(ctx *gin.Context) {
+	user, err := ebs_fields.GetUserWithKYCAndPassport(s.Db, ctx.GetString("mobile"))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error(), "code": "not_found"})
+		return
+	}
+	tier, err := ebs_fields.ActiveKYCTier(s.Db, user, time.Now())
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	if user.KYC == nil {
+		ctx.JSON(http.StatusOK, gin.H{"status": "", "kyc_tier": tier})
 		return
 	}
-	// Return a success message
-	ctx.JSON(http.StatusOK, gin.H{"message": "KYC created successfully", "code": "ok"})
+	ctx.JSON(http.StatusOK, gin.H{"status": user.KYC.Status, "kyc_tier": tier, "review_note": user.KYC.ReviewNote,
+		"reviewed_at": user.KYC.ReviewedAt, "passport_expiration_date": user.KYC.Passport.ExpirationDate})
 }
@@ -27,7 +27,10 @@ func TestService_isValidCard(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &Service{
-				Db: testDB,
+				Db:          testDB,
+				Logger:      testLogger,
+				NoebsConfig: noebsConfig,
+				EBSClient:   &ebs_fields.FakeEBSClient{},
 			}
 			got, err := s.isValidCard(tt.args.card)
 			if (err != nil) != tt.wantErr {
@@ -0,0 +1,95 @@
+package consumer
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// newSession signs mobile in from the device of the request and returns the
+// response carrying the tokens of the session, it writes the error response otherwise.
+// deviceID falls back to the X-Device-ID header.
+func (s *Service) newSession(c *gin.Context, mobile, deviceID string) (gin.H, bool) {
+	if deviceID == "" {
+		deviceID = c.GetHeader("X-Device-ID")
+	}
+	pair, err := s.Auth.NewSession(mobile, deviceID, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "session_error"})
+		return nil, false
+	}
+	c.Writer.Header().Set("Authorization", pair.AccessToken)
+	return gin.H{"authorization": pair.AccessToken, "refresh_token": pair.RefreshToken, "expires_in": pair.ExpiresIn, "session_id": pair.SessionID}, true
+}
+
+// ListSessions returns the devices the user is signed in from, the session of
+// the current request is marked as current.
+func (s *Service) ListSessions(c *gin.Context) {
+	sessions, err := s.Auth.Sessions(c.GetString("mobile"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	current := c.GetUint("session_id")
+	res := make([]gin.H, 0, len(sessions))
+	for _, session := range sessions {
+		res = append(res, gin.H{
+			"id":           session.ID,
+			"device_id":    session.DeviceID,
+			"user_agent":   session.UserAgent,
+			"ip":           session.IP,
+			"created_at":   session.CreatedAt,
+			"last_used_at": session.LastUsedAt,
+			"expires_at":   session.ExpiresAt,
+			"current":      session.ID == current,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"result": res})
+}
+
+// RevokeSession signs the user out of one of their sessions, e.g., a lost phone
+func (s *Service) RevokeSession(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "invalid session id", "code": "bad_request"})
+		return
+	}
+	err = s.Auth.RevokeSession(c.GetString("mobile"), uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"message": "session not found", "code": "not_found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// RevokeSessions signs the user out of all of their sessions, including the current one
+func (s *Service) RevokeSessions(c *gin.Context) {
+	if err := s.Auth.RevokeSessions(c.GetString("mobile")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// Logout revokes the session of the current request. A token issued without a
+// session is revoked on its own, and none of them can be refreshed anymore.
+func (s *Service) Logout(c *gin.Context) {
+	var err error
+	if id := c.GetUint("session_id"); id != 0 {
+		err = s.Auth.RevokeSession(c.GetString("mobile"), id)
+	} else if err = s.Auth.RevokeToken(c.GetString("jti"), time.Unix(c.GetInt64("jwt_expires_at"), 0)); err == nil {
+		err = s.Auth.RevokeLegacyTokens(c.GetString("mobile"))
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": "ok"})
+}
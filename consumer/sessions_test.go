@@ -0,0 +1,91 @@
+package consumer
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/adonese/noebs/apigateway"
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+func TestService_sessions(t *testing.T) {
+	db := openTestDB(t, &ebs_fields.User{}, &gateway.Session{}, &gateway.RevokedToken{}, &gateway.AuditLog{})
+	jwtAuth := &gateway.JWTAuth{Key: []byte("sessions test"), Db: db}
+	s := &Service{Db: db, Auth: jwtAuth, Logger: logrus.New()}
+	user := ebs_fields.User{Model: gorm.Model{ID: 1}, Mobile: "0912141679", Password: "12345678"}
+	user.HashPassword()
+	db.Create(&user)
+
+	r := gin.New()
+	r.POST("/refresh", s.RefreshHandler)
+	authorized := r.Group("/", jwtAuth.AuthMiddleware())
+	authorized.GET("/sessions", s.ListSessions)
+	authorized.POST("/change_password", s.ChangePassword)
+	authorized.POST("/logout", s.Logout)
+
+	do := func(method, path, token string, body any) (int, map[string]any) {
+		payload, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+		req.Header.Set("Authorization", token)
+		r.ServeHTTP(w, req)
+		var res map[string]any
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res
+	}
+
+	phone, _ := jwtAuth.NewSession(user.Mobile, "phone", "test", "127.0.0.1")
+	laptop, _ := jwtAuth.NewSession(user.Mobile, "laptop", "test", "127.0.0.1")
+
+	code, res := do(http.MethodPost, "/refresh", "", gin.H{"refresh_token": phone.RefreshToken})
+	if code != http.StatusOK || res["refresh_token"] == phone.RefreshToken {
+		t.Fatalf("RefreshHandler() = %v, %v", code, res)
+	}
+	phoneAccess := res["authorization"].(string)
+	if code, res := do(http.MethodGet, "/sessions", phoneAccess, nil); code != http.StatusOK || len(res["result"].([]any)) != 2 {
+		t.Errorf("ListSessions() = %v, %v", code, res)
+	}
+
+	for _, body := range []gin.H{
+		{"password": "87654321", "new_password": "Abc12345!"},
+		{"password": "12345678", "new_password": "abc12345"},
+	} {
+		if code, res := do(http.MethodPost, "/change_password", laptop.AccessToken, body); code != http.StatusBadRequest {
+			t.Errorf("ChangePassword(%v) = %v, %v", body, code, res)
+		}
+	}
+	// changing the password signs every device out and starts a new session
+	code, res = do(http.MethodPost, "/change_password", laptop.AccessToken, gin.H{"password": "12345678", "new_password": "Abc12345!"})
+	if code != http.StatusOK || res["refresh_token"] == nil {
+		t.Fatalf("ChangePassword() = %v, %v", code, res)
+	}
+	newAccess := res["authorization"].(string)
+	if sessions, _ := jwtAuth.Sessions(user.Mobile); len(sessions) != 1 || sessions[0].DeviceID != "laptop" {
+		t.Errorf("ChangePassword() sessions = %+v, want one of the laptop", sessions)
+	}
+	var audit gateway.AuditLog
+	if err := db.Where("mobile = ? AND event = ?", user.Mobile, "password_change").First(&audit).Error; err != nil {
+		t.Errorf("ChangePassword() wasn't audited: %v", err)
+	}
+	for _, token := range []string{phoneAccess, laptop.AccessToken} {
+		if code, _ := do(http.MethodGet, "/sessions", token, nil); code != http.StatusUnauthorized {
+			t.Errorf("a token issued before ChangePassword() got %v", code)
+		}
+	}
+	if code, _ := do(http.MethodPost, "/refresh", "", gin.H{"refresh_token": laptop.RefreshToken}); code != http.StatusUnauthorized {
+		t.Errorf("RefreshHandler() with a revoked session = %v", code)
+	}
+
+	if code, _ := do(http.MethodPost, "/logout", newAccess, nil); code != http.StatusOK {
+		t.Errorf("Logout() = %v", code)
+	}
+	if code, _ := do(http.MethodGet, "/sessions", newAccess, nil); code != http.StatusUnauthorized {
+		t.Errorf("a token used after Logout() got %v", code)
+	}
+}
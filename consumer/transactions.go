@@ -0,0 +1,303 @@
+package consumer
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// transactionCategories maps the transaction types, the names ToDatabasename
+// gives them, to the categories of the history.
+var transactionCategories = map[string]string{
+	"card_transfer":          "transfer",
+	"account_transfer":       "transfer",
+	"bill_payment":           "bill",
+	"purchase":               "purchase",
+	"qr_purchase":            "purchase",
+	"qr_refund":              "refund",
+	"cashin":                 "cash",
+	"cashout":                "cash",
+	"generate_voucher":       "voucher",
+	"complete_tran":          "transfer",
+	"balance":                "inquiry",
+	"bill_inquiry":           "inquiry",
+	"status":                 "inquiry",
+	"merchant_status":        "inquiry",
+	"customer_info":          "inquiry",
+	"msisdn_pan":             "inquiry",
+	"payees_list":            "inquiry",
+	"public_key":             "inquiry",
+	"alive":                  "inquiry",
+	"change_ipin":            "card",
+	"generate_ipin":          "card",
+	"ipin_completion":        "card",
+	"register":               "card",
+	"complete_card_issuance": "card",
+}
+
+// Transaction statuses of the history
+const (
+	TransactionSuccessful = "successful"
+	TransactionFailed     = "failed"
+	TransactionPending    = "pending"
+	TransactionReversed   = "reversed"
+)
+
+// TransactionView is a transaction in the history of a user
+type TransactionView struct {
+	UUID string    `json:"uuid"`
+	Date time.Time `json:"date"`
+	// Type is the name ToDatabasename gives the transaction, Category groups the types
+	Type      string  `json:"type"`
+	Category  string  `json:"category"`
+	Direction string  `json:"direction"`
+	Status    string  `json:"status"`
+	Amount    float32 `json:"amount"`
+	Fees      float32 `json:"fees"`
+	Currency  string  `json:"currency,omitempty"`
+	// Card is the masked card of the user, Counterparty the card, account,
+	// merchant or bill on the other side
+	Card            string `json:"card,omitempty"`
+	Counterparty    string `json:"counterparty,omitempty"`
+	ReferenceNumber string `json:"reference_number,omitempty"`
+	Message         string `json:"message,omitempty"`
+}
+
+// TransactionSummary totals the successful transactions of a history
+type TransactionSummary struct {
+	Count  int64   `json:"count"`
+	Debit  float64 `json:"debit"`
+	Credit float64 `json:"credit"`
+	Fees   float64 `json:"fees"`
+}
+
+// transactionStatus is the status of tran in the history
+func transactionStatus(tran *ebs_fields.EBSResponse) string {
+	switch tran.ReconcileState {
+	case ebs_fields.ReconcileReversed:
+		return TransactionReversed
+	case ebs_fields.ReconcilePending, ebs_fields.ReconcileUnresolved:
+		return TransactionPending
+	}
+	if tran.ResponseStatus == "Successful" {
+		return TransactionSuccessful
+	}
+	return TransactionFailed
+}
+
+// statusConds are the conditions of the statuses, they match transactionStatus
+var statusConds = map[string]string{
+	TransactionReversed:   "coalesce(reconcile_state, '') = 'reversed'",
+	TransactionPending:    "coalesce(reconcile_state, '') IN ('pending', 'unresolved')",
+	TransactionSuccessful: "coalesce(reconcile_state, '') NOT IN ('reversed', 'pending', 'unresolved') AND response_status = 'Successful'",
+	TransactionFailed:     "coalesce(reconcile_state, '') NOT IN ('reversed', 'pending', 'unresolved') AND coalesce(response_status, '') <> 'Successful'",
+}
+
+// creditCond matches the transactions that were made to the cards of the
+// user, by someone else. @cards are the fingerprints of the cards (see ebs_fields.HashPAN).
+const creditCond = "coalesce(receiver_pan_hash, '') IN @cards AND coalesce(mobile, '') <> @mobile"
+
+// newTransactionView returns tran as seen by the user it is a credit of when credit is set
+func newTransactionView(tran *ebs_fields.EBSResponse, credit bool) TransactionView {
+	view := TransactionView{
+		UUID:            tran.UUID,
+		Date:            tran.CreatedAt,
+		Type:            tran.Name,
+		Category:        transactionCategories[tran.Name],
+		Direction:       "debit",
+		Status:          transactionStatus(tran),
+		Amount:          tran.TranAmount,
+		Fees:            tran.DynamicFees,
+		Currency:        tran.TranCurrency,
+		Card:            firstOf(ebs_fields.MaskCard(tran.SenderPAN), ebs_fields.MaskCard(tran.PAN)),
+		Counterparty:    firstOf(ebs_fields.MaskCard(tran.ReceiverPAN), ebs_fields.MaskCard(tran.ToCard), tran.ToAccount, tran.MerchantName, tran.BillTo, tran.PayeeID),
+		ReferenceNumber: tran.ReferenceNumber,
+		Message:         tran.ResponseMessage,
+	}
+	if view.Category == "" {
+		view.Category = "other"
+	}
+	if tran.TranFee != nil {
+		view.Fees = *tran.TranFee
+	}
+	if credit {
+		// the fees are paid by the sender
+		view.Direction, view.Fees = "credit", 0
+		view.Card = firstOf(ebs_fields.MaskCard(tran.ReceiverPAN), ebs_fields.MaskCard(tran.ToCard))
+		view.Counterparty = firstOf(ebs_fields.MaskCard(tran.SenderPAN), ebs_fields.MaskCard(tran.PAN))
+	}
+	return view
+}
+
+func firstOf(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// encodeTransactionCursor returns the cursor of the page after view, the
+// last transaction of a page: its date and its uuid.
+func encodeTransactionCursor(view TransactionView) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(view.Date.UnixNano(), 10) + "|" + view.UUID))
+}
+
+func decodeTransactionCursor(cursor string) (time.Time, string, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	nanos, uuid, ok := strings.Cut(string(b), "|")
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if !ok || err != nil {
+		return time.Time{}, "", false
+	}
+	return time.Unix(0, n), uuid, true
+}
+
+func parseDate(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+// GetTransactions returns the transaction history of the user: the
+// transactions they made, and the ones made to their cards, the latest first.
+// Filters: from / to (RFC3339 or 2006-01-02, a date includes the whole day),
+// type (comma separated, see transactionCategories), min_amount / max_amount,
+// status and direction (debit or credit). It is paginated with limit and the
+// next_cursor of the previous page, and summarizes the whole history.
+func (s *Service) GetTransactions(c *gin.Context) {
+	mobile := c.GetString("mobile")
+	user, err := ebs_fields.GetCardsOrFail(mobile, s.Db)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	cards := make([]string, 0, len(user.Cards))
+	for _, card := range user.Cards {
+		cards = append(cards, ebs_fields.HashPAN(card.Pan))
+	}
+	args := map[string]any{"mobile": mobile, "cards": cards}
+
+	q := s.Db.Model(&ebs_fields.EBSResponse{}).
+		Where("mobile = @mobile OR sender_pan_hash IN @cards OR receiver_pan_hash IN @cards", args)
+	bad := func(message string) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": message, "code": "bad_request"})
+	}
+	if v := c.Query("from"); v != "" {
+		t, err := parseDate(v)
+		if err != nil {
+			bad("invalid from date: " + v)
+			return
+		}
+		q = q.Where("created_at >= ?", t)
+	}
+	if v := c.Query("to"); v != "" {
+		t, err := parseDate(v)
+		if err != nil {
+			bad("invalid to date: " + v)
+			return
+		}
+		if len(v) == len("2006-01-02") {
+			t = t.AddDate(0, 0, 1)
+		}
+		q = q.Where("created_at < ?", t)
+	}
+	if v := c.Query("type"); v != "" {
+		types := strings.Split(v, ",")
+		for _, t := range types {
+			if _, ok := transactionCategories[t]; !ok {
+				bad("unknown transaction type: " + t)
+				return
+			}
+		}
+		q = q.Where("name IN ?", types)
+	}
+	for _, bound := range []struct{ param, cond string }{{"min_amount", "tran_amount >= ?"}, {"max_amount", "tran_amount <= ?"}} {
+		v := c.Query(bound.param)
+		if v == "" {
+			continue
+		}
+		amount, err := strconv.ParseFloat(v, 32)
+		if err != nil {
+			bad("invalid " + bound.param + ": " + v)
+			return
+		}
+		q = q.Where(bound.cond, amount)
+	}
+	if v := c.Query("status"); v != "" {
+		cond, ok := statusConds[v]
+		if !ok {
+			bad("status must be one of: successful, failed, pending or reversed")
+			return
+		}
+		q = q.Where(cond)
+	}
+	switch c.Query("direction") {
+	case "":
+	case "credit":
+		q = q.Where(creditCond, args)
+	case "debit":
+		q = q.Where("NOT ("+creditCond+")", args)
+	default:
+		bad("direction must be debit or credit")
+		return
+	}
+	q = q.Session(&gorm.Session{})
+
+	var summary TransactionSummary
+	err = q.Select("count(*) AS count, "+
+		"coalesce(sum(CASE WHEN "+statusConds[TransactionSuccessful]+" AND NOT ("+creditCond+") THEN tran_amount ELSE 0 END), 0) AS debit, "+
+		"coalesce(sum(CASE WHEN "+statusConds[TransactionSuccessful]+" AND "+creditCond+" THEN tran_amount ELSE 0 END), 0) AS credit, "+
+		"coalesce(sum(CASE WHEN "+statusConds[TransactionSuccessful]+" AND NOT ("+creditCond+") THEN coalesce(tran_fee, dynamic_fees, 0) ELSE 0 END), 0) AS fees", args).
+		Scan(&summary).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	page := q
+	if v := c.Query("cursor"); v != "" {
+		date, uuid, ok := decodeTransactionCursor(v)
+		if !ok {
+			bad("invalid cursor")
+			return
+		}
+		page = page.Where("created_at < ? OR (created_at = ? AND uuid < ?)", date, date, uuid)
+	}
+	var trans []struct {
+		ebs_fields.EBSResponse
+		Credit bool
+	}
+	err = page.Select("*, "+creditCond+" AS credit", args).Order("created_at desc, uuid desc").Limit(limit + 1).Find(&trans).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	views := make([]TransactionView, 0, len(trans))
+	for i := range trans {
+		if i == limit {
+			break
+		}
+		views = append(views, newTransactionView(&trans[i].EBSResponse, trans[i].Credit))
+	}
+	res := gin.H{"result": views, "summary": summary}
+	if len(trans) > limit {
+		res["next_cursor"] = encodeTransactionCursor(views[len(views)-1])
+	}
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,131 @@
+package consumer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func TestService_GetTransactions(t *testing.T) {
+	db := openTestDB(t, &ebs_fields.User{}, &ebs_fields.Card{}, &ebs_fields.EBSResponse{})
+	s := &Service{Db: db}
+	user := ebs_fields.User{Model: gorm.Model{ID: 1}, Mobile: "0912141679"}
+	db.Create(&user)
+	db.Create(&ebs_fields.Card{Pan: "9222081700176714465", Expiry: "2302", UserID: user.ID})
+	// quick payments store the cards in clear, the others masked
+	mine, other := "9222081700176714465", "9222081700176714467"
+	// has the same first 6 and last 4 digits as the card of the user
+	lookalike := "9222081799999994465"
+
+	start := time.Date(2023, time.March, 15, 12, 0, 0, 0, time.Local)
+	fee := float32(2)
+	trans := []ebs_fields.EBSResponse{
+		{UUID: "t1", Name: "card_transfer", TranAmount: 100, TranFee: &fee, ResponseStatus: "Successful", Mobile: user.Mobile, SenderPAN: mine, ReceiverPAN: other},
+		{UUID: "t2", Name: "bill_payment", TranAmount: 50, DynamicFees: 1, ResponseStatus: "Successful", PAN: mine, BillTo: "0912141680"},
+		{UUID: "t3", Name: "card_transfer", TranAmount: 300, ResponseStatus: "Successful", Mobile: "0912141680", SenderPAN: other, ReceiverPAN: mine},
+		{UUID: "t4", Name: "purchase", TranAmount: 20, ResponseStatus: "Failed", PAN: mine},
+		{UUID: "t5", Name: "card_transfer", TranAmount: 40, ReconcileState: ebs_fields.ReconcilePending, Mobile: user.Mobile, SenderPAN: mine, ReceiverPAN: other},
+		// of another user
+		{UUID: "t6", Name: "card_transfer", TranAmount: 10, ResponseStatus: "Successful", Mobile: "0912141680", SenderPAN: other, ReceiverPAN: other},
+		{UUID: "t7", Name: "card_transfer", TranAmount: 10, ResponseStatus: "Successful", Mobile: "0912141680", SenderPAN: lookalike, ReceiverPAN: lookalike},
+		{UUID: "t8", Name: "card_transfer", TranAmount: 10, ResponseStatus: "Successful", Mobile: "0912141680", SenderPAN: "922208*****4467", ReceiverPAN: "922208*****4465"},
+	}
+	for i := range trans {
+		trans[i].Model = gorm.Model{ID: uint(i + 1), CreatedAt: start.Add(time.Duration(i) * time.Hour)}
+		if err := db.Create(&trans[i]).Error; err != nil {
+			t.Fatalf("unable to create transaction: %v", err)
+		}
+	}
+
+	r := gin.New()
+	r.GET("/transactions", func(c *gin.Context) { c.Set("mobile", user.Mobile) }, s.GetTransactions)
+	type response struct {
+		Result     []TransactionView  `json:"result"`
+		Summary    TransactionSummary `json:"summary"`
+		NextCursor string             `json:"next_cursor"`
+	}
+	get := func(query url.Values) (int, response) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/transactions?"+query.Encode(), nil))
+		var res response
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res
+	}
+	uuids := func(views []TransactionView) []string {
+		ids := []string{}
+		for _, v := range views {
+			ids = append(ids, v.UUID)
+		}
+		return ids
+	}
+
+	tests := []struct {
+		name     string
+		query    url.Values
+		wantCode int
+		want     []string
+	}{
+		{"all", url.Values{}, http.StatusOK, []string{"t5", "t4", "t3", "t2", "t1"}},
+		{"credit", url.Values{"direction": {"credit"}}, http.StatusOK, []string{"t3"}},
+		{"debit", url.Values{"direction": {"debit"}}, http.StatusOK, []string{"t5", "t4", "t2", "t1"}},
+		{"types", url.Values{"type": {"bill_payment,purchase"}}, http.StatusOK, []string{"t4", "t2"}},
+		{"failed", url.Values{"status": {"failed"}}, http.StatusOK, []string{"t4"}},
+		{"pending", url.Values{"status": {"pending"}}, http.StatusOK, []string{"t5"}},
+		{"amounts", url.Values{"min_amount": {"50"}, "max_amount": {"100"}}, http.StatusOK, []string{"t2", "t1"}},
+		{"dates", url.Values{"from": {start.Add(time.Hour).Format(time.RFC3339)}, "to": {start.Add(3 * time.Hour).Format(time.RFC3339)}}, http.StatusOK, []string{"t3", "t2"}},
+		{"unknown type", url.Values{"type": {"transfer"}}, http.StatusBadRequest, nil},
+		{"unknown direction", url.Values{"direction": {"in"}}, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, res := get(tt.query)
+			if code != tt.wantCode {
+				t.Fatalf("GetTransactions() code = %d, want %d", code, tt.wantCode)
+			}
+			if tt.want != nil && !reflect.DeepEqual(uuids(res.Result), tt.want) {
+				t.Errorf("GetTransactions() = %v, want %v", uuids(res.Result), tt.want)
+			}
+		})
+	}
+
+	_, res := get(url.Values{})
+	if want := (TransactionSummary{Count: 5, Debit: 150, Credit: 300, Fees: 3}); res.Summary != want {
+		t.Errorf("GetTransactions() summary = %+v, want %+v", res.Summary, want)
+	}
+	for _, view := range res.Result {
+		if strings.Contains(view.Card+view.Counterparty, mine) || strings.Contains(view.Card+view.Counterparty, other) {
+			t.Errorf("GetTransactions() exposes a card: %+v", view)
+		}
+	}
+	credit := res.Result[2]
+	if credit.Direction != "credit" || credit.Card != "922208*****4465" || credit.Counterparty != "922208*****4467" || credit.Category != "transfer" || credit.Fees != 0 {
+		t.Errorf("GetTransactions() credit = %+v", credit)
+	}
+	if bill := res.Result[3]; bill.Category != "bill" || bill.Counterparty != "0912141680" || bill.Fees != 1 {
+		t.Errorf("GetTransactions() bill payment = %+v", bill)
+	}
+
+	// the pages follow each other with next_cursor
+	var pages [][]string
+	query := url.Values{"limit": {"2"}}
+	for {
+		_, res := get(query)
+		pages = append(pages, uuids(res.Result))
+		if res.NextCursor == "" {
+			break
+		}
+		query.Set("cursor", res.NextCursor)
+	}
+	if want := [][]string{{"t5", "t4"}, {"t3", "t2"}, {"t1"}}; !reflect.DeepEqual(pages, want) {
+		t.Errorf("GetTransactions() pages = %v, want %v", pages, want)
+	}
+}
@@ -0,0 +1,29 @@
+package consumer
+
+import "github.com/adonese/noebs/ebs_fields"
+
+// tokenEvent is the data of token.paid and token.failed webhook events
+type tokenEvent struct {
+	Token       string                 `json:"token"`
+	Amount      float32                `json:"amount"`
+	Transaction ebs_fields.EBSResponse `json:"transaction"`
+}
+
+// webhookTransaction returns res as it is sent to webhook endpoints: card
+// numbers are replaced by their references.
+func webhookTransaction(res ebs_fields.EBSResponse) ebs_fields.EBSResponse {
+	res.PAN = ebs_fields.MaskCard(res.PAN)
+	res.SenderPAN = ebs_fields.MaskCard(res.SenderPAN)
+	res.ReceiverPAN = ebs_fields.MaskCard(res.ReceiverPAN)
+	res.ToCard = ebs_fields.MaskCard(res.ToCard)
+	return res
+}
+
+// publish sends a webhook event to the endpoints of owner, it is a no-op
+// when webhooks are not configured.
+func (s *Service) publish(owner, eventType string, data any) {
+	if s.Webhooks == nil {
+		return
+	}
+	s.Webhooks.Publish(owner, eventType, data)
+}
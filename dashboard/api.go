@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/adonese/noebs/ebs_fields"
+	"github.com/adonese/noebs/redact"
 	"github.com/adonese/noebs/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v7"
@@ -18,11 +19,13 @@ import (
 	"gorm.io/gorm"
 )
 
-var log = logrus.New()
+var log = redact.Install(logrus.New())
 
 type Service struct {
 	Redis *redis.Client
 	Db    *gorm.DB
+	// KYCStore keeps the images of the KYCs
+	KYCStore ebs_fields.KYCStore
 }
 
 func (s Service) calculateOffset(page, pageSize int) uint {
@@ -78,7 +81,7 @@ func (s *Service) TransactionsCount(c *gin.Context) {
 	var tran ebs_fields.EBSResponse
 	var count int64
 
-	if err := env.Db.Model(&tran).Count(&count).Error; err != nil {
+	if err := scope(c, env.Db.Model(&tran)).Count(&count).Error; err != nil {
 		log.WithFields(
 			logrus.Fields{
 				"code":    err.Error(),
@@ -104,7 +107,7 @@ func (s *Service) TransactionByTid(c *gin.Context) {
 	tid, _ := c.GetQuery("tid")
 
 	var tran []ebs_fields.EBSResponse
-	if err := db.Where("terminal_id LIKE ?", tid+"%").Find(&tran).Error; err != nil {
+	if err := scope(c, db).Where("terminal_id LIKE ?", tid+"%").Find(&tran).Error; err != nil {
 		log.WithFields(logrus.Fields{
 			"code":    err.Error(),
 			"details": tran,
@@ -147,7 +150,7 @@ func (s *Service) GetAll(c *gin.Context) {
 	page, _ := strconv.Atoi(p)
 
 	offset := s.calculateOffset(page, pageSize)
-	tran, count := sortTable(s.Db, searchField, search, sortField, sortCase, int(offset), pageSize)
+	tran, count := sortTable(scope(c, s.Db), searchField, search, sortField, sortCase, int(offset), pageSize)
 
 	paging := map[string]int{
 		"previous": page - 1,
@@ -163,7 +166,7 @@ func (s *Service) GetID(c *gin.Context) {
 	db, _ := gorm.Open(sqlite.Open("test.db"), &gorm.Config{})
 
 	var tran ebs_fields.EBSResponse
-	if err := db.Where("id = ?", id).First(&tran).Error; err != nil {
+	if err := scope(c, db).Where("id = ?", id).First(&tran).Error; err != nil {
 		c.AbortWithStatus(404)
 	} else {
 		c.JSON(http.StatusOK, gin.H{"result": tran})
@@ -297,6 +300,10 @@ func (s *Service) MerchantTransactionsEndpoint(c *gin.Context) {
 			"code": "terminal_id_not_present_in_request"})
 		return
 	}
+	if !inScope(c, tid) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "terminal id is not yours", "code": "forbidden"})
+		return
+	}
 
 	v, err := s.Redis.LRange(tid+":purchase", 0, -1).Result()
 	if err != nil {
@@ -320,6 +327,8 @@ func (s *Service) ReportIssueEndpoint(c *gin.Context) {
 	var issue merchantsIssues
 	if err := c.ShouldBindJSON(&issue); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"code": "terminalId_not_provided", "message": "Pls provide terminal Id"})
+	} else if !inScope(c, issue.TerminalID) {
+		c.JSON(http.StatusForbidden, gin.H{"message": "terminal id is not yours", "code": "forbidden"})
 	} else {
 		s.Redis.LPush("complaints", &issue)
 		s.Redis.LPush(issue.TerminalID+":complaints", &issue)
@@ -0,0 +1,146 @@
+package dashboard
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	gateway "github.com/adonese/noebs/apigateway"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// apiClientRequest is the body creating or updating an API client, fields
+// that aren't sent are kept as they are on updates.
+type apiClientRequest struct {
+	Name        *string    `json:"name"`
+	Email       *string    `json:"email"`
+	Scopes      []string   `json:"scopes"`
+	RateLimit   *int       `json:"rate_limit"`
+	AllowedIPs  []string   `json:"allowed_ips"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	TerminalIDs []string   `json:"terminal_ids"`
+}
+
+func (r *apiClientRequest) apply(client *gateway.APIClient) {
+	if r.Name != nil {
+		client.Name = *r.Name
+	}
+	if r.Email != nil {
+		client.Email = *r.Email
+	}
+	if r.Scopes != nil {
+		client.Scopes = r.Scopes
+	}
+	if r.RateLimit != nil {
+		client.RateLimit = *r.RateLimit
+	}
+	if r.AllowedIPs != nil {
+		client.AllowedIPs = r.AllowedIPs
+	}
+	if r.ExpiresAt != nil {
+		client.ExpiresAt = r.ExpiresAt
+	}
+	if r.TerminalIDs != nil {
+		client.TerminalIDs = r.TerminalIDs
+	}
+}
+
+// APIClients lists the API keys of the B2B clients, revoked ones included
+func (s *Service) APIClients(c *gin.Context) {
+	var clients []gateway.APIClient
+	if err := s.Db.Order("id desc").Find(&clients).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": clients})
+}
+
+// CreateAPIClient creates an API key for a B2B client, the key is only returned
+// in this response.
+func (s *Service) CreateAPIClient(c *gin.Context) {
+	var req apiClientRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	if req.Name == nil && req.Email == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "name or email is required", "code": "bad_request"})
+		return
+	}
+	client := gateway.APIClient{Scopes: []string{gateway.ScopeConsumer}}
+	req.apply(&client)
+	key, err := gateway.NewAPIClient(s.Db, &client)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"result": client, "api_key": key})
+}
+
+// UpdateAPIClient changes the scopes, rate limit, allowed IPs or expiry of an API key
+func (s *Service) UpdateAPIClient(c *gin.Context) {
+	var req apiClientRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	var client gateway.APIClient
+	if err := s.Db.First(&client, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "api client not found", "code": "not_found"})
+		return
+	}
+	req.apply(&client)
+	if err := client.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	if err := s.Db.Save(&client).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": client})
+}
+
+// RotateAPIClient issues a new key replacing an API key, the old key keeps
+// working for grace seconds (a day by default).
+func (s *Service) RotateAPIClient(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "invalid api client id", "code": "bad_request"})
+		return
+	}
+	grace, err := strconv.Atoi(c.DefaultQuery("grace", "86400"))
+	if err != nil || grace < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "invalid grace", "code": "bad_request"})
+		return
+	}
+	client, key, err := gateway.RotateAPIClient(s.Db, uint(id), time.Duration(grace)*time.Second)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"message": "api client not found", "code": "not_found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"result": client, "api_key": key})
+}
+
+// RevokeAPIClient revokes an API key right away
+func (s *Service) RevokeAPIClient(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "invalid api client id", "code": "bad_request"})
+		return
+	}
+	err = gateway.RevokeAPIClient(s.Db, uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"message": "api client not found or already revoked", "code": "not_found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": "ok"})
+}
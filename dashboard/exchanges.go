@@ -0,0 +1,68 @@
+package dashboard
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// EBSExchanges searches the requests sent to EBS and their responses, it is
+// used to answer EBS disputes. Filters: uuid, request_id, pan (its last 4
+// digits), and from / to (RFC3339 or 2006-01-02), paginated with page and page_size.
+func (s *Service) EBSExchanges(c *gin.Context) {
+	q := s.Db.Model(&ebs_fields.EBSExchange{})
+	if uuid := c.Query("uuid"); uuid != "" {
+		q = q.Where("uuid = ?", uuid)
+	}
+	if id := c.Query("request_id"); id != "" {
+		q = q.Where("request_id = ?", id)
+	}
+	if pan := c.Query("pan"); pan != "" {
+		if len(pan) > 4 {
+			pan = pan[len(pan)-4:]
+		}
+		q = q.Where("pan_last4 = ?", pan)
+	}
+	for _, bound := range []struct{ param, cond string }{{"from", "created_at >= ?"}, {"to", "created_at <= ?"}} {
+		v := c.Query(bound.param)
+		if v == "" {
+			continue
+		}
+		t, err := parseDate(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "invalid " + bound.param + " date: " + v, "code": "bad_request"})
+			return
+		}
+		q = q.Where(bound.cond, t)
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "50"))
+	if pageSize <= 0 || pageSize > 100 {
+		pageSize = 50
+	}
+	var count int64
+	var exchanges []ebs_fields.EBSExchange
+	q = q.Session(&gorm.Session{})
+	if err := q.Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	if err := q.Order("id desc").Offset(int(s.calculateOffset(page, pageSize))).Limit(pageSize).Find(&exchanges).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": exchanges, "count": count})
+}
+
+// parseDate parses an RFC3339 time or a date, the latter is the start of that day in UTC
+func parseDate(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
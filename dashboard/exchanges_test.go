@@ -0,0 +1,73 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestService_EBSExchanges(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:TestService_EBSExchanges?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("unable to open test db: %v", err)
+	}
+	db.AutoMigrate(&ebs_fields.EBSExchange{})
+	day := time.Date(2023, time.March, 1, 10, 0, 0, 0, time.UTC)
+	db.Create(&[]ebs_fields.EBSExchange{
+		{Model: gorm.Model{CreatedAt: day}, UUID: "abc", RequestID: "req-1", PANLast4: "4465"},
+		{Model: gorm.Model{CreatedAt: day.AddDate(0, 0, 1)}, UUID: "def", RequestID: "req-2", PANLast4: "4465"},
+		{Model: gorm.Model{CreatedAt: day.AddDate(0, 0, 2)}, UUID: "ghi", RequestID: "req-3", PANLast4: "1234"},
+	})
+
+	s := &Service{Db: db}
+	r := gin.New()
+	r.GET("/ebs_exchanges", s.EBSExchanges)
+
+	tests := []struct {
+		name      string
+		query     string
+		wantCode  int
+		wantUUIDs []string
+	}{
+		{"all", "", http.StatusOK, []string{"ghi", "def", "abc"}},
+		{"by uuid", "uuid=def", http.StatusOK, []string{"def"}},
+		{"by request id", "request_id=req-3", http.StatusOK, []string{"ghi"}},
+		{"by pan", "pan=9222081700176714465", http.StatusOK, []string{"def", "abc"}},
+		{"by time range", "from=2023-03-02&to=2023-03-02T23:59:59Z", http.StatusOK, []string{"def"}},
+		{"paginated", "page=2&page_size=2", http.StatusOK, []string{"abc"}},
+		{"invalid date", "from=yesterday", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/ebs_exchanges?"+tt.query, nil)
+			r.ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("EBSExchanges() code = %v, want %v: %s", w.Code, tt.wantCode, w.Body)
+			}
+			var res struct {
+				Result []ebs_fields.EBSExchange `json:"result"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &res)
+			var got []string
+			for _, e := range res.Result {
+				got = append(got, e.UUID)
+			}
+			if len(got) != len(tt.wantUUIDs) {
+				t.Fatalf("EBSExchanges() = %v, want %v", got, tt.wantUUIDs)
+			}
+			for i := range got {
+				if got[i] != tt.wantUUIDs[i] {
+					t.Errorf("EBSExchanges() = %v, want %v", got, tt.wantUUIDs)
+				}
+			}
+		})
+	}
+}
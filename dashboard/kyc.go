@@ -0,0 +1,102 @@
+package dashboard
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// kycReview is the decision of a reviewer on a KYC
+type kycReview struct {
+	Status string `json:"status" binding:"required,oneof=under_review approved rejected"`
+	Tier   int    `json:"tier" binding:"min=0"`
+	Note   string `json:"note"`
+}
+
+// KYCs lists the KYCs, the oldest first so that they are reviewed in order. ?status= filters them.
+func (s *Service) KYCs(c *gin.Context) {
+	q := s.Db.Model(&ebs_fields.KYC{})
+	if status := c.Query("status"); status != "" {
+		q = q.Where("status = ?", status)
+	}
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "50"))
+	if pageSize <= 0 || pageSize > 100 {
+		pageSize = 50
+	}
+	var count int64
+	var kycs []ebs_fields.KYC
+	q = q.Session(&gorm.Session{})
+	if err := q.Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	if err := q.Preload("Passport").Order("updated_at").Offset(int(s.calculateOffset(page, pageSize))).Limit(pageSize).Find(&kycs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": kycs, "count": count})
+}
+
+// KYC returns the KYC of the user :mobile
+func (s *Service) KYC(c *gin.Context) {
+	var kyc ebs_fields.KYC
+	if err := s.Db.Preload("Passport").First(&kyc, "mobile = ?", c.Param("mobile")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "kyc not found", "code": "not_found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": kyc})
+}
+
+// KYCImage returns the :image (selfie or passport_image) of the KYC of the user :mobile
+func (s *Service) KYCImage(c *gin.Context) {
+	var kyc ebs_fields.KYC
+	if err := s.Db.First(&kyc, "mobile = ?", c.Param("mobile")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "kyc not found", "code": "not_found"})
+		return
+	}
+	key := kyc.Selfie
+	if c.Param("image") == "passport_image" {
+		key = kyc.PassportImg
+	} else if c.Param("image") != "selfie" {
+		c.JSON(http.StatusNotFound, gin.H{"message": "image must be selfie or passport_image", "code": "not_found"})
+		return
+	}
+	data, err := s.KYCStore.Get(key)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "image not found", "code": "not_found"})
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, http.DetectContentType(data), data)
+}
+
+// ReviewKYC takes the KYC of the user :mobile for a review, or approves it with
+// a tier or rejects it with a note for the user.
+func (s *Service) ReviewKYC(c *gin.Context) {
+	var req kycReview
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	kyc, err := ebs_fields.ReviewKYC(s.Db, c.Param("mobile"), req.Status, req.Tier, c.GetString("operator"), req.Note, time.Now())
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"message": "kyc not found", "code": "not_found"})
+	case errors.Is(err, ebs_fields.ErrInvalidKYCTransition):
+		c.JSON(http.StatusConflict, gin.H{"message": err.Error(), "code": "invalid_transition"})
+	case errors.Is(err, ebs_fields.ErrPassportExpired):
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "passport_expired"})
+	case errors.Is(err, ebs_fields.ErrInvalidKYCTier), errors.Is(err, ebs_fields.ErrKYCNoteRequired), errors.Is(err, ebs_fields.ErrInvalidPassport):
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+	default:
+		c.JSON(http.StatusOK, gin.H{"result": kyc})
+	}
+}
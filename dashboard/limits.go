@@ -0,0 +1,53 @@
+package dashboard
+
+import (
+	"net/http"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+)
+
+// Limits lists the transaction limits, or the overrides of a user with ?mobile=
+func (s *Service) Limits(c *gin.Context) {
+	q := s.Db.Order("id")
+	if mobile := c.Query("mobile"); mobile != "" {
+		q = q.Where("mobile = ?", mobile)
+	}
+	var limits []ebs_fields.Limit
+	if err := q.Find(&limits).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": limits})
+}
+
+// CreateLimit adds a transaction limit. A limit with a mobile overrides the
+// limits of the same scope, tran_type and period for that user, e.g., to raise
+// the daily transfers of a corporate account.
+func (s *Service) CreateLimit(c *gin.Context) {
+	var limit ebs_fields.Limit
+	if err := c.ShouldBindJSON(&limit); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	limit.ID = 0
+	if err := s.Db.Create(&limit).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"result": limit})
+}
+
+// DeleteLimit removes a transaction limit
+func (s *Service) DeleteLimit(c *gin.Context) {
+	res := s.Db.Delete(&ebs_fields.Limit{}, "id = ?", c.Param("id"))
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": res.Error.Error(), "code": "database_error"})
+		return
+	}
+	if res.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"message": "limit not found", "code": "not_found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": "ok"})
+}
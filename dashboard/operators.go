@@ -0,0 +1,138 @@
+package dashboard
+
+import (
+	"net/http"
+	"strconv"
+
+	gateway "github.com/adonese/noebs/apigateway"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// scope restricts q to the transactions the operator of c can see: merchant
+// viewers only see the rows of their terminal and merchant, staff see them all.
+// It relies on the values gateway.RequireRole sets in the context.
+func scope(c *gin.Context, q *gorm.DB) *gorm.DB {
+	if c.GetString("role") != gateway.RoleMerchantViewer {
+		return q
+	}
+	tid, mid := c.GetString("terminal_id"), c.GetString("merchant_id")
+	if tid == "" && mid == "" {
+		return q.Where("1 = 0")
+	}
+	if tid != "" {
+		q = q.Where("terminal_id = ?", tid)
+	}
+	if mid != "" {
+		q = q.Where("merchant_id = ?", mid)
+	}
+	return q
+}
+
+// inScope reports whether the operator of c can see the data of terminalID
+func inScope(c *gin.Context, terminalID string) bool {
+	if c.GetString("role") != gateway.RoleMerchantViewer {
+		return true
+	}
+	return terminalID != "" && terminalID == c.GetString("terminal_id")
+}
+
+// CreateOperator creates a dashboard operator, merchant viewers need the terminal_id
+// or the merchant_id they are scoped to.
+func (s *Service) CreateOperator(c *gin.Context) {
+	var req struct {
+		Username   string `json:"username" binding:"required"`
+		Password   string `json:"password" binding:"required" redact:"secret"`
+		Role       string `json:"role" binding:"required"`
+		TerminalID string `json:"terminal_id"`
+		MerchantID string `json:"merchant_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	var count int64
+	s.Db.Model(&gateway.Operator{}).Where("username = ?", req.Username).Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "username is already taken", "code": "duplicate_username"})
+		return
+	}
+	op, err := gateway.NewOperator(s.Db, req.Username, req.Password, req.Role, req.TerminalID, req.MerchantID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"result": op})
+}
+
+// Operators lists the dashboard operators
+func (s *Service) Operators(c *gin.Context) {
+	var ops []gateway.Operator
+	if err := s.Db.Order("id").Find(&ops).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": ops})
+}
+
+// DisableOperator disables an operator, they are signed out of the dashboard
+// right away. Admins can't disable themselves so that there is always one left.
+func (s *Service) DisableOperator(c *gin.Context) {
+	var op gateway.Operator
+	if err := s.Db.First(&op, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "operator not found", "code": "not_found"})
+		return
+	}
+	if op.Username == c.GetString("operator") {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "you can't disable yourself", "code": "bad_request"})
+		return
+	}
+	if err := s.Db.Model(&op).Update("disabled", true).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": op})
+}
+
+// AuditLogs searches the audit trail of the operators and the users. Filters:
+// operator, mobile, and from / to (RFC3339 or 2006-01-02), paginated with page
+// and page_size.
+func (s *Service) AuditLogs(c *gin.Context) {
+	q := s.Db.Model(&gateway.AuditLog{})
+	if op := c.Query("operator"); op != "" {
+		q = q.Where("operator = ?", op)
+	}
+	if mobile := c.Query("mobile"); mobile != "" {
+		q = q.Where("mobile = ?", mobile)
+	}
+	for _, bound := range []struct{ param, cond string }{{"from", "created_at >= ?"}, {"to", "created_at <= ?"}} {
+		v := c.Query(bound.param)
+		if v == "" {
+			continue
+		}
+		t, err := parseDate(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "invalid " + bound.param + " date: " + v, "code": "bad_request"})
+			return
+		}
+		q = q.Where(bound.cond, t)
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "50"))
+	if pageSize <= 0 || pageSize > 100 {
+		pageSize = 50
+	}
+	var count int64
+	var logs []gateway.AuditLog
+	q = q.Session(&gorm.Session{})
+	if err := q.Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	if err := q.Order("id desc").Offset(int(s.calculateOffset(page, pageSize))).Limit(pageSize).Find(&logs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": logs, "count": count})
+}
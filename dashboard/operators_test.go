@@ -0,0 +1,61 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gateway "github.com/adonese/noebs/apigateway"
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestService_GetAll_scope(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:TestService_GetAll_scope?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("unable to open test db: %v", err)
+	}
+	db.AutoMigrate(&ebs_fields.EBSResponse{})
+	db.Create(&[]ebs_fields.EBSResponse{
+		{Model: gorm.Model{ID: 1}, UUID: "a", TerminalID: "12345678"},
+		{Model: gorm.Model{ID: 2}, UUID: "b", TerminalID: "12345678", MerchantID: "m1"},
+		{Model: gorm.Model{ID: 3}, UUID: "c", TerminalID: "87654321", MerchantID: "m1"},
+	})
+	s := &Service{Db: db}
+
+	tests := []struct {
+		name       string
+		role       string
+		terminalID string
+		merchantID string
+		want       int
+	}{
+		{"support", gateway.RoleSupport, "", "", 3},
+		{"terminal", gateway.RoleMerchantViewer, "12345678", "", 2},
+		{"terminal and merchant", gateway.RoleMerchantViewer, "12345678", "m1", 1},
+		{"merchant", gateway.RoleMerchantViewer, "", "m1", 2},
+		{"unscoped merchant viewer", gateway.RoleMerchantViewer, "", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.GET("/all", func(c *gin.Context) {
+				c.Set("role", tt.role)
+				c.Set("terminal_id", tt.terminalID)
+				c.Set("merchant_id", tt.merchantID)
+			}, s.GetAll)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/all", nil))
+			var res struct {
+				Result []ebs_fields.EBSResponse `json:"result"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &res)
+			if len(res.Result) != tt.want {
+				t.Errorf("GetAll() = %d transactions, want %d", len(res.Result), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,293 @@
+package ebs_fields
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// encryptedPrefix marks encrypted card data: enc:<key id>:<base64 nonce|ciphertext>.
+// Values without it were stored before encryption was enabled and are read as is.
+const encryptedPrefix = "enc:"
+
+var (
+	ErrCardKeyNotFound = errors.New("card data is encrypted with an unknown key")
+	ErrNoCardKey       = errors.New("card_keys, active_card_key and card_hash_key must be set to store card data")
+	errCardCiphertext  = errors.New("malformed encrypted card data")
+)
+
+// CardKeyring encrypts card data at rest with AES-GCM. New data is encrypted
+// with the active key, the other keys are only used to read data written
+// before a rotation (see EncryptCards). It also keys the card fingerprints
+// (see HashPAN) that replace plaintext lookups by PAN.
+type CardKeyring struct {
+	keys    map[string]cipher.AEAD
+	active  string
+	hashKey []byte
+}
+
+// NewCardKeyring creates a CardKeyring from the card_keys of noebsConfig. It
+// fails with ErrNoCardKey without card keys or card_hash_key: cards are never
+// stored in plaintext, nor fingerprinted with a key everyone knows.
+func NewCardKeyring(noebsConfig *NoebsConfig) (*CardKeyring, error) {
+	k := &CardKeyring{keys: map[string]cipher.AEAD{}, active: noebsConfig.ActiveCardKey, hashKey: []byte(noebsConfig.CardHashKey)}
+	for id, encoded := range noebsConfig.CardKeys {
+		if strings.Contains(id, ":") {
+			return nil, fmt.Errorf("card key id %q must not contain ':'", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("card key %q: %w", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("card key %q: %w", id, err)
+		}
+		if k.keys[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	// the fingerprints must survive key rotations, so they can't be derived from a card key
+	if len(k.keys) == 0 || len(k.hashKey) == 0 {
+		return nil, ErrNoCardKey
+	}
+	if _, ok := k.keys[k.active]; !ok {
+		return nil, fmt.Errorf("active_card_key %q is not one of the card_keys", k.active)
+	}
+	return k, nil
+}
+
+// Enabled reports whether k encrypts card data
+func (k *CardKeyring) Enabled() bool {
+	return len(k.keys) > 0
+}
+
+// Encrypt seals plain with the active key, plain is returned as is when k isn't enabled.
+func (k *CardKeyring) Encrypt(plain string) (string, error) {
+	if plain == "" || !k.Enabled() {
+		return plain, nil
+	}
+	gcm := k.keys[k.active]
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plain), []byte(k.active))
+	return encryptedPrefix + k.active + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens data sealed by Encrypt with any of the keys of k, plaintext data is returned as is.
+func (k *CardKeyring) Decrypt(data string) (string, error) {
+	if !strings.HasPrefix(data, encryptedPrefix) {
+		return data, nil
+	}
+	id, encoded, ok := strings.Cut(strings.TrimPrefix(data, encryptedPrefix), ":")
+	if !ok {
+		return "", errCardCiphertext
+	}
+	gcm, ok := k.keys[id]
+	if !ok {
+		return "", ErrCardKeyNotFound
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", errCardCiphertext
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(id))
+	if err != nil {
+		return "", errCardCiphertext
+	}
+	return string(plain), nil
+}
+
+// Stale reports whether stored data should be encrypted again: it is in
+// plaintext or it was encrypted with a key other than the active one.
+func (k *CardKeyring) Stale(data string) bool {
+	if data == "" || !k.Enabled() {
+		return false
+	}
+	return !strings.HasPrefix(data, encryptedPrefix+k.active+":")
+}
+
+// Hash returns the fingerprint of pan, it is used instead of the PAN in queries.
+func (k *CardKeyring) Hash(pan string) string {
+	if pan == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, k.hashKey)
+	mac.Write([]byte(pan))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+var (
+	cardKeyringMu sync.RWMutex
+	// cardKeyring stores card data in plaintext until SetCardKeyring, which
+	// noebs calls at startup, the tests and tools run with it.
+	cardKeyring = &CardKeyring{keys: map[string]cipher.AEAD{}, hashKey: []byte("noebs card fingerprint")}
+)
+
+// SetCardKeyring sets the keyring used by the card serializer and HashPAN. It
+// should be called once at startup, before the database is used.
+func SetCardKeyring(k *CardKeyring) {
+	cardKeyringMu.Lock()
+	defer cardKeyringMu.Unlock()
+	cardKeyring = k
+}
+
+func currentCardKeyring() *CardKeyring {
+	cardKeyringMu.RLock()
+	defer cardKeyringMu.RUnlock()
+	return cardKeyring
+}
+
+// HashPAN returns the fingerprint of pan as stored in the pan_hash columns
+func HashPAN(pan string) string {
+	return currentCardKeyring().Hash(pan)
+}
+
+func init() {
+	schema.RegisterSerializer("card", cardSerializer{})
+}
+
+// cardSerializer encrypts string fields tagged with `gorm:"serializer:card"`.
+// Queries can't match those columns, use the pan_hash columns instead.
+type cardSerializer struct{}
+
+func (cardSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue any) error {
+	var stored string
+	switch v := dbValue.(type) {
+	case nil:
+	case string:
+		stored = v
+	case []byte:
+		stored = string(v)
+	default:
+		return fmt.Errorf("unsupported card data type %T", dbValue)
+	}
+	plain, err := currentCardKeyring().Decrypt(stored)
+	if err != nil {
+		return err
+	}
+	field.ReflectValueOf(ctx, dst).SetString(plain)
+	return nil
+}
+
+func (cardSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue any) (any, error) {
+	plain, _ := fieldValue.(string)
+	return currentCardKeyring().Encrypt(plain)
+}
+
+// EncryptCards encrypts the card data stored in plaintext, or with a key other
+// than the active one, and fills the missing card fingerprints. It returns the
+// number of rows updated.
+func EncryptCards(db *gorm.DB) (int, error) {
+	k := currentCardKeyring()
+	var updated int
+
+	var cards []struct {
+		ID                         uint
+		Pan, Expiry, IPIN, PanHash string
+	}
+	if err := db.Table("cards").Select("id, coalesce(pan, '') pan, coalesce(expiry, '') expiry, coalesce(ipin, '') ipin, coalesce(pan_hash, '') pan_hash").Find(&cards).Error; err != nil {
+		return updated, err
+	}
+	for _, raw := range cards {
+		if !k.Stale(raw.Pan) && !k.Stale(raw.Expiry) && !k.Stale(raw.IPIN) && raw.PanHash != "" {
+			continue
+		}
+		var card Card
+		if err := db.Unscoped().First(&card, raw.ID).Error; err != nil {
+			return updated, err
+		}
+		if err := db.Unscoped().Model(&card).Select("pan", "expiry", "ipin", "pan_hash").Updates(&card).Error; err != nil {
+			return updated, err
+		}
+		updated++
+	}
+
+	var cached []struct {
+		ID                   uint
+		Pan, Expiry, PanHash string
+	}
+	if err := db.Table("cache_cards").Select("id, coalesce(pan, '') pan, coalesce(expiry, '') expiry, coalesce(pan_hash, '') pan_hash").Find(&cached).Error; err != nil {
+		return updated, err
+	}
+	for _, raw := range cached {
+		if !k.Stale(raw.Pan) && !k.Stale(raw.Expiry) && raw.PanHash != "" {
+			continue
+		}
+		var card CacheCards
+		if err := db.Unscoped().First(&card, raw.ID).Error; err != nil {
+			return updated, err
+		}
+		if err := db.Unscoped().Model(&card).Select("pan", "expiry", "pan_hash").Updates(&card).Error; err != nil {
+			return updated, err
+		}
+		updated++
+	}
+
+	var users []struct {
+		Mobile, MainCard, MainExpdate string
+	}
+	if err := db.Table("users").Select("mobile, coalesce(main_card, '') main_card, coalesce(main_expdate, '') main_expdate").Find(&users).Error; err != nil {
+		return updated, err
+	}
+	for _, raw := range users {
+		if !k.Stale(raw.MainCard) && !k.Stale(raw.MainExpdate) {
+			continue
+		}
+		var user User
+		if err := db.Unscoped().First(&user, "mobile = ?", raw.Mobile).Error; err != nil {
+			return updated, err
+		}
+		err := db.Unscoped().Model(&User{}).Where("mobile = ?", raw.Mobile).Select("main_card", "main_expdate").
+			Updates(&User{MainCard: user.MainCard, ExpDate: user.ExpDate}).Error
+		if err != nil {
+			return updated, err
+		}
+		updated++
+	}
+
+	// the cards standing orders pay to, see consumer.ScheduledPayment
+	if !db.Migrator().HasTable("scheduled_payments") {
+		return updated, nil
+	}
+	var scheduled []struct {
+		ID     uint
+		ToCard string
+	}
+	if err := db.Table("scheduled_payments").Select("id, coalesce(to_card, '') to_card").Find(&scheduled).Error; err != nil {
+		return updated, err
+	}
+	for _, raw := range scheduled {
+		if !k.Stale(raw.ToCard) {
+			continue
+		}
+		plain, err := k.Decrypt(raw.ToCard)
+		if err != nil {
+			return updated, err
+		}
+		sealed, err := k.Encrypt(plain)
+		if err != nil {
+			return updated, err
+		}
+		if err := db.Table("scheduled_payments").Where("id = ?", raw.ID).Update("to_card", sealed).Error; err != nil {
+			return updated, err
+		}
+		updated++
+	}
+	return updated, nil
+}
@@ -0,0 +1,152 @@
+package ebs_fields
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func testCardKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+}
+
+// useCardKeyring sets the keyring of cfg for the duration of the test
+func useCardKeyring(t *testing.T, cfg NoebsConfig) *CardKeyring {
+	k, err := NewCardKeyring(&cfg)
+	if err != nil {
+		t.Fatalf("NewCardKeyring() error = %v", err)
+	}
+	previous := currentCardKeyring()
+	SetCardKeyring(k)
+	t.Cleanup(func() { SetCardKeyring(previous) })
+	return k
+}
+
+func TestNewCardKeyring(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     NoebsConfig
+		wantErr bool
+	}{
+		{"no keys", NoebsConfig{}, true},
+		{"missing card keys", NoebsConfig{CardHashKey: "h"}, true},
+		{"encrypted", NoebsConfig{CardKeys: map[string]string{"k1": testCardKey('a')}, ActiveCardKey: "k1", CardHashKey: "h"}, false},
+		{"unknown active key", NoebsConfig{CardKeys: map[string]string{"k1": testCardKey('a')}, ActiveCardKey: "k2", CardHashKey: "h"}, true},
+		{"missing hash key", NoebsConfig{CardKeys: map[string]string{"k1": testCardKey('a')}, ActiveCardKey: "k1"}, true},
+		{"invalid key", NoebsConfig{CardKeys: map[string]string{"k1": "c2hvcnQ="}, ActiveCardKey: "k1", CardHashKey: "h"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewCardKeyring(&tt.cfg); (err != nil) != tt.wantErr {
+				t.Errorf("NewCardKeyring() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCardKeyring_rotation(t *testing.T) {
+	old, _ := NewCardKeyring(&NoebsConfig{CardKeys: map[string]string{"k1": testCardKey('a')}, ActiveCardKey: "k1", CardHashKey: "h"})
+	rotated, _ := NewCardKeyring(&NoebsConfig{CardKeys: map[string]string{"k1": testCardKey('a'), "k2": testCardKey('b')}, ActiveCardKey: "k2", CardHashKey: "h"})
+	other, _ := NewCardKeyring(&NoebsConfig{CardKeys: map[string]string{"k2": testCardKey('b')}, ActiveCardKey: "k2", CardHashKey: "h"})
+
+	sealed, _ := old.Encrypt("9222081700176714465")
+	if !strings.HasPrefix(sealed, "enc:k1:") || strings.Contains(sealed, "9222081700176714465") {
+		t.Fatalf("Encrypt() = %v", sealed)
+	}
+	tests := []struct {
+		name      string
+		keyring   *CardKeyring
+		data      string
+		want      string
+		wantErr   bool
+		wantStale bool
+	}{
+		{"active key", old, sealed, "9222081700176714465", false, false},
+		{"previous key", rotated, sealed, "9222081700176714465", false, true},
+		{"removed key", other, sealed, "", true, true},
+		{"tampered", old, sealed[:len(sealed)-2] + "AA", "", true, false},
+		{"plaintext", rotated, "9222081700176714465", "9222081700176714465", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.keyring.Decrypt(tt.data)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("Decrypt() = %v, %v, want %v", got, err, tt.want)
+			}
+			if stale := tt.keyring.Stale(tt.data); stale != tt.wantStale {
+				t.Errorf("Stale() = %v, want %v", stale, tt.wantStale)
+			}
+		})
+	}
+	if old.Hash("9222081700176714465") != rotated.Hash("9222081700176714465") {
+		t.Errorf("Hash() changed with the card keys")
+	}
+}
+
+func TestEncryptCards(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:TestEncryptCards?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("unable to open test db: %v", err)
+	}
+	db.AutoMigrate(&User{}, &Card{}, &CacheCards{})
+
+	// rows written before encryption was enabled
+	user := User{Model: gorm.Model{ID: 1}, Mobile: "0912141679", DeviceID: "device", MainCard: "9222081700176714465", ExpDate: "2302"}
+	db.Create(&user)
+	db.Create(&Card{Pan: "9222081700176714465", Expiry: "2302", IPIN: "0000", UserID: user.ID})
+	db.Exec("UPDATE cards SET pan_hash = NULL")
+	db.Create(&CacheCards{Pan: "9222081700176714466", Expiry: "2303"})
+
+	cfg := NoebsConfig{CardKeys: map[string]string{"k1": testCardKey('a')}, ActiveCardKey: "k1", CardHashKey: "h"}
+	useCardKeyring(t, cfg)
+	if n, err := EncryptCards(db); err != nil || n != 3 {
+		t.Fatalf("EncryptCards() = %v, %v, want 3 rows", n, err)
+	}
+	cfg.CardKeys["k2"], cfg.ActiveCardKey = testCardKey('b'), "k2"
+	useCardKeyring(t, cfg)
+	db.Create(&Card{Pan: "9222081700176714467", Expiry: "2304", IPIN: "1111", UserID: user.ID})
+	if n, err := EncryptCards(db); err != nil || n != 3 {
+		t.Fatalf("EncryptCards() after rotation = %v, %v, want 3 rows", n, err)
+	}
+	if n, _ := EncryptCards(db); n != 0 {
+		t.Errorf("EncryptCards() = %v rows when everything is encrypted", n)
+	}
+
+	var raw []string
+	db.Raw("SELECT pan || expiry || ipin FROM cards UNION ALL SELECT pan || expiry FROM cache_cards UNION ALL SELECT main_card || main_expdate FROM users").Scan(&raw)
+	for _, r := range raw {
+		if strings.Contains(r, "92220817") || strings.Count(r, "enc:k2:") < 2 {
+			t.Errorf("stored card data = %v, want encrypted with k2", r)
+		}
+	}
+
+	tests := []struct {
+		name string
+		pan  string
+		want string
+	}{
+		{"migrated card", "9222081700176714465", "2302"},
+		{"new card", "9222081700176714467", "2304"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var card Card
+			if err := db.First(&card, "pan_hash = ?", HashPAN(tt.pan)).Error; err != nil {
+				t.Fatalf("card not found by its hash: %v", err)
+			}
+			if card.Pan != tt.pan || card.Expiry != tt.want {
+				t.Errorf("card = %v %v, want %v %v", card.Pan, card.Expiry, tt.pan, tt.want)
+			}
+		})
+	}
+	got, err := GetUserByCard("9222081700176714465", db)
+	if err != nil || got.MainCard != "9222081700176714465" || got.ExpDate != "2302" {
+		t.Errorf("GetUserByCard() = %v %v, %v", got.MainCard, got.ExpDate, err)
+	}
+	if ids, _ := GetDeviceIDsByPan("9222081700176714465", db); len(ids) != 1 || ids[0] != "device" {
+		t.Errorf("GetDeviceIDsByPan() = %v", ids)
+	}
+}
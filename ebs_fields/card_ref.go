@@ -0,0 +1,70 @@
+package ebs_fields
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// cardRefPrefix starts every card reference, e.g., card_k5w2xq...
+const cardRefPrefix = "card_"
+
+var ErrCardNotFound = errors.New("card not found")
+
+var cardRefEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewCardRef returns a new random card reference. It says nothing about the
+// card it refers to, only noebs can resolve it (see GetCardByRef).
+func NewCardRef() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return cardRefPrefix + strings.ToLower(cardRefEncoding.EncodeToString(b))
+}
+
+// CardByRef returns the card referenced by ref among cards
+func CardByRef(cards []Card, ref string) (Card, error) {
+	if ref == "" {
+		return Card{}, ErrCardNotFound
+	}
+	for _, card := range cards {
+		if card.CardRef == ref {
+			return card, nil
+		}
+	}
+	return Card{}, ErrCardNotFound
+}
+
+// GetCardByRef returns the card of the user with mobile referenced by ref,
+// cards of other users are never resolved.
+func GetCardByRef(mobile, ref string, db *gorm.DB) (Card, error) {
+	var card Card
+	if ref == "" {
+		return card, ErrCardNotFound
+	}
+	err := db.Model(&Card{}).Joins("JOIN users ON users.id = cards.user_id").
+		Where("users.mobile = ? AND cards.card_ref = ?", mobile, ref).First(&card).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return card, ErrCardNotFound
+	}
+	return card, err
+}
+
+// AssignCardRefs gives a reference to the cards stored before card references
+// were introduced. It returns the number of cards updated.
+func AssignCardRefs(db *gorm.DB) (int, error) {
+	var ids []uint
+	if err := db.Unscoped().Model(&Card{}).Where("card_ref IS NULL OR card_ref = ''").Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+	for i, id := range ids {
+		if err := db.Unscoped().Model(&Card{}).Where("id = ?", id).UpdateColumn("card_ref", NewCardRef()).Error; err != nil {
+			return i, err
+		}
+	}
+	return len(ids), nil
+}
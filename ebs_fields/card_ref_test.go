@@ -0,0 +1,84 @@
+package ebs_fields
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestCard_MarshalJSON(t *testing.T) {
+	card := Card{Pan: "9222081700176714465", Expiry: "2302", IPIN: "0000", CardRef: "card_abc", Name: "main"}
+	data, err := json.Marshal([]Card{card})
+	if err != nil {
+		t.Fatalf("MarshalJSON() error = %v", err)
+	}
+	for _, secret := range []string{card.Pan, card.Expiry, card.IPIN} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("MarshalJSON() = %s, leaks %q", data, secret)
+		}
+	}
+	var got []map[string]any
+	json.Unmarshal(data, &got)
+	if got[0]["pan"] != "922208*****4465" || got[0]["card_ref"] != "card_abc" || got[0]["name"] != "main" {
+		t.Errorf("MarshalJSON() = %s", data)
+	}
+}
+
+func TestGetCardByRef(t *testing.T) {
+	db, _ := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	db.AutoMigrate(&User{}, &Card{})
+	owner := User{Model: gorm.Model{ID: 1}, Mobile: "0912141679", Password: "12345678"}
+	other := User{Model: gorm.Model{ID: 2}, Mobile: "0912141680", Password: "12345678"}
+	db.Create(&owner)
+	db.Create(&other)
+	card := Card{Pan: "9222081700176714465", Expiry: "2302", UserID: owner.ID}
+	db.Create(&card)
+	if !strings.HasPrefix(card.CardRef, cardRefPrefix) || len(card.CardRef) != len(cardRefPrefix)+26 {
+		t.Fatalf("Create() card_ref = %q", card.CardRef)
+	}
+
+	tests := []struct {
+		name    string
+		mobile  string
+		ref     string
+		wantPan string
+		wantErr error
+	}{
+		{"owner", owner.Mobile, card.CardRef, card.Pan, nil},
+		{"other user", other.Mobile, card.CardRef, "", ErrCardNotFound},
+		{"unknown ref", owner.Mobile, NewCardRef(), "", ErrCardNotFound},
+		{"empty ref", owner.Mobile, "", "", ErrCardNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetCardByRef(tt.mobile, tt.ref, db)
+			if err != tt.wantErr || got.Pan != tt.wantPan {
+				t.Errorf("GetCardByRef() = %v, %v, want %v, %v", got.Pan, err, tt.wantPan, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAssignCardRefs(t *testing.T) {
+	db, _ := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	db.AutoMigrate(&Card{})
+	db.Create(&Card{Pan: "9222081700176714465", UserID: 1})
+	db.Create(&Card{Pan: "9222081700176714467", UserID: 1})
+	// cards stored before card references were introduced
+	db.Exec("UPDATE cards SET card_ref = NULL")
+
+	if n, err := AssignCardRefs(db); err != nil || n != 2 {
+		t.Fatalf("AssignCardRefs() = %v, %v, want 2", n, err)
+	}
+	var refs []string
+	db.Model(&Card{}).Pluck("card_ref", &refs)
+	if len(refs) != 2 || refs[0] == "" || refs[0] == refs[1] {
+		t.Errorf("AssignCardRefs() refs = %v", refs)
+	}
+	if n, _ := AssignCardRefs(db); n != 0 {
+		t.Errorf("AssignCardRefs() again = %v, want 0", n)
+	}
+}
@@ -0,0 +1,149 @@
+package ebs_fields
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DeviceVerificationTTL is how long a new device can be verified for after the
+// user signed in on it.
+const DeviceVerificationTTL = 15 * time.Minute
+
+var (
+	ErrDeviceNotFound          = errors.New("device not found")
+	ErrDeviceVerificationEnded = errors.New("sign in on the device again to verify it")
+)
+
+// Device is a phone or a browser a user signed in from. Sessions are only
+// started on trusted devices: a new device is trusted once the user verifies
+// it with an otp or a card (see VerifyDevice and TrustDevice), except for the
+// User.DeviceID of a user without trusted devices, the device they used before
+// devices were recorded, which is trusted right away.
+type Device struct {
+	gorm.Model
+	UserMobile string `json:"-" gorm:"not null;uniqueIndex:idx_devices_user_device"`
+	// DeviceID is the id the app generated for the device
+	DeviceID string `json:"device_id" gorm:"not null;uniqueIndex:idx_devices_user_device"`
+	Platform string `json:"platform"`
+	// PushToken is the FCM registration token of the app on the device
+	PushToken string    `json:"-"`
+	PublicKey string    `json:"-"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Trusted   bool      `json:"trusted"`
+	// VerifyUntil is when the verification of an untrusted device started by a sign in ends
+	VerifyUntil *time.Time `json:"-"`
+}
+
+// SeeDevice records that the user mobile signed in on the device d at now, and
+// returns it. The platform of d is kept when it is set, and so is its public
+// key until the device is trusted: device ids are chosen by the apps, a sign in
+// can't replace the key of a trusted device.
+func SeeDevice(db *gorm.DB, mobile string, d Device, now time.Time) (*Device, error) {
+	var device Device
+	err := db.Where("user_mobile = ? AND device_id = ?", mobile, d.DeviceID).First(&device).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		var count int64
+		if err := db.Model(&Device{}).Where("user_mobile = ? AND trusted", mobile).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		var legacyIDs []string
+		if err := db.Model(&User{}).Where("mobile = ?", mobile).Pluck("device_id", &legacyIDs).Error; err != nil {
+			return nil, err
+		}
+		trusted := count == 0 && len(legacyIDs) == 1 && legacyIDs[0] != "" && legacyIDs[0] == d.DeviceID
+		device = Device{UserMobile: mobile, DeviceID: d.DeviceID, Platform: d.Platform, PublicKey: d.PublicKey,
+			FirstSeen: now, LastSeen: now, Trusted: trusted}
+		return &device, db.Create(&device).Error
+	} else if err != nil {
+		return nil, err
+	}
+	updates := map[string]any{"last_seen": now}
+	if d.Platform != "" {
+		device.Platform, updates["platform"] = d.Platform, d.Platform
+	}
+	if d.PublicKey != "" && !device.Trusted {
+		device.PublicKey, updates["public_key"] = d.PublicKey, d.PublicKey
+	}
+	device.LastSeen = now
+	return &device, db.Model(&device).Updates(updates).Error
+}
+
+// StartVerification lets d be verified until DeviceVerificationTTL from now
+func (d *Device) StartVerification(db *gorm.DB, now time.Time) error {
+	until := now.Add(DeviceVerificationTTL)
+	d.VerifyUntil = &until
+	return db.Model(d).Update("verify_until", until).Error
+}
+
+// PendingDevice returns the device deviceID of mobile when it is trusted or
+// its verification started by a sign in (see Device.StartVerification) didn't
+// end at now.
+func PendingDevice(db *gorm.DB, mobile, deviceID string, now time.Time) (*Device, error) {
+	var device Device
+	if err := db.Where("user_mobile = ? AND device_id = ?", mobile, deviceID).First(&device).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrDeviceNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if !device.Trusted && (device.VerifyUntil == nil || !now.Before(*device.VerifyUntil)) {
+		return nil, ErrDeviceVerificationEnded
+	}
+	return &device, nil
+}
+
+// VerifyDevice trusts the device deviceID of mobile, whose verification was
+// started by a sign in (see PendingDevice).
+func VerifyDevice(db *gorm.DB, mobile, deviceID string, now time.Time) (*Device, error) {
+	device, err := PendingDevice(db, mobile, deviceID, now)
+	if err != nil || device.Trusted {
+		return device, err
+	}
+	device.Trusted, device.VerifyUntil = true, nil
+	return device, db.Model(device).Updates(map[string]any{"trusted": true, "verify_until": nil}).Error
+}
+
+// TrustDevice trusts the device d of mobile right away, e.g., once the user
+// proved they have one of their cards.
+func TrustDevice(db *gorm.DB, mobile string, d Device, now time.Time) (*Device, error) {
+	device, err := SeeDevice(db, mobile, d, now)
+	if err != nil || device.Trusted {
+		return device, err
+	}
+	device.Trusted, device.VerifyUntil = true, nil
+	return device, db.Model(device).Updates(map[string]any{"trusted": true, "verify_until": nil}).Error
+}
+
+// GetDevices returns the devices of mobile, the last used first
+func GetDevices(db *gorm.DB, mobile string) ([]Device, error) {
+	var devices []Device
+	err := db.Where("user_mobile = ?", mobile).Order("last_seen desc").Find(&devices).Error
+	return devices, err
+}
+
+// RemoveDevice deletes the device id of mobile, the device has to be verified
+// again before the user can sign in on it.
+func RemoveDevice(db *gorm.DB, mobile string, id uint) (*Device, error) {
+	var device Device
+	if err := db.Where("user_mobile = ?", mobile).First(&device, id).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrDeviceNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &device, db.Unscoped().Delete(&device).Error
+}
+
+// SetPushToken sets the push token of the device deviceID of mobile
+func SetPushToken(db *gorm.DB, mobile, deviceID, token string) error {
+	return db.Model(&Device{}).Where("user_mobile = ? AND device_id = ?", mobile, deviceID).Update("push_token", token).Error
+}
+
+// PushTokens returns the push tokens of the trusted devices of mobile
+func PushTokens(db *gorm.DB, mobile string) ([]string, error) {
+	var tokens []string
+	err := db.Model(&Device{}).Where("user_mobile = ? AND trusted AND push_token != ''", mobile).
+		Order("last_seen desc").Pluck("push_token", &tokens).Error
+	return tokens, err
+}
@@ -0,0 +1,65 @@
+package ebs_fields
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestVerifyDevice(t *testing.T) {
+	db, _ := gorm.Open(sqlite.Open("file:TestVerifyDevice?mode=memory&cache=shared"), &gorm.Config{})
+	db.AutoMigrate(&User{}, &Device{})
+	now := time.Date(2023, time.March, 15, 12, 0, 0, 0, time.UTC)
+	mobile := "0912141679"
+	db.Create(&User{Model: gorm.Model{ID: 1}, Mobile: mobile, DeviceID: "phone"})
+
+	// the first device seen isn't trusted unless it is the one the user had
+	laptop, _ := SeeDevice(db, mobile, Device{DeviceID: "laptop", PublicKey: "laptop-key"}, now)
+	phone, err := SeeDevice(db, mobile, Device{DeviceID: "phone", Platform: "android", PublicKey: "phone-key"}, now)
+	if err != nil || !phone.Trusted {
+		t.Fatalf("SeeDevice() = %+v, %v, want a trusted device", phone, err)
+	}
+	tablet, _ := SeeDevice(db, mobile, Device{DeviceID: "tablet"}, now)
+	if laptop.Trusted || tablet.Trusted {
+		t.Fatalf("SeeDevice() trusted a new device")
+	}
+	// the key of a device is set until it is trusted
+	laptop, _ = SeeDevice(db, mobile, Device{DeviceID: "laptop", PublicKey: "new-laptop-key"}, now)
+	phone, _ = SeeDevice(db, mobile, Device{DeviceID: "phone", PublicKey: "another-key"}, now)
+	if laptop.PublicKey != "new-laptop-key" || phone.PublicKey != "phone-key" {
+		t.Fatalf("SeeDevice() keys = %q, %q", laptop.PublicKey, phone.PublicKey)
+	}
+	laptop.StartVerification(db, now)
+	tablet.StartVerification(db, now.Add(-time.Hour))
+
+	tests := []struct {
+		name     string
+		deviceID string
+		wantErr  error
+	}{
+		{"verified", "laptop", nil},
+		{"verification ended", "tablet", ErrDeviceVerificationEnded},
+		{"already trusted", "phone", nil},
+		{"unknown device", "watch", ErrDeviceNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			device, err := VerifyDevice(db, mobile, tt.deviceID, now.Add(time.Minute))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("VerifyDevice() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && !device.Trusted {
+				t.Errorf("VerifyDevice() didn't trust %s", tt.deviceID)
+			}
+		})
+	}
+
+	SetPushToken(db, mobile, "phone", "phone-token")
+	SetPushToken(db, mobile, "tablet", "tablet-token")
+	if tokens, err := PushTokens(db, mobile); err != nil || len(tokens) != 1 || tokens[0] != "phone-token" {
+		t.Errorf("PushTokens() = %v, %v, want the tokens of the trusted devices", tokens, err)
+	}
+}
@@ -1,76 +1,192 @@
 package ebs_fields
 
 import (
-	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
-	"fmt"
-	"io"
+	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/adonese/noebs/redact"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
 
-var log = logrus.New()
+var log = redact.Install(logrus.New())
 
-// EBSHttpClient the client to interact with EBS
-func EBSHttpClient(url string, req []byte) (int, EBSParserFields, error) {
+// EBSClient sends a marshalled request to an EBS endpoint and parses its
+// response. The returned status code and error follow the same conventions
+// handlers already rely on: 200 for approved transactions, 502 for EBS
+// rejections, 504 when EBS couldn't be reached, and 500 for malformed responses.
+// On a 504 the returned fields carry the request identifiers and are marked as
+// ReconcilePending, since EBS may still have processed the transaction.
+type EBSClient interface {
+	Do(ctx context.Context, url string, req []byte) (int, EBSParserFields, error)
+}
 
-	verifyTLS := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+// EBSClientConfig holds the transport settings for HTTPEBSClient
+type EBSClientConfig struct {
+	// CACert is a PEM encoded bundle, when set only certificates signed by
+	// it are accepted (EBS certificate pinning).
+	CACert             []byte
+	InsecureSkipVerify bool
+	// Timeout is applied to every request whose context has no deadline
+	Timeout      time.Duration
+	MaxIdleConns int
+}
+
+// HTTPEBSClient is the EBSClient used against the real EBS servers. It shares
+// a single pooled transport between requests and retries only the failures
+// where EBS couldn't have processed the transaction.
+type HTTPEBSClient struct {
+	client  *HTTPClient
+	timeout time.Duration
+	// Db, when set, stores every exchange with EBS in the ebs_exchanges table
+	Db *gorm.DB
+}
+
+// NewEBSClient creates an HTTPEBSClient from cfg
+func NewEBSClient(cfg EBSClientConfig) (*HTTPEBSClient, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if len(cfg.CACert) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(cfg.CACert) {
+			return nil, errors.New("ebs: no valid certificates in CA bundle")
+		}
+		tlsConfig.RootCAs = pool
+		tlsConfig.InsecureSkipVerify = false
 	}
-	ebsClient := http.Client{
-		Timeout:   3 * 30 * time.Second,
-		Transport: verifyTLS,
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 90 * time.Second
 	}
+	if cfg.MaxIdleConns == 0 {
+		cfg.MaxIdleConns = 32
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConns:        cfg.MaxIdleConns,
+		MaxIdleConnsPerHost: cfg.MaxIdleConns,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	maxDelay := 5 * time.Second
+	return &HTTPEBSClient{
+		client: &HTTPClient{
+			Client: &http.Client{Transport: transport},
+			RetryConfig: &RetryConfig{
+				MaxRetries:       2,
+				CheckForRetry:    retryUnprocessed,
+				ExpBackoffFactor: 0.5,
+				MaxDelay:         &maxDelay,
+			},
+			// EBS reports failures in the body, we parse every response ourselves
+			SuccessFn: func(r *Response) bool { return true },
+		},
+		timeout: cfg.Timeout,
+	}, nil
+}
 
-	log.Printf("EBS url is: %v", url)
-	log.Printf("our request to EBS: %v", string(req))
-	reqBuffer := bytes.NewBuffer(req)
-
-	var ebsGenericResponse EBSParserFields
+// NewEBSClientFromConfig creates an HTTPEBSClient using the ebs_* settings in n
+func NewEBSClientFromConfig(n *NoebsConfig) (*HTTPEBSClient, error) {
+	cfg := EBSClientConfig{
+		InsecureSkipVerify: n.EBSCACert == "",
+		Timeout:            time.Duration(n.EBSTimeout) * time.Second,
+		MaxIdleConns:       n.EBSMaxIdleConns,
+	}
+	if n.EBSCACert != "" {
+		ca, err := os.ReadFile(n.EBSCACert)
+		if err != nil {
+			return nil, err
+		}
+		cfg.CACert = ca
+	}
+	return NewEBSClient(cfg)
+}
 
-	reqHandler, err := http.NewRequest(http.MethodPost, url, reqBuffer)
+// retryUnprocessed retries requests that never reached EBS. Anything else,
+// including timeouts, may have been processed already and must not be resent.
+func retryUnprocessed(resp *http.Response, networkErr error) bool {
+	if networkErr != nil {
+		var opErr *net.OpError
+		if errors.As(networkErr, &opErr) && opErr.Op == "dial" {
+			return true
+		}
+		return errors.Is(networkErr, syscall.ECONNREFUSED)
+	}
+	return resp.StatusCode == http.StatusServiceUnavailable
+}
 
-	if err != nil {
-		fmt.Println(err.Error())
-		log.WithFields(logrus.Fields{
-			"code": err.Error(),
-		}).Error("Error in establishing connection to the host")
-		return 500, ebsGenericResponse, err
+// Do implements EBSClient
+func (e *HTTPEBSClient) Do(ctx context.Context, url string, req []byte) (int, EBSParserFields, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
 	}
-	reqHandler.Header.Set("Content-Type", "application/json")
 
-	ebsResponse, err := ebsClient.Do(reqHandler)
+	log.Printf("EBS url is: %v", url)
+	log.Printf("our request to EBS: %s", redact.JSON(req))
+
+	markSentToEBS(ctx)
+	start := time.Now()
+	ebsResponse, err := e.client.Do(ctx, &Request{
+		Method: http.MethodPost,
+		URL:    url,
+		Body:   rawJSON(req),
+	})
+	exchange := newExchange(ctx, url, req, time.Since(start))
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"code": err.Error(),
 		}).Error("Error in establishing connection to the host")
-		return http.StatusGatewayTimeout, ebsGenericResponse, EbsGatewayConnectivityErr
+		exchange.Error = err.Error()
+		e.record(exchange)
+		return http.StatusGatewayTimeout, pendingResponse(req), EbsGatewayConnectivityErr
 	}
+	exchange.HTTPStatus = ebsResponse.Status
+	exchange.Response = string(ebsResponse.Body)
+	e.record(exchange)
+	return parseEBSResponse(req, ebsResponse.Header.Get("Content-Type"), ebsResponse.Body)
+}
 
-	defer ebsResponse.Body.Close()
-	responseBody, err := io.ReadAll(ebsResponse.Body)
-	if err != nil {
-		log.WithFields(logrus.Fields{
-			"code": err.Error(),
-		}).Error("Error reading ebs response")
-		return http.StatusInternalServerError, ebsGenericResponse, EbsGatewayConnectivityErr
-	}
+var (
+	defaultEBSClient     *HTTPEBSClient
+	defaultEBSClientOnce sync.Once
+)
+
+// EBSHttpClient the client to interact with EBS
+//
+// Deprecated: services should hold an EBSClient and call its Do method, this
+// is kept for the few places that don't have access to one.
+func EBSHttpClient(url string, req []byte) (int, EBSParserFields, error) {
+	defaultEBSClientOnce.Do(func() {
+		defaultEBSClient, _ = NewEBSClient(EBSClientConfig{InsecureSkipVerify: true})
+	})
+	return defaultEBSClient.Do(context.Background(), url, req)
+}
+
+// parseEBSResponse maps an EBS response body into EBSParserFields, it also
+// reports the card validity to the EBSRes channel.
+func parseEBSResponse(req []byte, contentType string, responseBody []byte) (int, EBSParserFields, error) {
+	var ebsGenericResponse EBSParserFields
 	var c CacheCards
 	var isValid = true
 	c.Pan = getPan(req)
 
 	log.Printf("ebs_raw: %s", string(responseBody))
-	if !strings.Contains(ebsResponse.Header.Get("Content-Type"), "application/json") {
+	if !strings.Contains(contentType, "application/json") {
 		log.WithFields(logrus.Fields{
 			"code":    "wrong content type parsed",
-			"details": ebsResponse.Header.Get("Content-Type"),
+			"details": contentType,
 		}).Error("ebs response content type is not application/json")
 		return http.StatusInternalServerError, ebsGenericResponse, ContentTypeErr
 	}
@@ -104,9 +220,15 @@ func EBSHttpClient(url string, req []byte) (int, EBSParserFields, error) {
 		}
 		return http.StatusInternalServerError, ebsGenericResponse, err
 	}
-
 }
 
+// rawJSON is an HTTPEntity for an already marshalled request
+type rawJSON []byte
+
+func (r rawJSON) Bytes() ([]byte, error) { return r, nil }
+
+func (r rawJSON) Mime() string { return "application/json" }
+
 type IPINResponse struct {
 	UUID            string `json:"UUID"`
 	TranDateTime    int    `json:"tranDateTime"`
@@ -1 +1,163 @@
 package ebs_fields
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func drainEBSRes(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-EBSRes:
+			case <-done:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { close(done) })
+}
+
+func TestHTTPEBSClient_Do(t *testing.T) {
+	drainEBSRes(t)
+	var calls int32
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/unavailable":
+			if atomic.AddInt32(&calls, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/declined":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"responseCode": 51, "responseMessage": "Insufficient funds"}`))
+			return
+		case "/html":
+			w.Write([]byte(`<html></html>`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"responseCode": 0, "responseMessage": "Approval", "UUID": "abc"}`))
+	}))
+	defer ts.Close()
+	pinned := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+
+	tests := []struct {
+		name     string
+		cfg      EBSClientConfig
+		path     string
+		timeout  time.Duration
+		wantCode int
+		wantErr  error
+	}{
+		{"pinned ca", EBSClientConfig{CACert: pinned}, "/", 0, http.StatusOK, nil},
+		{"unknown ca", EBSClientConfig{}, "/", 0, http.StatusGatewayTimeout, EbsGatewayConnectivityErr},
+		{"retries unavailable", EBSClientConfig{CACert: pinned}, "/unavailable", 0, http.StatusOK, nil},
+		{"context deadline", EBSClientConfig{CACert: pinned}, "/slow", 50 * time.Millisecond, http.StatusGatewayTimeout, EbsGatewayConnectivityErr},
+		{"client timeout", EBSClientConfig{CACert: pinned, Timeout: 50 * time.Millisecond}, "/slow", 0, http.StatusGatewayTimeout, EbsGatewayConnectivityErr},
+		{"declined", EBSClientConfig{CACert: pinned}, "/declined", 0, http.StatusBadGateway, nil},
+		{"wrong content type", EBSClientConfig{CACert: pinned}, "/html", 0, http.StatusInternalServerError, ContentTypeErr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := NewEBSClient(tt.cfg)
+			if err != nil {
+				t.Fatalf("NewEBSClient() error = %v", err)
+			}
+			ctx := context.Background()
+			if tt.timeout != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			code, _, err := client.Do(ctx, ts.URL+tt.path, []byte(`{"PAN": "9222081700176714465"}`))
+			if code != tt.wantCode {
+				t.Errorf("HTTPEBSClient.Do() code = %v, want %v", code, tt.wantCode)
+			}
+			if tt.wantErr != nil && err != tt.wantErr {
+				t.Errorf("HTTPEBSClient.Do() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHTTPEBSClient_Do_exchanges(t *testing.T) {
+	drainEBSRes(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"responseCode": 51, "responseMessage": "Insufficient funds", "UUID": "abc"}`))
+	}))
+	defer ts.Close()
+	db, err := gorm.Open(sqlite.Open("file:TestHTTPEBSClient_Do_exchanges?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("unable to open test db: %v", err)
+	}
+	db.AutoMigrate(&EBSExchange{})
+
+	client, _ := NewEBSClient(EBSClientConfig{})
+	client.Db = db
+	ctx := WithRequestID(context.Background(), "req-1")
+	req := []byte(`{"UUID": "abc", "PAN": "9222081700176714465", "IPIN": "encrypted-ipin", "expDate": "2302", "tranAmount": 10}`)
+	client.Do(ctx, ts.URL+"/QAConsumer/doCardTransfer", req)
+	client.Do(context.Background(), "http://127.0.0.1:1/QAConsumer/getBalance", []byte(`{"UUID": "def"}`))
+
+	tests := []struct {
+		name         string
+		uuid         string
+		wantEndpoint string
+		wantStatus   int
+		wantRequest  string
+	}{
+		{"declined", "abc", "/QAConsumer/doCardTransfer", http.StatusOK, `{"IPIN":"*****","PAN":"922208*****4465","UUID":"abc","expDate":"*****","tranAmount":10}`},
+		{"unreachable", "def", "/QAConsumer/getBalance", 0, `{"UUID":"def"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got EBSExchange
+			if err := db.First(&got, "uuid = ?", tt.uuid).Error; err != nil {
+				t.Fatalf("exchange %v not recorded: %v", tt.uuid, err)
+			}
+			if got.Endpoint != tt.wantEndpoint || got.HTTPStatus != tt.wantStatus || got.Request != tt.wantRequest {
+				t.Errorf("exchange = %v %v %v, want %v %v %v", got.Endpoint, got.HTTPStatus, got.Request, tt.wantEndpoint, tt.wantStatus, tt.wantRequest)
+			}
+			if tt.wantStatus == 0 && got.Error == "" {
+				t.Errorf("exchange error is empty")
+			}
+			if tt.wantStatus != 0 && (got.RequestID != "req-1" || got.PANLast4 != "4465" || !strings.Contains(got.Response, "Insufficient funds")) {
+				t.Errorf("exchange = %+v", got)
+			}
+		})
+	}
+}
+
+func TestNewEBSClient_invalidCA(t *testing.T) {
+	if _, err := NewEBSClient(EBSClientConfig{CACert: []byte("not a certificate")}); err == nil {
+		t.Errorf("NewEBSClient() expected an error for an invalid CA bundle")
+	}
+}
+
+func TestFakeEBSClient_Do(t *testing.T) {
+	f := &FakeEBSClient{}
+	code, res, err := f.Do(context.Background(), "http://ebs/getBalance", []byte(`{"UUID": "abc", "tranAmount": 10}`))
+	if code != http.StatusOK || err != nil {
+		t.Fatalf("FakeEBSClient.Do() = %v, %v", code, err)
+	}
+	if res.UUID != "abc" || res.TranAmount != 10 {
+		t.Errorf("FakeEBSClient.Do() res = %+v", res.EBSResponse)
+	}
+	if got := f.Requests(); len(got) != 1 || got[0].URL != "http://ebs/getBalance" {
+		t.Errorf("FakeEBSClient.Requests() = %v", got)
+	}
+}
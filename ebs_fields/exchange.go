@@ -0,0 +1,107 @@
+package ebs_fields
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/adonese/noebs/redact"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// RequestIDHeader carries the id that ties a noebs request to the EBS exchanges it made
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the request id id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request id in ctx, if any
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+type ebsSentKey struct{}
+
+// TrackEBSRequests returns a copy of ctx that records whether a request was
+// sent to EBS with it, see SentToEBS.
+func TrackEBSRequests(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ebsSentKey{}, new(atomic.Bool))
+}
+
+// SentToEBS reports whether an EBSClient sent a request to EBS with ctx, or one
+// of its children. It is false when ctx isn't tracked by TrackEBSRequests.
+func SentToEBS(ctx context.Context) bool {
+	sent, _ := ctx.Value(ebsSentKey{}).(*atomic.Bool)
+	return sent != nil && sent.Load()
+}
+
+// markSentToEBS is called by the EBSClients before they send a request with ctx
+func markSentToEBS(ctx context.Context) {
+	if sent, _ := ctx.Value(ebsSentKey{}).(*atomic.Bool); sent != nil {
+		sent.Store(true)
+	}
+}
+
+// EBSExchange is a request sent to EBS together with what EBS answered. It is
+// what we refer to when EBS disputes a transaction, so the request is stored
+// with its card data redacted (see redact.JSON) while the response is kept as
+// EBS sent it.
+type EBSExchange struct {
+	gorm.Model
+	RequestID string `json:"request_id" gorm:"index"`
+	Endpoint  string `json:"endpoint"`
+	UUID      string `json:"uuid" gorm:"index"`
+	PANLast4  string `json:"pan_last4" gorm:"column:pan_last4;index"`
+	Request   string `json:"request"`
+	Response  string `json:"response"`
+	// HTTPStatus is 0 when EBS couldn't be reached, see Error
+	HTTPStatus int    `json:"http_status"`
+	LatencyMs  int64  `json:"latency_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// TableName of EBSExchange
+func (EBSExchange) TableName() string { return "ebs_exchanges" }
+
+// newExchange records req sent to rawURL, its response is filled in by the caller
+func newExchange(ctx context.Context, rawURL string, req []byte, latency time.Duration) EBSExchange {
+	exchange := EBSExchange{RequestID: RequestID(ctx), Endpoint: rawURL, LatencyMs: latency.Milliseconds()}
+	if u, err := url.Parse(rawURL); err == nil && u.Path != "" {
+		exchange.Endpoint = u.Path
+	}
+	exchange.Request = string(redact.JSON(req))
+	var fields struct {
+		UUID string `json:"UUID"`
+		PAN  string `json:"PAN"`
+	}
+	if err := json.Unmarshal(req, &fields); err != nil {
+		return exchange
+	}
+	exchange.UUID = fields.UUID
+	if len(fields.PAN) >= 4 {
+		exchange.PANLast4 = fields.PAN[len(fields.PAN)-4:]
+	}
+	return exchange
+}
+
+// record stores exchange, failing to do so must not fail the transaction
+func (e *HTTPEBSClient) record(exchange EBSExchange) {
+	if e.Db == nil {
+		return
+	}
+	if err := e.Db.Create(&exchange).Error; err != nil {
+		log.WithFields(logrus.Fields{
+			"code":       err.Error(),
+			"request_id": exchange.RequestID,
+			"uuid":       exchange.UUID,
+		}).Error("unable to record ebs exchange")
+	}
+}
@@ -0,0 +1,65 @@
+package ebs_fields
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// FakeEBSClient is an in-memory EBSClient to be used in tests. It records
+// every request it receives and answers them using Handler.
+type FakeEBSClient struct {
+	// Handler computes the response for a request, when it is nil every
+	// request is approved and echoes back its UUID.
+	Handler func(url string, req []byte) (int, EBSParserFields, error)
+
+	mu       sync.Mutex
+	requests []FakeEBSRequest
+}
+
+// FakeEBSRequest is a request received by FakeEBSClient
+type FakeEBSRequest struct {
+	URL  string
+	Body []byte
+}
+
+// Do implements EBSClient
+func (f *FakeEBSClient) Do(ctx context.Context, url string, req []byte) (int, EBSParserFields, error) {
+	f.mu.Lock()
+	f.requests = append(f.requests, FakeEBSRequest{URL: url, Body: req})
+	f.mu.Unlock()
+	markSentToEBS(ctx)
+	if err := ctx.Err(); err != nil {
+		return http.StatusGatewayTimeout, pendingResponse(req), EbsGatewayConnectivityErr
+	}
+	if f.Handler != nil {
+		return f.Handler(url, req)
+	}
+	return http.StatusOK, ApprovedResponse(req), nil
+}
+
+// Requests returns the requests received so far
+func (f *FakeEBSClient) Requests() []FakeEBSRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FakeEBSRequest(nil), f.requests...)
+}
+
+// ApprovedResponse builds a successful EBS response for req
+func ApprovedResponse(req []byte) EBSParserFields {
+	var fields struct {
+		UUID         string  `json:"UUID"`
+		TranDateTime string  `json:"tranDateTime"`
+		TranAmount   float32 `json:"tranAmount"`
+	}
+	json.Unmarshal(req, &fields)
+	var res EBSParserFields
+	res.UUID = fields.UUID
+	res.TranDateTime = fields.TranDateTime
+	res.TranAmount = fields.TranAmount
+	res.ResponseCode = SUCCESS
+	res.ResponseMessage = "Approval"
+	res.ResponseStatus = "Successful"
+	return res
+}
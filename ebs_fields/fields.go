@@ -5,6 +5,7 @@
 package ebs_fields
 
 import (
+	"context"
 	"database/sql/driver"
 	"encoding/json"
 	"errors"
@@ -12,8 +13,8 @@ import (
 	"regexp"
 	"time"
 
+	"github.com/adonese/noebs/redact"
 	"github.com/go-playground/validator/v10"
-	"github.com/google/uuid"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
@@ -66,7 +67,7 @@ func (f *MiniStatementFields) MustMarshal() []byte {
 type ChangePINFields struct {
 	CommonFields
 	CardInfoFields
-	NewPIN string `json:"newPIN" binding:"required"`
+	NewPIN string `json:"newPIN" binding:"required" redact:"secret"`
 }
 
 func (f *ChangePINFields) MustMarshal() []byte {
@@ -78,7 +79,7 @@ type CardTransferFields struct {
 	CommonFields
 	CardInfoFields
 	AmountFields
-	ToCard string `json:"toCard" binding:"required"`
+	ToCard string `json:"toCard" binding:"required" redact:"pan"`
 }
 
 type AccountTransferFields struct {
@@ -202,9 +203,9 @@ type CommonFields struct {
 
 // CardInfoFields implements a payment card info
 type CardInfoFields struct {
-	Pan     string `json:"PAN" binding:"required" form:"PAN"`
-	Pin     string `json:"PIN" binding:"required" form:"PIN"`
-	Expdate string `json:"expDate" binding:"required" form:"expDate"`
+	Pan     string `json:"PAN" binding:"required" form:"PAN" redact:"pan"`
+	Pin     string `json:"PIN" binding:"required" form:"PIN" redact:"secret"`
+	Expdate string `json:"expDate" binding:"required" form:"expDate" redact:"secret"`
 }
 
 // AmountFields transaction amount data
@@ -242,15 +243,15 @@ type EBSResponse struct {
 	TerminalID             string  `json:"terminalId,omitempty"`
 	SystemTraceAuditNumber int     `json:"systemTraceAuditNumber,omitempty"`
 	ClientID               string  `json:"clientId,omitempty"`
-	PAN                    string  `json:"PAN,omitempty"`
+	PAN                    string  `json:"PAN,omitempty" redact:"pan"`
 	ServiceID              string  `json:"serviceId,omitempty"`
 	TranAmount             float32 `json:"tranAmount,omitempty"`
 	PhoneNumber            string  `json:"phoneNumber,omitempty"`
 	FromAccount            string  `json:"fromAccount,omitempty"`
 	ToAccount              string  `json:"toAccount,omitempty"`
-	FromCard               string  `json:"fromCard,omitempty"`
-	ToCard                 string  `json:"toCard,omitempty"`
-	OTP                    string  `json:"otp,omitempty"`
+	FromCard               string  `json:"fromCard,omitempty" redact:"pan"`
+	ToCard                 string  `json:"toCard,omitempty" redact:"pan"`
+	OTP                    string  `json:"otp,omitempty" redact:"secret"`
 	OTPID                  string  `json:"otpId,omitempty"`
 	TranCurrencyCode       string  `json:"tranCurrencyCode,omitempty"`
 	EBSServiceName         string  `json:"-,omitempty"`
@@ -295,7 +296,7 @@ type EBSResponse struct {
 	Username                 string  `json:"userName,omitempty"`
 	DynamicFees              float32 `json:"dynamicFees,omitempty"`
 	QRCode                   string  `json:"QRCode,omitempty"`
-	ExpDate                  string  `json:"expDate,omitempty"` // FIXME(adonese): don't store it in database
+	ExpDate                  string  `json:"expDate,omitempty" redact:"secret"` // FIXME(adonese): don't store it in database
 	FinancialInstitutionID   string  `json:"financialInstitutionId,omitempty"`
 	CreationDate             string  `json:"creationDate,omitempty"`
 	PanCategory              string  `json:"panCategory,omitempty"`
@@ -308,14 +309,25 @@ type EBSResponse struct {
 	MerchantCategoryCode     string  `json:"merchantCategoryCode,omitempty"`
 	PostalCode               string  `json:"postalCode,omitempty"`
 
-	SenderPAN   string `json:"-"`
-	ReceiverPAN string `json:"-"`
+	SenderPAN   string `json:"-" redact:"pan"`
+	ReceiverPAN string `json:"-" redact:"pan"`
+	// Mobile is the noebs user who made the transaction and SenderPANHash the
+	// fingerprint of the card it was made with (see HashPAN), CheckLimits counts them.
+	// ReceiverPANHash is the fingerprint of the card that was paid, they are set
+	// by BeforeSave and match the transactions of a user's cards.
+	Mobile          string `json:"-" gorm:"index"`
+	SenderPANHash   string `json:"-" gorm:"index"`
+	ReceiverPANHash string `json:"-" gorm:"index"`
 	// BillType is the type of bill (TopUp, Electricity, Educations, ...etc)
 	BillType string `json:"bill_type,omitempty"`
 	// BillTo is the number associated with the bill type (TopUp: phone number, Electricity: meter number, ...etc)
 	BillTo string `json:"bill_to,omitempty"`
 	// BillInfo2 contains the electricicity token
 	BillInfo2 string `json:"bill_info2,omitempty"`
+
+	// ReconcileState is set when EBS didn't answer the transaction, see ReconcilePending
+	ReconcileState    string `json:"reconcile_state,omitempty" gorm:"index"`
+	ReconcileAttempts int    `json:"-"`
 }
 
 // TableName overrides the default table name for gorm
@@ -323,6 +335,55 @@ func (EBSResponse) TableName() string {
 	return "transactions"
 }
 
+// BeforeSave GORM hook, it fingerprints the cards of the transaction. Masked
+// card numbers can't be, they are left alone.
+func (res *EBSResponse) BeforeSave(tx *gorm.DB) error {
+	if pan := firstFullPAN(res.SenderPAN, res.PAN); res.SenderPANHash == "" && pan != "" {
+		res.SenderPANHash = HashPAN(pan)
+	}
+	if pan := firstFullPAN(res.ReceiverPAN, res.ToCard); res.ReceiverPANHash == "" && pan != "" {
+		res.ReceiverPANHash = HashPAN(pan)
+	}
+	return nil
+}
+
+var fullPANRe = regexp.MustCompile(`^\d{16,19}$`)
+
+func firstFullPAN(pans ...string) string {
+	for _, pan := range pans {
+		if fullPANRe.MatchString(pan) {
+			return pan
+		}
+	}
+	return ""
+}
+
+// HashTransactionPANs fingerprints the cards of the transactions stored before
+// BeforeSave did. It returns the number of transactions updated.
+func HashTransactionPANs(db *gorm.DB) (int, error) {
+	var trans []EBSResponse
+	err := db.Unscoped().Select("id", "pan", "sender_pan", "receiver_pan", "to_card", "sender_pan_hash", "receiver_pan_hash").
+		Where("coalesce(sender_pan_hash, '') = '' OR coalesce(receiver_pan_hash, '') = ''").Find(&trans).Error
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, tran := range trans {
+		sender, receiver := tran.SenderPANHash, tran.ReceiverPANHash
+		tran.BeforeSave(db)
+		if tran.SenderPANHash == sender && tran.ReceiverPANHash == receiver {
+			continue
+		}
+		err := db.Unscoped().Model(&EBSResponse{}).Where("id = ?", tran.ID).
+			UpdateColumns(map[string]any{"sender_pan_hash": tran.SenderPANHash, "receiver_pan_hash": tran.ReceiverPANHash}).Error
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
 type MinistatementDB []map[string]interface{}
 
 func (m *MinistatementDB) Scan(value interface{}) error {
@@ -344,19 +405,8 @@ func (res EBSResponse) GetByUUID(uuid string, db *gorm.DB) (EBSResponse, error)
 	return data, nil
 }
 
-func (e EBSResponse) GetEBSUUID(originalUUID string, db *gorm.DB, noebsConfig *NoebsConfig) (EBSResponse, error) {
-	url := noebsConfig.ConsumerIP + ConsumerTransactionStatusEndpoint
-	var fields = ConsumerTransactionStatusFields{}
-	fields.ApplicationId = noebsConfig.ConsumerID
-	fields.TranDateTime = EbsDate()
-	fields.OriginalTranUUID = originalUUID
-	uid, _ := uuid.NewRandom()
-	fields.UUID = uid.String()
-	jsonBuffer, err := json.Marshal(fields)
-	if err != nil {
-		return EBSResponse{}, err
-	}
-	_, res, ebsErr := EBSHttpClient(url, jsonBuffer)
+func (e EBSResponse) GetEBSUUID(ctx context.Context, client EBSClient, originalUUID string, db *gorm.DB, noebsConfig *NoebsConfig) (EBSResponse, error) {
+	res, ebsErr := QueryTransactionStatus(ctx, client, noebsConfig, originalUUID)
 	res.Name = "status"
 	db.Table("transactions").Create(&res.EBSResponse)
 	if ebsErr != nil {
@@ -410,14 +460,14 @@ type QRPurchase struct {
 	ApplicationID            string `json:"applicationId,omitempty"`
 	AuthenticationType       string `json:"authenticationType,omitempty"`
 	IssuerTranFee            string `json:"issuerTranFee,omitempty"`
-	MerchantAccountExpDate   string `json:"merchantAccountExpDate,omitempty"`
+	MerchantAccountExpDate   string `json:"merchantAccountExpDate,omitempty" redact:"secret"`
 	MerchantAccountReference string `json:"merchantAccountReference,omitempty"`
 	MerchantAccountType      string `json:"merchantAccountType,omitempty"`
 	MerchantCity             string `json:"merchantCity,omitempty"`
 	MerchantID               string `json:"merchantID,omitempty"`
 	MerchantMobileNo         string `json:"merchantMobileNo,omitempty"`
 	MerchantName             string `json:"merchantName,omitempty"`
-	Pan                      string `json:"pan,omitempty"`
+	Pan                      string `json:"pan,omitempty" redact:"pan"`
 	ResponseCode             int64  `json:"responseCode,omitempty"`
 	ResponseMessage          string `json:"responseMessage,omitempty"`
 	ResponseStatus           string `json:"responseStatus,omitempty"`
@@ -430,9 +480,9 @@ type QRPurchase struct {
 
 type ConsumerSpecificFields struct {
 	UUID            string  `json:"UUID" form:"UUID" binding:"required,len=36"`
-	Ipin            string  `json:"IPIN" form:"IPIN" binding:"required"`
-	PAN             string  `json:"PAN"`
-	ExpDate         string  `json:"expDate"`
+	Ipin            string  `json:"IPIN" form:"IPIN" binding:"required" redact:"secret"`
+	PAN             string  `json:"PAN" redact:"pan"`
+	ExpDate         string  `json:"expDate" redact:"secret"`
 	PanCategory     string  `json:"panCategory"`
 	FromAccountType string  `json:"fromAccountType" form:"fromAccountType"`
 	ToAccountType   string  `json:"toAccountType" form:"toAccountType"`
@@ -450,7 +500,7 @@ type ConsumerSpecificFields struct {
 
 	// User settings
 	Username     string `json:"userName" Form:"userName"`
-	UserPassword string `json:"userPassword" form:"userPassword"`
+	UserPassword string `json:"userPassword" form:"userPassword" redact:"secret"`
 
 	// Entities
 	EntityType  string `json:"entityType" form:"entityType"`
@@ -464,8 +514,8 @@ type ConsumerSpecificFields struct {
 	OriginalTransactionId  string                 `json:"originalTransactionId" form:"originalTransactionId"` // for QR, sometimes
 	MBR                    string                 `json:"mbr" form:"mbr"`
 	PhoneNo                string                 `json:"phoneNo" form:"phoneNo"`
-	NewIpin                string                 `json:"newIPIN" form:"newIPIN"`
-	NewUserPassword        string                 `json:"newUserPassword" form:"newUserPassword"`
+	NewIpin                string                 `json:"newIPIN" form:"newIPIN" redact:"secret"`
+	NewUserPassword        string                 `json:"newUserPassword" form:"newUserPassword" redact:"secret"`
 	SecurityQuestion       string                 `json:"securityQuestion" form:"securityQuestion"`
 	SecurityQuestionAnswer string                 `json:"securityQuestionAnswer" form:"securityQuestionAnswer"`
 	AdminUserName          string                 `json:"adminUserName" form:"adminUserName"`
@@ -478,21 +528,18 @@ type ConsumerSpecificFields struct {
 	FinancialInstitutionID string                 `json:"financialInstitutionId" form:"financialInstitutionId"`
 }
 
-// MaskPAN returns the last 4 digit of the PAN. We shouldn't care about the first 6
+// MaskPAN masks the card numbers of res, keeping their first 6 and last 4 digits (see redact.PAN)
 func (res *EBSResponse) MaskPAN() {
 	if res.PAN != "" {
-		length := len(res.PAN)
-		res.PAN = res.PAN[:6] + "*****" + res.PAN[length-4:]
+		res.PAN = redact.PAN(res.PAN)
 	}
 
 	if res.ToCard != "" {
-		length := len(res.ToCard)
-		res.ToCard = res.ToCard[:6] + "*****" + res.ToCard[length-4:]
+		res.ToCard = redact.PAN(res.ToCard)
 	}
 
 	if res.FromCard != "" {
-		length := len(res.FromCard)
-		res.FromCard = res.FromCard[:6] + "*****" + res.FromCard[length-4:]
+		res.FromCard = redact.PAN(res.FromCard)
 	}
 }
 
@@ -534,9 +581,9 @@ func (f *ConsumerBillInquiryFields) MustMarshal() []byte {
 }
 
 type ConsumerCardHolderFields struct {
-	Pan     string `json:"PAN" form:"PAN" binding:"required"`
-	Ipin    string `json:"IPIN" form:"IPIN" binding:"required"`
-	ExpDate string `json:"expDate" form:"expDate" binding:"required"`
+	Pan     string `json:"PAN" form:"PAN" binding:"required" redact:"pan"`
+	Ipin    string `json:"IPIN" form:"IPIN" binding:"required" redact:"secret"`
+	ExpDate string `json:"expDate" form:"expDate" binding:"required" redact:"secret"`
 }
 
 func (f *ConsumerCardHolderFields) MustMarshal() []byte {
@@ -611,7 +658,7 @@ type QRMerchantFields struct {
 	MobileNo string `json:"mobileNo" form:"mobileNo" binding:"required"`
 	IDType   string `json:"idType" form:"idType" binding:"required"`
 	IdNo     string `json:"idNo" form:"idNo" binding:"required"`
-	ExpDate  string `json:"expDate" form:"expDate" binding:"required_if=MerchantAccountType CARD"`
+	ExpDate  string `json:"expDate" form:"expDate" binding:"required_if=MerchantAccountType CARD" redact:"secret"`
 }
 
 type ConsumerQRRegistration struct {
@@ -636,13 +683,13 @@ type ConsumerRegistrationFields struct {
 
 type ConsumerCompleteRegistrationFields struct {
 	ConsumerCommonFields
-	OTP              string `json:"otp" binding:"required"`  // encrypted for fucks sake. fuck ebs
-	IPIN             string `json:"IPIN" binding:"required"` // also encrypted fml forever
+	OTP              string `json:"otp" binding:"required" redact:"secret"`  // encrypted for fucks sake. fuck ebs
+	IPIN             string `json:"IPIN" binding:"required" redact:"secret"` // also encrypted fml forever
 	ExtraInfo        string `json:"extraInfo,omitempty"`
 	OriginalTranUUID string `json:"originalTranUUID" binding:"required"`
-	Password         string `json:"userPassword" binding:"required"`
+	Password         string `json:"userPassword" binding:"required" redact:"secret"`
 	// Those are noebs-specific fields and shouldn't go to EBS
-	NoebsPassword string `json:"password,omitempty"`
+	NoebsPassword string `json:"password,omitempty" redact:"secret"`
 	Mobile        string `json:"mobile,omitempty"`
 }
 
@@ -660,22 +707,22 @@ func (f *ConsumerQRPaymentFields) MustMarshal() []byte {
 
 type ConsumerQRRefundFields struct {
 	ConsumerCommonFields
-	Pan                   string `json:"PAN,omitempty" form:"PAN"`
-	Ipin                  string `json:"IPIN,omitempty" form:"IPIN"`
-	ExpDate               string `json:"expDate,omitempty" form:"expDate"`
+	Pan                   string `json:"PAN,omitempty" form:"PAN" redact:"pan"`
+	Ipin                  string `json:"IPIN,omitempty" form:"IPIN" redact:"secret"`
+	ExpDate               string `json:"expDate,omitempty" form:"expDate" redact:"secret"`
 	OriginalTranUUID      string `json:"originalTranUUID" binding:"required"`
 	AuthenticationType    string `json:"authenticationType,omitempty"`
 	OriginalTransactionId string `json:"originalTransactionId,omitempty"`
 	MerchantID            string `json:"merchantID,omitempty"`
 	Last4PAN              string `json:"last4PANDigits,omitempty"`
-	OTP                   string `json:"OTP,omitempty"`
+	OTP                   string `json:"OTP,omitempty" redact:"secret"`
 }
 
 type ConsumerQRCompleteFields struct {
 	ConsumerCommonFields
 	OrigUUID   string `json:"originalTranUUID" binding:"required"`
 	OrigTranID string `json:"originalTransactionId,omitempty"`
-	OTP        string `json:"OTP,omitempty"`
+	OTP        string `json:"OTP,omitempty" redact:"secret"`
 }
 
 type ConsumerQRStatus struct {
@@ -698,7 +745,7 @@ type MerchantRegistrationFields struct {
 	MerchantAccountType string `json:"merchantAccountType" binding:"required"`
 	// this is the pan
 	MerchantAccountReference string `json:"merchantAccountReference" binding:"required"`
-	ExpDate                  string `json:"expDate" binding:"required"`
+	ExpDate                  string `json:"expDate" binding:"required" redact:"secret"`
 }
 
 func (f *MerchantRegistrationFields) MustMarshal() []byte {
@@ -716,7 +763,7 @@ type Merchant struct {
 	IDNo                 string `json:"id_no" form:"id_no" binding:"required" gorm:"column:id_no"`
 	TerminalID           string `json:"-" gorm:"-"`
 	PushID               string `json:"push_id" gorm:"column:push_id"`
-	Password             string `json:"password"`
+	Password             string `json:"password" redact:"secret"`
 	IsVerifed            bool   `json:"is_verified"`
 	BillerID             string `json:"biller_id"`
 	EBSBiller            string `json:"ebs_biller"`
@@ -780,7 +827,7 @@ func (f *ConsumerWorkingKeyFields) MustMarshal() []byte {
 type ConsumerIPinFields struct {
 	ConsumerCommonFields
 	ConsumerCardHolderFields
-	NewIPIN string `json:"newIPIN" binding:"required"`
+	NewIPIN string `json:"newIPIN" binding:"required" redact:"secret"`
 }
 
 func (f *ConsumerIPinFields) MustMarshal() []byte {
@@ -797,7 +844,7 @@ type ConsumerMobileTransferFields struct {
 	ConsumerCommonFields
 	ConsumerCardHolderFields
 	AmountFields
-	ToCard      string  `json:"toCard"`
+	ToCard      string  `json:"toCard" redact:"pan"`
 	DynamicFees float32 `json:"dynamicFees,omitempty"`
 	Mobile      string  `json:"mobile" binding:"required"`
 }
@@ -814,7 +861,7 @@ type ConsumerCardTransferFields struct {
 	ConsumerCommonFields
 	ConsumerCardHolderFields
 	AmountFields
-	ToCard      string  `json:"toCard" binding:"required"`
+	ToCard      string  `json:"toCard" binding:"required" redact:"pan"`
 	DynamicFees float32 `json:"dynamicFees,omitempty"`
 }
 
@@ -849,10 +896,10 @@ func (f *ConsumerStatusFields) MustMarshal() []byte {
 
 type ConsumerGenerateIPin struct {
 	ConsumerGenerateIPINFields
-	Password     string `json:"password"`
-	Pan          string `json:"pan"`
+	Password     string `json:"password" redact:"secret"`
+	Pan          string `json:"pan" redact:"pan"`
 	MobileNumber string `json:"phoneNumber" binding:"required"`
-	Expdate      string `json:"expDate"`
+	Expdate      string `json:"expDate" redact:"secret"`
 }
 
 func (gi *ConsumerGenerateIPin) MustMarshal() []byte {
@@ -862,11 +909,11 @@ func (gi *ConsumerGenerateIPin) MustMarshal() []byte {
 
 type ConsumerGenerateIPinCompletion struct {
 	ConsumerGenerateIPINFields
-	Password string `json:"password" binding:"required"`
-	Pan      string `json:"pan" binding:"required"`
-	Expdate  string `json:"expDate" binding:"required"`
-	Otp      string `json:"otp"  binding:"required"`
-	Ipin     string `json:"ipin" binding:"required"`
+	Password string `json:"password" binding:"required" redact:"secret"`
+	Pan      string `json:"pan" binding:"required" redact:"pan"`
+	Expdate  string `json:"expDate" binding:"required" redact:"secret"`
+	Otp      string `json:"otp"  binding:"required" redact:"secret"`
+	Ipin     string `json:"ipin" binding:"required" redact:"secret"`
 }
 
 type ConsumerPANFromMobileFields struct {
@@ -877,7 +924,7 @@ type ConsumerPANFromMobileFields struct {
 
 type ConsumerCardInfoFields struct {
 	ConsumerCommonFields
-	PAN string `json:"PAN" binding:"required"`
+	PAN string `json:"PAN" binding:"required" redact:"pan"`
 }
 
 func (gip *ConsumerGenerateIPinCompletion) MustMarshal() []byte {
@@ -943,11 +990,11 @@ type ValidationError struct {
 type NoebsConfig struct {
 	OneSignal    string `json:"onesignal_key"`
 	DatabasePath string `json:"db_path"`
-	SMSAPIKey    string `json:"sms_key"`
+	SMSAPIKey    string `json:"sms_key" redact:"secret"`
 	SMSSender    string `json:"sms_sender"`
 	SMSGateway   string `json:"sms_gateway"`
 	RedisPort    string `json:"redis_port"`
-	JWTKey       string `json:"jwt_secret"`
+	JWTKey       string `json:"jwt_secret" redact:"secret"`
 	Sentry       string `json:"sentry"`
 	Port         string `json:"port"`
 
@@ -978,14 +1025,14 @@ type NoebsConfig struct {
 
 	// IPIN generation configs
 	EBSIPINUsername string `json:"ipin_username"`
-	EBSIPINPassword string `json:"ipin_password"`
+	EBSIPINPassword string `json:"ipin_password" redact:"secret"`
 
 	// Bill inquiry specific hard-coded card holder information
 	// We highly don't recommend to store data, but this can be an exception
-	BillInquiryPAN     string `json:"pan"`
-	BillInquiryPIN     string `json:"pin"`
-	BillInquiryIPIN    string `json:"ipin"`
-	BillInquiryExpDate string `json:"exp_date"`
+	BillInquiryPAN     string `json:"pan" redact:"pan"`
+	BillInquiryPIN     string `json:"pin" redact:"secret"`
+	BillInquiryIPIN    string `json:"ipin" redact:"secret"`
+	BillInquiryExpDate string `json:"exp_date" redact:"secret"`
 	EBSConsumerKey     string `json:"pub_key"`
 	EBSIpinKey         string `json:"ipin_key"`
 
@@ -996,8 +1043,99 @@ type NoebsConfig struct {
 	// SMS message
 	SMSMessage string `json:"sms_message"`
 
+	// SMSProvider selects how SMS are sent: gateway (default, uses SMSGateway),
+	// webhook (posts JSON to SMSWebhookURL with SMSAPIKey as a bearer token), memory or
+	// file (SMSFilePath) for development.
+	SMSProvider   string `json:"sms_provider"`
+	SMSWebhookURL string `json:"sms_webhook_url"`
+	SMSFilePath   string `json:"sms_file_path"`
+
 	// This the base of the link for payment links
 	PaymentLinkBase string `json:"payment_link_base"`
+	// PaymentTokenTTL is how long (in seconds) a payment token can be paid, defaults to a day
+	PaymentTokenTTL int `json:"payment_token_ttl"`
+	// PaymentTokenKey signs payment tokens (JWTKey is used when it is empty), see TokenCodec.
+	// AllowUnsignedTokens still accepts the old base64 tokens until they are phased out.
+	PaymentTokenKey      string `json:"payment_token_key" redact:"secret"`
+	EncryptPaymentTokens bool   `json:"encrypt_payment_tokens"`
+	AllowUnsignedTokens  bool   `json:"allow_unsigned_tokens"`
+	// BillerWebhookURL receives the webhook events of every user, e.g., the
+	// biller confirming quick payments. BillerWebhookSecret signs them.
+	BillerWebhookURL    string `json:"biller_webhook_url"`
+	BillerWebhookSecret string `json:"biller_webhook_secret" redact:"secret"`
+
+	// CardKeys encrypt the card data stored in the database, they are base64
+	// encoded AES keys by key id. New data is encrypted with ActiveCardKey and the
+	// other keys are kept to read older data until `encrypt-cards` is run after a
+	// rotation. CardHashKey keys the card fingerprints, it must never change.
+	CardKeys      map[string]string `json:"card_keys" redact:"secret"`
+	ActiveCardKey string            `json:"active_card_key"`
+	CardHashKey   string            `json:"card_hash_key" redact:"secret"`
+
+	// EBS transport settings. EBSCACert is a path to a PEM bundle used to pin
+	// EBS certificate authority, when it is empty we skip verification since
+	// EBS QA servers use self-signed certificates.
+	EBSCACert       string `json:"ebs_ca_cert"`
+	EBSTimeout      int    `json:"ebs_timeout"`        // in seconds, defaults to 90
+	EBSMaxIdleConns int    `json:"ebs_max_idle_conns"` // size of the keep-alive pool
+
+	// Reconciliation of timed-out transactions, both in seconds. Pending transactions
+	// are checked every ReconcileInterval and given up on (or reversed, for merchant
+	// transactions) after ReconcileWindow.
+	ReconcileInterval int `json:"reconcile_interval"`
+	ReconcileWindow   int `json:"reconcile_window"`
+
+	// PushWorkers is the number of workers delivering notifications, defaults to 4
+	PushWorkers int `json:"push_workers"`
+
+	// Consumer sessions, both in seconds: access tokens expire after AccessTokenTTL
+	// (15 minutes by default) and are refreshed with a refresh token that is valid
+	// for RefreshTokenTTL (30 days by default) unless its session is revoked.
+	AccessTokenTTL  int `json:"access_token_ttl"`
+	RefreshTokenTTL int `json:"refresh_token_ttl"`
+	// LegacyRefreshUntil (RFC3339, empty for no limit) ends the refresh of the
+	// tokens issued before sessions, which have no refresh token.
+	LegacyRefreshUntil string `json:"legacy_refresh_until"`
+
+	// JWTKeys sign access tokens with RS256 or EdDSA so that partner services can
+	// verify them from /.well-known/jwks.json, keyed by their kid. JWTKey (HMAC) is
+	// used when there are none, and its tokens are still accepted until LegacyJWTUntil
+	// (RFC3339, empty for no limit) to migrate the tokens issued before.
+	JWTKeys        map[string]JWTKeyConfig `json:"jwt_keys" redact:"secret"`
+	LegacyJWTUntil string                  `json:"legacy_jwt_until"`
+
+	// AdminUsername and AdminPassword create the first dashboard admin when
+	// there are no operators yet, the other operators are created from the dashboard.
+	AdminUsername string `json:"admin_username"`
+	AdminPassword string `json:"admin_password" redact:"secret"`
+
+	// APIKeyScopes are the scopes (consumer, merchant or dashboard) whose endpoints
+	// require the X-API-Key of an API client, merchant and dashboard by default.
+	// API keys that are sent are checked on every scope, but they are optional on
+	// the scopes that aren't listed, and on all of them with OptionalAPIKeys.
+	APIKeyScopes    []string `json:"api_key_scopes"`
+	OptionalAPIKeys bool     `json:"optional_api_keys"`
+
+	// KYCStoragePath is the directory keeping the selfies and passport images
+	// of the KYCs (default kyc). MobileTransferKYCTier is the KYC tier a user
+	// needs to transfer to a mobile number, 0 for none.
+	KYCStoragePath        string `json:"kyc_storage_path"`
+	MobileTransferKYCTier int    `json:"mobile_transfer_kyc_tier"`
+
+	// LoginMaxAttempts is how many failed sign ins in a row lock an account (default 5)
+	LoginMaxAttempts int `json:"login_max_attempts"`
+}
+
+// JWTKeyConfig is a key of NoebsConfig.JWTKeys. Keys are published as soon as
+// they are configured, and the one with the latest ActiveFrom signs the new
+// tokens: a rotation is scheduled by adding a key that becomes active later.
+type JWTKeyConfig struct {
+	// PrivateKey is a PEM encoded RSA or Ed25519 private key, or the path to one
+	PrivateKey string `json:"private_key" redact:"secret"`
+	// ActiveFrom is when the key starts signing tokens (RFC3339), empty for right away
+	ActiveFrom string `json:"active_from"`
+	// RetireAt is when the tokens signed with the key stop being accepted (RFC3339), empty for never
+	RetireAt string `json:"retire_at"`
 }
 
 func (n *NoebsConfig) Defaults() {
@@ -1017,6 +1155,29 @@ func (n *NoebsConfig) Defaults() {
 		n.MerchantIP = n.MerchantQAIP
 		n.MerchantID = n.MerchantQAID
 	}
+	if n.ReconcileInterval == 0 {
+		n.ReconcileInterval = 60
+	}
+	if n.ReconcileWindow == 0 {
+		n.ReconcileWindow = 300
+	}
+	if n.PaymentTokenTTL == 0 {
+		n.PaymentTokenTTL = 24 * 60 * 60
+	}
+	if n.PushWorkers == 0 {
+		n.PushWorkers = 4
+	}
+	if n.KYCStoragePath == "" {
+		n.KYCStoragePath = "kyc"
+	}
+	if n.LoginMaxAttempts == 0 {
+		n.LoginMaxAttempts = 5
+	}
+	if n.OptionalAPIKeys {
+		n.APIKeyScopes = nil
+	} else if len(n.APIKeyScopes) == 0 {
+		n.APIKeyScopes = []string{"merchant", "dashboard"}
+	}
 }
 
 type QuickPaymentFields struct {
@@ -4,6 +4,7 @@ import (
 	"reflect"
 	"testing"
 
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
@@ -243,3 +244,46 @@ func TestEBSResponse_GetByUUID(t *testing.T) {
 		})
 	}
 }
+
+func TestHashTransactionPANs(t *testing.T) {
+	db, _ := gorm.Open(sqlite.Open("file:TestHashTransactionPANs?mode=memory&cache=shared"), &gorm.Config{})
+	db.AutoMigrate(&EBSResponse{})
+	pan, toCard := "9222081700176714465", "9222081700176714467"
+	db.Create(&EBSResponse{UUID: "1", PAN: pan, ToCard: toCard})
+	// stored before the cards were fingerprinted
+	db.Exec("INSERT INTO transactions (id, uuid, sender_pan, receiver_pan) VALUES (2, ?, ?, ?), (3, ?, ?, ?)", "2", pan, toCard, "3", "922208*****4465", "")
+
+	if n, err := HashTransactionPANs(db); n != 1 || err != nil {
+		t.Fatalf("HashTransactionPANs() = %v, %v, want 1", n, err)
+	}
+	var trans []EBSResponse
+	db.Order("uuid").Find(&trans)
+	for _, tran := range trans[:2] {
+		if tran.SenderPANHash != HashPAN(pan) || tran.ReceiverPANHash != HashPAN(toCard) {
+			t.Errorf("transaction %s hashes = %q, %q", tran.UUID, tran.SenderPANHash, tran.ReceiverPANHash)
+		}
+	}
+	if trans[2].SenderPANHash != "" {
+		t.Errorf("a masked card was fingerprinted: %q", trans[2].SenderPANHash)
+	}
+}
+
+func TestNoebsConfig_Defaults_apiKeyScopes(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  NoebsConfig
+		want []string
+	}{
+		{"default", NoebsConfig{}, []string{"merchant", "dashboard"}},
+		{"configured", NoebsConfig{APIKeyScopes: []string{"consumer"}}, []string{"consumer"}},
+		{"optional", NoebsConfig{APIKeyScopes: []string{"consumer"}, OptionalAPIKeys: true}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Defaults()
+			if !reflect.DeepEqual(tt.cfg.APIKeyScopes, tt.want) {
+				t.Errorf("Defaults() APIKeyScopes = %v, want %v", tt.cfg.APIKeyScopes, tt.want)
+			}
+		})
+	}
+}
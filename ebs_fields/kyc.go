@@ -0,0 +1,251 @@
+package ebs_fields
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// KYC statuses. A KYC is submitted by the user, taken by a reviewer and then
+// approved or rejected; a rejected or an approved KYC can be submitted again,
+// e.g., with a renewed passport.
+const (
+	KYCSubmitted   = "submitted"
+	KYCUnderReview = "under_review"
+	KYCApproved    = "approved"
+	KYCRejected    = "rejected"
+)
+
+var kycTransitions = map[string][]string{
+	KYCSubmitted:   {KYCUnderReview, KYCRejected},
+	KYCUnderReview: {KYCApproved, KYCRejected},
+	KYCApproved:    {KYCSubmitted},
+	KYCRejected:    {KYCSubmitted},
+}
+
+// maxKYCImageSize is the size of the largest selfie or passport image, once decoded
+const maxKYCImageSize = 5 << 20
+
+var (
+	ErrInvalidKYCTransition = errors.New("the kyc can't move to this status")
+	ErrInvalidPassport      = errors.New("passport_number and expiration_date are required")
+	ErrPassportExpired      = errors.New("the passport is expired")
+	ErrInvalidKYCImage      = errors.New("images must be base64 encoded jpeg or png files of at most 5MB")
+	ErrInvalidKYCTier       = errors.New("an approved kyc needs a tier of at least 1")
+	ErrKYCNoteRequired      = errors.New("a rejected kyc needs a note for the user")
+)
+
+// Transition moves k to the status to, or returns ErrInvalidKYCTransition
+func (k *KYC) Transition(to string) error {
+	status := k.Status
+	if status == "" {
+		status = KYCSubmitted
+	}
+	for _, s := range kycTransitions[status] {
+		if s == to {
+			k.Status = to
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s to %s", ErrInvalidKYCTransition, status, to)
+}
+
+// Valid checks that the passport can be used for a KYC at now
+func (p *Passport) Valid(now time.Time) error {
+	if p.PassportNumber == "" || p.ExpirationDate.IsZero() {
+		return ErrInvalidPassport
+	}
+	if !p.ExpirationDate.After(now) {
+		return ErrPassportExpired
+	}
+	return nil
+}
+
+// KYCStore keeps the selfies and passport images of the KYCs, the KYC rows only
+// have their keys.
+type KYCStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+}
+
+// DirStore is a KYCStore keeping the images as files under Dir
+type DirStore struct {
+	Dir string
+}
+
+func (d DirStore) path(key string) (string, error) {
+	key = filepath.Clean(key)
+	if filepath.IsAbs(key) || key == "." || strings.HasPrefix(key, "..") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(d.Dir, key), nil
+}
+
+func (d DirStore) Put(key string, data []byte) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+func (d DirStore) Get(key string) ([]byte, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// decodeKYCImage decodes a base64 image, with or without its data: URL prefix,
+// and returns it with its file extension.
+func decodeKYCImage(encoded string) ([]byte, string, error) {
+	if i := strings.Index(encoded, ";base64,"); strings.HasPrefix(encoded, "data:") && i > 0 {
+		encoded = encoded[i+len(";base64,"):]
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(data) == 0 || len(data) > maxKYCImageSize {
+		return nil, "", ErrInvalidKYCImage
+	}
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		return data, ".jpg", nil
+	case "image/png":
+		return data, ".png", nil
+	}
+	return nil, "", ErrInvalidKYCImage
+}
+
+// SubmitKYC stores the images of req in store and submits the KYC of the user
+// mobile for a review. A user with a KYC that was already reviewed submits it
+// again, the one that is waiting for a review can't be changed. Submitting it
+// again takes the tier of the user back until the new passport is approved.
+func SubmitKYC(db *gorm.DB, store KYCStore, mobile string, req *KYCPassport, now time.Time) (*KYC, error) {
+	if _, err := GetUserByMobile(mobile, db); err != nil {
+		return nil, err
+	}
+	if err := req.Passport.Valid(now); err != nil {
+		return nil, err
+	}
+	var kyc KYC
+	err := db.First(&kyc, "mobile = ?", mobile).Error
+	exists := err == nil
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if exists {
+		if err := kyc.Transition(KYCSubmitted); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := make([]string, 2)
+	for i, img := range []struct{ kind, data string }{{"selfie", req.Selfie}, {"passport", req.PassportImg}} {
+		data, ext, err := decodeKYCImage(img.data)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = fmt.Sprintf("%s/%s-%d%s", mobile, img.kind, now.UnixNano(), ext)
+		if err := store.Put(keys[i], data); err != nil {
+			return nil, err
+		}
+	}
+
+	passport := req.Passport
+	passport.Model = gorm.Model{}
+	passport.Mobile = mobile
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if !exists {
+			kyc = KYC{UserMobile: mobile, Mobile: mobile, Passport: passport, Selfie: keys[0], PassportImg: keys[1], Status: KYCSubmitted}
+			return tx.Create(&kyc).Error
+		}
+		err := tx.Model(&kyc).Omit(clause.Associations).Updates(map[string]any{"status": KYCSubmitted, "selfie": keys[0], "passport_img": keys[1],
+			"tier": 0, "review_note": "", "reviewed_by": "", "reviewed_at": nil}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&User{}).Where("mobile = ?", mobile).Update("kyc_tier", 0).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Passport{}).Where("mobile = ?", mobile).
+			Select("birth_date", "issue_date", "expiration_date", "national_number", "passport_number", "gender", "nationality", "holder_name").
+			Updates(&passport).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	kyc.Passport = passport
+	return &kyc, nil
+}
+
+// ReviewKYC moves the KYC of the user mobile to status, on behalf of reviewer.
+// Approving it grants tier to the user, rejecting it takes their tier back
+// and note tells them why.
+func ReviewKYC(db *gorm.DB, mobile, status string, tier int, reviewer, note string, now time.Time) (*KYC, error) {
+	var kyc KYC
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Preload("Passport").First(&kyc, "mobile = ?", mobile).Error; err != nil {
+			return err
+		}
+		if err := kyc.Transition(status); err != nil {
+			return err
+		}
+		userTier := -1
+		switch status {
+		case KYCApproved:
+			if tier < 1 {
+				return ErrInvalidKYCTier
+			}
+			if err := kyc.Passport.Valid(now); err != nil {
+				return err
+			}
+			kyc.Tier, userTier = tier, tier
+		case KYCRejected:
+			if note == "" {
+				return ErrKYCNoteRequired
+			}
+			kyc.Tier, userTier = 0, 0
+		}
+		kyc.ReviewedBy, kyc.ReviewNote, kyc.ReviewedAt = reviewer, note, &now
+		err := tx.Model(&kyc).Omit(clause.Associations).Updates(map[string]any{"status": kyc.Status, "tier": kyc.Tier,
+			"reviewed_by": reviewer, "review_note": note, "reviewed_at": now}).Error
+		if err != nil || userTier < 0 {
+			return err
+		}
+		return tx.Model(&User{}).Where("mobile = ?", mobile).Update("kyc_tier", userTier).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &kyc, nil
+}
+
+// ActiveKYCTier returns the KYC tier of user at now. The tier lapses, back to
+// 0, once the passport it was granted with expires.
+func ActiveKYCTier(db *gorm.DB, user *User, now time.Time) (int, error) {
+	if user.KYCTier == 0 {
+		return 0, nil
+	}
+	var passport Passport
+	err := db.Select("expiration_date").First(&passport, "mobile = ?", user.Mobile).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if !passport.ExpirationDate.After(now) {
+		return 0, nil
+	}
+	return user.KYCTier, nil
+}
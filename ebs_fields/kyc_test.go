@@ -0,0 +1,132 @@
+package ebs_fields
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestKYC_Transition(t *testing.T) {
+	tests := []struct {
+		from    string
+		to      string
+		wantErr bool
+	}{
+		{"", KYCUnderReview, false},
+		{KYCSubmitted, KYCApproved, true},
+		{KYCSubmitted, KYCRejected, false},
+		{KYCUnderReview, KYCApproved, false},
+		{KYCUnderReview, KYCSubmitted, true},
+		{KYCApproved, KYCRejected, true},
+		{KYCApproved, KYCSubmitted, false},
+		{KYCRejected, KYCSubmitted, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.from+"_"+tt.to, func(t *testing.T) {
+			k := &KYC{Status: tt.from}
+			err := k.Transition(tt.to)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Transition() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && k.Status != tt.to {
+				t.Errorf("Transition() status = %q, want %q", k.Status, tt.to)
+			}
+		})
+	}
+}
+
+func TestSubmitKYC(t *testing.T) {
+	db, _ := gorm.Open(sqlite.Open("file:TestSubmitKYC?mode=memory&cache=shared"), &gorm.Config{})
+	db.AutoMigrate(&User{}, &KYC{}, &Passport{})
+	db.Create(&User{Model: gorm.Model{ID: 1}, Mobile: "0912141679"})
+	store := DirStore{Dir: t.TempDir()}
+	now := time.Date(2023, time.March, 15, 12, 0, 0, 0, time.UTC)
+	png := base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n0000"))
+	valid := Passport{PassportNumber: "P01234567", HolderName: "Mohamed Ahmed", ExpirationDate: now.AddDate(5, 0, 0)}
+	expired := valid
+	expired.ExpirationDate = now.AddDate(0, 0, -1)
+
+	tests := []struct {
+		name    string
+		req     KYCPassport
+		review  string // status the KYC is moved to after it is submitted
+		wantErr error
+	}{
+		{"expired passport", KYCPassport{Selfie: png, PassportImg: png, Passport: expired}, "", ErrPassportExpired},
+		{"not an image", KYCPassport{Selfie: base64.StdEncoding.EncodeToString([]byte("hello")), PassportImg: png, Passport: valid}, "", ErrInvalidKYCImage},
+		{"submitted", KYCPassport{Selfie: "data:image/png;base64," + png, PassportImg: png, Passport: valid}, KYCUnderReview, nil},
+		{"waiting for a review", KYCPassport{Selfie: png, PassportImg: png, Passport: valid}, "", ErrInvalidKYCTransition},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kyc, err := SubmitKYC(db, store, "0912141679", &tt.req, now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SubmitKYC() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if data, err := store.Get(kyc.Selfie); err != nil || string(data) != "\x89PNG\r\n\x1a\n0000" {
+				t.Errorf("SubmitKYC() stored the selfie %q, %v", data, err)
+			}
+			if _, err := ReviewKYC(db, "0912141679", tt.review, 0, "support", "", now); err != nil {
+				t.Fatalf("ReviewKYC() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestReviewKYC(t *testing.T) {
+	db, _ := gorm.Open(sqlite.Open("file:TestReviewKYC?mode=memory&cache=shared"), &gorm.Config{})
+	db.AutoMigrate(&User{}, &KYC{}, &Passport{})
+	now := time.Date(2023, time.March, 15, 12, 0, 0, 0, time.UTC)
+	db.Create(&User{Model: gorm.Model{ID: 1}, Mobile: "0912141679"})
+	db.Create(&KYC{UserMobile: "0912141679", Mobile: "0912141679", Status: KYCUnderReview,
+		Passport: Passport{PassportNumber: "P01234567", ExpirationDate: now.AddDate(1, 0, 0)}})
+
+	tests := []struct {
+		name     string
+		status   string
+		tier     int
+		note     string
+		wantErr  error
+		wantTier int
+	}{
+		{"no tier", KYCApproved, 0, "", ErrInvalidKYCTier, 0},
+		{"approved", KYCApproved, 2, "", nil, 2},
+		{"approved again", KYCApproved, 2, "", ErrInvalidKYCTransition, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReviewKYC(db, "0912141679", tt.status, tt.tier, "support", tt.note, now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReviewKYC() error = %v, want %v", err, tt.wantErr)
+			}
+			user, _ := GetUserByMobile("0912141679", db)
+			if user.KYCTier != tt.wantTier {
+				t.Errorf("ReviewKYC() kyc_tier = %d, want %d", user.KYCTier, tt.wantTier)
+			}
+		})
+	}
+
+	user, _ := GetUserByMobile("0912141679", db)
+	for at, want := range map[time.Time]int{now: 2, now.AddDate(2, 0, 0): 0} {
+		if tier, err := ActiveKYCTier(db, &user, at); err != nil || tier != want {
+			t.Errorf("ActiveKYCTier(%v) = %d, %v, want %d", at, tier, err, want)
+		}
+	}
+	// a new passport is reviewed before the user gets their tier back
+	png := base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n0000"))
+	req := KYCPassport{Selfie: png, PassportImg: png, Passport: Passport{PassportNumber: "P07654321", ExpirationDate: now.AddDate(5, 0, 0)}}
+	if _, err := SubmitKYC(db, DirStore{Dir: t.TempDir()}, "0912141679", &req, now); err != nil {
+		t.Fatalf("SubmitKYC() error = %v", err)
+	}
+	user, _ = GetUserByMobile("0912141679", db)
+	if tier, err := ActiveKYCTier(db, &user, now); err != nil || tier != 0 {
+		t.Errorf("ActiveKYCTier() after a new submission = %d, %v, want 0", tier, err)
+	}
+}
@@ -0,0 +1,245 @@
+package ebs_fields
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Limit scopes: a user limit counts the transactions of all the cards of the
+// user, a card limit counts the transactions of each card on its own.
+const (
+	LimitPerUser = "user"
+	LimitPerCard = "card"
+)
+
+// Limit periods, they are calendar periods: a daily limit resets at midnight,
+// a weekly one on Monday and a monthly one on the first of the month.
+const (
+	LimitDaily   = "day"
+	LimitWeekly  = "week"
+	LimitMonthly = "month"
+)
+
+// Limit caps the number and the amount of the transactions made in a period.
+// TranType, KYCTier and Mobile narrow down the transactions it applies to, a
+// limit with a Mobile is an override: it replaces the other limits of the
+// same scope, transaction type and period for that user.
+type Limit struct {
+	gorm.Model
+	Scope  string `json:"scope" binding:"required,oneof=user card"`
+	Period string `json:"period" binding:"required,oneof=day week month"`
+	// TranType is the transaction name as stored in the transactions table (e.g., card_transfer), empty for all of them
+	TranType string `json:"tran_type"`
+	// KYCTier is the tier of the users the limit applies to, nil for every tier
+	KYCTier *int   `json:"kyc_tier"`
+	Mobile  string `json:"mobile" gorm:"index"`
+	// MaxCount and MaxAmount are the caps, 0 for no cap
+	MaxCount  int     `json:"max_count" binding:"min=0"`
+	MaxAmount float32 `json:"max_amount" binding:"min=0"`
+}
+
+// limitReservationTTL is how long a reservation that wasn't released, e.g.,
+// because noebs stopped while waiting for EBS, still holds its amount.
+const limitReservationTTL = 5 * time.Minute
+
+// LimitReservation holds the amount of a transaction against the limits of its
+// user and card while it is sent to EBS, until it is stored in the transactions
+// table. Concurrent transactions count each other's reservations.
+type LimitReservation struct {
+	ID            uint   `gorm:"primarykey"`
+	Mobile        string `gorm:"index"`
+	SenderPANHash string `gorm:"index"`
+	TranType      string
+	Amount        float32
+	ExpiresAt     time.Time `gorm:"index"`
+}
+
+// Release gives back the amount held by r, a nil r holds nothing
+func (r *LimitReservation) Release(db *gorm.DB) error {
+	if r == nil {
+		return nil
+	}
+	return db.Delete(r).Error
+}
+
+// LimitUsage is what was spent in the current period of a Limit
+type LimitUsage struct {
+	Count  int     `json:"count"`
+	Amount float32 `json:"amount"`
+}
+
+// LimitExceededError is returned by CheckLimits when a transaction would go over a limit
+type LimitExceededError struct {
+	Limit    Limit      `json:"limit"`
+	Used     LimitUsage `json:"used"`
+	ResetsAt time.Time  `json:"resets_at"`
+}
+
+func (e *LimitExceededError) Error() string {
+	tranType := e.Limit.TranType
+	if tranType == "" {
+		tranType = "all transactions"
+	}
+	return fmt.Sprintf("the %s limit of %s per %s is exceeded", e.Limit.Period, tranType, e.Limit.Scope)
+}
+
+// periodStart returns the start of the period of now, and the start of the next one
+func periodStart(period string, now time.Time) (time.Time, time.Time) {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch period {
+	case LimitWeekly:
+		start := day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+		return start, start.AddDate(0, 0, 7)
+	case LimitMonthly:
+		start := day.AddDate(0, 0, 1-day.Day())
+		return start, start.AddDate(0, 1, 0)
+	default:
+		return day, day.AddDate(0, 0, 1)
+	}
+}
+
+// specificity ranks the limits of the same scope, type and period: overrides of the user
+// come first, then the limits of the user's tier and finally the ones of every tier.
+func (l *Limit) specificity() int {
+	switch {
+	case l.Mobile != "":
+		return 2
+	case l.KYCTier != nil:
+		return 1
+	}
+	return 0
+}
+
+// EffectiveLimits returns the limits that apply to the transactions of type
+// tranType of the user mobile, whose KYC tier is tier.
+func EffectiveLimits(db *gorm.DB, mobile string, tier int, tranType string) ([]Limit, error) {
+	var limits []Limit
+	err := db.Where("(kyc_tier IS NULL OR kyc_tier = ?) AND (tran_type = '' OR tran_type = ?) AND (mobile = '' OR mobile = ?)",
+		tier, tranType, mobile).Order("id").Find(&limits).Error
+	if err != nil {
+		return nil, err
+	}
+	type key struct{ scope, tranType, period string }
+	best := map[key]int{}
+	for _, l := range limits {
+		k := key{l.Scope, l.TranType, l.Period}
+		if s, ok := best[k]; !ok || l.specificity() > s {
+			best[k] = l.specificity()
+		}
+	}
+	effective := limits[:0]
+	for _, l := range limits {
+		if l.specificity() == best[key{l.Scope, l.TranType, l.Period}] {
+			effective = append(effective, l)
+		}
+	}
+	return effective, nil
+}
+
+// Usage returns what the user mobile, or the card of panHash for card limits,
+// spent in the current period of l. Only successful transactions, the ones
+// pending a reconciliation and the ones being sent to EBS are counted.
+func (l *Limit) Usage(db *gorm.DB, mobile, panHash string, now time.Time) (LimitUsage, error) {
+	return l.usage(db, mobile, panHash, now, 0)
+}
+
+// usage is Usage without the reservation except
+func (l *Limit) usage(db *gorm.DB, mobile, panHash string, now time.Time, except uint) (LimitUsage, error) {
+	var usage, reserved LimitUsage
+	start, _ := periodStart(l.Period, now)
+	q := db.Table("transactions").Select("count(*) as count, coalesce(sum(tran_amount), 0) as amount").
+		Where("created_at >= ? AND deleted_at IS NULL", start).
+		Where("response_status = ? OR reconcile_state = ?", "Successful", ReconcilePending)
+	if l.Scope == LimitPerCard {
+		q = q.Where("sender_pan_hash = ?", panHash)
+	} else {
+		q = q.Where("mobile = ?", mobile)
+	}
+	if l.TranType != "" {
+		q = q.Where("name = ?", l.TranType)
+	}
+	if err := q.Scan(&usage).Error; err != nil {
+		return usage, err
+	}
+
+	q = db.Model(&LimitReservation{}).Select("count(*) as count, coalesce(sum(amount), 0) as amount").
+		Where("expires_at > ? AND id <> ?", now, except)
+	if l.Scope == LimitPerCard {
+		q = q.Where("sender_pan_hash = ?", panHash)
+	} else {
+		q = q.Where("mobile = ?", mobile)
+	}
+	if l.TranType != "" {
+		q = q.Where("tran_type = ?", l.TranType)
+	}
+	err := q.Scan(&reserved).Error
+	usage.Count += reserved.Count
+	usage.Amount += reserved.Amount
+	return usage, err
+}
+
+// CheckLimits checks that a transaction of type tranType and amount, made by
+// the user mobile with the card pan, stays within the limits of the user. It
+// returns a *LimitExceededError for the first limit it would go over. mobile is
+// empty for cards that don't belong to a noebs user, only card limits apply then.
+func CheckLimits(db *gorm.DB, mobile string, tier int, pan, tranType string, amount float32, now time.Time) error {
+	limits, err := EffectiveLimits(db, mobile, tier, tranType)
+	if err != nil {
+		return err
+	}
+	return checkLimits(db, limits, mobile, HashPAN(pan), amount, now, 0)
+}
+
+// ReserveLimits is CheckLimits for a transaction that is about to be sent to
+// EBS. It reserves the amount before checking the limits, so that concurrent
+// transactions of the same user or card can't go over a limit together: they
+// count each other's reservations, and the ones that would go over it together
+// are all declined. The caller releases the reservation once the transaction
+// is stored in the transactions table. No reservation is made, and nil is
+// returned, when no limit applies.
+func ReserveLimits(db *gorm.DB, mobile string, tier int, pan, tranType string, amount float32, now time.Time) (*LimitReservation, error) {
+	limits, err := EffectiveLimits(db, mobile, tier, tranType)
+	if err != nil || len(limits) == 0 {
+		return nil, err
+	}
+	if err := db.Where("expires_at <= ?", now).Delete(&LimitReservation{}).Error; err != nil {
+		return nil, err
+	}
+	r := &LimitReservation{Mobile: mobile, SenderPANHash: HashPAN(pan), TranType: tranType, Amount: amount, ExpiresAt: now.Add(limitReservationTTL)}
+	if err := db.Create(r).Error; err != nil {
+		return nil, err
+	}
+	if err := checkLimits(db, limits, mobile, r.SenderPANHash, amount, now, r.ID); err != nil {
+		r.Release(db)
+		return nil, err
+	}
+	return r, nil
+}
+
+// checkLimits checks limits, not counting the reservation except
+func checkLimits(db *gorm.DB, limits []Limit, mobile, panHash string, amount float32, now time.Time, except uint) error {
+	for _, l := range limits {
+		if l.Scope == LimitPerUser && mobile == "" {
+			continue
+		}
+		usage, err := l.usage(db, mobile, panHash, now, except)
+		if err != nil {
+			return err
+		}
+		if (l.MaxCount > 0 && usage.Count+1 > l.MaxCount) || (l.MaxAmount > 0 && usage.Amount+amount > l.MaxAmount) {
+			_, resetsAt := periodStart(l.Period, now)
+			return &LimitExceededError{Limit: l, Used: usage, ResetsAt: resetsAt}
+		}
+	}
+	return nil
+}
+
+// IsLimitExceeded reports whether err is a *LimitExceededError, and returns it
+func IsLimitExceeded(err error) (*LimitExceededError, bool) {
+	var e *LimitExceededError
+	ok := errors.As(err, &e)
+	return e, ok
+}
@@ -0,0 +1,130 @@
+package ebs_fields
+
+import (
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestCheckLimits(t *testing.T) {
+	db, _ := gorm.Open(sqlite.Open("file:TestCheckLimits?mode=memory&cache=shared"), &gorm.Config{})
+	db.AutoMigrate(&EBSResponse{}, &Limit{}, &LimitReservation{})
+	// a Wednesday
+	now := time.Date(2023, time.March, 15, 12, 0, 0, 0, time.UTC)
+	pan, otherPAN := "9222081700176714465", "9222081700176711234"
+	db.Create(&[]EBSResponse{
+		{Model: gorm.Model{ID: 1, CreatedAt: now.Add(-time.Hour)}, UUID: "1", Name: "card_transfer", TranAmount: 300, ResponseStatus: "Successful", Mobile: "0912141679", SenderPANHash: HashPAN(pan)},
+		{Model: gorm.Model{ID: 2, CreatedAt: now.Add(-2 * time.Hour)}, UUID: "2", Name: "card_transfer", TranAmount: 200, ReconcileState: ReconcilePending, Mobile: "0912141679", SenderPANHash: HashPAN(otherPAN)},
+		{Model: gorm.Model{ID: 3, CreatedAt: now.Add(-time.Hour)}, UUID: "3", Name: "card_transfer", TranAmount: 5000, ResponseStatus: "Failed", Mobile: "0912141679", SenderPANHash: HashPAN(pan)},
+		{Model: gorm.Model{ID: 4, CreatedAt: now.AddDate(0, 0, -2)}, UUID: "4", Name: "card_transfer", TranAmount: 400, ResponseStatus: "Successful", Mobile: "0912141679", SenderPANHash: HashPAN(pan)},
+		{Model: gorm.Model{ID: 5, CreatedAt: now.Add(-time.Hour)}, UUID: "5", Name: "bill_payment", TranAmount: 100, ResponseStatus: "Successful", Mobile: "0912141679", SenderPANHash: HashPAN(pan)},
+	})
+	tier1 := 1
+	db.Create(&[]Limit{
+		{Scope: LimitPerUser, Period: LimitDaily, TranType: "card_transfer", MaxAmount: 1000},
+		{Scope: LimitPerUser, Period: LimitDaily, TranType: "card_transfer", KYCTier: &tier1, MaxAmount: 5000},
+		{Scope: LimitPerUser, Period: LimitDaily, TranType: "card_transfer", Mobile: "0912141680", MaxAmount: 100},
+		{Scope: LimitPerCard, Period: LimitDaily, MaxCount: 2},
+		{Scope: LimitPerUser, Period: LimitWeekly, TranType: "card_transfer", MaxAmount: 1500},
+	})
+
+	tests := []struct {
+		name      string
+		mobile    string
+		tier      int
+		pan       string
+		tranType  string
+		amount    float32
+		wantLimit string // period and scope of the limit that is exceeded, empty for none
+	}{
+		{"within the limits", "0912141679", 0, otherPAN, "card_transfer", 400, ""},
+		// 500 were spent today, failed transactions aren't counted
+		{"daily amount", "0912141679", 0, otherPAN, "card_transfer", 600, "day/user"},
+		{"higher tier", "0912141679", 1, otherPAN, "card_transfer", 600, ""},
+		{"weekly amount", "0912141679", 1, otherPAN, "card_transfer", 700, "week/user"},
+		{"override of the user", "0912141680", 1, "9222081700170000000", "card_transfer", 200, "day/user"},
+		{"card count", "0912141679", 0, pan, "card_transfer", 1, "day/card"},
+		{"other transaction type", "0912141679", 0, otherPAN, "bill_payment", 5000, ""},
+		{"card of no user", "", 0, pan, "bill_payment", 1, "day/card"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckLimits(db, tt.mobile, tt.tier, tt.pan, tt.tranType, tt.amount, now)
+			e, ok := IsLimitExceeded(err)
+			if !ok && err != nil {
+				t.Fatalf("CheckLimits() error = %v", err)
+			}
+			var got string
+			if ok {
+				got = e.Limit.Period + "/" + e.Limit.Scope
+			}
+			if got != tt.wantLimit {
+				t.Errorf("CheckLimits() exceeded %q, want %q (%v)", got, tt.wantLimit, err)
+			}
+		})
+	}
+}
+
+func TestReserveLimits(t *testing.T) {
+	db, _ := gorm.Open(sqlite.Open("file:TestReserveLimits?mode=memory&cache=shared"), &gorm.Config{})
+	db.AutoMigrate(&EBSResponse{}, &Limit{}, &LimitReservation{})
+	now := time.Date(2023, time.March, 15, 12, 0, 0, 0, time.UTC)
+	pan := "9222081700176714465"
+	db.Create(&Limit{Scope: LimitPerUser, Period: LimitDaily, TranType: "card_transfer", MaxAmount: 1000})
+
+	first, err := ReserveLimits(db, "0912141679", 0, pan, "card_transfer", 600, now)
+	if err != nil || first == nil {
+		t.Fatalf("ReserveLimits() = %v, %v", first, err)
+	}
+	tests := []struct {
+		name     string
+		tranType string
+		at       time.Time
+		release  bool // release the first reservation before
+		wantErr  bool
+	}{
+		{"no limit", "bill_payment", now, false, false},
+		// the first transfer wasn't stored yet, it is still counted
+		{"concurrent transfer", "card_transfer", now, false, true},
+		{"expired reservation", "card_transfer", now.Add(limitReservationTTL), false, false},
+		{"released reservation", "card_transfer", now, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.release {
+				first.Release(db)
+			}
+			r, err := ReserveLimits(db, "0912141679", 0, pan, tt.tranType, 600, tt.at)
+			if _, ok := IsLimitExceeded(err); ok != tt.wantErr || (!ok && err != nil) {
+				t.Fatalf("ReserveLimits() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (r == nil) != (tt.wantErr || tt.tranType == "bill_payment") {
+				t.Errorf("ReserveLimits() reservation = %+v", r)
+			}
+			r.Release(db)
+		})
+	}
+}
+
+func Test_periodStart(t *testing.T) {
+	now := time.Date(2023, time.March, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		period    string
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{LimitDaily, time.Date(2023, time.March, 15, 0, 0, 0, 0, time.UTC), time.Date(2023, time.March, 16, 0, 0, 0, 0, time.UTC)},
+		{LimitWeekly, time.Date(2023, time.March, 13, 0, 0, 0, 0, time.UTC), time.Date(2023, time.March, 20, 0, 0, 0, 0, time.UTC)},
+		{LimitMonthly, time.Date(2023, time.March, 1, 0, 0, 0, 0, time.UTC), time.Date(2023, time.April, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.period, func(t *testing.T) {
+			start, end := periodStart(tt.period, now)
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Errorf("periodStart() = %v, %v, want %v, %v", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package ebs_fields
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"gorm.io/gorm"
+)
+
+const (
+	// MFAChallengeTTL is how long a user has to enter their code after signing
+	// in with their password.
+	MFAChallengeTTL = 5 * time.Minute
+	// backupCodes is how many backup codes a user gets
+	backupCodes = 10
+	// totpPeriod is the period of the codes of authenticator apps, most of them only support 30s
+	totpPeriod = 30
+)
+
+var (
+	ErrMFANotEnrolled       = errors.New("two-factor authentication is not set up")
+	ErrMFAEnabled           = errors.New("two-factor authentication is already enabled")
+	ErrInvalidMFACode       = errors.New("invalid two-factor authentication code")
+	ErrMFAChallengeNotFound = errors.New("sign in again to get a new two-factor authentication challenge")
+)
+
+// BackupCode is a single use code a user signs in with when they lost their
+// authenticator app. Only its hash is stored.
+type BackupCode struct {
+	gorm.Model
+	UserMobile string `gorm:"index;not null"`
+	Hash       string `gorm:"not null"`
+	UsedAt     *time.Time
+}
+
+// MFAChallenge is a sign in that waits for the user's second factor. The
+// device the user signs in on is kept for the session that follows it.
+type MFAChallenge struct {
+	gorm.Model
+	Mobile    string `gorm:"index;not null"`
+	TokenHash string `gorm:"uniqueIndex;not null"`
+	DeviceID  string
+	PublicKey string
+	ExpiresAt time.Time
+}
+
+func hashCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomCode returns a random base32 code of n characters
+func randomCode(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)[:n], nil
+}
+
+// EnrollTOTP generates a new TOTP secret for user, it is only used once the
+// user confirms it with a code of their app (see ConfirmTOTP).
+func EnrollTOTP(db *gorm.DB, user *User, issuer string) (*otp.Key, error) {
+	if user.MFAEnabled {
+		return nil, ErrMFAEnabled
+	}
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: issuer, AccountName: user.Mobile, Period: totpPeriod})
+	if err != nil {
+		return nil, err
+	}
+	user.TOTPSecret, user.TOTPStep = key.Secret(), 0
+	err = db.Model(&User{}).Where("mobile = ?", user.Mobile).Select("totp_secret", "totp_step").
+		Updates(&User{TOTPSecret: user.TOTPSecret}).Error
+	return key, err
+}
+
+// validateTOTP checks code against the TOTP secret of user at now, allowing a
+// period of clock skew. A code is only accepted once.
+func (u *User) validateTOTP(db *gorm.DB, code string, now time.Time) (bool, error) {
+	if u.TOTPSecret == "" {
+		return false, ErrMFANotEnrolled
+	}
+	step := now.Unix() / totpPeriod
+	for _, s := range []int64{step - 1, step, step + 1} {
+		want, err := totp.GenerateCodeCustom(u.TOTPSecret, time.Unix(s*totpPeriod, 0), totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			return false, err
+		}
+		if want != code || s <= u.TOTPStep {
+			continue
+		}
+		u.TOTPStep = s
+		return true, db.Model(&User{}).Where("mobile = ?", u.Mobile).Update("totp_step", s).Error
+	}
+	return false, nil
+}
+
+// ConfirmTOTP enables the two-factor authentication of user once code matches
+// the secret of EnrollTOTP, and returns their backup codes.
+func ConfirmTOTP(db *gorm.DB, user *User, code string, now time.Time) ([]string, error) {
+	if user.MFAEnabled {
+		return nil, ErrMFAEnabled
+	}
+	ok, err := user.validateTOTP(db, code, now)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+	var codes []string
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&User{}).Where("mobile = ?", user.Mobile).Update("mfa_enabled", true).Error; err != nil {
+			return err
+		}
+		codes, err = newBackupCodes(tx, user.Mobile)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	user.MFAEnabled = true
+	return codes, nil
+}
+
+// newBackupCodes replaces the backup codes of mobile
+func newBackupCodes(db *gorm.DB, mobile string) ([]string, error) {
+	if err := db.Unscoped().Where("user_mobile = ?", mobile).Delete(&BackupCode{}).Error; err != nil {
+		return nil, err
+	}
+	codes := make([]string, backupCodes)
+	rows := make([]BackupCode, backupCodes)
+	for i := range codes {
+		code, err := randomCode(10)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = strings.ToLower(code)
+		rows[i] = BackupCode{UserMobile: mobile, Hash: hashCode(codes[i])}
+	}
+	return codes, db.Create(&rows).Error
+}
+
+// NewBackupCodes replaces the backup codes of user, once they verified a code
+// of their app or one of their current backup codes.
+func NewBackupCodes(db *gorm.DB, user *User, code string, now time.Time) ([]string, error) {
+	if err := VerifyMFA(db, user, code, now); err != nil {
+		return nil, err
+	}
+	return newBackupCodes(db, user.Mobile)
+}
+
+// VerifyMFA checks the second factor of user: a code of their authenticator
+// app, or one of their backup codes which is then used up.
+func VerifyMFA(db *gorm.DB, user *User, code string, now time.Time) error {
+	if !user.MFAEnabled {
+		return ErrMFANotEnrolled
+	}
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	if ok, err := user.validateTOTP(db, code, now); err != nil || ok {
+		return err
+	}
+	res := db.Model(&BackupCode{}).Where("user_mobile = ? AND hash = ? AND used_at IS NULL", user.Mobile, hashCode(code)).Update("used_at", now)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// BackupCodesLeft returns how many backup codes of mobile were not used
+func BackupCodesLeft(db *gorm.DB, mobile string) (int64, error) {
+	var n int64
+	err := db.Model(&BackupCode{}).Where("user_mobile = ? AND used_at IS NULL", mobile).Count(&n).Error
+	return n, err
+}
+
+// DisableMFA turns off the two-factor authentication of user, once they
+// verified a code of their app or a backup code.
+func DisableMFA(db *gorm.DB, user *User, code string, now time.Time) error {
+	if err := VerifyMFA(db, user, code, now); err != nil {
+		return err
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&User{}).Where("mobile = ?", user.Mobile).
+			Updates(map[string]any{"mfa_enabled": false, "totp_secret": "", "totp_step": 0}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("user_mobile = ?", user.Mobile).Delete(&BackupCode{}).Error
+	})
+	if err != nil {
+		return err
+	}
+	user.MFAEnabled, user.TOTPSecret, user.TOTPStep = false, "", 0
+	return nil
+}
+
+// NewMFAChallenge starts the sign in of mobile on deviceID, which ends with
+// GetMFAChallenge and Done. It returns the token of the challenge.
+func NewMFAChallenge(db *gorm.DB, mobile, deviceID, publicKey string, now time.Time) (string, *MFAChallenge, error) {
+	token, err := randomCode(32)
+	if err != nil {
+		return "", nil, err
+	}
+	// the challenges of mobile that ended are of no use
+	db.Unscoped().Where("mobile = ? AND expires_at < ?", mobile, now).Delete(&MFAChallenge{})
+	challenge := MFAChallenge{Mobile: mobile, TokenHash: hashCode(token), DeviceID: deviceID, PublicKey: publicKey, ExpiresAt: now.Add(MFAChallengeTTL)}
+	return token, &challenge, db.Create(&challenge).Error
+}
+
+// GetMFAChallenge returns the challenge of token, while it didn't expire
+func GetMFAChallenge(db *gorm.DB, token string, now time.Time) (*MFAChallenge, error) {
+	var challenge MFAChallenge
+	err := db.Where("token_hash = ? AND expires_at > ?", hashCode(token), now).First(&challenge).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrMFAChallengeNotFound
+	}
+	return &challenge, err
+}
+
+// Done ends the challenge, its token can't be used again
+func (c *MFAChallenge) Done(db *gorm.DB) error {
+	return db.Unscoped().Delete(c).Error
+}
@@ -0,0 +1,64 @@
+package ebs_fields
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestVerifyMFA(t *testing.T) {
+	db, _ := gorm.Open(sqlite.Open("file:TestVerifyMFA?mode=memory&cache=shared"), &gorm.Config{})
+	db.AutoMigrate(&User{}, &BackupCode{})
+	now := time.Date(2023, time.March, 15, 12, 0, 0, 0, time.UTC)
+	user := User{Model: gorm.Model{ID: 1}, Mobile: "0912141679"}
+	db.Create(&user)
+
+	key, err := EnrollTOTP(db, &user, "noebs")
+	if err != nil {
+		t.Fatalf("EnrollTOTP() error = %v", err)
+	}
+	if err := VerifyMFA(db, &user, "000000", now); !errors.Is(err, ErrMFANotEnrolled) {
+		t.Errorf("VerifyMFA() before ConfirmTOTP error = %v, want %v", err, ErrMFANotEnrolled)
+	}
+	code, _ := totp.GenerateCode(key.Secret(), now)
+	backup, err := ConfirmTOTP(db, &user, code, now)
+	if err != nil || len(backup) != backupCodes {
+		t.Fatalf("ConfirmTOTP() = %v, %v", backup, err)
+	}
+	stored, _ := GetUserByMobile(user.Mobile, db)
+	if !stored.MFAEnabled || stored.TOTPSecret != key.Secret() {
+		t.Fatalf("ConfirmTOTP() stored %+v", stored)
+	}
+
+	next, _ := totp.GenerateCode(key.Secret(), now.Add(30*time.Second))
+	late, _ := totp.GenerateCode(key.Secret(), now.Add(-5*time.Minute))
+	tests := []struct {
+		name    string
+		code    string
+		at      time.Time
+		wantErr error
+	}{
+		// ConfirmTOTP used it
+		{"used code", code, now, ErrInvalidMFACode},
+		{"next code", next, now.Add(30 * time.Second), nil},
+		{"expired code", late, now.Add(time.Minute), ErrInvalidMFACode},
+		{"backup code", backup[0], now, nil},
+		{"used backup code", backup[0], now, ErrInvalidMFACode},
+		{"formatted backup code", backup[1][:5] + "-" + backup[1][5:], now, nil},
+		{"wrong code", "123456", now.Add(time.Hour), ErrInvalidMFACode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := VerifyMFA(db, &stored, tt.code, tt.at); !errors.Is(err, tt.wantErr) {
+				t.Errorf("VerifyMFA() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+	if left, _ := BackupCodesLeft(db, user.Mobile); left != backupCodes-2 {
+		t.Errorf("BackupCodesLeft() = %d, want %d", left, backupCodes-2)
+	}
+}
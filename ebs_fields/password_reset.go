@@ -0,0 +1,59 @@
+package ebs_fields
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ResetTicketTTL is how long a user has to set their new password after they
+// proved it is them.
+const ResetTicketTTL = 10 * time.Minute
+
+var ErrInvalidResetTicket = errors.New("the reset ticket is invalid, expired or was already used")
+
+// ResetTicket lets a user set a new password once, after they verified an
+// otp or one of their cards. Only the hash of its token is stored.
+type ResetTicket struct {
+	gorm.Model
+	Mobile    string `gorm:"index;not null"`
+	TokenHash string `gorm:"uniqueIndex;not null"`
+	// Method is how the user proved it is them: otp or card
+	Method    string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// NewResetTicket issues a reset ticket to mobile, who proved it is them with
+// method. It returns the token of the ticket.
+func NewResetTicket(db *gorm.DB, mobile, method string, now time.Time) (string, *ResetTicket, error) {
+	token, err := randomCode(32)
+	if err != nil {
+		return "", nil, err
+	}
+	ticket := ResetTicket{Mobile: mobile, TokenHash: hashCode(token), Method: method, ExpiresAt: now.Add(ResetTicketTTL)}
+	return token, &ticket, db.Create(&ticket).Error
+}
+
+// UseResetTicket uses up the ticket of token, it can't be used again. It
+// returns ErrInvalidResetTicket when the ticket expired or was used.
+func UseResetTicket(db *gorm.DB, token string, now time.Time) (*ResetTicket, error) {
+	var ticket ResetTicket
+	err := db.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashCode(token), now).First(&ticket).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidResetTicket
+	} else if err != nil {
+		return nil, err
+	}
+	// a concurrent request could have used it since
+	res := db.Model(&ResetTicket{}).Where("id = ? AND used_at IS NULL", ticket.ID).Update("used_at", now)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrInvalidResetTicket
+	}
+	ticket.UsedAt = &now
+	return &ticket, nil
+}
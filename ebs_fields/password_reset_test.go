@@ -0,0 +1,40 @@
+package ebs_fields
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestUseResetTicket(t *testing.T) {
+	db, _ := gorm.Open(sqlite.Open("file:TestUseResetTicket?mode=memory&cache=shared"), &gorm.Config{})
+	db.AutoMigrate(&ResetTicket{})
+	now := time.Date(2023, time.March, 15, 12, 0, 0, 0, time.UTC)
+	valid, _, _ := NewResetTicket(db, "0912141679", "otp", now)
+	expired, _, _ := NewResetTicket(db, "0912141679", "card", now.Add(-ResetTicketTTL))
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"valid", valid, nil},
+		{"used", valid, ErrInvalidResetTicket},
+		{"expired", expired, ErrInvalidResetTicket},
+		{"unknown", "not a ticket", ErrInvalidResetTicket},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ticket, err := UseResetTicket(db, tt.token, now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("UseResetTicket() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (ticket.Mobile != "0912141679" || ticket.Method != "otp") {
+				t.Errorf("UseResetTicket() = %+v", ticket)
+			}
+		})
+	}
+}
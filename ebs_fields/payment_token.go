@@ -0,0 +1,195 @@
+package ebs_fields
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/adonese/noebs/redact"
+)
+
+// Prefixes of the payment token formats. Tokens without a prefix are the legacy
+// base64 encoded QrData, which carries the full PAN of the receiver.
+const (
+	tokenSigned    = "v1."
+	tokenEncrypted = "v1e."
+)
+
+var (
+	ErrInvalidToken  = errors.New("invalid payment token")
+	ErrUnsignedToken = errors.New("unsigned payment tokens are not accepted")
+	ErrNoTokenKey    = errors.New("payment_token_key or jwt_secret must be set to sign payment tokens")
+)
+
+// tokenClaims is what a payment token carries. The token is shared publicly,
+// so it says nothing of the receiver card, which is taken from the database.
+type tokenClaims struct {
+	UUID      string `json:"uuid"`
+	Amount    int    `json:"amount,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+}
+
+// TokenCodec encodes payment tokens as HMAC-SHA256 signed strings (v1.<claims>.<signature>),
+// or AES-GCM encrypted ones (v1e.<sealed claims>) when Encrypt is set.
+type TokenCodec struct {
+	signKey []byte
+	encKey  []byte
+	// Encrypt hides the token claims, otherwise they are only signed.
+	Encrypt bool
+	// AllowUnsigned accepts legacy tokens in Decode, it is meant for the
+	// migration period while old links and QR codes are still in use.
+	AllowUnsigned bool
+}
+
+// NewTokenCodec creates a TokenCodec keyed by noebsConfig.PaymentTokenKey,
+// falling back to JWTKey. The signing and encryption keys are derived from it.
+// It fails with ErrNoTokenKey without either.
+func NewTokenCodec(noebsConfig *NoebsConfig) (*TokenCodec, error) {
+	secret := noebsConfig.PaymentTokenKey
+	if secret == "" {
+		secret = noebsConfig.JWTKey
+	}
+	if secret == "" {
+		return nil, ErrNoTokenKey
+	}
+	return &TokenCodec{
+		signKey:       deriveKey(secret, "noebs payment token signature"),
+		encKey:        deriveKey(secret, "noebs payment token encryption"),
+		Encrypt:       noebsConfig.EncryptPaymentTokens,
+		AllowUnsigned: noebsConfig.AllowUnsignedTokens,
+	}, nil
+}
+
+func deriveKey(secret, label string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// Encode a payment token to a URL safe string that can be used for online purchases
+func (c *TokenCodec) Encode(p *Token) (string, error) {
+	claims := tokenClaims{UUID: p.UUID, Amount: p.Amount}
+	if p.ExpiresAt != nil {
+		claims.ExpiresAt = p.ExpiresAt.Unix()
+	}
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	if c.Encrypt {
+		sealed, err := c.seal(data)
+		if err != nil {
+			return "", err
+		}
+		return tokenEncrypted + base64.RawURLEncoding.EncodeToString(sealed), nil
+	}
+	signed := tokenSigned + base64.RawURLEncoding.EncodeToString(data)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(c.sign(signed)), nil
+}
+
+// Decode verifies a payment token and returns the Token it refers to. Only
+// UUID, Amount and ExpiresAt are set, the rest lives in the database.
+func (c *TokenCodec) Decode(data string) (Token, error) {
+	var claimsJSON []byte
+	switch {
+	case strings.HasPrefix(data, tokenEncrypted):
+		sealed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(data, tokenEncrypted))
+		if err != nil {
+			return Token{}, ErrInvalidToken
+		}
+		if claimsJSON, err = c.open(sealed); err != nil {
+			return Token{}, ErrInvalidToken
+		}
+	case strings.HasPrefix(data, tokenSigned):
+		i := strings.LastIndex(data, ".")
+		signature, err := base64.RawURLEncoding.DecodeString(data[i+1:])
+		if err != nil || !hmac.Equal(signature, c.sign(data[:i])) {
+			return Token{}, ErrInvalidToken
+		}
+		if claimsJSON, err = base64.RawURLEncoding.DecodeString(data[len(tokenSigned):i]); err != nil {
+			return Token{}, ErrInvalidToken
+		}
+	default:
+		if !c.AllowUnsigned {
+			return Token{}, ErrUnsignedToken
+		}
+		return decodeLegacyToken(data)
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil || claims.UUID == "" {
+		return Token{}, ErrInvalidToken
+	}
+	token := Token{UUID: claims.UUID, Amount: claims.Amount}
+	if claims.ExpiresAt != 0 {
+		expiresAt := time.Unix(claims.ExpiresAt, 0)
+		token.ExpiresAt = &expiresAt
+	}
+	return token, nil
+}
+
+func (c *TokenCodec) sign(data string) []byte {
+	mac := hmac.New(sha256.New, c.signKey)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func (c *TokenCodec) seal(data []byte) ([]byte, error) {
+	gcm, err := c.gcm()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, []byte(tokenEncrypted)), nil
+}
+
+func (c *TokenCodec) open(sealed []byte) ([]byte, error) {
+	gcm, err := c.gcm()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrInvalidToken
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, []byte(tokenEncrypted))
+}
+
+func (c *TokenCodec) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(c.encKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// decodeLegacyToken decodes the unsigned base64 QrData tokens. Their toCard is
+// dropped, the receiver of a token is always taken from the database.
+func decodeLegacyToken(data string) (Token, error) {
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return Token{}, ErrInvalidToken
+	}
+	var qr QrData
+	if err := json.Unmarshal(decoded, &qr); err != nil || qr.UUID == "" {
+		return Token{}, ErrInvalidToken
+	}
+	return Token{UUID: qr.UUID, Amount: qr.Amount}, nil
+}
+
+// MaskCard returns pan in a form that is safe to share: its first 6 and last 4 digits
+func MaskCard(pan string) string {
+	if len(pan) < 10 {
+		return ""
+	}
+	return redact.PAN(pan)
+}
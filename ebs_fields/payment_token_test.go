@@ -0,0 +1,77 @@
+package ebs_fields
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenCodec(t *testing.T) {
+	expiresAt := time.Unix(time.Now().Add(time.Hour).Unix(), 0)
+	token := &Token{UUID: "cbd7688f-2a60-439d-b53a-66eb04c060f1", Amount: 100, ToCard: "9222081700176714465", ExpiresAt: &expiresAt}
+	legacy := base64.StdEncoding.EncodeToString([]byte(`{"uuid":"cbd7688f-2a60-439d-b53a-66eb04c060f1","toCard":"9222081700176714465","amount":100}`))
+	other, _ := NewTokenCodec(&NoebsConfig{PaymentTokenKey: "another key"})
+
+	tests := []struct {
+		name    string
+		config  NoebsConfig
+		encode  func(c *TokenCodec) string
+		wantErr error
+	}{
+		{"signed", NoebsConfig{PaymentTokenKey: "key"}, func(c *TokenCodec) string { s, _ := c.Encode(token); return s }, nil},
+		{"encrypted", NoebsConfig{PaymentTokenKey: "key", EncryptPaymentTokens: true}, func(c *TokenCodec) string { s, _ := c.Encode(token); return s }, nil},
+		{"tampered claims", NoebsConfig{PaymentTokenKey: "key"}, func(c *TokenCodec) string {
+			s, _ := c.Encode(token)
+			parts := strings.Split(s, ".")
+			forged, _ := c.Encode(&Token{UUID: token.UUID, Amount: 1})
+			return parts[0] + "." + strings.Split(forged, ".")[1] + "." + parts[2]
+		}, ErrInvalidToken},
+		{"tampered ciphertext", NoebsConfig{PaymentTokenKey: "key", EncryptPaymentTokens: true}, func(c *TokenCodec) string { s, _ := c.Encode(token); return s[:len(s)-2] + "AA" }, ErrInvalidToken},
+		{"signed with another key", NoebsConfig{PaymentTokenKey: "key"}, func(c *TokenCodec) string { s, _ := other.Encode(token); return s }, ErrInvalidToken},
+		{"legacy rejected", NoebsConfig{PaymentTokenKey: "key"}, func(c *TokenCodec) string { return legacy }, ErrUnsignedToken},
+		{"legacy in compat mode", NoebsConfig{PaymentTokenKey: "key", AllowUnsignedTokens: true}, func(c *TokenCodec) string { return legacy }, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewTokenCodec(&tt.config)
+			if err != nil {
+				t.Fatalf("NewTokenCodec() error = %v", err)
+			}
+			encoded := tt.encode(c)
+			if strings.Contains(encoded, "9222081700176714465") {
+				t.Errorf("Encode() = %v exposes the PAN", encoded)
+			}
+			got, err := c.Decode(encoded)
+			if err != tt.wantErr {
+				t.Fatalf("Decode() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (got.UUID != token.UUID || got.Amount != token.Amount || got.ToCard != "") {
+				t.Errorf("Decode() = %+v", got)
+			}
+		})
+	}
+}
+
+func TestTokenCodec_claims(t *testing.T) {
+	c, _ := NewTokenCodec(&NoebsConfig{PaymentTokenKey: "key"})
+	expiresAt := time.Unix(1700000000, 0)
+	encoded, _ := c.Encode(&Token{UUID: "uuid", ToCard: "9222081700176714465", ExpiresAt: &expiresAt})
+	claims, _ := base64.RawURLEncoding.DecodeString(strings.Split(encoded, ".")[1])
+	if want := `{"uuid":"uuid","exp":1700000000}`; string(claims) != want {
+		t.Errorf("Encode() claims = %s, want %s", claims, want)
+	}
+	got, err := c.Decode(encoded)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if got.ExpiresAt == nil || !got.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("Decode() expires at = %v", got.ExpiresAt)
+	}
+}
+
+func TestNewTokenCodec_noKey(t *testing.T) {
+	if _, err := NewTokenCodec(&NoebsConfig{}); err != ErrNoTokenKey {
+		t.Errorf("NewTokenCodec() error = %v, want %v", err, ErrNoTokenKey)
+	}
+}
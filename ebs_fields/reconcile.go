@@ -0,0 +1,99 @@
+package ebs_fields
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Reconciliation states of a transaction that EBS didn't answer. A timed-out
+// transaction is stored as pending and is later either confirmed through
+// getTransactionStatus, reversed, or marked unresolved for manual follow-up.
+const (
+	ReconcilePending    = "pending"
+	ReconcileConfirmed  = "confirmed"
+	ReconcileReversed   = "reversed"
+	ReconcileUnresolved = "unresolved"
+)
+
+// PENDING is the response code we store for transactions with an unknown outcome
+const PENDING = -1
+
+var errStatusNotFound = errors.New("ebs: original transaction not found")
+
+// pendingResponse copies the identifiers of req (UUID, PAN, amount, terminal
+// and trace number) into a response, so that a transaction that timed out can
+// still be found and reconciled later.
+func pendingResponse(req []byte) EBSParserFields {
+	var res EBSParserFields
+	json.Unmarshal(req, &res.EBSResponse)
+	res.ExpDate = ""
+	res.ResponseCode = PENDING
+	res.ResponseStatus = "Pending"
+	res.ResponseMessage = EbsGatewayConnectivityErr.Error()
+	res.ReconcileState = ReconcilePending
+	return res
+}
+
+// QueryTransactionStatus asks EBS for the outcome of the consumer transaction originalUUID
+func QueryTransactionStatus(ctx context.Context, client EBSClient, noebsConfig *NoebsConfig, originalUUID string) (EBSParserFields, error) {
+	url := noebsConfig.ConsumerIP + ConsumerTransactionStatusEndpoint
+	var fields = ConsumerTransactionStatusFields{}
+	fields.ApplicationId = noebsConfig.ConsumerID
+	fields.TranDateTime = EbsDate()
+	fields.OriginalTranUUID = originalUUID
+	uid, _ := uuid.NewRandom()
+	fields.UUID = uid.String()
+	jsonBuffer, err := json.Marshal(fields)
+	if err != nil {
+		return EBSParserFields{}, err
+	}
+	_, res, err := client.Do(ctx, url, jsonBuffer)
+	return res, err
+}
+
+// PendingTransactions returns the transactions waiting for reconciliation that were created before t
+func PendingTransactions(db *gorm.DB, t time.Time) ([]EBSResponse, error) {
+	var res []EBSResponse
+	err := db.Table("transactions").Where("reconcile_state = ? AND created_at < ?", ReconcilePending, t).Find(&res).Error
+	return res, err
+}
+
+// Reconcile updates a pending transaction with its outcome as reported by
+// getTransactionStatus. It returns errStatusNotFound if status doesn't carry the original transaction.
+func (e *EBSResponse) Reconcile(db *gorm.DB, status EBSParserFields) error {
+	original := status.OriginalTransaction
+	if original.ResponseStatus == "" && original.ResponseMessage == "" {
+		return errStatusNotFound
+	}
+	e.ResponseCode = original.ResponseCode
+	e.ResponseMessage = original.ResponseMessage
+	e.ResponseStatus = original.ResponseStatus
+	e.ApprovalCode = original.ApprovalCode
+	e.ReferenceNumber = original.ReferenceNumber
+	e.ReconcileState = ReconcileConfirmed
+	return e.saveReconciliation(db)
+}
+
+// MarkReconciliation sets the reconciliation state of a transaction, e.g., after it was reversed.
+func (e *EBSResponse) MarkReconciliation(db *gorm.DB, state string) error {
+	e.ReconcileState = state
+	return e.saveReconciliation(db)
+}
+
+func (e *EBSResponse) saveReconciliation(db *gorm.DB) error {
+	q := db.Table("transactions")
+	if e.UUID == "" {
+		// merchant transactions have no UUID, they are identified by their terminal and trace number
+		q = q.Where("terminal_id = ? AND system_trace_audit_number = ? AND tran_date_time = ?",
+			e.TerminalID, e.SystemTraceAuditNumber, e.TranDateTime)
+	}
+	// zero values (a 0 response code is an approval) must be written too, hence the explicit Select.
+	return q.Select("response_code", "response_message", "response_status", "approval_code",
+		"reference_number", "reconcile_state", "reconcile_attempts").
+		Updates(e).Error
+}
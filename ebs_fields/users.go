@@ -3,12 +3,13 @@ package ebs_fields
 import (
 	"encoding/base32"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"regexp"
 	"strings"
 	"time"
 
-	"github.com/goccy/go-json"
+	"github.com/adonese/noebs/redact"
 	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
 	"github.com/sirupsen/logrus"
@@ -21,7 +22,7 @@ import (
 type User struct {
 	gorm.Model
 	Created  int64  `gorm:"autoCreateTime"`
-	Password string `binding:"required,min=8,max=20" json:"password"`
+	Password string `binding:"required,min=8,max=20" json:"password" redact:"secret"`
 	Fullname string `json:"fullname"`
 	Username string `json:"username"`
 	Gender   string `json:"gender"`
@@ -32,30 +33,61 @@ type User struct {
 	IsMerchant      bool   `json:"is_merchant" gorm:"default:false"`
 	PublicKey       string `json:"user_pubkey"`
 	DeviceID        string `json:"device_id"`
-	OTP             string `json:"otp"`
-	SignedOTP       string `json:"signed_otp"`
+	OTP             string `json:"otp" redact:"secret"`
+	SignedOTP       string `json:"signed_otp" redact:"secret"`
 	Tokens          []Token
 	Beneficiaries   []Beneficiary
 	db              *gorm.DB
 	Cards           []Card
 	FirebaseIDToken string `json:"firebase_token"`
-	NewPassword     string `json:"new_password" gorm:"-"`
+	NewPassword     string `json:"new_password" gorm:"-" redact:"secret"`
 	IsPasswordOTP   bool   `json:"is_password_otp" gorm:"default:false"`
-	MainCard        string `json:"main_card" gorm:"column:main_card"`
-	ExpDate         string `json:"exp_date" gorm:"column:main_expdate"`
+	MainCard        string `json:"main_card" gorm:"column:main_card;serializer:card" redact:"pan"`
+	ExpDate         string `json:"exp_date" gorm:"column:main_expdate;serializer:card" redact:"secret"`
 	Language        string `json:"language"`
-	IsVerified      bool   `json:"is_verified"`
-	Mobile          string `json:"mobile" gorm:"primaryKey;not null;unique;uniqueIndex"`
-	KYC             *KYC   `gorm:"foreignKey:UserMobile;references:Mobile"`
+	// NotificationChannel is how the user wants to be notified: push (default), sms, ws or none
+	NotificationChannel string `json:"notification_channel"`
+	IsVerified          bool   `json:"is_verified"`
+	// KYCTier is the verification level of the user, it selects their transaction limits (see Limit)
+	KYCTier int `json:"kyc_tier" gorm:"default:0"`
+	// LockedAt is when the account was locked after too many failed sign ins, the user unlocks it with an OTP
+	LockedAt *time.Time `json:"locked_at,omitempty"`
+	// SignRequests makes the user sign their transfers and payments of more
+	// than SignAbove with the key of their device, see gateway.JWTAuth.SignedRequests
+	SignRequests bool    `json:"sign_requests"`
+	SignAbove    float32 `json:"sign_above"`
+	// MFAEnabled makes the user enter a code of their authenticator app, or a
+	// backup code, after their password (see VerifyMFA)
+	MFAEnabled bool   `json:"mfa_enabled"`
+	TOTPSecret string `json:"-" gorm:"column:totp_secret;serializer:card" redact:"secret"`
+	// TOTPStep is the time step of the last code used, a code can't be used twice
+	TOTPStep int64  `json:"-"`
+	Mobile   string `json:"mobile" gorm:"primaryKey;not null;unique;uniqueIndex"`
+	KYC      *KYC   `gorm:"foreignKey:UserMobile;references:Mobile"`
+
+	// LegacyTokensRevokedAt is when the user was signed out of the tokens issued
+	// without a session, they can't be refreshed after it.
+	LegacyTokensRevokedAt *time.Time `json:"-"`
+
+	// OTPStep is the time step of the last otp sent by SMS that was used, see UseOtp
+	OTPStep int64 `json:"-"`
 }
 
 type KYC struct {
 	gorm.Model
-	UserMobile  string   `gorm:"not null;unique"`
-	Mobile      string   `gorm:"primaryKey;not null;unique"`
-	Passport    Passport `gorm:"foreignKey:Mobile;references:Mobile"`
+	UserMobile string   `gorm:"not null;unique"`
+	Mobile     string   `gorm:"primaryKey;not null;unique"`
+	Passport   Passport `gorm:"foreignKey:Mobile;references:Mobile"`
+	// Selfie and PassportImg are the keys of the images in the KYCStore, not the images
 	Selfie      string
 	PassportImg string
+	// Status is where the KYC is in the review (see KYC.Transition), Tier is
+	// the KYC tier granted to the user when it is approved.
+	Status     string     `json:"status" gorm:"index;default:submitted"`
+	Tier       int        `json:"tier"`
+	ReviewedBy string     `json:"reviewed_by"`
+	ReviewNote string     `json:"review_note"`
+	ReviewedAt *time.Time `json:"reviewed_at"`
 }
 
 // BeforeSave GORM hook
@@ -130,13 +162,16 @@ type QRMerchant struct {
 	Mobile string
 }
 
+// otpPeriod is the period of the otps sent by SMS, they are valid for up to 3 periods
+const otpPeriod = 900
+
 // GenerateOtp for a noebs user
 func (u User) GenerateOtp() (string, error) {
 	if u.PublicKey == "" {
 		return "", errors.New("no publickey")
 	}
 	code, err := totp.GenerateCodeCustom(u.EncodePublickey32(), time.Now(), totp.ValidateOpts{
-		Period:    900,
+		Period:    otpPeriod,
 		Skew:      1,
 		Digits:    otp.DigitsSix,
 		Algorithm: otp.AlgorithmSHA1,
@@ -159,7 +194,7 @@ func (u User) VerifyOtp(code string) bool {
 		u.EncodePublickey32(),
 		time.Now().UTC(),
 		totp.ValidateOpts{
-			Period:    900,
+			Period:    otpPeriod,
 			Skew:      1,
 			Digits:    otp.DigitsSix,
 			Algorithm: otp.AlgorithmSHA1,
@@ -168,6 +203,37 @@ func (u User) VerifyOtp(code string) bool {
 	return isValid
 }
 
+// UseOtp reports whether code is an otp of u (see GenerateOtp) at now, and
+// spends it: an otp proves the user has their phone once, whatever it is sent
+// for, so the codes of its time step and the earlier ones are refused after.
+func (u *User) UseOtp(db *gorm.DB, code string, now time.Time) (bool, error) {
+	if u.PublicKey == "" {
+		return false, nil
+	}
+	step := now.Unix() / otpPeriod
+	for _, s := range []int64{step - 1, step, step + 1} {
+		want, err := totp.GenerateCodeCustom(u.EncodePublickey32(), time.Unix(s*otpPeriod, 0), totp.ValidateOpts{
+			Period:    otpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			return false, err
+		}
+		if want != code || s <= u.OTPStep {
+			continue
+		}
+		// a code sent twice at once is only used by one of them
+		res := db.Model(&User{}).Where("mobile = ? AND otp_step < ?", u.Mobile, s).Update("otp_step", s)
+		if res.Error != nil {
+			return false, res.Error
+		}
+		u.OTPStep = s
+		return res.RowsAffected == 1, nil
+	}
+	return false, nil
+}
+
 // GetUser retrieves a user via their mobile number
 func GetUser(mobile string, db *gorm.DB) (*User, error) {
 	var user User
@@ -206,7 +272,7 @@ func NewUserWithBeneficiaries(mobile string, db *gorm.DB) (*User, error) {
 func GetUserByCard(pan string, db *gorm.DB) (User, error) {
 	var card Card
 	var user User
-	if err := db.Model(&Card{}).Where("pan = ?", pan).First(&card); errors.Is(err.Error, gorm.ErrRecordNotFound) {
+	if err := db.Model(&Card{}).Where("pan_hash = ?", HashPAN(pan)).First(&card); errors.Is(err.Error, gorm.ErrRecordNotFound) {
 		return User{}, err.Error
 	}
 	if err := db.Model(&User{}).Where("id = ?", card.UserID).First(&user); errors.Is(err.Error, gorm.ErrRecordNotFound) {
@@ -218,14 +284,14 @@ func GetUserByCard(pan string, db *gorm.DB) (User, error) {
 // GetDeviceIDsByPan retrieves device_ids associated to a card number
 func GetDeviceIDsByPan(pan string, db *gorm.DB) ([]string, error) {
 	var results []string
-	err := db.Model(&User{}).Distinct("users.device_id").Joins("left join cards on cards.user_id = users.id").Where("users.device_id != ?", "").Where("cards.pan = ? and cards.deleted_at is null", pan).Scan(&results)
+	err := db.Model(&User{}).Distinct("users.device_id").Joins("left join cards on cards.user_id = users.id").Where("users.device_id != ?", "").Where("cards.pan_hash = ? and cards.deleted_at is null", HashPAN(pan)).Scan(&results)
 	return results, err.Error
 }
 
 // GetCardsOrFail returns a user model and fails if user doesn't exist. It loads
 // an existing user model with their cards. The user model itself might be used for other
 // cases, that's why we are not just returning Card
-// NOTE: we are not masking cards here which is really *very* insecure to say the least.
+// The cards hold their full PAN, they are masked when they are marshalled (see Card.MarshalJSON).
 func GetCardsOrFail(mobile string, db *gorm.DB) (*User, error) {
 	var user User
 	result := db.Model(&User{}).First(&user, "mobile = ?", mobile)
@@ -304,7 +370,7 @@ func (u User) UpsertBeneficiary(beneficiary []Beneficiary) error {
 
 // UpdateCard only changes a card pan number
 func UpdateCard(card Card, db *gorm.DB) error {
-	return db.Where("pan = ? AND user_id = ?", card.CardIdx, card.UserID).Updates(&card).Error
+	return whereCard(card, db).Updates(&card).Error
 }
 
 // DeleteCards soft-deletes a card of list of cards associated to a user
@@ -318,7 +384,15 @@ func (u User) DeleteCards(cards []Card) error {
 
 // DeleteCard with a user_id
 func DeleteCard(card Card, db *gorm.DB) error {
-	return db.Debug().Where("pan = ? AND user_id = ?", card.CardIdx, card.UserID).Delete(&card).Error
+	return whereCard(card, db.Debug()).Delete(&card).Error
+}
+
+// whereCard matches the user's card by its card_ref, or by its PAN in CardIdx
+func whereCard(card Card, db *gorm.DB) *gorm.DB {
+	if card.CardRef != "" {
+		return db.Where("card_ref = ? AND user_id = ?", card.CardRef, card.UserID)
+	}
+	return db.Where("pan_hash = ? AND user_id = ?", HashPAN(card.CardIdx), card.UserID)
 }
 
 // DeleteBeneficiary with a user_id
@@ -399,15 +473,110 @@ type Token struct {
 	UUID         string        `json:"uuid,omitempty" gorm:"not null;unique;uniqueIndex"`
 	Note         string        `json:"note,omitempty"`
 	db           *gorm.DB      `gorm:"-"`
-	ToCard       string        `json:"toCard,omitempty"`
+	ToCard       string        `json:"toCard,omitempty" redact:"pan"`
 	EBSResponses []EBSResponse `json:"transaction,omitempty"`
 	IsPaid       bool          `json:"is_paid"`
+	ExpiresAt    *time.Time    `json:"expires_at,omitempty"`
+	MaxUses      int           `json:"max_uses" gorm:"default:1"`
+	UsedCount    int           `json:"used_count"`
+	Status       string        `json:"status" gorm:"default:pending;index"`
+	CardRef      string        `json:"card_ref,omitempty" gorm:"-"` // the user's card to be paid, instead of ToCard
+}
+
+// Payment token statuses
+const (
+	TokenPending   = "pending"
+	TokenPaid      = "paid"
+	TokenCancelled = "cancelled"
+	TokenExpired   = "expired"
+)
+
+var (
+	ErrTokenExpired   = errors.New("payment token has expired")
+	ErrTokenSpent     = errors.New("payment token was already paid")
+	ErrTokenCancelled = errors.New("payment token was cancelled")
+)
+
+// Usable returns an error if the token can't be paid at t
+func (t *Token) Usable(now time.Time) error {
+	switch {
+	case t.Status == TokenCancelled:
+		return ErrTokenCancelled
+	case t.Status == TokenPaid || t.IsPaid || (t.MaxUses > 0 && t.UsedCount >= t.MaxUses):
+		return ErrTokenSpent
+	case t.Status == TokenExpired || (t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)):
+		return ErrTokenExpired
+	}
+	return nil
+}
+
+// ReserveToken atomically takes one use of a pending token, so that concurrent
+// payments can't spend a token more than MaxUses times. The use is either kept
+// by CompleteToken or given back by ReleaseToken once the payment outcome is known.
+func ReserveToken(uuid string, now time.Time, db *gorm.DB) error {
+	res := db.Model(&Token{}).
+		Where("uuid = ? AND status = ? AND is_paid = ? AND used_count < max_uses AND (expires_at IS NULL OR expires_at > ?)", uuid, TokenPending, false, now).
+		Update("used_count", gorm.Expr("used_count + 1"))
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		// GetTokenByUUID tells why the token can't be used, if it looks usable
+		// then a concurrent payment took its last use.
+		if _, err := GetTokenByUUID(uuid, db); err != nil {
+			return err
+		}
+		return ErrTokenSpent
+	}
+	return nil
+}
+
+// CompleteToken marks the token as paid once all of its uses are taken
+func CompleteToken(uuid string, db *gorm.DB) error {
+	return db.Model(&Token{}).Where("uuid = ? AND used_count >= max_uses", uuid).
+		Updates(map[string]any{"status": TokenPaid, "is_paid": true}).Error
+}
+
+// ReleaseToken gives back a use taken by ReserveToken, e.g., when the payment failed
+func ReleaseToken(uuid string, db *gorm.DB) error {
+	return db.Model(&Token{}).Where("uuid = ? AND used_count > 0", uuid).
+		Update("used_count", gorm.Expr("used_count - 1")).Error
+}
+
+// SettleToken completes or releases the use of the payment token reserved
+// by tran, a payment that was pending, once it is reconciled.
+func SettleToken(tran *EBSResponse, db *gorm.DB) error {
+	if tran.TokenID == 0 {
+		return nil
+	}
+	var token Token
+	if err := db.Select("uuid").First(&token, tran.TokenID).Error; err != nil {
+		return err
+	}
+	if tran.ResponseStatus == "Successful" {
+		return CompleteToken(token.UUID, db)
+	}
+	return ReleaseToken(token.UUID, db)
+}
+
+// CancelToken cancels a pending token of userID
+func CancelToken(uuid string, userID uint, db *gorm.DB) error {
+	token, err := GetTokenByUUID(uuid, db)
+	if err != nil && !errors.Is(err, ErrTokenExpired) {
+		return err
+	}
+	if token.UserID != userID {
+		return gorm.ErrRecordNotFound
+	}
+	return db.Model(&Token{}).Where("uuid = ? AND status IN ?", uuid, []string{TokenPending, TokenExpired}).
+		Update("status", TokenCancelled).Error
 }
 
 type QrData struct {
-	UUID   string `json:"uuid"`
-	ToCard string `json:"toCard,omitempty"`
-	Amount int    `json:"amount,omitempty"`
+	UUID       string `json:"uuid"`
+	ToCard     string `json:"toCard,omitempty" redact:"pan"`
+	MaskedCard string `json:"masked_card,omitempty"`
+	Amount     int    `json:"amount,omitempty"`
 }
 
 // NewPaymentToken creates a new payment token and assign it to a user
@@ -480,7 +649,8 @@ func GetTokenWithResult(uuid string, db *gorm.DB) (Token, error) {
 	return payment, result.Error
 }
 
-// GetTokenByUUID gets a preloaded token with the user's ID and their cards
+// GetTokenByUUID gets a preloaded token with the user's ID and their cards.
+// A token that is spent, cancelled or expired is returned with its Usable error.
 func GetTokenByUUID(uuid string, db *gorm.DB) (Token, error) {
 	var payment Token
 	result := db.Debug().Where("uuid = ?", uuid).First(&payment)
@@ -494,7 +664,12 @@ func GetTokenByUUID(uuid string, db *gorm.DB) (Token, error) {
 	}
 	payment.db = db
 	payment.User = user
-	return payment, result.Error
+	err := payment.Usable(time.Now())
+	if errors.Is(err, ErrTokenExpired) && payment.Status == TokenPending {
+		payment.Status = TokenExpired
+		db.Model(&Token{}).Where("uuid = ? AND status = ?", uuid, TokenPending).Update("status", TokenExpired)
+	}
+	return payment, err
 }
 
 // GetAllTokens associated to a user. This requires a populated model (u.Mobile != "")
@@ -504,53 +679,57 @@ func (u *User) GetAllTokens() ([]Token, error) {
 	return user.Tokens, result.Error
 }
 
-// Encode PaymentToken to a URL safe link that can be used for online purchases
-func Encode(p *Token) (string, error) {
-	var qr QrData
-	qr.Amount = p.Amount
-	qr.ToCard = p.ToCard
-	qr.UUID = p.UUID
-	data, err := json.Marshal(qr)
-	if err != nil {
-		return "", err
-	}
-	return base64.StdEncoding.EncodeToString(data), nil
-}
-
-// Decode a noebs payment token to an internal PaymentToken that we understand
-func Decode(data string) (Token, error) {
-	var p Token
-	decoded, err := base64.StdEncoding.DecodeString(data)
-	if err != nil {
-		return p, err
-	}
-	if err = json.Unmarshal(decoded, &p); err != nil {
-		return p, err
-	}
-	return p, nil
-
-}
-
 // Card represents a single card in noebs.
 type Card struct {
 	gorm.Model
-	Pan     string `json:"pan"`
-	Expiry  string `json:"exp_date"`
+	Pan     string `json:"pan" gorm:"serializer:card" redact:"pan"`
+	Expiry  string `json:"exp_date" gorm:"serializer:card" redact:"secret"`
 	Name    string `json:"name"`
-	IPIN    string `json:"ipin" gorm:"column:ipin"` // set gorm db name to ipin to avoid conflict with the field name in the struct
+	IPIN    string `json:"ipin" gorm:"column:ipin;serializer:card" redact:"secret"` // set gorm db name to ipin to avoid conflict with the field name in the struct
+	PanHash string `json:"-" gorm:"index"`                                          // see HashPAN
+	// CardRef is an opaque reference to the card, clients use it instead of the PAN
+	CardRef string `json:"card_ref" gorm:"uniqueIndex"`
 	UserID  uint
 	IsMain  bool   `json:"is_main" gorm:"default:false"`
 	CardIdx string `json:"card_index" gorm:"-:all"`
 	IsValid *bool  `json:"is_valid"`
 }
 
+// BeforeSave GORM hook, it keeps the card fingerprint in sync with its PAN
+func (c *Card) BeforeSave(tx *gorm.DB) error {
+	if c.Pan != "" {
+		c.PanHash = HashPAN(c.Pan)
+	}
+	return nil
+}
+
+// BeforeCreate GORM hook, it assigns the card reference
+func (c *Card) BeforeCreate(tx *gorm.DB) error {
+	if c.CardRef == "" {
+		c.CardRef = NewCardRef()
+	}
+	return nil
+}
+
+// MarshalJSON masks the PAN and leaves out the expiry date and IPIN, cards are
+// only ever sent to clients this way.
+func (c Card) MarshalJSON() ([]byte, error) {
+	type card Card
+	masked := card(c)
+	masked.Pan = redact.PAN(c.Pan)
+	masked.Expiry = ""
+	masked.IPIN = ""
+	return json.Marshal(masked)
+}
+
 type CacheCards struct {
 	gorm.Model
-	Pan       string `json:"pan" gorm:"uniqueIndex"`
-	Expiry    string `json:"exp_date"`
+	Pan       string `json:"pan" gorm:"serializer:card" redact:"pan"`
+	PanHash   string `json:"-" gorm:"uniqueIndex"` // see HashPAN
+	Expiry    string `json:"exp_date" gorm:"serializer:card" redact:"secret"`
 	Name      string `json:"name"`
 	Mobile    string `json:"mobile" gorm:"-:all"`
-	Password  string `json:"password" gorm:"-:all"`
+	Password  string `json:"password" gorm:"-:all" redact:"secret"`
 	PublicKey string `json:"user_pubkey" gorm:"-:all"`
 	IsValid   *bool  `json:"is_valid"`
 }
@@ -560,7 +739,15 @@ func (c CacheCards) OverrideField() string {
 }
 
 func (c CacheCards) GetPk() string {
-	return "pan"
+	return "pan_hash"
+}
+
+// BeforeSave GORM hook, it keeps the card fingerprint in sync with its PAN
+func (c *CacheCards) BeforeSave(tx *gorm.DB) error {
+	if c.Pan != "" {
+		c.PanHash = HashPAN(c.Pan)
+	}
+	return nil
 }
 
 func (c CacheCards) NewCardFromCached(id int) Card {
@@ -7,6 +7,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -268,6 +270,40 @@ func TestUser_VerifyOtp(t *testing.T) {
 	}
 }
 
+func TestUser_UseOtp(t *testing.T) {
+	db, _ := gorm.Open(sqlite.Open("file:TestUser_UseOtp?mode=memory&cache=shared"), &gorm.Config{})
+	db.AutoMigrate(&User{})
+	now := time.Date(2023, time.March, 15, 12, 0, 0, 0, time.UTC)
+	u := User{Model: gorm.Model{ID: 1}, Mobile: "0912141679", PublicKey: "MFwwDQYJKoZIhvcNAQEBBQADSwAwSAJBANx4gKYSMv3CrWWsxdPfxDxFvl"}
+	db.Create(&u)
+	code := func(at time.Time) string {
+		c, _ := totp.GenerateCodeCustom(u.EncodePublickey32(), at, totp.ValidateOpts{Period: otpPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1})
+		return c
+	}
+
+	tests := []struct {
+		name string
+		code string
+		want bool
+	}{
+		{"wrong code", "000000", false},
+		{"code", code(now), true},
+		{"used code", code(now), false},
+		{"code of the previous step", code(now.Add(-otpPeriod * time.Second)), false},
+		{"code of the next step", code(now.Add(otpPeriod * time.Second)), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the step is read from the database, as when the user is loaded again
+			var user User
+			db.First(&user, "mobile = ?", u.Mobile)
+			if got, err := user.UseOtp(db, tt.code, now); got != tt.want || err != nil {
+				t.Errorf("User.UseOtp() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
 func TestExpandCard(t *testing.T) {
 	type args struct {
 		card      string
@@ -527,3 +563,91 @@ func TestGetUserWithKYCAndPassport(t *testing.T) {
 		}
 	})
 }
+
+func TestToken_Usable(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Minute)
+	tests := []struct {
+		name  string
+		token Token
+		want  error
+	}{
+		{"pending", Token{Status: TokenPending, MaxUses: 1, ExpiresAt: &future}, nil},
+		{"no expiry", Token{Status: TokenPending, MaxUses: 1}, nil},
+		{"expired", Token{Status: TokenPending, MaxUses: 1, ExpiresAt: &past}, ErrTokenExpired},
+		{"used", Token{Status: TokenPending, MaxUses: 2, UsedCount: 2}, ErrTokenSpent},
+		{"paid before statuses", Token{IsPaid: true}, ErrTokenSpent},
+		{"cancelled", Token{Status: TokenCancelled, MaxUses: 1}, ErrTokenCancelled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.token.Usable(now); got != tt.want {
+				t.Errorf("Token.Usable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReserveToken(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:TestReserveToken?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("unable to open db: %v", err)
+	}
+	db.AutoMigrate(&User{}, &Token{})
+	db.Create(&User{Mobile: "0912141679"})
+	db.Create(&Token{UUID: "single", MaxUses: 1, Status: TokenPending})
+	db.Create(&Token{UUID: "twice", MaxUses: 2, Status: TokenPending})
+	now := time.Now()
+
+	steps := []struct {
+		name string
+		do   func() error
+		want error
+	}{
+		{"reserve single", func() error { return ReserveToken("single", now, db) }, nil},
+		{"single is taken", func() error { return ReserveToken("single", now, db) }, ErrTokenSpent},
+		{"failed payment releases it", func() error { return ReleaseToken("single", db) }, nil},
+		{"reserve single again", func() error { return ReserveToken("single", now, db) }, nil},
+		{"complete single", func() error { return CompleteToken("single", db) }, nil},
+		{"single is paid", func() error { _, err := GetTokenByUUID("single", db); return err }, ErrTokenSpent},
+		{"reserve twice", func() error { return ReserveToken("twice", now, db) }, nil},
+		{"twice is not paid yet", func() error { CompleteToken("twice", db); return ReserveToken("twice", now, db) }, nil},
+		{"twice is spent", func() error { return ReserveToken("twice", now, db) }, ErrTokenSpent},
+	}
+	for _, tt := range steps {
+		if got := tt.do(); got != tt.want {
+			t.Fatalf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCancelToken(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:TestCancelToken?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("unable to open db: %v", err)
+	}
+	db.AutoMigrate(&User{}, &Token{})
+	db.Create(&User{Mobile: "0912141679"})
+	past := time.Now().Add(-time.Minute)
+	db.Create(&Token{UUID: "pending", MaxUses: 1, Status: TokenPending})
+	db.Create(&Token{UUID: "expired", MaxUses: 1, Status: TokenPending, ExpiresAt: &past})
+	db.Create(&Token{UUID: "paid", MaxUses: 1, UsedCount: 1, Status: TokenPaid, IsPaid: true})
+
+	tests := []struct {
+		uuid    string
+		wantErr error
+	}{
+		{"pending", nil},
+		{"expired", nil},
+		{"paid", ErrTokenSpent},
+		{"pending", ErrTokenCancelled},
+	}
+	for _, tt := range tests {
+		if err := CancelToken(tt.uuid, 0, db); err != tt.wantErr {
+			t.Errorf("CancelToken(%v) error = %v, want %v", tt.uuid, err, tt.wantErr)
+		}
+	}
+	if err := ReserveToken("pending", time.Now(), db); err != ErrTokenCancelled {
+		t.Errorf("ReserveToken() of a cancelled token error = %v", err)
+	}
+}
@@ -35,6 +35,9 @@ func GetUserWithKYCAndPassport(db *gorm.DB, mobile string) (*User, error) {
 	return &user, nil
 }
 
+// UpdateUserWithKYC creates the KYC of kycRequest.Mobile with its images inline.
+//
+// Deprecated: use SubmitKYC, which keeps the images in a KYCStore and checks the passport.
 func UpdateUserWithKYC(db *gorm.DB, kycRequest *KYCPassport) error {
 	// Find the user
 	var user User
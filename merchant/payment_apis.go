@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/adonese/noebs/ebs_fields"
+	"github.com/adonese/noebs/redact"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 	"github.com/go-playground/validator/v10"
@@ -42,8 +43,8 @@ func (s *Service) IsAlive(c *gin.Context) {
 			c.AbortWithStatusJSON(400, er)
 		}
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		res.Name = "change me"
 
@@ -77,7 +78,7 @@ func (s *Service) IsAliveWrk(c *gin.Context) {
 	url := s.NoebsConfig.MerchantIP + ebs_fields.IsAliveEndpoint
 	req := strings.NewReader(`{"clientId": "ACTS", "systemTraceAuditNumber": 79, "tranDateTime": "200419085611", "terminalId": "18000377"}`)
 	b, _ := json.Marshal(&req)
-	ebs_fields.EBSHttpClient(url, b) // let that sink in
+	s.EBSClient.Do(c.Request.Context(), url, b) // let that sink in
 	c.JSON(http.StatusOK, gin.H{"result": true})
 
 }
@@ -103,8 +104,8 @@ func (s *Service) WorkingKey(c *gin.Context) {
 			return
 		}
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 		res.Name = "change me"
 		// God please make it works.
 		if err := s.Db.Create(&res.EBSResponse).Error; err != nil {
@@ -142,8 +143,8 @@ func (s *Service) Purchase(c *gin.Context) {
 			c.AbortWithStatusJSON(400, ebs_fields.ErrorResponse{ErrorDetails: er})
 		}
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 		// mask the pan
 		res.MaskPAN()
 
@@ -154,6 +155,9 @@ func (s *Service) Purchase(c *gin.Context) {
 				"message": err,
 			}).Info("error in migrating purchase model")
 		}
+		if ebsErr == ebs_fields.EbsGatewayConnectivityErr {
+			s.schedulePurchaseReversal(fields)
+		}
 		uid := generateUUID()
 		s.Redis.HSet(fields.TerminalID+":purchase", uid, &res)
 		s.Redis.Incr(fields.TerminalID + ":number_purchase_transactions")
@@ -198,8 +202,8 @@ func (s *Service) Balance(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		// mask the pan
 		res.MaskPAN()
@@ -246,8 +250,8 @@ func (s *Service) CardTransfer(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		res.MaskPAN()
 
@@ -300,8 +304,8 @@ func (s *Service) BillInquiry(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		res.Name = "change me"
 		// God please make it works.
@@ -343,8 +347,8 @@ func (s *Service) BillPayment(c *gin.Context) {
 			c.AbortWithStatusJSON(http.StatusBadRequest, ebs_fields.ErrorResponse{ErrorDetails: er})
 		}
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 		res.Name = "change me"
 		res.MaskPAN()
 		s.Db.Create(&res.EBSResponse)
@@ -387,8 +391,8 @@ func (s *Service) TopUpPayment(c *gin.Context) {
 			c.AbortWithStatusJSON(http.StatusBadRequest, ebs_fields.ErrorResponse{ErrorDetails: er})
 		}
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 		res.Name = "change me"
 		res.MaskPAN()
 		s.Db.Create(&res.EBSResponse)
@@ -434,8 +438,8 @@ func (s *Service) ChangePIN(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		res.MaskPAN()
 
@@ -486,8 +490,8 @@ func (s *Service) CashOut(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		res.Name = "change me"
 		// God please make it works.
@@ -537,8 +541,8 @@ func (s *Service) VoucherCashOut(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		res.Name = "change me"
 		// God please make it works.
@@ -588,8 +592,8 @@ func (s *Service) VoucherCashIn(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		res.Name = "change me"
 		// God please make it works.
@@ -639,8 +643,8 @@ func (s *Service) Statement(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		res.Name = "change me"
 		// God please make it works.
@@ -680,8 +684,8 @@ func (s *Service) GenerateVoucher(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 		res.Name = "change me"
 		// God please make it works.
 		s.Db.Create(&res.EBSResponse)
@@ -717,8 +721,8 @@ func (s *Service) CashIn(c *gin.Context) {
 		}
 
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 
 		res.Name = "change me"
 		// God please make it works.
@@ -756,8 +760,8 @@ func (s *Service) ToAccount(c *gin.Context) {
 			c.AbortWithStatusJSON(400, ebs_fields.ErrorResponse{ErrorDetails: er})
 		}
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 		res.Name = "change me"
 		// God please make it works.
 		s.Db.Create(&res.EBSResponse)
@@ -798,8 +802,8 @@ func (s *Service) MiniStatement(c *gin.Context) {
 			c.AbortWithStatusJSON(400, ebs_fields.ErrorResponse{ErrorDetails: er})
 		}
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 		res.Name = "change me"
 		// God please make it works.
 		s.Db.Create(&res.EBSResponse)
@@ -836,8 +840,8 @@ func (s *Service) testAPI(c *gin.Context) {
 			c.AbortWithStatusJSON(400, ebs_fields.ErrorResponse{ErrorDetails: er})
 		}
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 		res.Name = "change me"
 		// God please make it works.
 		s.Db.Create(&res.EBSResponse)
@@ -877,8 +881,8 @@ func (s *Service) Refund(c *gin.Context) {
 			c.AbortWithStatusJSON(400, ebs_fields.ErrorResponse{ErrorDetails: er})
 		}
 		// the only part left is fixing EBS errors. Formalizing them per se.
-		code, res, ebsErr := ebs_fields.EBSHttpClient(url, jsonBuffer)
-		s.Logger.Printf("response is: %d, %+v, %v", code, res, ebsErr)
+		code, res, ebsErr := s.EBSClient.Do(c.Request.Context(), url, jsonBuffer)
+		s.Logger.Printf("response is: %d, %+v, %v", code, redact.Value(res), ebsErr)
 		// mask the pan
 		res.MaskPAN()
 
@@ -912,7 +916,7 @@ func (s *Service) EBS(c *gin.Context) {
 	if err != nil {
 		panic(err)
 	}
-	_, res, _ := ebs_fields.EBSHttpClient(ebsURL, jsonBuffer)
+	_, res, _ := s.EBSClient.Do(c.Request.Context(), ebsURL, jsonBuffer)
 
 	res.Name = "change me"
 	// God please make it works.
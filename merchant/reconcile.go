@@ -0,0 +1,96 @@
+package merchant
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/adonese/noebs/webhook"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// PendingReversal keeps the original request of a merchant transaction that
+// timed out. Merchant web services can't query a transaction status, so once the
+// reconciliation window passes we reverse it using the same request, without
+// the PIN block: a reversal doesn't need it, and it isn't kept at rest. The
+// record is deleted as soon as the reversal is settled.
+type PendingReversal struct {
+	gorm.Model
+	TerminalID             string
+	SystemTraceAuditNumber int
+	TranDateTime           string
+	Request                []byte
+	Attempts               int
+}
+
+// maxReversalAttempts is how many times we try to reverse before leaving a transaction to manual reconciliation
+const maxReversalAttempts = 5
+
+// schedulePurchaseReversal records fields of a timed-out purchase so that it gets reversed by Reconcile
+func (s *Service) schedulePurchaseReversal(fields ebs_fields.PurchaseFields) {
+	fields.Pin = ""
+	req, _ := json.Marshal(ebs_fields.ReverseFields{PurchaseFields: fields})
+	pending := PendingReversal{
+		TerminalID:             fields.TerminalID,
+		SystemTraceAuditNumber: fields.SystemTraceAuditNumber,
+		TranDateTime:           fields.TranDateTime,
+		Request:                req,
+	}
+	if err := s.Db.Create(&pending).Error; err != nil {
+		s.Logger.WithFields(logrus.Fields{
+			"code":    err.Error(),
+			"details": "Error in writing to Database",
+		}).Error("unable to schedule reversal")
+	}
+}
+
+// Reconcile reverses the merchant transactions that EBS didn't answer within
+// the reconciliation window. It should be started once as a goroutine.
+func (s *Service) Reconcile() {
+	ticker := time.NewTicker(time.Duration(s.NoebsConfig.ReconcileInterval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.reversePending(context.Background(), time.Now())
+	}
+}
+
+func (s *Service) reversePending(ctx context.Context, now time.Time) {
+	var pending []PendingReversal
+	window := time.Duration(s.NoebsConfig.ReconcileWindow) * time.Second
+	if err := s.Db.Where("created_at < ?", now.Add(-window)).Find(&pending).Error; err != nil {
+		s.Logger.WithFields(logrus.Fields{"code": "reconcile_error", "message": err.Error()}).Error("unable to load pending reversals")
+		return
+	}
+	url := s.NoebsConfig.MerchantIP + ebs_fields.ReverseEndpoint
+	for _, p := range pending {
+		tran := ebs_fields.EBSResponse{
+			TerminalID:             p.TerminalID,
+			SystemTraceAuditNumber: p.SystemTraceAuditNumber,
+			TranDateTime:           p.TranDateTime,
+		}
+		_, res, err := s.EBSClient.Do(ctx, url, p.Request)
+		if err == nil {
+			tran.ResponseCode = res.ResponseCode
+			tran.ResponseMessage = res.ResponseMessage
+			tran.ResponseStatus = res.ResponseStatus
+			tran.MarkReconciliation(s.Db, ebs_fields.ReconcileReversed)
+			s.Db.Unscoped().Delete(&p)
+			if s.Webhooks != nil {
+				s.Webhooks.Publish(p.TerminalID, webhook.TransactionReversed, tran)
+			}
+			continue
+		}
+		p.Attempts++
+		if p.Attempts < maxReversalAttempts {
+			s.Db.Model(&p).Update("attempts", p.Attempts)
+			continue
+		}
+		s.Logger.WithFields(logrus.Fields{"terminal_id": p.TerminalID, "stan": p.SystemTraceAuditNumber, "message": err.Error()}).Error("unable to reverse transaction")
+		tran.ResponseCode = ebs_fields.PENDING
+		tran.ResponseMessage = err.Error()
+		tran.MarkReconciliation(s.Db, ebs_fields.ReconcileUnresolved)
+		s.Db.Unscoped().Delete(&p)
+	}
+}
@@ -3,6 +3,7 @@ package merchant
 
 import (
 	"github.com/adonese/noebs/ebs_fields"
+	"github.com/adonese/noebs/webhook"
 	"github.com/go-redis/redis/v7"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
@@ -15,6 +16,8 @@ type Service struct {
 	IP          string
 	Logger      *logrus.Logger
 	NoebsConfig ebs_fields.NoebsConfig
+	EBSClient   ebs_fields.EBSClient
+	Webhooks    *webhook.Service
 }
 
 // billChan it is used to asyncronysly parses ebs response to get and assign values to the billers
@@ -0,0 +1,65 @@
+package redact
+
+import (
+	"io"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Formatter redacts log entries before Next formats them, and scrubs its
+// output so that a PAN printed in any form never reaches the log sink.
+type Formatter struct {
+	Next logrus.Formatter
+}
+
+// Format implements logrus.Formatter
+func (f *Formatter) Format(e *logrus.Entry) ([]byte, error) {
+	entry := e.Dup()
+	entry.Level, entry.Caller, entry.Message = e.Level, e.Caller, String(e.Message)
+	for k, v := range e.Data {
+		switch v := v.(type) {
+		case string:
+			if IsSecret(k) {
+				entry.Data[k] = Mask
+			} else {
+				entry.Data[k] = String(v)
+			}
+		case error:
+			entry.Data[k] = String(v.Error())
+		default:
+			if IsSecret(k) {
+				entry.Data[k] = Mask
+			} else {
+				entry.Data[k] = Value(v)
+			}
+		}
+	}
+	out, err := f.Next.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(String(string(out))), nil
+}
+
+// Install makes l redact its entries and returns it
+func Install(l *logrus.Logger) *logrus.Logger {
+	if _, ok := l.Formatter.(*Formatter); !ok {
+		l.SetFormatter(&Formatter{Next: l.Formatter})
+	}
+	return l
+}
+
+// Writer scrubs what is written to it before passing it to w, it is meant for
+// loggers that don't go through logrus, e.g., the standard library log.
+func Writer(w io.Writer) io.Writer {
+	return writer{w}
+}
+
+type writer struct{ w io.Writer }
+
+func (w writer) Write(p []byte) (int, error) {
+	if _, err := w.w.Write([]byte(String(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,106 @@
+// Package redact keeps card data and secrets out of logs. Struct fields are
+// marked with a redact tag:
+//
+//	PAN  string `json:"PAN" redact:"pan"`     // masked, see PAN
+//	IPIN string `json:"IPIN" redact:"secret"` // replaced by Mask
+//
+// Value applies the tags to a copy of a struct, and Formatter scrubs whatever
+// reaches a logrus logger: PANs in free text and the values of secret keys
+// (IPIN, PIN, passwords, OTPs, JWT keys...) in JSON or %+v output.
+package redact
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// Mask replaces a redacted value
+const Mask = "*****"
+
+// PAN masks pan the same way EBS receipts do, keeping its first 6 and last 4 digits
+func PAN(pan string) string {
+	if len(pan) < 10 {
+		return Mask
+	}
+	return pan[:6] + Mask + pan[len(pan)-4:]
+}
+
+var (
+	panRe    = regexp.MustCompile(`\b\d{16,19}\b`)
+	bearerRe = regexp.MustCompile(`(?i)(bearer\s+)[a-z0-9._~+/=-]+`)
+	// keyValueRe matches key:value and key=value pairs, quoted or not, as in JSON, %+v and query strings
+	keyValueRe = regexp.MustCompile(`([\\"]*([A-Za-z0-9_]+)[\\"]*\s*[:=]\s*[\\"]*)([^\s\\",}&)\]]+)`)
+)
+
+// secretSuffixes are matched against lower cased keys without underscores,
+// e.g., IPIN, newPIN, userPassword, Expiry, jwt_secret and payment_token_key.
+var secretSuffixes = []string{"pin", "pinblock", "password", "secret", "otp", "expdate", "expiry", "track2", "jwtkey", "tokenkey", "apikey", "smskey", "hashkey", "cardkeys", "privatekey", "jwtkeys"}
+
+// IsSecret reports whether values of key must never be logged
+func IsSecret(key string) bool {
+	k := strings.ToLower(strings.ReplaceAll(key, "_", ""))
+	for _, s := range secretSuffixes {
+		if strings.HasSuffix(k, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsCard reports whether key holds a card number, e.g., PAN, toCard or senderPAN
+func IsCard(key string) bool {
+	k := strings.ToLower(strings.ReplaceAll(key, "_", ""))
+	return strings.HasSuffix(k, "pan") || k == "tocard" || k == "fromcard"
+}
+
+// String scrubs free text: PANs are masked and the values of secret keys are replaced.
+func String(s string) string {
+	s = keyValueRe.ReplaceAllStringFunc(s, func(m string) string {
+		sub := keyValueRe.FindStringSubmatch(m)
+		if IsSecret(sub[2]) {
+			return sub[1] + Mask
+		}
+		return m
+	})
+	s = bearerRe.ReplaceAllString(s, "${1}"+Mask)
+	return panRe.ReplaceAllStringFunc(s, PAN)
+}
+
+// JSON redacts a JSON document by its keys, a document that can't be parsed is scrubbed with String.
+func JSON(data []byte) []byte {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return []byte(String(string(data)))
+	}
+	redacted, err := json.Marshal(redactJSON("", v))
+	if err != nil {
+		return []byte(String(string(data)))
+	}
+	return redacted
+}
+
+func redactJSON(key string, v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, field := range v {
+			if IsSecret(k) {
+				v[k] = Mask
+				continue
+			}
+			v[k] = redactJSON(k, field)
+		}
+		return v
+	case []any:
+		for i := range v {
+			v[i] = redactJSON(key, v[i])
+		}
+		return v
+	case string:
+		if IsCard(key) && v != "" {
+			return PAN(v)
+		}
+		return String(v)
+	}
+	return v
+}
@@ -0,0 +1,71 @@
+package redact
+
+import "reflect"
+
+// maxDepth bounds the copy of self referencing values
+const maxDepth = 8
+
+// Value returns a copy of v with its redact tags applied, the fields of nested
+// structs, pointers and slices included. v itself is not modified.
+// Secret fields that aren't strings, e.g., a map of keys, are zeroed.
+func Value(v any) any {
+	if v == nil {
+		return nil
+	}
+	return redactValue(reflect.ValueOf(v), 0).Interface()
+}
+
+func redactValue(v reflect.Value, depth int) reflect.Value {
+	if depth > maxDepth {
+		return v
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return v
+		}
+		p := reflect.New(v.Elem().Type())
+		p.Elem().Set(redactValue(v.Elem(), depth+1))
+		return p
+	case reflect.Slice:
+		if v.IsNil() || !hasStruct(v.Type().Elem()) {
+			return v
+		}
+		s := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			s.Index(i).Set(redactValue(v.Index(i), depth+1))
+		}
+		return s
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			field := c.Field(i)
+			switch tag := f.Tag.Get("redact"); {
+			case field.Kind() == reflect.String && field.String() != "" && tag == "pan":
+				field.SetString(PAN(field.String()))
+			case field.Kind() == reflect.String && field.String() != "" && tag == "secret":
+				field.SetString(Mask)
+			case tag == "secret" && field.Kind() != reflect.String:
+				field.Set(reflect.Zero(field.Type()))
+			case tag == "":
+				field.Set(redactValue(field, depth+1))
+			}
+		}
+		return c
+	}
+	return v
+}
+
+// hasStruct reports whether values of t may carry redact tags
+func hasStruct(t reflect.Type) bool {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct
+}
@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCron_Next(t *testing.T) {
+	from := time.Date(2023, time.January, 31, 10, 30, 0, 0, time.UTC) // a tuesday
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2023, time.January, 31, 10, 31, 0, 0, time.UTC)},
+		{"0 9 1 * *", time.Date(2023, time.February, 1, 9, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2023, time.January, 31, 10, 45, 0, 0, time.UTC)},
+		{"0 8 * * 5", time.Date(2023, time.February, 3, 8, 0, 0, 0, time.UTC)},
+		{"0 8 * * 7", time.Date(2023, time.February, 5, 8, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 15 * 3", time.Date(2023, time.February, 1, 0, 0, 0, 0, time.UTC)}, // 15th or a wednesday
+		{"@monthly", time.Date(2023, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			c, err := ParseCron(tt.spec)
+			if err != nil {
+				t.Fatalf("ParseCron() error = %v", err)
+			}
+			if got := c.Next(from); !got.Equal(tt.want) {
+				t.Errorf("Cron.Next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCron_invalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := ParseCron(spec); err == nil {
+			t.Errorf("ParseCron(%q) expected an error", spec)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"gorm.io/gorm"
+)
+
+// SMSSender sends an SMS through a provider, implementations are selected by
+// NoebsConfig.SMSProvider, see NewSMSSender.
+type SMSSender interface {
+	Send(ctx context.Context, sms SMS) error
+}
+
+// SMSDelivery is the delivery status of an SMS. We don't keep the message
+// itself as it is usually a one-time code.
+type SMSDelivery struct {
+	gorm.Model
+	Mobile   string `gorm:"index"`
+	Provider string
+	Status   string
+	Error    string
+}
+
+// SMS delivery statuses
+const (
+	SMSSent   = "sent"
+	SMSFailed = "failed"
+)
+
+// NewSMSSender returns the SMSSender configured in noebsConfig. Deliveries are
+// recorded in db when it is not nil.
+func NewSMSSender(noebsConfig *ebs_fields.NoebsConfig, db *gorm.DB) (SMSSender, error) {
+	var sender SMSSender
+	switch noebsConfig.SMSProvider {
+	case "", "gateway":
+		sender = &GatewaySMS{Config: noebsConfig, Client: smsHTTPClient()}
+	case "webhook":
+		if noebsConfig.SMSWebhookURL == "" {
+			return nil, fmt.Errorf("sms: sms_webhook_url is required for the webhook provider")
+		}
+		sender = &WebhookSMS{URL: noebsConfig.SMSWebhookURL, Token: noebsConfig.SMSAPIKey, Sender: noebsConfig.SMSSender, Client: smsHTTPClient()}
+	case "memory":
+		sender = &MemorySMS{}
+	case "file":
+		sender = &FileSMS{Path: noebsConfig.SMSFilePath}
+	default:
+		return nil, fmt.Errorf("sms: unknown provider %q", noebsConfig.SMSProvider)
+	}
+	if db == nil {
+		return sender, nil
+	}
+	provider := noebsConfig.SMSProvider
+	if provider == "" {
+		provider = "gateway"
+	}
+	return &RecordingSMS{Next: sender, Db: db, Provider: provider}, nil
+}
+
+// smsHTTPClient retries network errors and 5xx responses with exponential backoff
+func smsHTTPClient() *ebs_fields.HTTPClient {
+	maxDelay := 30 * time.Second
+	return &ebs_fields.HTTPClient{
+		Client: &http.Client{Timeout: 15 * time.Second},
+		RetryConfig: &ebs_fields.RetryConfig{
+			MaxRetries:       3,
+			ExpBackoffFactor: 0.5,
+			MaxDelay:         &maxDelay,
+		},
+	}
+}
+
+// sudaneseMSISDN formats a local mobile number (0912345678) as 249912345678
+func sudaneseMSISDN(mobile string) string {
+	return "249" + strings.TrimPrefix(mobile, "0")
+}
+
+// GatewaySMS sends SMS through a query-string gateway: NoebsConfig.SMSGateway
+// followed by api_key, from, to and sms parameters.
+type GatewaySMS struct {
+	Config *ebs_fields.NoebsConfig
+	Client *ebs_fields.HTTPClient
+}
+
+// Send implements SMSSender
+func (g *GatewaySMS) Send(ctx context.Context, sms SMS) error {
+	v := url.Values{}
+	v.Add("api_key", g.Config.SMSAPIKey)
+	v.Add("from", g.Config.SMSSender)
+	v.Add("to", sudaneseMSISDN(sms.Mobile))
+	v.Add("sms", sms.Message+"\n\n"+g.Config.SMSMessage)
+	_, err := g.Client.Do(ctx, &ebs_fields.Request{Method: http.MethodGet, URL: g.Config.SMSGateway + v.Encode()})
+	return err
+}
+
+// WebhookSMS posts the SMS as a JSON document to URL, for gateways that
+// accept {"to": "", "from": "", "message": ""} payloads.
+type WebhookSMS struct {
+	URL    string
+	Token  string // sent as a bearer token when set
+	Sender string
+	Client *ebs_fields.HTTPClient
+}
+
+// Send implements SMSSender
+func (w *WebhookSMS) Send(ctx context.Context, sms SMS) error {
+	req := &ebs_fields.Request{
+		Method: http.MethodPost,
+		URL:    w.URL,
+		Body: ebs_fields.NewJSONEntity(map[string]string{
+			"to":      sudaneseMSISDN(sms.Mobile),
+			"from":    w.Sender,
+			"message": sms.Message,
+		}),
+	}
+	if w.Token != "" {
+		req.Opts = append(req.Opts, ebs_fields.WithHeader("Authorization", "Bearer "+w.Token))
+	}
+	_, err := w.Client.Do(ctx, req)
+	return err
+}
+
+// MemorySMS keeps sent messages in memory, it is meant for tests.
+type MemorySMS struct {
+	mu       sync.Mutex
+	messages []SMS
+}
+
+// Send implements SMSSender
+func (m *MemorySMS) Send(ctx context.Context, sms SMS) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, sms)
+	return nil
+}
+
+// Messages returns the messages sent so far
+func (m *MemorySMS) Messages() []SMS {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]SMS(nil), m.messages...)
+}
+
+// FileSMS appends messages as JSON lines to Path (stdout when empty), it is
+// meant for development where we don't want to hit a real gateway.
+type FileSMS struct {
+	Path string
+	mu   sync.Mutex
+}
+
+// Send implements SMSSender
+func (f *FileSMS) Send(ctx context.Context, sms SMS) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := os.Stdout
+	if f.Path != "" {
+		file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	return json.NewEncoder(out).Encode(sms)
+}
+
+// RecordingSMS records the delivery status of every SMS sent through Next
+type RecordingSMS struct {
+	Next     SMSSender
+	Db       *gorm.DB
+	Provider string
+}
+
+// Send implements SMSSender
+func (r *RecordingSMS) Send(ctx context.Context, sms SMS) error {
+	err := r.Next.Send(ctx, sms)
+	delivery := SMSDelivery{Mobile: sms.Mobile, Provider: r.Provider, Status: SMSSent}
+	if err != nil {
+		delivery.Status = SMSFailed
+		delivery.Error = err.Error()
+	}
+	if dbErr := r.Db.Create(&delivery).Error; dbErr != nil {
+		log.Printf("unable to record sms delivery: %v", dbErr)
+	}
+	return err
+}
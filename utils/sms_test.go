@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestGatewaySMS_Send(t *testing.T) {
+	var calls int
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		got = r.URL.Query().Get("to")
+	}))
+	defer ts.Close()
+
+	g := &GatewaySMS{Config: &ebs_fields.NoebsConfig{SMSGateway: ts.URL + "/?"}, Client: smsHTTPClient()}
+	if err := g.Send(context.Background(), SMS{Mobile: "0912141679", Message: "hi"}); err != nil {
+		t.Fatalf("GatewaySMS.Send() error = %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("GatewaySMS.Send() calls = %v, want 2", calls)
+	}
+	if got != "249912141679" {
+		t.Errorf("GatewaySMS.Send() to = %v, want 249912141679", got)
+	}
+}
+
+func TestWebhookSMS_Send(t *testing.T) {
+	var body map[string]string
+	var token string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer ts.Close()
+
+	wh := &WebhookSMS{URL: ts.URL, Token: "secret", Sender: "noebs", Client: smsHTTPClient()}
+	if err := wh.Send(context.Background(), SMS{Mobile: "0912141679", Message: "hi"}); err != nil {
+		t.Fatalf("WebhookSMS.Send() error = %v", err)
+	}
+	if token != "Bearer secret" || body["to"] != "249912141679" || body["message"] != "hi" {
+		t.Errorf("WebhookSMS.Send() got token %q and body %v", token, body)
+	}
+}
+
+type failingSMS struct{}
+
+func (failingSMS) Send(ctx context.Context, sms SMS) error { return errors.New("gateway is down") }
+
+func TestRecordingSMS_Send(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:TestRecordingSMS?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("unable to open db: %v", err)
+	}
+	db.AutoMigrate(&SMSDelivery{})
+
+	tests := []struct {
+		name       string
+		next       SMSSender
+		wantStatus string
+	}{
+		{"sent", &MemorySMS{}, SMSSent},
+		{"failed", failingSMS{}, SMSFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &RecordingSMS{Next: tt.next, Db: db, Provider: tt.name}
+			r.Send(context.Background(), SMS{Mobile: "0912141679", Message: "1234"})
+			var got SMSDelivery
+			db.Last(&got, "provider = ?", tt.name)
+			if got.Status != tt.wantStatus {
+				t.Errorf("RecordingSMS.Send() status = %v, want %v", got.Status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestNewSMSSender(t *testing.T) {
+	tests := []struct {
+		provider string
+		want     SMSSender
+		wantErr  bool
+	}{
+		{"", &GatewaySMS{}, false},
+		{"memory", &MemorySMS{}, false},
+		{"file", &FileSMS{}, false},
+		{"webhook", nil, true}, // missing sms_webhook_url
+		{"carrier-pigeon", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.provider, func(t *testing.T) {
+			got, err := NewSMSSender(&ebs_fields.NoebsConfig{SMSProvider: tt.provider}, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewSMSSender() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.want != nil && fmt.Sprintf("%T", got) != fmt.Sprintf("%T", tt.want) {
+				t.Errorf("NewSMSSender() = %T, want %T", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package webhook
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The handlers below serve the endpoints of the authenticated user, whose mobile
+// is set in the context by the auth middleware, or of the terminals of the
+// merchant API key set by the API key middleware.
+
+// requestOwners returns the owners of the endpoints the request can manage, it
+// writes the error response when there are none.
+func requestOwners(c *gin.Context) ([]string, bool) {
+	if mobile := c.GetString("mobile"); mobile != "" {
+		return []string{mobile}, true
+	}
+	if terminals := c.GetStringSlice("terminal_ids"); len(terminals) > 0 {
+		return terminals, true
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{"message": "a merchant api key with terminals is required", "code": "api_key_required"})
+	return nil, false
+}
+
+// ListEndpoints returns the user's webhook endpoints, their secrets are not included
+func (s *Service) ListEndpoints(c *gin.Context) {
+	owners, ok := requestOwners(c)
+	if !ok {
+		return
+	}
+	var endpoints []Endpoint
+	if err := s.Db.Where("owner IN ?", owners).Order("id").Find(&endpoints).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	for i := range endpoints {
+		endpoints[i].Secret = ""
+	}
+	c.JSON(http.StatusOK, endpoints)
+}
+
+// CreateEndpoint registers a webhook endpoint. The secret used to sign the
+// deliveries is generated unless it is set, and it is only returned here.
+// Merchants register it for one of the terminals of their API key, in owner.
+func (s *Service) CreateEndpoint(c *gin.Context) {
+	owners, ok := requestOwners(c)
+	if !ok {
+		return
+	}
+	var req Endpoint
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "bad_request"})
+		return
+	}
+	owner := owners[0]
+	if c.GetString("mobile") == "" {
+		owner = ""
+		for _, terminal := range owners {
+			if terminal == req.Owner {
+				owner = terminal
+			}
+		}
+		if owner == "" {
+			c.JSON(http.StatusForbidden, gin.H{"message": "owner must be one of the terminals of the api key", "code": "forbidden"})
+			return
+		}
+	}
+	if err := ValidateURL(c.Request.Context(), req.URL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "code": "forbidden_url"})
+		return
+	}
+	endpoint := Endpoint{Owner: owner, URL: req.URL, Secret: req.Secret, Events: req.Events, Active: true}
+	if endpoint.Secret == "" {
+		endpoint.Secret = newSecret()
+	}
+	if err := s.Db.Create(&endpoint).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusCreated, endpoint)
+}
+
+// DeleteEndpoint removes a webhook endpoint, its pending deliveries are dropped
+func (s *Service) DeleteEndpoint(c *gin.Context) {
+	endpoint, ok := s.endpoint(c)
+	if !ok {
+		return
+	}
+	s.Db.Model(&Delivery{}).Where("endpoint_id = ? AND status = ?", endpoint.ID, StatusPending).Update("status", StatusFailed)
+	if err := s.Db.Delete(&endpoint).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// ListDeliveries returns the latest deliveries of an endpoint
+func (s *Service) ListDeliveries(c *gin.Context) {
+	endpoint, ok := s.endpoint(c)
+	if !ok {
+		return
+	}
+	var deliveries []Delivery
+	if err := s.Db.Where("endpoint_id = ?", endpoint.ID).Order("id DESC").Limit(100).Find(&deliveries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// Redeliver sends a delivery again, e.g., after the endpoint was fixed, and returns its outcome
+func (s *Service) Redeliver(c *gin.Context) {
+	owners, ok := requestOwners(c)
+	if !ok {
+		return
+	}
+	var delivery Delivery
+	err := s.Db.Joins("JOIN webhook_endpoints ON webhook_endpoints.id = webhook_deliveries.endpoint_id").
+		Where("webhook_endpoints.owner IN ? AND webhook_endpoints.deleted_at IS NULL", owners).
+		First(&delivery, "webhook_deliveries.id = ?", c.Param("id")).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "delivery not found", "code": "not_found"})
+		return
+	}
+	if err := s.deliver(c.Request.Context(), &delivery); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error(), "code": "database_error"})
+		return
+	}
+	c.JSON(http.StatusOK, delivery)
+}
+
+// endpoint loads the user's endpoint in the id path parameter, it writes the error response otherwise
+func (s *Service) endpoint(c *gin.Context) (Endpoint, bool) {
+	var endpoint Endpoint
+	owners, ok := requestOwners(c)
+	if !ok {
+		return endpoint, false
+	}
+	if err := s.Db.Where("owner IN ?", owners).First(&endpoint, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "webhook endpoint not found", "code": "not_found"})
+		return endpoint, false
+	}
+	return endpoint, true
+}
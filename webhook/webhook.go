@@ -0,0 +1,320 @@
+// Package webhook delivers noebs events (e.g., a payment token was paid) to
+// endpoints registered by merchants. Every delivery is signed with the
+// endpoint's secret using HMAC-SHA256, see Sign, and is recorded in the
+// webhook_deliveries table so that it can be inspected and redelivered.
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/adonese/noebs/ebs_fields"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Event types
+const (
+	TokenPaid           = "token.paid"
+	TokenFailed         = "token.failed"
+	TransactionReversed = "transaction.reversed"
+	BillPaid            = "bill.paid"
+)
+
+// AllOwners is the owner of endpoints that receive the events of every owner,
+// e.g., the biller endpoint configured in NoebsConfig.BillerWebhookURL
+const AllOwners = "*"
+
+// Delivery statuses
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+// Headers of a webhook request
+const (
+	HeaderEvent     = "Noebs-Event"
+	HeaderDelivery  = "Noebs-Delivery"
+	HeaderTimestamp = "Noebs-Timestamp"
+	HeaderSignature = "Noebs-Signature"
+)
+
+// Endpoint is a URL that receives the events of Owner (a user mobile, a
+// terminal id or AllOwners).
+type Endpoint struct {
+	gorm.Model
+	// Owner is set to the signed in user, merchants set it to one of the terminals of their API key
+	Owner  string `json:"owner,omitempty" gorm:"index"`
+	URL    string `json:"url" binding:"required,url"`
+	Secret string `json:"secret,omitempty"`
+	// Events is a comma separated list of the event types the endpoint is subscribed to, all of them when empty
+	Events string `json:"events"`
+	Active bool   `json:"active"`
+}
+
+// TableName of Endpoint
+func (Endpoint) TableName() string { return "webhook_endpoints" }
+
+// Subscribed reports whether e receives events of eventType
+func (e Endpoint) Subscribed(eventType string) bool {
+	if e.Events == "" {
+		return true
+	}
+	for _, ev := range strings.Split(e.Events, ",") {
+		if strings.TrimSpace(ev) == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrForbiddenURL is returned for the endpoint URLs noebs doesn't deliver to
+var ErrForbiddenURL = errors.New("webhook urls must be https urls of public hosts")
+
+// publicIP reports whether ip can receive webhooks: loopback, private and
+// link-local addresses are refused, so that endpoints can't reach the
+// services next to noebs.
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// ValidateURL checks that raw is an https URL whose host resolves to public
+// addresses only, it is checked again when the host is resolved for each delivery.
+func ValidateURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" || u.User != nil {
+		return ErrForbiddenURL
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		if !publicIP(ip) {
+			return ErrForbiddenURL
+		}
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrForbiddenURL, err)
+	}
+	for _, addr := range addrs {
+		if !publicIP(addr.IP) {
+			return ErrForbiddenURL
+		}
+	}
+	return nil
+}
+
+// dialPublic refuses the connections to the addresses that aren't public, it
+// is called once the host of the URL is resolved.
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("%w: %s", ErrForbiddenURL, host)
+	}
+	return nil
+}
+
+// Delivery is an event sent (or to be sent) to an endpoint
+type Delivery struct {
+	gorm.Model
+	EndpointID uint            `json:"endpoint_id" gorm:"index"`
+	EventID    string          `json:"event_id" gorm:"index"`
+	Event      string          `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+	Status     string          `json:"status" gorm:"index"`
+	StatusCode int             `json:"status_code"`
+	// Attempts counts delivery runs, each run retries failed requests with exponential backoff
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+}
+
+// TableName of Delivery
+func (Delivery) TableName() string { return "webhook_deliveries" }
+
+// Event is the body of a webhook request
+type Event struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	CreatedAt int64  `json:"created_at"`
+	Data      any    `json:"data"`
+}
+
+// Service stores endpoints and delivers events to them
+type Service struct {
+	Db     *gorm.DB
+	Logger *logrus.Logger
+	Client *ebs_fields.HTTPClient
+
+	queue chan uint
+}
+
+const (
+	deliveryWorkers = 4
+	// stalledAfter is when a pending delivery is picked up again, e.g., after a restart or when the queue was full
+	stalledAfter = 5 * time.Minute
+)
+
+// NewService creates a webhook Service, its deliveries start once Run is called.
+// The deliveries only connect to public addresses, and don't go through proxies.
+func NewService(db *gorm.DB, logger *logrus.Logger) *Service {
+	maxDelay := time.Minute
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{Timeout: 15 * time.Second, Control: dialPublic}).DialContext
+	return &Service{
+		Db:     db,
+		Logger: logger,
+		Client: &ebs_fields.HTTPClient{
+			Client: &http.Client{Timeout: 15 * time.Second, Transport: transport},
+			RetryConfig: &ebs_fields.RetryConfig{
+				MaxRetries:       5,
+				ExpBackoffFactor: 1,
+				MaxDelay:         &maxDelay,
+			},
+			// the response status is recorded and checked in deliver
+			SuccessFn: func(r *ebs_fields.Response) bool { return true },
+		},
+		queue: make(chan uint, 1024),
+	}
+}
+
+// Sign returns the signature of a webhook body sent at timestamp (unix seconds):
+// the hex encoded HMAC-SHA256 of "<timestamp>.<body>" keyed by the endpoint secret.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a webhook request, receivers should also reject old timestamps.
+func Verify(secret string, timestamp int64, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+func newSecret() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return "whsec_" + hex.EncodeToString(b)
+}
+
+// EnsureEndpoint registers url for owner unless it is already registered, it
+// is used to seed endpoints from the configuration.
+func (s *Service) EnsureEndpoint(owner, url, secret string) error {
+	endpoint := Endpoint{Owner: owner, URL: url, Secret: secret, Active: true}
+	return s.Db.Where(Endpoint{Owner: owner, URL: url}).Attrs(endpoint).FirstOrCreate(&endpoint).Error
+}
+
+// Publish records eventType for the endpoints of owner (and AllOwners) and
+// queues their delivery. It doesn't block the caller.
+func (s *Service) Publish(owner, eventType string, data any) {
+	var endpoints []Endpoint
+	if err := s.Db.Where("active = ? AND owner IN ?", true, []string{owner, AllOwners}).Find(&endpoints).Error; err != nil {
+		s.Logger.WithFields(logrus.Fields{"code": "webhook_error", "message": err.Error()}).Error("unable to load webhook endpoints")
+		return
+	}
+	event := Event{ID: uuid.New().String(), Type: eventType, CreatedAt: time.Now().Unix(), Data: data}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	for _, e := range endpoints {
+		if !e.Subscribed(eventType) {
+			continue
+		}
+		delivery := Delivery{EndpointID: e.ID, EventID: event.ID, Event: eventType, Payload: payload, Status: StatusPending}
+		if err := s.Db.Create(&delivery).Error; err != nil {
+			s.Logger.WithFields(logrus.Fields{
+				"code":    err.Error(),
+				"details": "Error in writing to Database",
+			}).Error("unable to record webhook delivery")
+			continue
+		}
+		select {
+		case s.queue <- delivery.ID:
+		default:
+			// the delivery stays pending and is picked up by Run
+		}
+	}
+}
+
+// Run delivers the queued events. It should be started once as a goroutine.
+func (s *Service) Run() {
+	for i := 0; i < deliveryWorkers; i++ {
+		go func() {
+			for id := range s.queue {
+				var d Delivery
+				if err := s.Db.First(&d, id).Error; err == nil {
+					s.deliver(context.Background(), &d)
+				}
+			}
+		}()
+	}
+	ticker := time.NewTicker(stalledAfter)
+	defer ticker.Stop()
+	for range ticker.C {
+		var stalled []Delivery
+		s.Db.Where("status = ? AND updated_at < ?", StatusPending, time.Now().Add(-stalledAfter)).Find(&stalled)
+		for _, d := range stalled {
+			s.deliver(context.Background(), &d)
+		}
+	}
+}
+
+// deliver posts d to its endpoint and records the outcome
+func (s *Service) deliver(ctx context.Context, d *Delivery) error {
+	var endpoint Endpoint
+	if err := s.Db.First(&endpoint, d.EndpointID).Error; err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+	req := &ebs_fields.Request{
+		Method: http.MethodPost,
+		URL:    endpoint.URL,
+		Body:   rawJSON(d.Payload),
+		Opts: []ebs_fields.HTTPOption{
+			ebs_fields.WithHeader(HeaderEvent, d.Event),
+			ebs_fields.WithHeader(HeaderDelivery, d.EventID),
+			ebs_fields.WithHeader(HeaderTimestamp, strconv.FormatInt(timestamp, 10)),
+			ebs_fields.WithHeader(HeaderSignature, Sign(endpoint.Secret, timestamp, d.Payload)),
+		},
+	}
+	d.Attempts++
+	res, err := s.Client.Do(ctx, req)
+	switch {
+	case err != nil:
+		d.Status, d.StatusCode, d.Error = StatusFailed, 0, err.Error()
+	case !ebs_fields.HasSuccessStatus(res):
+		d.Status, d.StatusCode, d.Error = StatusFailed, res.Status, http.StatusText(res.Status)
+	default:
+		d.Status, d.StatusCode, d.Error = StatusDelivered, res.Status, ""
+	}
+	if d.Status == StatusFailed {
+		s.Logger.WithFields(logrus.Fields{"code": "webhook_error", "url": endpoint.URL, "message": d.Error}).Error("unable to deliver webhook")
+	}
+	return s.Db.Model(d).Select("status", "status_code", "attempts", "error").Updates(d).Error
+}
+
+// rawJSON is an HTTPEntity of an already encoded JSON document
+type rawJSON []byte
+
+func (r rawJSON) Bytes() ([]byte, error) { return r, nil }
+func (r rawJSON) Mime() string           { return "application/json" }
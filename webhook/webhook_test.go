@@ -0,0 +1,264 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func testService(t *testing.T) *Service {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("unable to open test db: %v", err)
+	}
+	if err := db.AutoMigrate(&Endpoint{}, &Delivery{}); err != nil {
+		t.Fatalf("unable to migrate test db: %v", err)
+	}
+	s := NewService(db, logrus.New())
+	// the test receivers listen on the loopback, which the deliveries refuse
+	s.Client.Client = &http.Client{Timeout: 15 * time.Second}
+	return s
+}
+
+// receiver records the requests it gets and answers them with status
+type receiver struct {
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+	w.WriteHeader(r.status)
+}
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"type":"token.paid"}`)
+	signature := Sign("whsec_test", 1700000000, body)
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp int64
+		body      []byte
+		want      bool
+	}{
+		{"valid", "whsec_test", 1700000000, body, true},
+		{"other secret", "whsec_other", 1700000000, body, false},
+		{"other timestamp", "whsec_test", 1700000001, body, false},
+		{"tampered body", "whsec_test", 1700000000, []byte(`{"type":"token.failed"}`), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Verify(tt.secret, tt.timestamp, tt.body, signature); got != tt.want {
+				t.Errorf("Verify() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEndpoint_Subscribed(t *testing.T) {
+	tests := []struct {
+		name   string
+		events string
+		event  string
+		want   bool
+	}{
+		{"all events", "", TokenPaid, true},
+		{"subscribed", "token.paid, token.failed", TokenFailed, true},
+		{"not subscribed", "token.paid,token.failed", BillPaid, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (Endpoint{Events: tt.events}).Subscribed(tt.event); got != tt.want {
+				t.Errorf("Subscribed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestService_Publish(t *testing.T) {
+	s := testService(t)
+	ok := &receiver{status: http.StatusOK}
+	okServer := httptest.NewServer(ok)
+	defer okServer.Close()
+	rejecting := &receiver{status: http.StatusBadRequest}
+	rejectingServer := httptest.NewServer(rejecting)
+	defer rejectingServer.Close()
+
+	endpoints := []Endpoint{
+		{Owner: "0912141679", URL: okServer.URL, Secret: "whsec_owner", Active: true},
+		{Owner: AllOwners, URL: rejectingServer.URL, Secret: "whsec_biller", Active: true},
+		{Owner: "0912141679", URL: okServer.URL, Secret: "whsec_bills", Events: BillPaid, Active: true},
+		{Owner: "0912141680", URL: okServer.URL, Secret: "whsec_other", Active: true},
+	}
+	s.Db.Create(&endpoints)
+
+	s.Publish("0912141679", TokenPaid, map[string]string{"token": "cbd7688f"})
+	if got := len(s.queue); got != 2 {
+		t.Fatalf("Publish() queued %d deliveries, want 2", got)
+	}
+	for len(s.queue) > 0 {
+		var d Delivery
+		s.Db.First(&d, <-s.queue)
+		if err := s.deliver(context.Background(), &d); err != nil {
+			t.Fatalf("deliver() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		endpoint   Endpoint
+		wantStatus string
+		wantCode   int
+	}{
+		{"owner endpoint", endpoints[0], StatusDelivered, http.StatusOK},
+		{"failing endpoint", endpoints[1], StatusFailed, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var d Delivery
+			if err := s.Db.First(&d, "endpoint_id = ?", tt.endpoint.ID).Error; err != nil {
+				t.Fatalf("no delivery recorded: %v", err)
+			}
+			if d.Status != tt.wantStatus || d.StatusCode != tt.wantCode || d.Attempts != 1 {
+				t.Errorf("delivery = %v, %v, %d attempts, want %v, %v", d.Status, d.StatusCode, d.Attempts, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+
+	req, body := ok.requests[0], ok.bodies[0]
+	timestamp, _ := strconv.ParseInt(req.Header.Get(HeaderTimestamp), 10, 64)
+	if !Verify("whsec_owner", timestamp, body, req.Header.Get(HeaderSignature)) {
+		t.Errorf("delivery signature %q doesn't match its body", req.Header.Get(HeaderSignature))
+	}
+	var event Event
+	json.Unmarshal(body, &event)
+	if event.Type != TokenPaid || req.Header.Get(HeaderEvent) != TokenPaid || req.Header.Get(HeaderDelivery) != event.ID {
+		t.Errorf("delivered event = %+v, headers = %v", event, req.Header)
+	}
+}
+
+func TestService_Redeliver(t *testing.T) {
+	s := testService(t)
+	rcv := &receiver{status: http.StatusOK}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	endpoint := Endpoint{Owner: "0912141679", URL: server.URL, Secret: "whsec_owner", Active: true}
+	s.Db.Create(&endpoint)
+	delivery := Delivery{EndpointID: endpoint.ID, EventID: "evt", Event: TokenFailed, Payload: []byte(`{}`), Status: StatusFailed, Attempts: 1}
+	s.Db.Create(&delivery)
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("mobile", c.GetHeader("X-Mobile")) })
+	r.POST("/webhooks/deliveries/:id/redeliver", s.Redeliver)
+
+	tests := []struct {
+		name     string
+		mobile   string
+		wantCode int
+	}{
+		{"other user", "0912141680", http.StatusNotFound},
+		{"owner", "0912141679", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPost, "/webhooks/deliveries/"+strconv.Itoa(int(delivery.ID))+"/redeliver", nil)
+			req.Header.Set("X-Mobile", tt.mobile)
+			r.ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Errorf("Redeliver() code = %v, want %v: %s", w.Code, tt.wantCode, w.Body)
+			}
+		})
+	}
+	var got Delivery
+	s.Db.First(&got, delivery.ID)
+	if got.Status != StatusDelivered || got.Attempts != 2 || len(rcv.requests) != 1 {
+		t.Errorf("Redeliver() delivery = %v, %d attempts, %d requests", got.Status, got.Attempts, len(rcv.requests))
+	}
+}
+
+func TestService_CreateEndpoint(t *testing.T) {
+	s := testService(t)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		if mobile := c.GetHeader("X-Mobile"); mobile != "" {
+			c.Set("mobile", mobile)
+		}
+		if terminals := c.GetHeader("X-Terminals"); terminals != "" {
+			c.Set("terminal_ids", strings.Split(terminals, ","))
+		}
+	})
+	r.POST("/webhooks", s.CreateEndpoint)
+
+	tests := []struct {
+		name      string
+		mobile    string
+		terminals string
+		body      string
+		wantCode  int
+		wantOwner string
+	}{
+		{"user", "0912141679", "", `{"url": "https://93.184.216.34/hooks"}`, http.StatusCreated, "0912141679"},
+		{"http", "0912141679", "", `{"url": "http://93.184.216.34/hooks"}`, http.StatusBadRequest, ""},
+		{"loopback", "0912141679", "", `{"url": "https://127.0.0.1/hooks"}`, http.StatusBadRequest, ""},
+		{"private", "0912141679", "", `{"url": "https://10.0.0.12/hooks"}`, http.StatusBadRequest, ""},
+		{"link-local", "0912141679", "", `{"url": "https://169.254.169.254/latest/meta-data"}`, http.StatusBadRequest, ""},
+		{"localhost", "0912141679", "", `{"url": "https://localhost/hooks"}`, http.StatusBadRequest, ""},
+		{"merchant terminal", "", "18000377,18000378", `{"url": "https://93.184.216.34/hooks", "owner": "18000378"}`, http.StatusCreated, "18000378"},
+		{"other terminal", "", "18000377", `{"url": "https://93.184.216.34/hooks", "owner": "18000378"}`, http.StatusForbidden, ""},
+		{"no owner", "", "", `{"url": "https://93.184.216.34/hooks"}`, http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPost, "/webhooks", strings.NewReader(tt.body))
+			req.Header.Set("X-Mobile", tt.mobile)
+			req.Header.Set("X-Terminals", tt.terminals)
+			r.ServeHTTP(w, req)
+			var got Endpoint
+			json.Unmarshal(w.Body.Bytes(), &got)
+			if w.Code != tt.wantCode || got.Owner != tt.wantOwner {
+				t.Errorf("CreateEndpoint() = %v, %s, want %v, owner %q", w.Code, w.Body, tt.wantCode, tt.wantOwner)
+			}
+		})
+	}
+}
+
+func TestService_deliver_private(t *testing.T) {
+	db, _ := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	db.AutoMigrate(&Endpoint{}, &Delivery{})
+	s := NewService(db, logrus.New())
+	s.Client.RetryConfig.MaxRetries = 0
+	rcv := &receiver{status: http.StatusOK}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	// e.g., a host that resolved to a public address when it was registered
+	endpoint := Endpoint{Owner: "0912141679", URL: server.URL, Secret: "whsec_owner", Active: true}
+	s.Db.Create(&endpoint)
+	delivery := Delivery{EndpointID: endpoint.ID, EventID: "evt", Event: TokenPaid, Payload: []byte(`{}`), Status: StatusPending}
+	s.Db.Create(&delivery)
+	s.deliver(context.Background(), &delivery)
+	if delivery.Status != StatusFailed || len(rcv.requests) != 0 {
+		t.Errorf("deliver() to %s = %v, %d requests, want it refused", server.URL, delivery.Status, len(rcv.requests))
+	}
+}